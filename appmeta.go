@@ -0,0 +1,108 @@
+package lsmtree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+// The file that holds the application metadata entries.
+const appMetaFileName = "app-meta.db"
+
+// PutMeta stores the application metadata entry under the given name.
+// The metadata lives in its own file outside of the LSM keyspace, so
+// it never collides with the user keys, does not appear in the scans
+// and survives the compactions. It suits the small entries like the
+// schema version: the whole file is rewritten on every update.
+func (t *LSMTree) PutMeta(name string, value []byte) error {
+	if len(name) == 0 {
+		return ErrKeyRequired
+	}
+	if len(value) == 0 {
+		return ErrValueRequired
+	}
+
+	t.appMeta[name] = append([]byte(nil), value...)
+
+	return writeAppMeta(t.dbDir, t.appMeta)
+}
+
+// GetMeta returns the application metadata entry stored under the
+// given name and whether it exists.
+func (t *LSMTree) GetMeta(name string) ([]byte, bool) {
+	value, exists := t.appMeta[name]
+
+	return value, exists
+}
+
+// DeleteMeta removes the application metadata entry stored under the
+// given name. It does nothing if the entry does not exist.
+func (t *LSMTree) DeleteMeta(name string) error {
+	if _, exists := t.appMeta[name]; !exists {
+		return nil
+	}
+
+	delete(t.appMeta, name)
+
+	return writeAppMeta(t.dbDir, t.appMeta)
+}
+
+// writeAppMeta writes all application metadata entries into the file.
+// The entries are ordered by the name, so the file content is
+// deterministic.
+func writeAppMeta(dbDir string, entries map[string][]byte) error {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	encoded := make([]byte, 0)
+	for _, name := range names {
+		encoded = append(encoded, encodeInt(len(name))...)
+		encoded = append(encoded, name...)
+		encoded = append(encoded, encodeInt(len(entries[name]))...)
+		encoded = append(encoded, entries[name]...)
+	}
+
+	filePath := path.Join(dbDir, appMetaFileName)
+	if err := ioutil.WriteFile(filePath, encoded, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filePath, err)
+	}
+
+	return nil
+}
+
+// readAppMeta reads all application metadata entries from the file.
+// A missing file means no entries.
+func readAppMeta(dbDir string) (map[string][]byte, error) {
+	filePath := path.Join(dbDir, appMetaFileName)
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
+	}
+
+	entries := make(map[string][]byte)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("file %s is corrupted", filePath)
+		}
+		nameLen := decodeInt(data[:8])
+		if nameLen <= 0 || 8+nameLen+8 > len(data) {
+			return nil, fmt.Errorf("file %s is corrupted", filePath)
+		}
+		name := string(data[8 : 8+nameLen])
+		data = data[8+nameLen:]
+
+		valueLen := decodeInt(data[:8])
+		if valueLen <= 0 || 8+valueLen > len(data) {
+			return nil, fmt.Errorf("file %s is corrupted", filePath)
+		}
+		entries[name] = append([]byte(nil), data[8:8+valueLen]...)
+		data = data[8+valueLen:]
+	}
+
+	return entries, nil
+}
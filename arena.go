@@ -0,0 +1,56 @@
+package lsmtree
+
+// arena serves byte slice copies from large preallocated blocks, so
+// the keys and the values copied into the MemTable do not burden the
+// garbage collector with millions of individual small allocations.
+// The handed-out slices keep their block alive, so the arena itself
+// only tracks the block it currently fills.
+type arena struct {
+	blockSize int
+	// The block the next copy is served from and how much of it is
+	// already used.
+	block []byte
+	used  int
+}
+
+// newArena returns a new arena that allocates the blocks of the given
+// size in bytes.
+func newArena(blockSize int) *arena {
+	return &arena{blockSize: blockSize}
+}
+
+// copy returns a copy of b placed into the arena blocks. A nil b is
+// returned as nil, so the tombstone values stay nil. A b larger than
+// the block size receives a dedicated block.
+func (a *arena) copy(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+
+	if len(b) > a.blockSize {
+		block := make([]byte, len(b))
+		copy(block, b)
+
+		return block
+	}
+
+	if a.used+len(b) > len(a.block) {
+		a.block = make([]byte, a.blockSize)
+		a.used = 0
+	}
+
+	// the capacity is capped, so appending to a handed-out slice does
+	// not bleed into the neighbouring copies
+	dst := a.block[a.used : a.used+len(b) : a.used+len(b)]
+	copy(dst, b)
+	a.used += len(b)
+
+	return dst
+}
+
+// reset drops the current block, so the next copies start from a fresh
+// one and the entries flushed out of the MemTable stop pinning it.
+func (a *arena) reset() {
+	a.block = nil
+	a.used = 0
+}
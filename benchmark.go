@@ -0,0 +1,176 @@
+package lsmtree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// BenchmarkDistribution selects how the benchmark draws the keys from
+// the keyspace.
+type BenchmarkDistribution int
+
+const (
+	// BenchmarkUniform draws every key with the same probability.
+	BenchmarkUniform BenchmarkDistribution = iota
+	// BenchmarkZipfian draws a small subset of hot keys most of the
+	// time, which resembles the skew of the real workloads.
+	BenchmarkZipfian
+)
+
+// BenchmarkConfig describes the workload of the benchmark: the total
+// number of operations, the relative mix of the operation kinds, the
+// size of the keyspace and the values, and the key distribution.
+// The zero weights of all kinds default to an even put and get mix.
+type BenchmarkConfig struct {
+	// Operations is the total number of operations to run.
+	Operations int
+	// PutWeight, GetWeight, DeleteWeight and ScanWeight set the
+	// relative frequency of the operation kinds.
+	PutWeight    int
+	GetWeight    int
+	DeleteWeight int
+	ScanWeight   int
+	// Keys is the size of the keyspace the keys are drawn from.
+	Keys int
+	// ValueSize is the size of the written values in bytes.
+	ValueSize int
+	// ScanLimit caps the number of entries read by a single scan.
+	ScanLimit int
+	// Distribution selects how the keys are drawn from the keyspace.
+	Distribution BenchmarkDistribution
+	// Seed makes the workload reproducible. The zero seed is replaced
+	// with the current time.
+	Seed int64
+}
+
+// BenchmarkResult holds the measurements of a benchmark run: the
+// throughput and the latency percentiles across all operations.
+type BenchmarkResult struct {
+	// Operations is the number of the executed operations.
+	Operations int
+	// Duration is the wall time of the whole run.
+	Duration time.Duration
+	// OpsPerSecond is the overall throughput of the run.
+	OpsPerSecond float64
+	// P50, P95 and P99 are the operation latency percentiles.
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+}
+
+// Benchmark runs the configured mix of puts, gets, deletes and scans
+// against the tree and reports the throughput and the latency
+// percentiles. It is a measurement tool, not a test: it builds only on
+// the public API of the tree and leaves the written keys behind, so it
+// should run against a scratch database.
+func Benchmark(t *LSMTree, config BenchmarkConfig) (*BenchmarkResult, error) {
+	if config.Operations <= 0 {
+		config.Operations = 1000
+	}
+	if config.Keys <= 0 {
+		config.Keys = 1000
+	}
+	if config.ValueSize <= 0 {
+		config.ValueSize = 100
+	}
+	if config.ScanLimit <= 0 {
+		config.ScanLimit = 100
+	}
+	if config.PutWeight <= 0 && config.GetWeight <= 0 && config.DeleteWeight <= 0 && config.ScanWeight <= 0 {
+		config.PutWeight, config.GetWeight = 1, 1
+	}
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+
+	random := rand.New(rand.NewSource(config.Seed))
+
+	var zipf *rand.Zipf
+	if config.Distribution == BenchmarkZipfian {
+		zipf = rand.NewZipf(random, 1.1, 1, uint64(config.Keys-1))
+	}
+
+	nextKey := func() []byte {
+		if zipf != nil {
+			return []byte(fmt.Sprintf("bench-%09d", zipf.Uint64()))
+		}
+
+		return []byte(fmt.Sprintf("bench-%09d", random.Intn(config.Keys)))
+	}
+
+	value := make([]byte, config.ValueSize)
+	for i := range value {
+		value[i] = 'v'
+	}
+
+	totalWeight := config.PutWeight + config.GetWeight + config.DeleteWeight + config.ScanWeight
+	latencies := make([]time.Duration, 0, config.Operations)
+
+	start := time.Now()
+	for i := 0; i < config.Operations; i++ {
+		roll := random.Intn(totalWeight)
+		opStart := time.Now()
+
+		var err error
+		switch {
+		case roll < config.PutWeight:
+			err = t.Put(nextKey(), value)
+		case roll < config.PutWeight+config.GetWeight:
+			_, _, err = t.Get(nextKey())
+		case roll < config.PutWeight+config.GetWeight+config.DeleteWeight:
+			err = t.Delete(nextKey())
+		default:
+			err = benchmarkScan(t, nextKey(), config.ScanLimit)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("benchmark operation %d failed: %w", i, err)
+		}
+
+		latencies = append(latencies, time.Since(opStart))
+	}
+	duration := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	return &BenchmarkResult{
+		Operations:   config.Operations,
+		Duration:     duration,
+		OpsPerSecond: float64(config.Operations) / duration.Seconds(),
+		P50:          percentile(latencies, 50),
+		P95:          percentile(latencies, 95),
+		P99:          percentile(latencies, 99),
+	}, nil
+}
+
+// benchmarkScan reads up to limit entries starting from the key.
+func benchmarkScan(t *LSMTree, start []byte, limit int) error {
+	it, err := t.Range(start, nil, DefaultRangeOptions)
+	if err != nil {
+		return err
+	}
+
+	for read := 0; read < limit && it.HasNext(); read++ {
+		if _, err := it.Next(); err != nil {
+			it.Close()
+			return err
+		}
+	}
+
+	return it.Close()
+}
+
+// percentile returns the p-th percentile of the sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	index := len(sorted)*p/100 - 1
+	if index < 0 {
+		index = 0
+	}
+
+	return sorted[index]
+}
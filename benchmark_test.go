@@ -0,0 +1,55 @@
+package lsmtree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBenchmarkTinyWorkload(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Benchmark(tree, BenchmarkConfig{
+		Operations:   200,
+		PutWeight:    2,
+		GetWeight:    2,
+		DeleteWeight: 1,
+		ScanWeight:   1,
+		Keys:         50,
+		ValueSize:    16,
+		ScanLimit:    10,
+		Distribution: BenchmarkZipfian,
+		Seed:         42,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if result.Operations != 200 {
+		t.Fatalf("expected 200 operations, got %d", result.Operations)
+	}
+	if result.OpsPerSecond <= 0 {
+		t.Fatalf("expected a positive throughput, got %f", result.OpsPerSecond)
+	}
+	if result.P50 > result.P95 || result.P95 > result.P99 {
+		t.Fatalf("the percentiles must not decrease: %s, %s, %s", result.P50, result.P95, result.P99)
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
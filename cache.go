@@ -0,0 +1,115 @@
+package lsmtree
+
+import (
+	"container/list"
+	"sync/atomic"
+)
+
+// valueCache is an LRU cache of the recently read values, bounded by
+// the total number of key and value bytes it holds. It speeds up the
+// repeated reads of hot keys that already reside in the disk tables.
+// A nil cache discards all operations.
+type valueCache struct {
+	maxBytes int
+	bytes    int
+	// The entries ordered from the most to the least recently used.
+	order   *list.List
+	entries map[string]*list.Element
+
+	// Cumulative hit and miss counters of the lookups. They are
+	// updated atomically, so reading the stats does not race with
+	// the lookups.
+	hits, misses int64
+}
+
+// valueCacheEntry is a single cached key-value pair.
+type valueCacheEntry struct {
+	key   string
+	value []byte
+}
+
+// newValueCache returns a new LRU value cache bounded by maxBytes.
+func newValueCache(maxBytes int) *valueCache {
+	return &valueCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached value for the key and marks it as the most
+// recently used.
+func (c *valueCache) get(key []byte) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	element, exists := c.entries[string(key)]
+	if !exists {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+
+	atomic.AddInt64(&c.hits, 1)
+	c.order.MoveToFront(element)
+
+	return element.Value.(*valueCacheEntry).value, true
+}
+
+// stats returns the cumulative hit and miss counters of the lookups.
+func (c *valueCache) stats() (int64, int64) {
+	if c == nil {
+		return 0, 0
+	}
+
+	return atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+}
+
+// put caches the value for the key and evicts the least recently used
+// entries if the cache grows over the bound.
+func (c *valueCache) put(key []byte, value []byte) {
+	if c == nil {
+		return
+	}
+
+	c.invalidate(key)
+
+	entry := &valueCacheEntry{key: string(key), value: value}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.bytes += len(key) + len(value)
+
+	for c.bytes > c.maxBytes && c.order.Len() > 0 {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidate removes the key from the cache.
+func (c *valueCache) invalidate(key []byte) {
+	if c == nil {
+		return
+	}
+
+	if element, exists := c.entries[string(key)]; exists {
+		c.remove(element)
+	}
+}
+
+// clear removes all the entries from the cache.
+func (c *valueCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+	c.bytes = 0
+}
+
+// remove removes the element from the cache.
+func (c *valueCache) remove(element *list.Element) {
+	entry := element.Value.(*valueCacheEntry)
+
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+	c.bytes -= len(entry.key) + len(entry.value)
+}
@@ -0,0 +1,68 @@
+package lsmtree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestValueCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	// each entry takes 4 bytes, so only two entries fit
+	cache := newValueCache(8)
+
+	cache.put([]byte("a"), []byte("va1"))
+	cache.put([]byte("b"), []byte("vb1"))
+
+	// touch a, so b becomes the least recently used
+	if _, exists := cache.get([]byte("a")); !exists {
+		t.Fatalf("the key a must be cached")
+	}
+
+	cache.put([]byte("c"), []byte("vc1"))
+
+	if _, exists := cache.get([]byte("b")); exists {
+		t.Fatalf("the key b must be evicted")
+	}
+	if _, exists := cache.get([]byte("a")); !exists {
+		t.Fatalf("the key a must still be cached")
+	}
+	if _, exists := cache.get([]byte("c")); !exists {
+		t.Fatalf("the key c must still be cached")
+	}
+}
+
+func TestValueCacheInvalidateAndClear(t *testing.T) {
+	cache := newValueCache(64)
+
+	cache.put([]byte("a"), []byte("va1"))
+	cache.put([]byte("a"), []byte("va2"))
+
+	if value, exists := cache.get([]byte("a")); !exists || !bytes.Equal(value, []byte("va2")) {
+		t.Fatalf("expected va2, got %s", value)
+	}
+
+	cache.invalidate([]byte("a"))
+	if _, exists := cache.get([]byte("a")); exists {
+		t.Fatalf("the key a must be invalidated")
+	}
+
+	cache.put([]byte("b"), []byte("vb1"))
+	cache.clear()
+	if _, exists := cache.get([]byte("b")); exists {
+		t.Fatalf("the key b must be gone after the clear")
+	}
+	if cache.bytes != 0 {
+		t.Fatalf("expected 0 cached bytes after the clear, got %d", cache.bytes)
+	}
+}
+
+func TestNilValueCacheDiscardsOperations(t *testing.T) {
+	var cache *valueCache
+
+	cache.put([]byte("a"), []byte("va"))
+	cache.invalidate([]byte("a"))
+	cache.clear()
+
+	if _, exists := cache.get([]byte("a")); exists {
+		t.Fatalf("a nil cache must not hold values")
+	}
+}
@@ -0,0 +1,55 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// ChangesSince streams the changes recorded after the given sequence
+// number in the order they were written. The sequence number of a
+// change is the timestamp of its WAL record in nanoseconds, so a
+// checkpoint is simply the largest sequence seen so far. Only the
+// changes still held by the WAL carry sequence numbers: the records
+// already flushed to the disk tables lose them, so the checkpoint must
+// advance before a flush clears the WAL. The records written by the
+// older versions carry no timestamp and are skipped. The tombstones
+// are reported with a nil value and the deleted flag set. An error
+// returned by the callback stops the scan and is returned as is.
+func (t *LSMTree) ChangesSince(seq uint64, fn func(key, value []byte, deleted bool, seq uint64) error) error {
+	walPath := path.Join(t.dbDir, walFileName)
+	wal, err := os.Open(walPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open the file %s: %w", walPath, err)
+	}
+	defer wal.Close()
+
+	for {
+		key, value, flags, nanos, err := decodeRecordTimestamp(wal)
+		// a record truncated by a crash ends the WAL, like in the replay
+		if err == io.EOF || errors.Is(err, errTruncatedRecord) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the WAL record: %w", err)
+		}
+
+		if nanos <= 0 || uint64(nanos) <= seq {
+			continue
+		}
+
+		deleted := flags == recordDelete
+		if deleted {
+			value = nil
+		}
+
+		if err := fn(key, value, deleted, uint64(nanos)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package lsmtree
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// chunkValueMagic prefixes the marker value that is stored under the
+// user key for a chunked value. The values that happen to start with
+// the magic are stored as a single chunk, so a marker is never
+// mistaken for the user data.
+var chunkValueMagic = []byte("\x00lsm-chunk\x00")
+
+// chunkKeySuffix separates the user key from the chunk index in the
+// keys of the chunk records. The caller must not use keys that contain
+// the suffix while the chunking is enabled.
+var chunkKeySuffix = []byte("\x00chunk\x00")
+
+// ChunkLargeValues makes Put accept values larger than MaxValueSize by
+// transparently splitting them into chunk records of at most
+// MaxValueSize bytes each, stored under the keys derived from the user
+// key and the chunk index. Get detects the chunked marker and
+// reassembles the value, so the chunking is invisible to the reads by
+// key. The range scans reassemble the value too and skip the chunk
+// records, which stay visible to KeyIterator under the derived keys.
+// The option must be set consistently across the runs that share the
+// same directory.
+func ChunkLargeValues() func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.chunkLargeValues = true
+	}
+}
+
+// chunkKey returns the key of the chunk record with the given index.
+func chunkKey(key []byte, index int) []byte {
+	chunkKey := make([]byte, 0, len(key)+len(chunkKeySuffix)+8)
+	chunkKey = append(chunkKey, key...)
+	chunkKey = append(chunkKey, chunkKeySuffix...)
+	chunkKey = append(chunkKey, encodeInt(index)...)
+
+	return chunkKey
+}
+
+// chunkMarker returns the marker value that describes the chunked
+// value: the number of chunks and the total size in bytes.
+func chunkMarker(chunks, size int) []byte {
+	marker := make([]byte, 0, len(chunkValueMagic)+16)
+	marker = append(marker, chunkValueMagic...)
+	marker = append(marker, encodeInt(chunks)...)
+	marker = append(marker, encodeInt(size)...)
+
+	return marker
+}
+
+// isChunkMarker returns true if the value is a chunked value marker.
+func isChunkMarker(value []byte) bool {
+	return len(value) == len(chunkValueMagic)+16 && bytes.HasPrefix(value, chunkValueMagic)
+}
+
+// decodeChunkMarker decodes the number of chunks and the total size
+// in bytes from the marker value.
+func decodeChunkMarker(marker []byte) (int, int) {
+	return decodeIntPair(marker[len(chunkValueMagic):])
+}
+
+// putChunked splits the value into chunks of at most MaxValueSize
+// bytes, writes each chunk under a derived key and then writes the
+// marker under the user key. The marker is written last, so a write
+// that fails between the chunks leaves the key pointing at its
+// previous value instead of at an incomplete set of chunks.
+func (t *LSMTree) putChunked(key []byte, value []byte) error {
+	if len(key)+len(chunkKeySuffix)+8 > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+
+	// an overwrite with fewer chunks must not leave the stale
+	// chunks of the previous value behind
+	oldChunks := 0
+	if old, exists, err := t.get(key); err != nil {
+		return fmt.Errorf("failed to get the previous value: %w", err)
+	} else if exists && isChunkMarker(old) {
+		oldChunks, _ = decodeChunkMarker(old)
+	}
+
+	chunks := (len(value) + MaxValueSize - 1) / MaxValueSize
+	for i := 0; i < chunks; i++ {
+		start := i * MaxValueSize
+		end := start + MaxValueSize
+		if end > len(value) {
+			end = len(value)
+		}
+
+		if err := t.put(chunkKey(key, i), value[start:end]); err != nil {
+			return fmt.Errorf("failed to put chunk %d: %w", i, err)
+		}
+	}
+
+	if err := t.put(key, chunkMarker(chunks, len(value))); err != nil {
+		return fmt.Errorf("failed to put the chunk marker: %w", err)
+	}
+
+	for i := chunks; i < oldChunks; i++ {
+		if err := t.delete(chunkKey(key, i)); err != nil {
+			return fmt.Errorf("failed to delete stale chunk %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// getChunked reassembles the chunked value described by the marker by
+// concatenating its chunk records in order.
+func (t *LSMTree) getChunked(key []byte, marker []byte) ([]byte, bool, error) {
+	chunks, size := decodeChunkMarker(marker)
+
+	value := make([]byte, 0, size)
+	for i := 0; i < chunks; i++ {
+		chunk, exists, err := t.get(chunkKey(key, i))
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to get chunk %d: %w", i, err)
+		}
+		if !exists {
+			return nil, false, fmt.Errorf("the chunked value is corrupted, chunk %d is missing", i)
+		}
+
+		value = append(value, chunk...)
+	}
+
+	if len(value) != size {
+		return nil, false, fmt.Errorf("the chunked value is corrupted, expected %d bytes, got %d", size, len(value))
+	}
+
+	return value, true, nil
+}
+
+// deleteChunks deletes the chunk records of the chunked value stored
+// under the key, if any. The marker itself is left to the caller.
+func (t *LSMTree) deleteChunks(key []byte) error {
+	value, exists, err := t.get(key)
+	if err != nil {
+		return fmt.Errorf("failed to get the current value: %w", err)
+	}
+	if !exists || !isChunkMarker(value) {
+		return nil
+	}
+
+	chunks, _ := decodeChunkMarker(value)
+	for i := 0; i < chunks; i++ {
+		if err := t.delete(chunkKey(key, i)); err != nil {
+			return fmt.Errorf("failed to delete chunk %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
@@ -1,13 +1,16 @@
 package lsmtree
 
 import (
-	"bytes"
+	"bufio"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -19,43 +22,202 @@ const (
 	diskTableIndexFileName = "index.db"
 	// DiskTable sparse index. A sampling of every 64th entry in the index file.
 	diskTableSparseIndexFileName = "sparse.db"
+	// DiskTable bounds file. It contains the smallest and the largest keys
+	// of the table, so the searches outside of the range skip the table
+	// without opening the sparse index.
+	diskTableBoundsFileName = "bounds.db"
+	// DiskTable manifest file. It records the sizes and the checksums
+	// of the table files at the flush time, so VerifyTable detects the
+	// files altered afterwards.
+	diskTableManifestFileName = "manifest.db"
 	// A flag to open file for new disk table files: data, index and sparse index.
 	newDiskTableFlag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC | os.O_APPEND
+	// The directory that holds the per-table subdirectories in the
+	// subdirectory layout.
+	diskTableSubdirName = "tables"
+	// The suffix appended to the file names of a quarantined disk
+	// table, so the bad files stop being read but stay around for
+	// inspection.
+	quarantineSuffix = ".corrupt"
 )
 
+// usesSubdirLayout reports whether the database directory stores each
+// disk table in its own subdirectory under dbDir/tables instead of
+// prefixing the file names with the disk table index. The layout is
+// detected from the presence of the tables directory, so the databases
+// with the flat layout stay readable as they are.
+func usesSubdirLayout(dbDir string) bool {
+	stat, err := os.Stat(path.Join(dbDir, diskTableSubdirName))
+
+	return err == nil && stat.IsDir()
+}
+
+// diskTableDirPath returns the directory that holds the files of the
+// disk table with the given prefix in the subdirectory layout.
+func diskTableDirPath(dbDir, prefix string) string {
+	return path.Join(dbDir, diskTableSubdirName, strings.TrimSuffix(prefix, "-"))
+}
+
+// diskTableFilePath returns the path of the disk table file with the
+// given prefix and name, respecting the layout of the directory:
+// dbDir/tables/<index>/<name> in the subdirectory layout and
+// dbDir/<index>-<name> in the flat one.
+func diskTableFilePath(dbDir, prefix, fileName string) string {
+	if usesSubdirLayout(dbDir) {
+		return path.Join(diskTableDirPath(dbDir, prefix), fileName)
+	}
+
+	return path.Join(dbDir, prefix+fileName)
+}
+
 // createDiskTable creates a DiskTable from the given MemTable with the given prefix
-// and in the given directory.
-func createDiskTable(memTable *memTable, dbDir string, index, sparseKeyDistance int) error {
+// and in the given directory. If checksummed is set, the data file records
+// carry the checksums of their payload. If blockAlign is set, the data
+// file records are padded to the block boundaries.
+// Returns the total number of bytes written.
+func createDiskTable(memTable *memTable, dbDir string, index, sparseKeyDistance, sparseByteDistance int, checksummed bool, blockAlign int) (int, error) {
 	prefix := strconv.Itoa(index) + "-"
 
-	w, err := newDiskTableWriter(dbDir, prefix, sparseKeyDistance)
+	w, err := newDiskTableWriter(dbDir, prefix, sparseKeyDistance, sparseByteDistance, checksummed)
 	if err != nil {
-		return fmt.Errorf("failed to create disk table writer: %w", err)
+		return 0, fmt.Errorf("failed to create disk table writer: %w", err)
 	}
+	w.blockAlign = blockAlign
 
 	for it := memTable.iterator(); it.hasNext(); {
 		key, value := it.next()
 		if err := w.write(key, value); err != nil {
-			return fmt.Errorf("failed to write to disk table %d: %w", index, err)
+			return 0, fmt.Errorf("failed to write to disk table %d: %w", index, err)
 		}
 	}
 
 	if err := w.sync(); err != nil {
-		return fmt.Errorf("failed to sync disk table: %w", err)
+		return 0, fmt.Errorf("failed to sync disk table: %w", err)
 	}
 
 	if err := w.close(); err != nil {
-		return fmt.Errorf("failed to close disk table: %w", err)
+		return 0, fmt.Errorf("failed to close disk table: %w", err)
 	}
 
-	return nil
+	if err := writeDiskTableManifest(dbDir, prefix); err != nil {
+		return 0, fmt.Errorf("failed to write disk table manifest: %w", err)
+	}
+
+	return w.bytes(), nil
+}
+
+// createPartitionedDiskTables writes the MemTable as up to partitions
+// disk tables covering disjoint key ranges, with the indexes starting
+// at firstIndex. The split points follow the key distribution of the
+// MemTable: each table receives an equal share of the keys, so a skewed
+// keyspace still splits evenly. Fewer tables are written when the
+// MemTable holds fewer keys than partitions.
+// Returns the total number of bytes written and the number of tables.
+func createPartitionedDiskTables(memTable *memTable, dbDir string, firstIndex, partitions, sparseKeyDistance, sparseByteDistance int, checksummed bool, blockAlign int) (int, int, error) {
+	if partitions > memTable.keys() {
+		partitions = memTable.keys()
+	}
+	if partitions < 1 {
+		partitions = 1
+	}
+
+	perTable := (memTable.keys() + partitions - 1) / partitions
+
+	bytes, tables, written := 0, 0, 0
+	var w *diskTableWriter
+	for it := memTable.iterator(); it.hasNext(); {
+		key, value := it.next()
+
+		if w == nil {
+			index := firstIndex + tables
+			writer, err := newDiskTableWriter(dbDir, strconv.Itoa(index)+"-", sparseKeyDistance, sparseByteDistance, checksummed)
+			if err != nil {
+				return 0, 0, fmt.Errorf("failed to create disk table writer: %w", err)
+			}
+			writer.blockAlign = blockAlign
+
+			w = writer
+		}
+
+		if err := w.write(key, value); err != nil {
+			return 0, 0, fmt.Errorf("failed to write to disk table %d: %w", firstIndex+tables, err)
+		}
+		written++
+
+		if written == perTable {
+			if err := w.sync(); err != nil {
+				return 0, 0, fmt.Errorf("failed to sync disk table: %w", err)
+			}
+			if err := w.close(); err != nil {
+				return 0, 0, fmt.Errorf("failed to close disk table: %w", err)
+			}
+			if err := writeDiskTableManifest(dbDir, strconv.Itoa(firstIndex+tables)+"-"); err != nil {
+				return 0, 0, fmt.Errorf("failed to write disk table manifest: %w", err)
+			}
+
+			bytes += w.bytes()
+			tables++
+			written = 0
+			w = nil
+		}
+	}
+
+	if w != nil {
+		if err := w.sync(); err != nil {
+			return 0, 0, fmt.Errorf("failed to sync disk table: %w", err)
+		}
+		if err := w.close(); err != nil {
+			return 0, 0, fmt.Errorf("failed to close disk table: %w", err)
+		}
+		if err := writeDiskTableManifest(dbDir, strconv.Itoa(firstIndex+tables)+"-"); err != nil {
+			return 0, 0, fmt.Errorf("failed to write disk table manifest: %w", err)
+		}
+
+		bytes += w.bytes()
+		tables++
+	}
+
+	return bytes, tables, nil
 }
 
 // searchInDiskTables searches a value by the key in DiskTables, by traversing
-// all tables in the directory.
-func searchInDiskTables(dbDir string, maxIndex int, key []byte) ([]byte, bool, error) {
+// all tables in the directory. The indexes that do not point to a disk table
+// are skipped, since the table might have been merged into a newer one.
+// The tables must be sorted in the order defined by the comparator.
+// The file handles are taken from the file cache, which may be nil.
+// If fetch is not nil, it is invoked for a table with missing files and
+// the search is retried, so the tables evicted to a remote storage can
+// be restored on demand.
+// The onCorrupt policy sets how a table that fails to be read or
+// decoded is treated: returning the error, skipping the table or
+// quarantining its files aside.
+func searchInDiskTables(dbDir string, maxIndex int, key []byte, compare Comparator, files *fileCache, readBufferSize int, fetch func(dbDir string, index int) error, onCorrupt int, logger Logger) ([]byte, bool, error) {
 	for index := maxIndex; index >= 0; index-- {
-		value, exists, err := searchInDiskTable(dbDir, index, key)
+		value, exists, err := searchInDiskTable(dbDir, index, key, compare, files, readBufferSize, logger)
+		if errors.Is(err, ErrDiskTableMissing) && fetch != nil {
+			// the files may be evicted to the remote storage, the
+			// hook restores them before the retry; a hook error means
+			// the table does not exist remotely either and the index
+			// is skipped like a merged-away table
+			if fetchErr := fetch(dbDir, index); fetchErr == nil {
+				value, exists, err = searchInDiskTable(dbDir, index, key, compare, files, readBufferSize, logger)
+			}
+		}
+		if errors.Is(err, ErrDiskTableMissing) {
+			continue
+		}
+		if err != nil && onCorrupt == CorruptTableSkip {
+			logger.Printf("skipping corrupted disk table %d: %s", index, err)
+			continue
+		}
+		if err != nil && onCorrupt == CorruptTableQuarantine {
+			logger.Printf("quarantining corrupted disk table %d: %s", index, err)
+			if err := quarantineDiskTable(dbDir, index, files); err != nil {
+				return nil, false, err
+			}
+
+			continue
+		}
 		if err != nil {
 			return nil, false, fmt.Errorf("failed to search in disk table with index %d: %w", index, err)
 		}
@@ -68,18 +230,131 @@ func searchInDiskTables(dbDir string, maxIndex int, key []byte) ([]byte, bool, e
 	return nil, false, nil
 }
 
+// quarantineDiskTable renames the files of the disk table aside with
+// the quarantine suffix, so the table stops being read like a merged-away
+// one, but its files stay around for inspection. The cached handles are
+// dropped first, so the renamed files are not served from the cache.
+func quarantineDiskTable(dbDir string, index int, files *fileCache) error {
+	if err := files.clear(); err != nil {
+		return fmt.Errorf("failed to clear the file cache: %w", err)
+	}
+
+	prefix := strconv.Itoa(index) + "-"
+	fileNames := []string{diskTableDataFileName, diskTableIndexFileName, diskTableSparseIndexFileName, diskTableBoundsFileName, diskTableManifestFileName}
+	for _, fileName := range fileNames {
+		filePath := diskTableFilePath(dbDir, prefix, fileName)
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			// the older tables carry no bounds file
+			continue
+		}
+
+		if err := os.Rename(filePath, filePath+quarantineSuffix); err != nil {
+			return fmt.Errorf("failed to quarantine %s: %w", filePath, err)
+		}
+	}
+
+	return nil
+}
+
+// listDiskTables returns the indexes of the disk tables that exist in the
+// directory in ascending order. The indexes are not necessarily contiguous,
+// since merged disk tables leave gaps behind.
+func listDiskTables(dbDir string, maxIndex int) ([]int, error) {
+	indexes := make([]int, 0, maxIndex+1)
+	for index := 0; index <= maxIndex; index++ {
+		dataPath := diskTableFilePath(dbDir, strconv.Itoa(index)+"-", diskTableDataFileName)
+		if _, err := os.Stat(dataPath); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, fmt.Errorf("failed to stat data file %s: %w", dataPath, err)
+		}
+
+		indexes = append(indexes, index)
+	}
+
+	return indexes, nil
+}
+
+// verifyDiskTables reads every record of every disk table in the
+// directory, so the records that carry a checksum are verified.
+// Returns the first verification error.
+func verifyDiskTables(dbDir string, maxIndex int) error {
+	indexes, err := listDiskTables(dbDir, maxIndex)
+	if err != nil {
+		return fmt.Errorf("failed to list disk tables: %w", err)
+	}
+
+	for _, index := range indexes {
+		dataPath := diskTableFilePath(dbDir, strconv.Itoa(index)+"-", diskTableDataFileName)
+		it, err := newDataFileIterator(dataPath)
+		if err != nil {
+			return fmt.Errorf("failed to instantiate iterator for %s: %w", dataPath, err)
+		}
+
+		for it.hasNext() {
+			if _, _, err := it.next(); err != nil {
+				it.close()
+				return fmt.Errorf("failed to verify disk table %d: %w", index, err)
+			}
+		}
+
+		if err := it.close(); err != nil {
+			return fmt.Errorf("failed to close iterator for %s: %w", dataPath, err)
+		}
+	}
+
+	return nil
+}
+
+// readDiskTableBounds reads the smallest and the largest keys of the disk
+// table with the given prefix. ok is false if the table carries no bounds
+// file, which is the case for the tables written by the older versions.
+func readDiskTableBounds(dbDir, prefix string) (min, max []byte, ok bool, err error) {
+	boundsPath := diskTableFilePath(dbDir, prefix, diskTableBoundsFileName)
+	data, err := ioutil.ReadFile(boundsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, false, nil
+		}
+
+		return nil, nil, false, fmt.Errorf("failed to read bounds file %s: %w", boundsPath, err)
+	}
+
+	min, max, ok = decodeKeyBounds(data)
+
+	return min, max, ok, nil
+}
+
 // searchInDiskTable searches a given key in a given disk table.
-func searchInDiskTable(dbDir string, index int, key []byte) ([]byte, bool, error) {
+// The table must be sorted in the order defined by the comparator.
+func searchInDiskTable(dbDir string, index int, key []byte, compare Comparator, files *fileCache, readBufferSize int, logger Logger) ([]byte, bool, error) {
 	prefix := strconv.Itoa(index) + "-"
 
-	sparseIndexPath := path.Join(dbDir, prefix+diskTableSparseIndexFileName)
-	sparseIndexFile, err := os.OpenFile(sparseIndexPath, os.O_RDONLY, 0600)
+	// the bounds prune the table without opening the sparse index if
+	// the key cannot be stored in it; the tables written by the older
+	// versions carry no bounds file and are searched as before
+	min, max, bounded, err := readDiskTableBounds(dbDir, prefix)
+	if err != nil {
+		return nil, false, err
+	}
+	if bounded && (compare(key, min) < 0 || compare(key, max) > 0) {
+		return nil, false, nil
+	}
+
+	sparseIndexPath := diskTableFilePath(dbDir, prefix, diskTableSparseIndexFileName)
+	sparseIndexFile, err := files.open(sparseIndexPath)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, wrapError(ErrDiskTableMissing, err)
+		}
+
 		return nil, false, fmt.Errorf("failed to open sparse index file: %w", err)
 	}
-	defer sparseIndexFile.Close()
+	defer files.release(sparseIndexFile)
 
-	from, to, ok, err := searchInSparseIndex(sparseIndexFile, key)
+	from, to, ok, err := searchInSparseIndex(sparseIndexFile, key, compare)
 	if err != nil {
 		return nil, false, fmt.Errorf("failed to search in sparse index file %s: %w", sparseIndexPath, err)
 	}
@@ -87,14 +362,18 @@ func searchInDiskTable(dbDir string, index int, key []byte) ([]byte, bool, error
 		return nil, false, nil
 	}
 
-	indexPath := path.Join(dbDir, prefix+diskTableIndexFileName)
-	indexFile, err := os.OpenFile(indexPath, os.O_RDONLY, 0600)
+	indexPath := diskTableFilePath(dbDir, prefix, diskTableIndexFileName)
+	indexFile, err := files.open(indexPath)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, wrapError(ErrDiskTableMissing, err)
+		}
+
 		return nil, false, fmt.Errorf("failed to open index file: %w", err)
 	}
-	defer indexFile.Close()
+	defer files.release(indexFile)
 
-	offset, ok, err := searchInIndex(indexFile, from, to, key)
+	offset, ok, err := searchInIndex(indexFile, from, to, key, compare)
 	if err != nil {
 		return nil, false, fmt.Errorf("failed to search in index file %s: %w", indexPath, err)
 	}
@@ -102,42 +381,104 @@ func searchInDiskTable(dbDir string, index int, key []byte) ([]byte, bool, error
 		return nil, false, nil
 	}
 
-	dataPath := path.Join(dbDir, prefix+diskTableDataFileName)
-	dataFile, err := os.OpenFile(dataPath, os.O_RDONLY, 0600)
+	dataPath := diskTableFilePath(dbDir, prefix, diskTableDataFileName)
+	dataFile, err := files.open(dataPath)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, wrapError(ErrDiskTableMissing, err)
+		}
+
 		return nil, false, fmt.Errorf("failed to open data file: %w", err)
 	}
-	defer dataFile.Close()
+	defer files.release(dataFile)
 
-	value, ok, err := searchInDataFile(dataFile, offset, key)
+	value, ok, err := searchInDataFile(dataFile, offset, key, compare, readBufferSize, logger)
 	if err != nil {
 		return nil, false, fmt.Errorf("failed to search in data file %s: %w", dataPath, err)
 	}
 
-	if err := sparseIndexFile.Close(); err != nil {
+	if err := files.release(sparseIndexFile); err != nil {
 		return nil, false, fmt.Errorf("failed to close sparse index file: %w", err)
 	}
 
-	if err := indexFile.Close(); err != nil {
+	if err := files.release(indexFile); err != nil {
 		return nil, false, fmt.Errorf("failed to close index file: %w", err)
 	}
 
-	if err := dataFile.Close(); err != nil {
+	if err := files.release(dataFile); err != nil {
 		return nil, false, fmt.Errorf("failed to close data file: %w", err)
 	}
 
 	return value, ok, nil
 }
 
+// keyInDiskTable reports whether the disk table with the given index
+// stores a record for the key, including a tombstone. Only the sparse
+// index and the index files are read, the data file is not touched.
+func keyInDiskTable(dbDir string, index int, key []byte, compare Comparator, files *fileCache) (bool, error) {
+	prefix := strconv.Itoa(index) + "-"
+
+	sparseIndexPath := diskTableFilePath(dbDir, prefix, diskTableSparseIndexFileName)
+	sparseIndexFile, err := files.open(sparseIndexPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, wrapError(ErrDiskTableMissing, err)
+		}
+
+		return false, fmt.Errorf("failed to open sparse index file: %w", err)
+	}
+	defer files.release(sparseIndexFile)
+
+	from, to, ok, err := searchInSparseIndex(sparseIndexFile, key, compare)
+	if err != nil {
+		return false, fmt.Errorf("failed to search in sparse index file %s: %w", sparseIndexPath, err)
+	}
+	if !ok {
+		return false, nil
+	}
+
+	indexPath := diskTableFilePath(dbDir, prefix, diskTableIndexFileName)
+	indexFile, err := files.open(indexPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, wrapError(ErrDiskTableMissing, err)
+		}
+
+		return false, fmt.Errorf("failed to open index file: %w", err)
+	}
+	defer files.release(indexFile)
+
+	_, ok, err = searchInIndex(indexFile, from, to, key, compare)
+	if err != nil {
+		return false, fmt.Errorf("failed to search in index file %s: %w", indexPath, err)
+	}
+
+	return ok, nil
+}
+
 // searchInDataFile searches a value by the key in the data file from the given offset.
 // The offset must always point to the beginning of the record.
-func searchInDataFile(r io.ReadSeeker, offset int, searchKey []byte) ([]byte, bool, error) {
+// A record truncated by a crash ends the data file: the search treats
+// it as the end of data, so the intact records before it stay readable.
+// A positive readBufferSize buffers the scan after the seek, so the
+// bounded scan between the sparse samples issues fewer syscalls.
+func searchInDataFile(r io.ReadSeeker, offset int, searchKey []byte, compare Comparator, readBufferSize int, logger Logger) ([]byte, bool, error) {
 	if _, err := r.Seek(int64(offset), io.SeekStart); err != nil {
 		return nil, false, fmt.Errorf("failed to seek: %w", err)
 	}
 
+	// the buffer cannot outlive the seek, so it is created per search
+	var reader io.Reader = r
+	if readBufferSize > 0 {
+		reader = bufio.NewReaderSize(r, readBufferSize)
+	}
+
 	for {
-		key, value, err := decode(r)
+		key, value, err := decode(reader)
+		if errors.Is(err, errTruncatedRecord) {
+			logger.Printf("warning: the data file ends with a truncated record, treating it as the end of data")
+			return nil, false, nil
+		}
 		if err != nil && err != io.EOF {
 			return nil, false, fmt.Errorf("failed to read: %w", err)
 		}
@@ -145,29 +486,232 @@ func searchInDataFile(r io.ReadSeeker, offset int, searchKey []byte) ([]byte, bo
 			return nil, false, nil
 		}
 
-		if bytes.Equal(key, searchKey) {
+		if compare(key, searchKey) == 0 {
 			return value, true, nil
 		}
 	}
 }
 
+// valueReader streams the value bytes of a single data file record
+// and closes the underlying file when done.
+type valueReader struct {
+	*io.SectionReader
+	file *os.File
+}
+
+// Close closes the underlying data file.
+func (r *valueReader) Close() error {
+	return r.file.Close()
+}
+
+// openValueInDiskTable returns a reader over the value region of the
+// record for the key in the disk table with the given index, along
+// with the value length. The reader owns its own handle of the data
+// file, so it stays valid after the search returns. A tombstone is
+// reported as found with a nil reader, mirroring searchInDiskTable.
+func openValueInDiskTable(dbDir string, index int, key []byte, compare Comparator, files *fileCache, logger Logger) (io.ReadCloser, int, bool, error) {
+	prefix := strconv.Itoa(index) + "-"
+
+	min, max, bounded, err := readDiskTableBounds(dbDir, prefix)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if bounded && (compare(key, min) < 0 || compare(key, max) > 0) {
+		return nil, 0, false, nil
+	}
+
+	sparseIndexPath := diskTableFilePath(dbDir, prefix, diskTableSparseIndexFileName)
+	sparseIndexFile, err := files.open(sparseIndexPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, false, wrapError(ErrDiskTableMissing, err)
+		}
+
+		return nil, 0, false, fmt.Errorf("failed to open sparse index file: %w", err)
+	}
+	defer files.release(sparseIndexFile)
+
+	from, to, ok, err := searchInSparseIndex(sparseIndexFile, key, compare)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("failed to search in sparse index file %s: %w", sparseIndexPath, err)
+	}
+	if !ok {
+		return nil, 0, false, nil
+	}
+
+	indexPath := diskTableFilePath(dbDir, prefix, diskTableIndexFileName)
+	indexFile, err := files.open(indexPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, false, wrapError(ErrDiskTableMissing, err)
+		}
+
+		return nil, 0, false, fmt.Errorf("failed to open index file: %w", err)
+	}
+	defer files.release(indexFile)
+
+	offset, ok, err := searchInIndex(indexFile, from, to, key, compare)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("failed to search in index file %s: %w", indexPath, err)
+	}
+	if !ok {
+		return nil, 0, false, nil
+	}
+
+	dataPath := diskTableFilePath(dbDir, prefix, diskTableDataFileName)
+	dataFile, err := os.Open(dataPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, false, wrapError(ErrDiskTableMissing, err)
+		}
+
+		return nil, 0, false, fmt.Errorf("failed to open data file: %w", err)
+	}
+
+	valueOffset, valueLen, found, deleted, err := findValueRegion(dataFile, offset, key, compare, logger)
+	if err != nil {
+		dataFile.Close()
+		return nil, 0, false, fmt.Errorf("failed to search in data file %s: %w", dataPath, err)
+	}
+	if !found || deleted {
+		if err := dataFile.Close(); err != nil {
+			return nil, 0, false, fmt.Errorf("failed to close data file: %w", err)
+		}
+
+		return nil, 0, found, nil
+	}
+
+	return &valueReader{io.NewSectionReader(dataFile, valueOffset, valueLen), dataFile}, int(valueLen), true, nil
+}
+
+// findValueRegion scans the data file from the given offset and returns
+// the offset and the length of the value bytes of the record for the
+// key. Only the record headers and the keys are read, the values are
+// seeked over, so the scan does not load them into memory and the
+// record checksums are not verified. The deleted result reports that
+// the matched record is a tombstone.
+func findValueRegion(r io.ReadSeeker, offset int, searchKey []byte, compare Comparator, logger Logger) (int64, int64, bool, bool, error) {
+	recordStart, err := r.Seek(int64(offset), io.SeekStart)
+	if err != nil {
+		return 0, 0, false, false, fmt.Errorf("failed to seek: %w", err)
+	}
+
+	for {
+		var encodedEntryLen [8]byte
+		if _, err := io.ReadFull(r, encodedEntryLen[:]); err != nil {
+			if err == io.EOF {
+				return 0, 0, false, false, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				logger.Printf("warning: the data file ends with a truncated record, treating it as the end of data")
+				return 0, 0, false, false, nil
+			}
+
+			return 0, 0, false, false, fmt.Errorf("failed to read: %w", err)
+		}
+
+		rawEntryLen := binary.BigEndian.Uint64(encodedEntryLen[:])
+		flagged := rawEntryLen&recordFlagsBit != 0
+		checksummed := rawEntryLen&recordChecksumBit != 0
+		timestamped := rawEntryLen&recordTimestampBit != 0
+		padded := rawEntryLen&recordPaddingBit != 0
+		entryLen := int64(rawEntryLen &^ (recordFlagsBit | recordChecksumBit | recordTimestampBit | recordPaddingBit))
+
+		// the fields stored between the total length and the key
+		preLen := 8
+		if padded {
+			preLen++
+		}
+		if checksummed {
+			preLen += 4
+		}
+		if timestamped {
+			preLen += 8
+		}
+		if flagged {
+			preLen++
+		}
+
+		pre := make([]byte, preLen)
+		if _, err := io.ReadFull(r, pre); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				logger.Printf("warning: the data file ends with a truncated record, treating it as the end of data")
+				return 0, 0, false, false, nil
+			}
+
+			return 0, 0, false, false, fmt.Errorf("failed to read: %w", err)
+		}
+
+		padLen := int64(0)
+		pos := 0
+		if padded {
+			padLen = int64(pre[0])
+			pos++
+		}
+		if checksummed {
+			pos += 4
+		}
+		if timestamped {
+			pos += 8
+		}
+		keyLen := int64(decodeInt(pre[pos : pos+8]))
+		pos += 8
+
+		flags := recordPut
+		if flagged {
+			flags = pre[pos]
+		}
+
+		if keyLen < 0 || int64(preLen)+keyLen+padLen > entryLen {
+			return 0, 0, false, false, fmt.Errorf("the file is corrupted, failed to read the record")
+		}
+
+		key := make([]byte, keyLen)
+		if _, err := io.ReadFull(r, key); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				logger.Printf("warning: the data file ends with a truncated record, treating it as the end of data")
+				return 0, 0, false, false, nil
+			}
+
+			return 0, 0, false, false, fmt.Errorf("failed to read: %w", err)
+		}
+
+		valueLen := entryLen - int64(preLen) - keyLen - padLen
+		if compare(key, searchKey) == 0 {
+			deleted := flags == recordDelete || (!flagged && valueLen == 0)
+
+			return recordStart + 8 + int64(preLen) + keyLen, valueLen, true, deleted, nil
+		}
+
+		recordStart, err = r.Seek(recordStart+8+entryLen, io.SeekStart)
+		if err != nil {
+			return 0, 0, false, false, fmt.Errorf("failed to seek: %w", err)
+		}
+	}
+}
+
 // searchInIndex searches key in the index file in specified range.
-func searchInIndex(r io.ReadSeeker, from, to int, searchKey []byte) (int, bool, error) {
+// The keys are compared in the order defined by the comparator.
+func searchInIndex(r io.ReadSeeker, from, to int, searchKey []byte, compare Comparator) (int, bool, error) {
 	if _, err := r.Seek(int64(from), io.SeekStart); err != nil {
 		return 0, false, fmt.Errorf("failed to seek: %w", err)
 	}
 
+	// the scan starts at a restart point, so the prefix-compressed
+	// entries are reconstructed from the preceding keys
+	var prevKey []byte
 	for {
-		key, value, err := decode(r)
+		suffix, value, err := decode(r)
 		if err != nil && err != io.EOF {
 			return 0, false, fmt.Errorf("failed to read: %w", err)
 		}
 		if err == io.EOF {
 			return 0, false, nil
 		}
-		offset := decodeInt(value)
+		key, offset := decodeKeyOffset(prevKey, suffix, value)
+		prevKey = key
 
-		if bytes.Equal(key, searchKey) {
+		if compare(key, searchKey) == 0 {
 			return offset, true, nil
 		}
 
@@ -185,19 +729,22 @@ func searchInIndex(r io.ReadSeeker, from, to int, searchKey []byte) (int, bool,
 }
 
 // searchInSparseIndex searches a range between which the key is located.
-func searchInSparseIndex(r io.Reader, searchKey []byte) (int, int, bool, error) {
+// The sparse index must be sorted in the order defined by the comparator.
+func searchInSparseIndex(r io.Reader, searchKey []byte, compare Comparator) (int, int, bool, error) {
 	from := -1
+	var prevKey []byte
 	for {
-		key, value, err := decode(r)
+		suffix, value, err := decode(r)
 		if err != nil && err != io.EOF {
 			return 0, 0, false, fmt.Errorf("failed to read: %w", err)
 		}
 		if err == io.EOF {
 			return from, 0, from != -1, nil
 		}
-		offset := decodeInt(value)
+		key, offset := decodeKeyOffset(prevKey, suffix, value)
+		prevKey = key
 
-		cmp := bytes.Compare(key, searchKey)
+		cmp := compare(key, searchKey)
 		if cmp == 0 {
 			return offset, offset, true, nil
 		} else if cmp < 0 {
@@ -214,8 +761,102 @@ func searchInSparseIndex(r io.Reader, searchKey []byte) (int, int, bool, error)
 	}
 }
 
+// RebuildIndex regenerates the index and sparse index files of the disk
+// table with the given index from its data file. It is useful for
+// recovering the disk table if the index files are lost or corrupted,
+// but the data file is intact.
+func RebuildIndex(dbDir string, index int, sparseKeyDistance int) error {
+	prefix := strconv.Itoa(index) + "-"
+
+	dataPath := diskTableFilePath(dbDir, prefix, diskTableDataFileName)
+	it, err := newDataFileIterator(dataPath)
+	if err != nil {
+		return fmt.Errorf("failed to instantiate iterator for %s: %w", dataPath, err)
+	}
+	defer it.close()
+
+	indexPath := diskTableFilePath(dbDir, prefix, diskTableIndexFileName)
+	indexFile, err := os.OpenFile(indexPath, newDiskTableFlag, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open index file %s: %w", indexPath, err)
+	}
+	defer indexFile.Close()
+
+	sparseIndexPath := diskTableFilePath(dbDir, prefix, diskTableSparseIndexFileName)
+	sparseIndexFile, err := os.OpenFile(sparseIndexPath, newDiskTableFlag, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open sparse index file %s: %w", sparseIndexPath, err)
+	}
+	defer sparseIndexFile.Close()
+
+	keyNum, indexPos := 0, 0
+	var firstKey, prevIndexKey, prevSparseIndexKey []byte
+	for it.hasNext() {
+		key, _, err := it.next()
+		if err != nil {
+			return fmt.Errorf("failed to read from the data file: %w", err)
+		}
+
+		if keyNum == 0 {
+			firstKey = key
+		}
+
+		// the entries at the sparse boundaries are restart points:
+		// searchInIndex seeks to them, so they store the full key
+		if keyNum%sparseKeyDistance == 0 {
+			prevIndexKey = nil
+		}
+
+		indexBytes, err := encodeKeyOffset(key, prevIndexKey, it.offset(), indexFile)
+		if err != nil {
+			return fmt.Errorf("failed to write to the index file: %w", err)
+		}
+
+		if keyNum%sparseKeyDistance == 0 {
+			if _, err := encodeKeyOffset(key, prevSparseIndexKey, indexPos, sparseIndexFile); err != nil {
+				return fmt.Errorf("failed to write to the sparse index file: %w", err)
+			}
+
+			prevSparseIndexKey = key
+		}
+
+		prevIndexKey = key
+		indexPos += indexBytes
+		keyNum++
+	}
+
+	if err := indexFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync index file: %w", err)
+	}
+
+	if err := sparseIndexFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync sparse index file: %w", err)
+	}
+
+	// the bounds file is regenerated as well, since the data file order
+	// gives the smallest and the largest keys for free
+	if keyNum > 0 {
+		boundsPath := diskTableFilePath(dbDir, prefix, diskTableBoundsFileName)
+		if err := ioutil.WriteFile(boundsPath, encodeKeyBounds(firstKey, prevIndexKey), 0600); err != nil {
+			return fmt.Errorf("failed to write bounds file %s: %w", boundsPath, err)
+		}
+	}
+
+	return nil
+}
+
 // renameDiskTable renames disk table: data, index and sparse index files.
+// In the subdirectory layout the whole table directory is renamed
+// instead, which also keeps the descriptors open on the files valid.
 func renameDiskTable(dbDir string, oldPrefix, newPrefix string) error {
+	if usesSubdirLayout(dbDir) {
+		if err := os.Rename(diskTableDirPath(dbDir, oldPrefix), diskTableDirPath(dbDir, newPrefix)); err != nil {
+			return fmt.Errorf("failed to rename disk table directory: %w", err)
+		}
+
+		return nil
+	}
+
 	if err := os.Rename(path.Join(dbDir, oldPrefix+diskTableDataFileName), path.Join(dbDir, newPrefix+diskTableDataFileName)); err != nil {
 		return fmt.Errorf("failed to rename data file: %w", err)
 	}
@@ -228,26 +869,85 @@ func renameDiskTable(dbDir string, oldPrefix, newPrefix string) error {
 		return fmt.Errorf("failed to rename sparse index file: %w", err)
 	}
 
+	// the tables written by the older versions carry no bounds file
+	if err := os.Rename(path.Join(dbDir, oldPrefix+diskTableBoundsFileName), path.Join(dbDir, newPrefix+diskTableBoundsFileName)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to rename bounds file: %w", err)
+	}
+
+	// only the flushed tables carry a manifest file
+	if err := os.Rename(path.Join(dbDir, oldPrefix+diskTableManifestFileName), path.Join(dbDir, newPrefix+diskTableManifestFileName)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to rename manifest file: %w", err)
+	}
+
 	return nil
 }
 
 // deleteDiskTable deletes disk table: data, index and sparse index files.
+// In the subdirectory layout the emptied table directory is removed as well.
 func deleteDiskTables(dbDir string, prefixes ...string) error {
+	subdir := usesSubdirLayout(dbDir)
 	for _, prefix := range prefixes {
-		dataPath := path.Join(dbDir, prefix+diskTableDataFileName)
+		dataPath := diskTableFilePath(dbDir, prefix, diskTableDataFileName)
 		if err := os.Remove(dataPath); err != nil {
 			return fmt.Errorf("failed to remove data file %s: %w", dataPath, err)
 		}
 
-		indexPath := path.Join(dbDir, prefix+diskTableIndexFileName)
+		indexPath := diskTableFilePath(dbDir, prefix, diskTableIndexFileName)
 		if err := os.Remove(indexPath); err != nil {
 			return fmt.Errorf("failed to remove data file %s: %w", indexPath, err)
 		}
 
-		sparseIndexPath := path.Join(dbDir, prefix+diskTableSparseIndexFileName)
+		sparseIndexPath := diskTableFilePath(dbDir, prefix, diskTableSparseIndexFileName)
 		if err := os.Remove(sparseIndexPath); err != nil {
 			return fmt.Errorf("failed to remove data file %s: %w", sparseIndexPath, err)
 		}
+
+		// the tables written by the older versions carry no bounds file
+		boundsPath := diskTableFilePath(dbDir, prefix, diskTableBoundsFileName)
+		if err := os.Remove(boundsPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove bounds file %s: %w", boundsPath, err)
+		}
+
+		// only the flushed tables carry a manifest file
+		manifestPath := diskTableFilePath(dbDir, prefix, diskTableManifestFileName)
+		if err := os.Remove(manifestPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove manifest file %s: %w", manifestPath, err)
+		}
+
+		if subdir {
+			dirPath := diskTableDirPath(dbDir, prefix)
+			if err := os.Remove(dirPath); err != nil {
+				return fmt.Errorf("failed to remove disk table directory %s: %w", dirPath, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// removePartialDiskTables removes whatever files the disk tables in
+// the index range left behind, tolerating the missing ones. It cleans
+// up after a flush that failed partway, when some of the tables are
+// complete, one may be partial and the rest were never started, so a
+// later open does not read the leftovers as live tables.
+func removePartialDiskTables(dbDir string, firstIndex, lastIndex int) error {
+	subdir := usesSubdirLayout(dbDir)
+	fileNames := []string{diskTableDataFileName, diskTableIndexFileName, diskTableSparseIndexFileName, diskTableBoundsFileName, diskTableManifestFileName}
+	for index := firstIndex; index <= lastIndex; index++ {
+		prefix := strconv.Itoa(index) + "-"
+		for _, fileName := range fileNames {
+			filePath := diskTableFilePath(dbDir, prefix, fileName)
+			if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove %s: %w", filePath, err)
+			}
+		}
+
+		if subdir {
+			dirPath := diskTableDirPath(dbDir, prefix)
+			if err := os.Remove(dirPath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove disk table directory %s: %w", dirPath, err)
+			}
+		}
 	}
 
 	return nil
@@ -256,65 +956,158 @@ func deleteDiskTables(dbDir string, prefixes ...string) error {
 // diskTableWriter is a simple abstraction over the disk table, but only
 // for the writing purposes.
 type diskTableWriter struct {
+	dbDir  string
+	prefix string
+
 	dataFile        *os.File
 	indexFile       *os.File
 	sparseIndexFile *os.File
 
+	// Buffered writers over the files, so writing a record does not
+	// cost several small write syscalls. The buffers are flushed
+	// before the files are synced.
+	dataBuf        *bufio.Writer
+	indexBuf       *bufio.Writer
+	sparseIndexBuf *bufio.Writer
+
 	sparseKeyDistance int
 
-	keyNum, dataPos, indexPos int
+	// If positive, a sparse sample is also emitted once the index file
+	// grows by that many bytes since the last sample, so the bounded
+	// index scan stays small for the large keys as well.
+	sparseByteDistance int
+
+	// The number of keys and the number of index bytes written since
+	// the last sparse sample.
+	keysSinceSample, indexBytesSinceSample int
+
+	// Whether the data file records carry the checksums of their payload.
+	checksummed bool
+
+	// If positive, the data file records are padded with zero bytes to
+	// the multiples of blockAlign, so every record starts at a block
+	// boundary and the aligned reads do not straddle blocks.
+	blockAlign int
+
+	// If set, the writes are throttled by the limiter. The merges set
+	// it, so the background compaction does not saturate the disk; the
+	// flushes are never throttled.
+	limiter *compactionRateLimiter
+
+	// The last keys written to the index and the sparse index files,
+	// the following entries are prefix-compressed against them.
+	prevIndexKey, prevSparseIndexKey []byte
+
+	// The smallest and the largest keys written so far, stored in the
+	// bounds file on sync. The writes come in the comparator order, so
+	// these are simply the first and the last written keys.
+	minKey, maxKey []byte
+
+	keyNum, dataPos, indexPos, sparseIndexPos int
 }
 
 // newDiskTableWriter returns new instance of diskTableWriter.
-func newDiskTableWriter(dbDir, prefix string, sparseKeyDistance int) (*diskTableWriter, error) {
-	dataPath := path.Join(dbDir, prefix+diskTableDataFileName)
+func newDiskTableWriter(dbDir, prefix string, sparseKeyDistance, sparseByteDistance int, checksummed bool) (*diskTableWriter, error) {
+	if usesSubdirLayout(dbDir) {
+		dirPath := diskTableDirPath(dbDir, prefix)
+		if err := os.MkdirAll(dirPath, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create disk table directory %s: %w", dirPath, err)
+		}
+	}
+
+	dataPath := diskTableFilePath(dbDir, prefix, diskTableDataFileName)
 	dataFile, err := os.OpenFile(dataPath, newDiskTableFlag, 0600)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open data file %s: %w", dataPath, err)
 	}
 
-	indexPath := path.Join(dbDir, prefix+diskTableIndexFileName)
+	indexPath := diskTableFilePath(dbDir, prefix, diskTableIndexFileName)
 	indexFile, err := os.OpenFile(indexPath, newDiskTableFlag, 0600)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open index file %s: %w", indexPath, err)
 	}
 
-	sparseIndexPath := path.Join(dbDir, prefix+diskTableSparseIndexFileName)
+	sparseIndexPath := diskTableFilePath(dbDir, prefix, diskTableSparseIndexFileName)
 	sparseIndexFile, err := os.OpenFile(sparseIndexPath, newDiskTableFlag, 0600)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open sparse index file %s: %w", sparseIndexPath, err)
 	}
 
 	return &diskTableWriter{
-		dataFile:          dataFile,
-		indexFile:         indexFile,
-		sparseIndexFile:   sparseIndexFile,
-		sparseKeyDistance: sparseKeyDistance,
-		keyNum:            0,
-		dataPos:           0,
-		indexPos:          0,
+		dbDir:              dbDir,
+		prefix:             prefix,
+		dataFile:           dataFile,
+		indexFile:          indexFile,
+		sparseIndexFile:    sparseIndexFile,
+		dataBuf:            bufio.NewWriter(dataFile),
+		indexBuf:           bufio.NewWriter(indexFile),
+		sparseIndexBuf:     bufio.NewWriter(sparseIndexFile),
+		sparseKeyDistance:  sparseKeyDistance,
+		sparseByteDistance: sparseByteDistance,
+		checksummed:        checksummed,
+		keyNum:             0,
+		dataPos:            0,
+		indexPos:           0,
 	}, nil
 }
 
 // write writes key and value into the disk table: data, index and
 // sparse index file.
 func (w *diskTableWriter) write(key, value []byte) error {
-	dataBytes, err := encode(key, value, w.dataFile)
+	var dataBytes int
+	var err error
+	if w.blockAlign > 0 {
+		dataBytes, err = encodePadded(key, value, w.checksummed, w.blockAlign, w.dataBuf)
+	} else if w.checksummed {
+		dataBytes, err = encodeChecksummed(key, value, w.dataBuf)
+	} else {
+		dataBytes, err = encode(key, value, w.dataBuf)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to write to the data file: %w", err)
 	}
 
-	indexBytes, err := encodeKeyOffset(key, w.dataPos, w.indexFile)
+	if w.limiter != nil {
+		w.limiter.wait(dataBytes)
+	}
+
+	// a sample is emitted when either enough keys or enough index
+	// bytes have passed since the last one, whichever comes first
+	sample := w.keyNum == 0 ||
+		w.keysSinceSample >= w.sparseKeyDistance ||
+		(w.sparseByteDistance > 0 && w.indexBytesSinceSample >= w.sparseByteDistance)
+
+	// the entries at the sparse boundaries are restart points:
+	// searchInIndex seeks to them, so they store the full key
+	if sample {
+		w.prevIndexKey = nil
+	}
+
+	indexBytes, err := encodeKeyOffset(key, w.prevIndexKey, w.dataPos, w.indexBuf)
 	if err != nil {
 		return fmt.Errorf("failed to write to the index file: %w", err)
 	}
 
-	if w.keyNum%w.sparseKeyDistance == 0 {
-		if _, err := encodeKeyOffset(key, w.indexPos, w.sparseIndexFile); err != nil {
+	if sample {
+		sparseIndexBytes, err := encodeKeyOffset(key, w.prevSparseIndexKey, w.indexPos, w.sparseIndexBuf)
+		if err != nil {
 			return fmt.Errorf("failed to write to the file: %w", err)
 		}
+
+		w.sparseIndexPos += sparseIndexBytes
+		w.prevSparseIndexKey = append([]byte(nil), key...)
+		w.keysSinceSample = 0
+		w.indexBytesSinceSample = 0
 	}
 
+	w.keysSinceSample++
+	w.indexBytesSinceSample += indexBytes
+
+	w.prevIndexKey = append([]byte(nil), key...)
+	if w.minKey == nil {
+		w.minKey = w.prevIndexKey
+	}
+	w.maxKey = w.prevIndexKey
 	w.dataPos += dataBytes
 	w.indexPos += indexBytes
 	w.keyNum++
@@ -322,8 +1115,19 @@ func (w *diskTableWriter) write(key, value []byte) error {
 	return nil
 }
 
-// sync commits all written contents to the stable storage.
+// bytes returns the total number of bytes written to the data, index
+// and sparse index files.
+func (w *diskTableWriter) bytes() int {
+	return w.dataPos + w.indexPos + w.sparseIndexPos
+}
+
+// sync flushes the buffered writes and commits all written contents
+// to the stable storage.
 func (w *diskTableWriter) sync() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+
 	if err := w.dataFile.Sync(); err != nil {
 		return fmt.Errorf("failed to sync data file: %w", err)
 	}
@@ -336,11 +1140,41 @@ func (w *diskTableWriter) sync() error {
 		return fmt.Errorf("failed to sync sparse index file: %w", err)
 	}
 
+	// the bounds are known only after the last write, so the bounds
+	// file appears as part of the final sync
+	if w.minKey != nil {
+		boundsPath := diskTableFilePath(w.dbDir, w.prefix, diskTableBoundsFileName)
+		if err := ioutil.WriteFile(boundsPath, encodeKeyBounds(w.minKey, w.maxKey), 0600); err != nil {
+			return fmt.Errorf("failed to write bounds file %s: %w", boundsPath, err)
+		}
+	}
+
+	return nil
+}
+
+// flush flushes the buffered writes into the files.
+func (w *diskTableWriter) flush() error {
+	if err := w.dataBuf.Flush(); err != nil {
+		return fmt.Errorf("failed to flush data file buffer: %w", err)
+	}
+
+	if err := w.indexBuf.Flush(); err != nil {
+		return fmt.Errorf("failed to flush index file buffer: %w", err)
+	}
+
+	if err := w.sparseIndexBuf.Flush(); err != nil {
+		return fmt.Errorf("failed to flush sparse index file buffer: %w", err)
+	}
+
 	return nil
 }
 
 // close closes all associated files with the disk table.
 func (w *diskTableWriter) close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+
 	if err := w.dataFile.Close(); err != nil {
 		return fmt.Errorf("failed to close data file: %w", err)
 	}
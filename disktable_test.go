@@ -2,6 +2,7 @@ package lsmtree
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -31,11 +32,13 @@ func TestSearchInDiskTables(t *testing.T) {
 		{0, []byte("f"), []byte("vf"), true, false},
 		{0, []byte("f"), []byte("vf"), true, false},
 		{0, []byte("k"), nil, false, false},
-		{1, []byte("b"), nil, false, true},
+		// the missing disk table 1 is skipped and the key is
+		// found in the disk table 0
+		{1, []byte("b"), []byte("vb"), true, false},
 	}
 
 	for _, c := range cases {
-		value, ok, err := searchInDiskTables(dbDir, c.maxIndex, c.key)
+		value, ok, err := searchInDiskTables(dbDir, c.maxIndex, c.key, bytes.Compare, nil, 0, nil, CorruptTableFail, noopLogger{})
 		if c.hasErr && err == nil {
 			t.Fatalf("err == nil, but must be returned for %s: %v != %v", string(c.key), c.ok, ok)
 		}
@@ -75,7 +78,7 @@ func TestSearchInDiskTable(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		value, ok, err := searchInDiskTable(dbDir, c.index, c.key)
+		value, ok, err := searchInDiskTable(dbDir, c.index, c.key, bytes.Compare, nil, 0, noopLogger{})
 		if c.hasErr && err == nil {
 			t.Fatalf("err == nil, but must be returned for %s: %v != %v", string(c.key), c.ok, ok)
 		}
@@ -121,7 +124,7 @@ func TestSearchInDataFile(t *testing.T) {
 	defer dataFile.Close()
 
 	for _, c := range cases {
-		value, ok, err := searchInDataFile(dataFile, c.offset, c.key)
+		value, ok, err := searchInDataFile(dataFile, c.offset, c.key, bytes.Compare, 0, noopLogger{})
 		if !((c.value == nil && value == nil) || (bytes.Equal(c.value, value))) {
 			t.Fatalf("values do not match for %s, err = %v: %s != %s", string(c.key), err, string(c.value), string(value))
 		}
@@ -150,9 +153,9 @@ func TestSearchInIndex(t *testing.T) {
 	}{
 		{[]byte("a"), 0, 1000, false, false, 0},
 		{[]byte("b"), 0, 0, true, false, 0},
-		{[]byte("c"), 0, 75, true, false, 19},
-		{[]byte("f"), 75, 150, true, false, 76},
-		{[]byte("k"), 150, 0, false, false, 0},
+		{[]byte("c"), 0, 99, true, false, 19},
+		{[]byte("f"), 99, 198, true, false, 76},
+		{[]byte("k"), 198, 0, false, false, 0},
 	}
 
 	indexFile, err := os.OpenFile(path.Join(dbDir, "0-index.db"), os.O_RDONLY, 0600)
@@ -162,7 +165,7 @@ func TestSearchInIndex(t *testing.T) {
 	defer indexFile.Close()
 
 	for _, c := range cases {
-		offset, ok, err := searchInIndex(indexFile, c.from, c.to, c.key)
+		offset, ok, err := searchInIndex(indexFile, c.from, c.to, c.key, bytes.Compare)
 		if c.offset != offset {
 			t.Fatalf("offset does not match for %s, err = %v: %d != %d", string(c.key), err, c.offset, offset)
 		}
@@ -190,9 +193,9 @@ func TestSearchInSparseIndex(t *testing.T) {
 	}{
 		{[]byte("a"), 0, 0, false, false},
 		{[]byte("b"), 0, 0, true, false},
-		{[]byte("c"), 0, 75, true, false},
-		{[]byte("f"), 75, 150, true, false},
-		{[]byte("k"), 150, 0, true, false},
+		{[]byte("c"), 0, 99, true, false},
+		{[]byte("f"), 99, 198, true, false},
+		{[]byte("k"), 198, 0, true, false},
 	}
 
 	sparseIndexFile, err := os.OpenFile(path.Join(dbDir, "0-sparse.db"), os.O_RDONLY, 0600)
@@ -203,7 +206,7 @@ func TestSearchInSparseIndex(t *testing.T) {
 
 	for _, c := range cases {
 		sparseIndexFile.Seek(0, io.SeekStart)
-		from, to, ok, err := searchInSparseIndex(sparseIndexFile, c.key)
+		from, to, ok, err := searchInSparseIndex(sparseIndexFile, c.key, bytes.Compare)
 		if c.from != from || c.to != to {
 			t.Fatalf("from and to do not match for %s, err = %v: %d != %d or %d != %d", string(c.key), err, c.from, from, c.to, to)
 		}
@@ -216,6 +219,101 @@ func TestSearchInSparseIndex(t *testing.T) {
 	}
 }
 
+func TestSearchInMissingDiskTable(t *testing.T) {
+	dbDir, close, err := prepareDiskTable(prepareMemTable(), 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	_, _, err = searchInDiskTable(dbDir, 1, []byte("b"), bytes.Compare, nil, 0, noopLogger{})
+	if !errors.Is(err, ErrDiskTableMissing) {
+		t.Fatalf("expected %v, but got %v", ErrDiskTableMissing, err)
+	}
+}
+
+func TestDiskTableBoundsPruning(t *testing.T) {
+	dbDir, close, err := prepareDiskTable(prepareMemTable(), 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	min, max, ok, err := readDiskTableBounds(dbDir, "0-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || string(min) != "b" || string(max) != "h" {
+		t.Fatalf("expected the bounds [b, h], got [%s, %s], ok = %v", min, max, ok)
+	}
+
+	// removing the sparse index proves that the searches outside of
+	// the bounds never open it
+	if err := os.Remove(path.Join(dbDir, "0-"+diskTableSparseIndexFileName)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "z"} {
+		value, ok, err := searchInDiskTable(dbDir, 0, []byte(key), bytes.Compare, nil, 0, noopLogger{})
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %s", key, err)
+		}
+		if ok || value != nil {
+			t.Fatalf("the key %s must not be found", key)
+		}
+	}
+
+	// the keys within the bounds still reach the sparse index
+	_, _, err = searchInDiskTable(dbDir, 0, []byte("c"), bytes.Compare, nil, 0, noopLogger{})
+	if !errors.Is(err, ErrDiskTableMissing) {
+		t.Fatalf("expected %v, but got %v", ErrDiskTableMissing, err)
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	dbDir, close, err := prepareDiskTable(prepareMemTable(), 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err := os.Remove(path.Join(dbDir, "0-index.db")); err != nil {
+		t.Fatalf("failed to remove index file: %s", err)
+	}
+	if err := os.Remove(path.Join(dbDir, "0-sparse.db")); err != nil {
+		t.Fatalf("failed to remove sparse index file: %s", err)
+	}
+
+	if err := RebuildIndex(dbDir, 0, 3); err != nil {
+		t.Fatalf("failed to rebuild index: %s", err)
+	}
+
+	cases := []struct {
+		key   []byte
+		value []byte
+		ok    bool
+	}{
+		{[]byte("a"), nil, false},
+		{[]byte("b"), []byte("vb"), true},
+		{[]byte("f"), []byte("vf"), true},
+		{[]byte("h"), []byte("vh"), true},
+		{[]byte("k"), nil, false},
+	}
+
+	for _, c := range cases {
+		value, ok, err := searchInDiskTable(dbDir, 0, c.key, bytes.Compare, nil, 0, noopLogger{})
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %s", string(c.key), err)
+		}
+		if !((c.value == nil && value == nil) || (bytes.Equal(c.value, value))) {
+			t.Fatalf("values do not match for %s: %s != %s", string(c.key), string(c.value), string(value))
+		}
+		if c.ok != ok {
+			t.Fatalf("ok does not match for %s: %v != %v", string(c.key), c.ok, ok)
+		}
+	}
+}
+
 func TestDataFileIterator(t *testing.T) {
 	dbDir, close, err := prepareDiskTable(prepareMemTable(), 0, 3)
 	if err != nil {
@@ -253,13 +351,193 @@ func TestDataFileIterator(t *testing.T) {
 	}
 }
 
+func TestDataFileIteratorWithOffset(t *testing.T) {
+	dbDir, close, err := prepareDiskTable(prepareMemTable(), 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	it, err := newDataFileIterator(path.Join(dbDir, "0-data.db"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	actual := make([]int, 0)
+	for it.hasNext() {
+		_, _, offset, err := it.nextWithOffset()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		actual = append(actual, offset)
+	}
+
+	expected := []int{0, 19, 38, 57, 76, 95, 114}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("%v != %v", expected, actual)
+	}
+}
+
+func TestBlockAlignedDiskTable(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	const align = 64
+
+	memTable := prepareMemTable1()
+	memTable.delete([]byte("d"))
+	if _, err := createDiskTable(memTable, dbDir, 0, 2, 0, true, align); err != nil {
+		t.Fatal(err)
+	}
+
+	// the records are padded to the alignment, so the offsets stored
+	// in the index must be multiples of the block size
+	indexPath := path.Join(dbDir, "0-"+diskTableIndexFileName)
+	indexFile, err := os.Open(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexFile.Close()
+
+	var prevKey []byte
+	for {
+		suffix, value, err := decode(indexFile)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		key, offset := decodeKeyOffset(prevKey, suffix, value)
+		if offset%align != 0 {
+			t.Fatalf("the offset of %s is not aligned: %d", key, offset)
+		}
+		prevKey = key
+	}
+
+	// the aligned table must read back correctly through the search
+	// path, including the tombstone
+	cases := []struct {
+		key   []byte
+		value []byte
+	}{
+		{[]byte("b"), []byte("vb1")},
+		{[]byte("c"), []byte("vc")},
+		{[]byte("d"), nil},
+		{[]byte("h"), []byte("vh")},
+	}
+
+	for _, c := range cases {
+		value, exists, err := searchInDiskTables(dbDir, 0, c.key, bytes.Compare, nil, 0, nil, CorruptTableFail, noopLogger{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !exists {
+			t.Fatalf("key %s is not found", c.key)
+		}
+		if !bytes.Equal(c.value, value) {
+			t.Fatalf("values do not match for %s: %s != %s", c.key, c.value, value)
+		}
+	}
+}
+
+func TestSearchAcrossMixedSparseKeyDistances(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	// the sparse index is self-describing per file, so the disk
+	// tables written with different distances must read correctly
+	// side by side
+	if _, err := createDiskTable(prepareMemTable1(), dbDir, 0, 2, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createDiskTable(prepareMemTable2(), dbDir, 1, 8, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		key   []byte
+		value []byte
+	}{
+		{[]byte("b"), []byte("vb2")},
+		{[]byte("c"), []byte("vc")},
+		{[]byte("f"), []byte("vf2")},
+		{[]byte("h"), []byte("vh")},
+	}
+
+	assert := func() {
+		for _, c := range cases {
+			value, exists, err := searchInDiskTables(dbDir, 1, c.key, bytes.Compare, nil, 0, nil, CorruptTableFail, noopLogger{})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !exists {
+				t.Fatalf("key %s is not found", c.key)
+			}
+			if !bytes.Equal(c.value, value) {
+				t.Fatalf("values do not match for %s: %s != %s", c.key, c.value, value)
+			}
+		}
+	}
+	assert()
+
+	// the merged table is written with the current distance
+	// and must still read correctly
+	if _, err := mergeDiskTables(dbDir, 0, 1, 4); err != nil {
+		t.Fatal(err)
+	}
+	assert()
+
+	// with distance 4 and 7 merged keys, the sparse index holds
+	// the keys number 0 and 4
+	sparseIndexPath := path.Join(dbDir, "1-"+diskTableSparseIndexFileName)
+	sparseIndexFile, err := os.Open(sparseIndexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sparseIndexFile.Close()
+
+	sparseKeys := 0
+	for {
+		_, _, err := decode(sparseIndexFile)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		sparseKeys++
+	}
+
+	if sparseKeys != 2 {
+		t.Fatalf("expected 2 sparse index keys, got %d", sparseKeys)
+	}
+}
+
 func prepareDiskTable(memTable *memTable, index, sparseKeyDistance int) (string, func(), error) {
 	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
 	if err != nil {
 		return "", nil, err
 	}
 
-	err = createDiskTable(memTable, dbDir, index, sparseKeyDistance)
+	_, err = createDiskTable(memTable, dbDir, index, sparseKeyDistance, 0, false, 0)
 	if err != nil {
 		return "", nil, err
 	}
@@ -284,3 +562,397 @@ func prepareMemTable() *memTable {
 
 	return memTable
 }
+
+func TestSparseSampling(t *testing.T) {
+	// writes ten keys with the given sampling bounds and returns the
+	// number of emitted sparse samples
+	sparseSamples := func(everyNKeys, everyMBytes int) int {
+		dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := os.RemoveAll(dbDir); err != nil {
+				panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+			}
+		}()
+
+		w, err := newDiskTableWriter(dbDir, "0-", everyNKeys, everyMBytes, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("key-%02d", i))
+			if err := w.write(key, []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.sync(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the sampled table must stay searchable
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("key-%02d", i))
+			if _, ok, err := searchInDiskTable(dbDir, 0, key, bytes.Compare, nil, 0, noopLogger{}); err != nil || !ok {
+				t.Fatalf("key %s is not found: %v, %v", key, ok, err)
+			}
+		}
+
+		it, err := newDataFileIterator(path.Join(dbDir, "0-sparse.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.close()
+
+		samples := 0
+		for it.hasNext() {
+			if _, _, err := it.next(); err != nil {
+				t.Fatal(err)
+			}
+			samples++
+		}
+
+		return samples
+	}
+
+	// only the count triggers: the keys 0, 4 and 8 are sampled
+	if samples := sparseSamples(4, 0); samples != 3 {
+		t.Fatalf("expected 3 samples for the count trigger, but got %d", samples)
+	}
+
+	// only the byte bound triggers: every key is sampled
+	if samples := sparseSamples(1000, 1); samples != 10 {
+		t.Fatalf("expected 10 samples for the byte trigger, but got %d", samples)
+	}
+
+	// combined: the byte bound comes first and samples every key
+	if samples := sparseSamples(4, 1); samples != 10 {
+		t.Fatalf("expected 10 samples for the combined sampling, but got %d", samples)
+	}
+
+	// combined: the count comes first and samples every other key
+	if samples := sparseSamples(2, 1<<20); samples != 5 {
+		t.Fatalf("expected 5 samples for the combined sampling, but got %d", samples)
+	}
+}
+
+func TestSearchWithReverseComparator(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	reverse := func(a, b []byte) int {
+		return -bytes.Compare(a, b)
+	}
+
+	// a disk table written in the reverse byte order of the keys
+	w, err := newDiskTableWriter(dbDir, "0-", 2, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"e", "d", "c", "b", "a"} {
+		if err := w.write([]byte(key), []byte("v"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"e", "d", "c", "b", "a"} {
+		value, ok, err := searchInDiskTable(dbDir, 0, []byte(key), reverse, nil, 0, noopLogger{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !ok || !bytes.Equal(value, []byte("v"+key)) {
+			t.Fatalf("expected %s for key %s, got %s", "v"+key, key, value)
+		}
+	}
+
+	if _, ok, err := searchInDiskTable(dbDir, 0, []byte("x"), reverse, nil, 0, noopLogger{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if ok {
+		t.Fatalf("the key x must not be found")
+	}
+}
+
+func TestSearchInBufferedDataFile(t *testing.T) {
+	dbDir, close, err := prepareDiskTable(prepareMemTable(), 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	// the buffered search must return exactly what the plain one does
+	cases := []struct {
+		key   []byte
+		value []byte
+		ok    bool
+	}{
+		{[]byte("a"), nil, false},
+		{[]byte("b"), []byte("vb"), true},
+		{[]byte("f"), []byte("vf"), true},
+		{[]byte("k"), nil, false},
+	}
+
+	for _, c := range cases {
+		value, ok, err := searchInDiskTable(dbDir, 0, c.key, bytes.Compare, nil, 4096, noopLogger{})
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %s", c.key, err)
+		}
+		if c.ok != ok || !((c.value == nil && value == nil) || bytes.Equal(c.value, value)) {
+			t.Fatalf("values do not match for %s: %s != %s", c.key, c.value, value)
+		}
+	}
+}
+
+func TestCreatePartitionedDiskTables(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	const keys = 10
+	memTable := newMemTable()
+	for i := 0; i < keys; i++ {
+		memTable.put([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%02d", i)))
+	}
+
+	_, tables, err := createPartitionedDiskTables(memTable, dbDir, 0, 3, 2, 0, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tables != 3 {
+		t.Fatalf("expected 3 partitioned disk tables, but got %d", tables)
+	}
+
+	// the partitions must cover disjoint ascending key ranges
+	var prevMax []byte
+	for index := 0; index < tables; index++ {
+		min, max, ok, err := readDiskTableBounds(dbDir, fmt.Sprintf("%d-", index))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("the partitioned disk table %d must carry bounds", index)
+		}
+		if prevMax != nil && bytes.Compare(min, prevMax) <= 0 {
+			t.Fatalf("the partitions must not overlap: %s <= %s", min, prevMax)
+		}
+
+		prevMax = max
+	}
+
+	// every key must read back through the regular search path
+	for i := 0; i < keys; i++ {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		value, ok, err := searchInDiskTables(dbDir, tables-1, key, bytes.Compare, nil, 0, nil, CorruptTableFail, noopLogger{})
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %s", key, err)
+		}
+		if !ok || !bytes.Equal(value, []byte(fmt.Sprintf("value-%02d", i))) {
+			t.Fatalf("values do not match for %s: %s", key, value)
+		}
+	}
+
+	// fewer keys than partitions produce one table per key, not
+	// empty tables
+	small := newMemTable()
+	small.put([]byte("a"), []byte("va"))
+	if _, tables, err := createPartitionedDiskTables(small, dbDir, 10, 3, 2, 0, false, 0); err != nil || tables != 1 {
+		t.Fatalf("expected a single disk table for a single key, got %d, err = %v", tables, err)
+	}
+}
+
+func benchmarkSearchInDataFile(b *testing.B, readBufferSize int, files *fileCache) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	// a large sparse distance forces a long bounded scan per search
+	const keys = 10000
+	memTable := newMemTable()
+	for i := 0; i < keys; i++ {
+		memTable.put([]byte(fmt.Sprintf("key-%09d", i)), []byte(fmt.Sprintf("value-%09d", i)))
+	}
+	if _, err := createDiskTable(memTable, dbDir, 0, keys, 0, false, 0); err != nil {
+		b.Fatal(err)
+	}
+
+	key := []byte(fmt.Sprintf("key-%09d", keys-1))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, ok, err := searchInDiskTable(dbDir, 0, key, bytes.Compare, files, readBufferSize, noopLogger{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if !ok {
+			b.Fatalf("key %s is not found", key)
+		}
+	}
+	b.StopTimer()
+
+	if err := files.clear(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkSearchInDataFile(b *testing.B) {
+	benchmarkSearchInDataFile(b, 0, nil)
+}
+
+func BenchmarkSearchInBufferedDataFile(b *testing.B) {
+	benchmarkSearchInDataFile(b, 4096, nil)
+}
+
+func BenchmarkSearchInMmapDataFile(b *testing.B) {
+	files := newFileCache(3)
+	files.mmap = true
+
+	benchmarkSearchInDataFile(b, 0, files)
+}
+
+func TestPrefixCompressedIndex(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	const keys = 500
+	memTable := newMemTable()
+	for i := 0; i < keys; i++ {
+		memTable.put([]byte(fmt.Sprintf("tenant:0001:user:%06d", i)), []byte("v"))
+	}
+	if _, err := createDiskTable(memTable, dbDir, 0, defaultSparseKeyDistance, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// every key must survive the compression and reconstruction
+	for i := 0; i < keys; i++ {
+		key := []byte(fmt.Sprintf("tenant:0001:user:%06d", i))
+		value, ok, err := searchInDiskTable(dbDir, 0, key, bytes.Compare, nil, 0, noopLogger{})
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %s", key, err)
+		}
+		if !ok || !bytes.Equal(value, []byte("v")) {
+			t.Fatalf("key %s is lost by the index compression", key)
+		}
+	}
+
+	// the keys share a long prefix, so the index must be much
+	// smaller than with the full keys stored per entry
+	stat, err := os.Stat(path.Join(dbDir, "0-"+diskTableIndexFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fullSize := 0
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("tenant:0001:user:%06d", i)
+		fullSize += encodedLen([]byte(key), encodeIntPair(0, 0))
+	}
+	if stat.Size() >= int64(fullSize)*2/3 {
+		t.Fatalf("the index must shrink with the common prefixes: %d >= %d", stat.Size(), fullSize*2/3)
+	}
+}
+
+func BenchmarkCreateDiskTable100k(b *testing.B) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	memTable := newMemTable()
+	for i := 0; i < 100000; i++ {
+		memTable.put([]byte(fmt.Sprintf("key-%09d", i)), []byte(fmt.Sprintf("value-%09d", i)))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := createDiskTable(memTable, dbDir, i, defaultSparseKeyDistance, 0, true, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSearchInTruncatedDataFile(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	memTable := newMemTable()
+	memTable.put([]byte("a"), []byte("va"))
+	memTable.put([]byte("b"), []byte("vb"))
+	memTable.put([]byte("c"), []byte("vc"))
+	if _, err := createDiskTable(memTable, dbDir, 0, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// cut the last record short, as a crash in the middle of
+	// a write would
+	dataPath := path.Join(dbDir, "0-data.db")
+	stat, err := os.Stat(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(dataPath, stat.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	// the keys before the truncation point must stay readable
+	for _, key := range []string{"a", "b"} {
+		value, ok, err := searchInDiskTable(dbDir, 0, []byte(key), bytes.Compare, nil, 0, noopLogger{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !ok || !bytes.Equal(value, []byte("v"+key)) {
+			t.Fatalf("the key %s before the truncation point must be found", key)
+		}
+	}
+
+	// the truncated record is treated as the end of data
+	if _, ok, err := searchInDiskTable(dbDir, 0, []byte("c"), bytes.Compare, nil, 0, noopLogger{}); err != nil || ok {
+		t.Fatalf("the truncated key c must not be found and must not fail the search: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package lsmtree
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Dump writes a human-readable listing of the MemTable and every disk
+// table to the given writer for debugging. The MemTable comes first and
+// the disk tables follow from the newest to the oldest. Every record
+// takes one line with the source, the record type, the key in hex and
+// the value length, so the output is easy to grep. The records are
+// listed as stored, so the idle entries and the chunk records keep
+// their internal encoding. Dump does not modify the state of the tree.
+func (t *LSMTree) Dump(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "memtable bytes=%d\n", t.memTable.bytes()); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+
+	for it := t.memTable.iterator(); it.hasNext(); {
+		key, value := it.next()
+		if err := dumpRecord(w, "memtable", key, value); err != nil {
+			return err
+		}
+	}
+
+	indexes, err := listDiskTables(t.dbDir, t.maxDiskTableIndex)
+	if err != nil {
+		return fmt.Errorf("failed to list disk tables: %w", err)
+	}
+
+	for i := len(indexes) - 1; i >= 0; i-- {
+		index := indexes[i]
+
+		if _, err := fmt.Fprintf(w, "disktable %d\n", index); err != nil {
+			return fmt.Errorf("failed to write: %w", err)
+		}
+
+		dataPath := diskTableFilePath(t.dbDir, strconv.Itoa(index)+"-", diskTableDataFileName)
+		it, err := newDataFileIterator(dataPath)
+		if err != nil {
+			return fmt.Errorf("failed to instantiate iterator for %s: %w", dataPath, err)
+		}
+
+		source := "disktable " + strconv.Itoa(index)
+		for it.hasNext() {
+			key, value, err := it.next()
+			if err != nil {
+				it.close()
+				return fmt.Errorf("failed to read from %s: %w", dataPath, err)
+			}
+
+			if err := dumpRecord(w, source, key, value); err != nil {
+				it.close()
+				return err
+			}
+		}
+
+		if err := it.close(); err != nil {
+			return fmt.Errorf("failed to close iterator for %s: %w", dataPath, err)
+		}
+	}
+
+	return nil
+}
+
+// dumpRecord writes one line for the record: the source, the record
+// type, the key in hex and the value length. Tombstones are marked
+// with "tombstone" instead of "put".
+func dumpRecord(w io.Writer, source string, key, value []byte) error {
+	marker := "put"
+	if value == nil {
+		marker = "tombstone"
+	}
+
+	if _, err := fmt.Fprintf(w, "%s %s key=%x value-len=%d\n", source, marker, key, len(value)); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+
+	return nil
+}
@@ -2,10 +2,55 @@ package lsmtree
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 )
 
+// errTruncatedRecord is returned when a record claims more bytes than
+// the file holds, which happens when the last write was cut short by
+// a crash. The records before the truncated one are intact.
+var errTruncatedRecord = errors.New("the file is corrupted, the last record is truncated")
+
+const (
+	// recordPut marks a record that stores a key and a value.
+	recordPut byte = 0
+	// recordDelete marks a record that is a tombstone for the key.
+	recordDelete byte = 1
+	// recordMerge marks a record that stores a merge operand for the key.
+	recordMerge byte = 2
+	// recordExpire marks a record that stores a value with an expiration.
+	recordExpire byte = 3
+)
+
+// recordFlagsBit is set in the encoded total length of the records
+// that carry the flags byte. The records written by the older versions
+// never have the bit set, so the old files still load.
+const recordFlagsBit = uint64(1) << 63
+
+// recordChecksumBit is set in the encoded total length of the records
+// that carry the CRC-32 checksum of their payload. The records written
+// by the older versions never have the bit set, so the old files
+// still load.
+const recordChecksumBit = uint64(1) << 62
+
+// recordTimestampBit is set in the encoded total length of the records
+// that carry the timestamp of the write. The records written by the
+// older versions never have the bit set, so the old files still load.
+const recordTimestampBit = uint64(1) << 61
+
+// recordPaddingBit is set in the encoded total length of the records
+// that are padded to a block boundary. The pad length byte follows the
+// total length and the padding bytes trail the record. The records
+// written by the older versions never have the bit set, so the old
+// files still load.
+const recordPaddingBit = uint64(1) << 60
+
+// maxBlockAlign is the largest supported block alignment: the pad
+// length must fit a single byte.
+const maxBlockAlign = 256
+
 // encode encodes key and value and writes it to the specified writer.
 // Returns the number of bytes written and error if occurred.
 // The function must be compatible with decode: encode(decode(v)) == v.
@@ -47,46 +92,548 @@ func encode(key []byte, value []byte, w io.Writer) (int, error) {
 	return bytes, nil
 }
 
+// encodeFrom encodes the key and the value streamed from the reader
+// and writes them to the specified writer. Exactly size bytes are read
+// from the reader. The output is identical to encode for the same key
+// and value, so decode reads it back.
+// Returns the number of bytes written and error if occurred.
+func encodeFrom(key []byte, value io.Reader, size int, w io.Writer) (int, error) {
+	// encoding format:
+	// [encoded total length in bytes][encoded key length in bytes][key][value]
+
+	// number of bytes written
+	bytes := 0
+
+	keyLen := encodeInt(len(key))
+	len := len(keyLen) + len(key) + size
+	encodedLen := encodeInt(len)
+
+	if n, err := w.Write(encodedLen); err != nil {
+		return n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write(keyLen); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write(key); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := io.CopyN(w, value, int64(size)); err != nil {
+		return bytes + int(n), err
+	} else {
+		bytes += int(n)
+	}
+
+	return bytes, nil
+}
+
+// encodeChecksummed encodes key and value together with the CRC-32
+// checksum of the payload and writes them to the specified writer.
+// Returns the number of bytes written and error if occurred.
+// The function must be compatible with decodeRecord, which verifies
+// the checksum.
+func encodeChecksummed(key []byte, value []byte, w io.Writer) (int, error) {
+	// encoding format:
+	// [encoded total length in bytes with the checksum bit set]
+	// [checksum][encoded key length in bytes][key][value]
+
+	payload := make([]byte, 0, 8+len(key)+len(value))
+	payload = append(payload, encodeInt(len(key))...)
+	payload = append(payload, key...)
+	payload = append(payload, value...)
+
+	var encodedLen [8]byte
+	binary.BigEndian.PutUint64(encodedLen[:], uint64(4+len(payload))|recordChecksumBit)
+
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(payload))
+
+	// number of bytes written
+	bytes := 0
+
+	if n, err := w.Write(encodedLen[:]); err != nil {
+		return n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write(checksum[:]); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write(payload); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	return bytes, nil
+}
+
+// encodeTimestamped encodes key and value together with the timestamp
+// of the write in nanoseconds and writes them to the specified writer.
+// Returns the number of bytes written and error if occurred.
+// The function must be compatible with decodeRecord, which skips
+// the timestamp.
+func encodeTimestamped(key []byte, value []byte, nanos int64, w io.Writer) (int, error) {
+	// encoding format:
+	// [encoded total length in bytes with the timestamp bit set]
+	// [timestamp][encoded key length in bytes][key][value]
+
+	// number of bytes written
+	bytes := 0
+
+	keyLen := encodeInt(len(key))
+	len := 8 + len(keyLen) + len(key) + len(value)
+
+	var encodedLen [8]byte
+	binary.BigEndian.PutUint64(encodedLen[:], uint64(len)|recordTimestampBit)
+
+	if n, err := w.Write(encodedLen[:]); err != nil {
+		return n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write(encodeInt(int(nanos))); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write(keyLen); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write(key); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write(value); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	return bytes, nil
+}
+
+// encodeTimestampedFrom encodes the key, the timestamp of the write in
+// nanoseconds and the value streamed from the reader and writes them to
+// the specified writer. Exactly size bytes are read from the reader.
+// The output is identical to encodeTimestamped for the same key and value.
+// Returns the number of bytes written and error if occurred.
+func encodeTimestampedFrom(key []byte, nanos int64, value io.Reader, size int, w io.Writer) (int, error) {
+	// encoding format:
+	// [encoded total length in bytes with the timestamp bit set]
+	// [timestamp][encoded key length in bytes][key][value]
+
+	// number of bytes written
+	bytes := 0
+
+	keyLen := encodeInt(len(key))
+	len := 8 + len(keyLen) + len(key) + size
+
+	var encodedLen [8]byte
+	binary.BigEndian.PutUint64(encodedLen[:], uint64(len)|recordTimestampBit)
+
+	if n, err := w.Write(encodedLen[:]); err != nil {
+		return n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write(encodeInt(int(nanos))); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write(keyLen); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write(key); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := io.CopyN(w, value, int64(size)); err != nil {
+		return bytes + int(n), err
+	} else {
+		bytes += int(n)
+	}
+
+	return bytes, nil
+}
+
+// encodeChecksummedTimestamped encodes key and value together with the
+// timestamp of the write in nanoseconds and the CRC-32 checksum of the
+// payload, which covers the timestamp as well. It is used for the WAL
+// records when the WAL checksums are enabled.
+// The function must be compatible with decodeRecord.
+func encodeChecksummedTimestamped(key []byte, value []byte, nanos int64, w io.Writer) (int, error) {
+	// encoding format:
+	// [encoded total length in bytes with the checksum and timestamp bits set]
+	// [checksum][timestamp][encoded key length in bytes][key][value]
+
+	payload := make([]byte, 0, 16+len(key)+len(value))
+	payload = append(payload, encodeInt(int(nanos))...)
+	payload = append(payload, encodeInt(len(key))...)
+	payload = append(payload, key...)
+	payload = append(payload, value...)
+
+	var encodedLen [8]byte
+	binary.BigEndian.PutUint64(encodedLen[:], uint64(4+len(payload))|recordChecksumBit|recordTimestampBit)
+
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(payload))
+
+	// number of bytes written
+	bytes := 0
+
+	if n, err := w.Write(encodedLen[:]); err != nil {
+		return n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write(checksum[:]); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write(payload); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	return bytes, nil
+}
+
+// encodePadded encodes key and value like encode or encodeChecksummed
+// and pads the record with zero bytes, so its total size on disk is a
+// multiple of align and the records of an aligned file start at the
+// block boundaries. The pad length is recorded right after the total
+// length, so decodeRecord skips the padding. The align must not exceed
+// maxBlockAlign, so the pad length fits a single byte.
+// The function must be compatible with decodeRecord.
+func encodePadded(key []byte, value []byte, checksummed bool, align int, w io.Writer) (int, error) {
+	// encoding format:
+	// [encoded total length in bytes with the padding bit set]
+	// [pad length][checksum][encoded key length in bytes][key][value][padding]
+
+	payload := make([]byte, 0, 8+len(key)+len(value))
+	payload = append(payload, encodeInt(len(key))...)
+	payload = append(payload, key...)
+	payload = append(payload, value...)
+
+	// the record occupies the length word, the pad length byte, the
+	// optional checksum, the payload and the padding
+	base := 8 + 1 + len(payload)
+	if checksummed {
+		base += 4
+	}
+	padLen := (align - base%align) % align
+
+	rawLen := uint64(base - 8 + padLen) | recordPaddingBit
+	if checksummed {
+		rawLen |= recordChecksumBit
+	}
+
+	var encodedLen [8]byte
+	binary.BigEndian.PutUint64(encodedLen[:], rawLen)
+
+	// number of bytes written
+	bytes := 0
+
+	if n, err := w.Write(encodedLen[:]); err != nil {
+		return n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write([]byte{byte(padLen)}); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	if checksummed {
+		var checksum [4]byte
+		binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(payload))
+
+		if n, err := w.Write(checksum[:]); err != nil {
+			return bytes + n, err
+		} else {
+			bytes += n
+		}
+	}
+
+	if n, err := w.Write(payload); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write(make([]byte, padLen)); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	return bytes, nil
+}
+
+// encodeRecord encodes key, value and the record flags and writes them
+// to the specified writer. Returns the number of bytes written and error
+// if occurred. The function must be compatible with decodeRecord.
+func encodeRecord(key []byte, value []byte, flags byte, w io.Writer) (int, error) {
+	// encoding format:
+	// [encoded total length in bytes with the flags bit set]
+	// [encoded key length in bytes][flags][key][value]
+
+	// number of bytes written
+	bytes := 0
+
+	keyLen := encodeInt(len(key))
+	len := len(keyLen) + 1 + len(key) + len(value)
+
+	var encodedLen [8]byte
+	binary.BigEndian.PutUint64(encodedLen[:], uint64(len)|recordFlagsBit)
+
+	if n, err := w.Write(encodedLen[:]); err != nil {
+		return n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write(keyLen); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write([]byte{flags}); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write(key); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	if n, err := w.Write(value); err != nil {
+		return bytes + n, err
+	} else {
+		bytes += n
+	}
+
+	return bytes, nil
+}
+
 // decode decodes key and value by reading from the specified reader.
 // Returns the number of bytes read and error if occurred.
 // The function must be compatible with encode: encode(decode(v)) == v.
+// The records that carry the flags byte are decoded as well: the value
+// is nil for the delete records.
 func decode(r io.Reader) ([]byte, []byte, error) {
+	key, value, flags, err := decodeRecord(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if flags == recordDelete {
+		return key, nil, nil
+	}
+
+	return key, value, nil
+}
+
+// decodeRecord decodes key, value and the record flags by reading from
+// the specified reader. The records written without the flags byte are
+// decoded as recordPut, or recordDelete if they store no value.
+// The function must be compatible with encode and encodeRecord.
+func decodeRecord(r io.Reader) ([]byte, []byte, byte, error) {
+	key, value, flags, _, err := decodeRecordTimestamp(r)
+
+	return key, value, flags, err
+}
+
+// decodeRecordTimestamp decodes a record like decodeRecord and also
+// returns the timestamp of the write in nanoseconds for the records
+// that carry one, or zero for the records written without it.
+func decodeRecordTimestamp(r io.Reader) ([]byte, []byte, byte, int64, error) {
 	// encoding format:
 	// [encoded total length in bytes][encoded key length in bytes][key][value]
+	// or, if the flags bit is set in the total length:
+	// [encoded total length in bytes][encoded key length in bytes][flags][key][value]
+	// the records with the checksum bit set carry the checksum of the
+	// payload right after the total length, the records with the
+	// timestamp bit set carry the timestamp of the write after it;
+	// the records with the padding bit set store the pad length first
+	// and carry that many zero bytes at the end
 
 	var encodedEntryLen [8]byte
-	if _, err := r.Read(encodedEntryLen[:]); err != nil {
-		return nil, nil, err
+	if _, err := io.ReadFull(r, encodedEntryLen[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, nil, recordPut, 0, errTruncatedRecord
+		}
+
+		return nil, nil, recordPut, 0, err
 	}
 
-	entryLen := decodeInt(encodedEntryLen[:])
+	rawEntryLen := binary.BigEndian.Uint64(encodedEntryLen[:])
+	flagged := rawEntryLen&recordFlagsBit != 0
+	checksummed := rawEntryLen&recordChecksumBit != 0
+	timestamped := rawEntryLen&recordTimestampBit != 0
+	padded := rawEntryLen&recordPaddingBit != 0
+
+	entryLen := int(rawEntryLen &^ (recordFlagsBit | recordChecksumBit | recordTimestampBit | recordPaddingBit))
 	encodedEntry := make([]byte, entryLen)
-	n, err := r.Read(encodedEntry)
-	if err != nil {
-		return nil, nil, err
+	if _, err := io.ReadFull(r, encodedEntry); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, recordPut, 0, errTruncatedRecord
+		}
+
+		return nil, nil, recordPut, 0, err
+	}
+
+	if padded {
+		if entryLen < 1 || len(encodedEntry) < 1+int(encodedEntry[0]) {
+			return nil, nil, recordPut, 0, fmt.Errorf("the file is corrupted, failed to read padding")
+		}
+
+		padLen := int(encodedEntry[0])
+		encodedEntry = encodedEntry[1 : len(encodedEntry)-padLen]
+	}
+
+	if checksummed {
+		if entryLen < 4 {
+			return nil, nil, recordPut, 0, fmt.Errorf("the file is corrupted, failed to read checksum")
+		}
+
+		checksum := binary.BigEndian.Uint32(encodedEntry[0:4])
+		encodedEntry = encodedEntry[4:]
+
+		if crc32.ChecksumIEEE(encodedEntry) != checksum {
+			return nil, nil, recordPut, 0, wrapError(ErrChecksumMismatch, fmt.Errorf("the file is corrupted, the record checksum does not match"))
+		}
 	}
 
-	if n < entryLen {
-		return nil, nil, fmt.Errorf("the file is corrupted, failed to read entry")
+	var nanos int64
+	if timestamped {
+		if len(encodedEntry) < 8 {
+			return nil, nil, recordPut, 0, fmt.Errorf("the file is corrupted, failed to read timestamp")
+		}
+
+		nanos = int64(binary.BigEndian.Uint64(encodedEntry[0:8]))
+		encodedEntry = encodedEntry[8:]
 	}
 
 	keyLen := decodeInt(encodedEntry[0:8])
-	key := encodedEntry[8 : 8+keyLen]
-	keyPartLen := 8 + keyLen
+
+	flags := recordPut
+	keyStart := 8
+	if flagged {
+		flags = encodedEntry[8]
+		keyStart = 9
+	}
+
+	key := encodedEntry[keyStart : keyStart+keyLen]
+	keyPartLen := keyStart + keyLen
 
 	if keyPartLen == len(encodedEntry) {
-		return key, nil, err
+		if !flagged {
+			return key, nil, recordDelete, nanos, nil
+		}
+
+		return key, nil, flags, nanos, nil
+	}
+
+	value := encodedEntry[keyPartLen:]
+
+	return key, value, flags, nanos, nil
+}
+
+// encodedLen returns the number of bytes that encode writes
+// for the given key and value.
+func encodedLen(key []byte, value []byte) int {
+	// encoding format:
+	// [encoded total length in bytes][encoded key length in bytes][key][value]
+	return 8 + 8 + len(key) + len(value)
+}
+
+// timestampedLen returns the number of bytes that encodeTimestamped
+// writes for the given key and value.
+func timestampedLen(key []byte, value []byte) int {
+	// encoding format:
+	// [encoded total length in bytes][timestamp][encoded key length in bytes][key][value]
+	return 8 + 8 + 8 + len(key) + len(value)
+}
+
+// encodeKeyOffset encodes the key and the offset as an index entry and
+// writes it to the given writer. The key is prefix-compressed against
+// prevKey: only the suffix behind their shared prefix is stored, since
+// the keys are written in sorted order and often share long prefixes.
+// A nil prevKey stores the full key, so the entry is a restart point
+// that decodes without the preceding entries.
+func encodeKeyOffset(key []byte, prevKey []byte, offset int, w io.Writer) (int, error) {
+	shared := sharedPrefixLen(key, prevKey)
+
+	return encode(key[shared:], encodeIntPair(shared, offset), w)
+}
+
+// decodeKeyOffset reconstructs the key and the offset of an index
+// entry from its decoded suffix and value, where prevKey is the
+// reconstructed key of the preceding entry. The entries written by the
+// older versions store the full key and the bare offset, they are told
+// apart by the value length.
+func decodeKeyOffset(prevKey, suffix, value []byte) ([]byte, int) {
+	if len(value) == 8 {
+		return suffix, decodeInt(value)
 	}
 
-	valueStart := keyPartLen
-	value := encodedEntry[valueStart:]
+	shared, offset := decodeIntPair(value)
+
+	key := make([]byte, 0, shared+len(suffix))
+	key = append(key, prevKey[:shared]...)
+	key = append(key, suffix...)
 
-	return key, value, err
+	return key, offset
 }
 
-// encodeKeyOffset encodes key offset and writes it to the given writer.
-func encodeKeyOffset(key []byte, offset int, w io.Writer) (int, error) {
-	return encode(key, encodeInt(offset), w)
+// sharedPrefixLen returns the length of the longest common prefix
+// of a and b.
+func sharedPrefixLen(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+
+	return n
 }
 
 // encodeInt encodes the int as a slice of bytes.
@@ -120,3 +667,30 @@ func decodeIntPair(encoded []byte) (int, int) {
 
 	return x, y
 }
+
+// encodeKeyBounds encodes the smallest and the largest keys of a disk
+// table. Must be compatible with decodeKeyBounds.
+func encodeKeyBounds(min, max []byte) []byte {
+	encoded := make([]byte, 0, 8+len(min)+len(max))
+	encoded = append(encoded, encodeInt(len(min))...)
+	encoded = append(encoded, min...)
+	encoded = append(encoded, max...)
+
+	return encoded
+}
+
+// decodeKeyBounds decodes the smallest and the largest keys of a disk
+// table. ok is false if the encoding is malformed.
+// Must be compatible with encodeKeyBounds.
+func decodeKeyBounds(encoded []byte) (min, max []byte, ok bool) {
+	if len(encoded) < 8 {
+		return nil, nil, false
+	}
+
+	minLen := decodeInt(encoded[:8])
+	if minLen < 0 || 8+minLen > len(encoded) {
+		return nil, nil, false
+	}
+
+	return encoded[8 : 8+minLen], encoded[8+minLen:], true
+}
@@ -72,6 +72,72 @@ func TestDecodeDelete(t *testing.T) {
 	}
 }
 
+func TestEncodeRecordDecodeRecord(t *testing.T) {
+	cases := []struct {
+		flags byte
+		key   []byte
+		value []byte
+	}{
+		{recordPut, []byte{1, 2, 3}, []byte{4, 5, 6}},
+		{recordDelete, []byte{1, 2, 3}, nil},
+		{recordMerge, []byte{1, 2, 3}, []byte{4, 5, 6}},
+		{recordExpire, []byte{1, 2, 3}, []byte{4, 5, 6}},
+	}
+
+	for _, c := range cases {
+		buffer := &bytes.Buffer{}
+		if _, err := encodeRecord(c.key, c.value, c.flags, buffer); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		key, value, flags, err := decodeRecord(buffer)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if flags != c.flags {
+			t.Fatalf("failed to decode flags, expected %v, but received %v", c.flags, flags)
+		}
+
+		if !bytes.Equal(c.key, key) {
+			t.Fatalf("failed to decode key, expected %v, but received %v", c.key, key)
+		}
+
+		if !bytes.Equal(c.value, value) {
+			t.Fatalf("failed to decode value, expected %v, but received %v", c.value, value)
+		}
+	}
+}
+
+func TestDecodeRecordWithoutFlags(t *testing.T) {
+	buffer := &bytes.Buffer{}
+
+	key := []byte{1, 2, 3}
+	value := []byte{4, 5, 6}
+	if _, err := encode(key, value, buffer); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := encode(key, nil, buffer); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, _, flags, err := decodeRecord(buffer)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if flags != recordPut {
+		t.Fatalf("failed to decode flags, expected %v, but received %v", recordPut, flags)
+	}
+
+	_, _, flags, err = decodeRecord(buffer)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if flags != recordDelete {
+		t.Fatalf("failed to decode flags, expected %v, but received %v", recordDelete, flags)
+	}
+}
+
 func TestEncodePutDecode(t *testing.T) {
 	buffer := &bytes.Buffer{}
 
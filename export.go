@@ -0,0 +1,239 @@
+package lsmtree
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// exportBufferSize is the number of records each table reader may
+// buffer ahead of the merge.
+const exportBufferSize = 64
+
+// exportRecord is a single record read by a table reader. A record
+// with a non-nil err reports a read failure and ends the stream of
+// the reader.
+type exportRecord struct {
+	key   []byte
+	value []byte
+	err   error
+}
+
+// exportSource is one entry of the merge heap: the buffered record of
+// a table reader and the channel to refill it from.
+type exportSource struct {
+	ch    <-chan exportRecord
+	key   []byte
+	value []byte
+	// rank orders the sources from the newest to the oldest,
+	// the lowest rank wins on the key collisions.
+	rank int
+}
+
+// exportHeap orders the sources by the buffered key and, for the equal
+// keys, by the rank, so the top of the heap is always the next record
+// of the merged stream.
+type exportHeap []*exportSource
+
+func (h exportHeap) Len() int { return len(h) }
+
+func (h exportHeap) Less(i, j int) bool {
+	cmp := bytes.Compare(h[i].key, h[j].key)
+	if cmp != 0 {
+		return cmp < 0
+	}
+
+	return h[i].rank < h[j].rank
+}
+
+func (h exportHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *exportHeap) Push(x interface{}) { *h = append(*h, x.(*exportSource)) }
+
+func (h *exportHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	source := old[n-1]
+	*h = old[:n-1]
+
+	return source
+}
+
+// ExportParallel writes the full sorted key-value stream of the database
+// to the given writer in the encode format. The MemTable and every disk
+// table are read by their own goroutines into bounded channels, and the
+// merge consumes from all of them maintaining the global sort order via
+// a heap, so the I/O latency of one table does not stall the reads of
+// the others. At most workers table reads run at once; a non-positive
+// workers does not limit them. The newest value wins on the key
+// collisions across the tables and the deleted keys are skipped.
+// The records are exported as stored, so the idle entries keep their
+// expiration metadata and the chunked values stay split into their
+// chunk records.
+func (t *LSMTree) ExportParallel(w io.Writer, workers int) error {
+	indexes, err := listDiskTables(t.dbDir, t.maxDiskTableIndex)
+	if err != nil {
+		return fmt.Errorf("failed to list disk tables: %w", err)
+	}
+
+	// the references defer the deletion of the disk tables by the
+	// merges until the readers are done with them
+	for _, index := range indexes {
+		t.tables.acquire(index)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	var limit chan struct{}
+	if workers > 0 {
+		limit = make(chan struct{}, workers)
+	}
+
+	// the MemTable is the newest source and gets the lowest rank,
+	// the disk tables follow from the newest to the oldest
+	channels := make([]<-chan exportRecord, 0, len(indexes)+1)
+	channels = append(channels, t.exportMemTable(done))
+	for i := len(indexes) - 1; i >= 0; i-- {
+		channels = append(channels, t.exportDiskTable(indexes[i], limit, done))
+	}
+
+	return mergeExported(channels, w)
+}
+
+// exportMemTable reads the MemTable records into a bounded channel.
+func (t *LSMTree) exportMemTable(done <-chan struct{}) <-chan exportRecord {
+	ch := make(chan exportRecord, exportBufferSize)
+
+	go func() {
+		defer close(ch)
+
+		for it := t.memTable.iterator(); it.hasNext(); {
+			key, value := it.next()
+
+			select {
+			case ch <- exportRecord{key: key, value: value}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// exportDiskTable reads the records of the disk table with the given
+// index into a bounded channel. Each read takes a worker slot from
+// limit, if it is not nil. The reference taken on the disk table is
+// released once the reader is done with it.
+func (t *LSMTree) exportDiskTable(index int, limit chan struct{}, done <-chan struct{}) <-chan exportRecord {
+	ch := make(chan exportRecord, exportBufferSize)
+
+	go func() {
+		defer close(ch)
+		defer t.tables.release(index)
+
+		dataPath := diskTableFilePath(t.dbDir, strconv.Itoa(index)+"-", diskTableDataFileName)
+		it, err := newDataFileIterator(dataPath)
+		if err != nil {
+			select {
+			case ch <- exportRecord{err: fmt.Errorf("failed to instantiate iterator for %s: %w", dataPath, err)}:
+			case <-done:
+			}
+			return
+		}
+		defer it.close()
+
+		for it.hasNext() {
+			if limit != nil {
+				limit <- struct{}{}
+			}
+			key, value, err := it.next()
+			if limit != nil {
+				<-limit
+			}
+
+			if err != nil {
+				err = fmt.Errorf("failed to read from %s: %w", dataPath, err)
+			}
+
+			select {
+			case ch <- exportRecord{key: key, value: value, err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// mergeExported merges the sorted record streams of the channels,
+// ordered from the newest to the oldest, and writes the merged stream
+// to the given writer. For the same key the record of the newest
+// channel wins and the tombstones are skipped.
+func mergeExported(channels []<-chan exportRecord, w io.Writer) error {
+	h := make(exportHeap, 0, len(channels))
+	for rank, ch := range channels {
+		source := &exportSource{ch: ch, rank: rank}
+		ok, err := source.refill()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h = append(h, source)
+		}
+	}
+	heap.Init(&h)
+
+	for h.Len() > 0 {
+		key := h[0].key
+
+		// consume the key from every source that buffers it,
+		// the source with the lowest rank is the newest and wins
+		value := h[0].value
+		for h.Len() > 0 && bytes.Equal(h[0].key, key) {
+			source := heap.Pop(&h).(*exportSource)
+
+			ok, err := source.refill()
+			if err != nil {
+				return err
+			}
+			if ok {
+				heap.Push(&h, source)
+			}
+		}
+
+		// a nil value marks a tombstone
+		if value == nil {
+			continue
+		}
+
+		if _, err := encode(key, value, w); err != nil {
+			return fmt.Errorf("failed to write: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// refill buffers the next record of the source. It returns false if
+// the stream of the source has ended.
+func (s *exportSource) refill() (bool, error) {
+	record, ok := <-s.ch
+	if !ok {
+		return false, nil
+	}
+	if record.err != nil {
+		return false, record.err
+	}
+
+	s.key, s.value = record.key, record.value
+
+	return true, nil
+}
@@ -0,0 +1,105 @@
+package lsmtree
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestExportParallel(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := Open(dbDir, MemTableThreshold(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// overlapping updates and deletes spread across several disk
+	// tables, with the newest changes pending in the MemTable
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		if err := tree.Put(key, []byte(fmt.Sprintf("value-%03d", i))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	for i := 0; i < 100; i += 3 {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		if err := tree.Put(key, []byte(fmt.Sprintf("updated-%03d", i))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	for i := 1; i < 100; i += 7 {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		if err := tree.Delete(key); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// the serial path is the reference for the parallel merge
+	expected := make([]Entry, 0, 100)
+	it, err := tree.Range(nil, nil, DefaultRangeOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for it.HasNext() {
+		entry, err := it.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		expected = append(expected, entry)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var exported bytes.Buffer
+	if err := tree.ExportParallel(&exported, 2); err != nil {
+		t.Fatalf("failed to export: %s", err)
+	}
+
+	count := 0
+	var prevKey []byte
+	for {
+		key, value, err := decode(&exported)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if prevKey != nil && bytes.Compare(prevKey, key) >= 0 {
+			t.Fatalf("the exported keys must be strictly increasing, but %s >= %s", prevKey, key)
+		}
+		prevKey = append(prevKey[:0], key...)
+
+		if count >= len(expected) {
+			t.Fatalf("exported more entries than the serial path: %d", count+1)
+		}
+		if !bytes.Equal(key, expected[count].Key) || !bytes.Equal(value, expected[count].Value) {
+			t.Fatalf("entry %d: expected %s=%s, got %s=%s", count, expected[count].Key, expected[count].Value, key, value)
+		}
+
+		count++
+	}
+
+	if count != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), count)
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,171 @@
+package lsmtree
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+)
+
+// fileCache is an LRU cache of the open disk table file handles,
+// bounded by the number of handles it keeps open. It avoids reopening
+// the same files on every read and bounds the number of file
+// descriptors the tree uses, so many disk tables do not run the
+// process into the "too many open files" errors.
+// In the mmap mode the files are memory-mapped instead and the reads
+// are served from the mapped bytes without per-read syscalls.
+// A nil cache opens and closes the files on every use.
+type fileCache struct {
+	maxOpen int
+	// Whether the files are memory-mapped instead of being read
+	// through the handles.
+	mmap bool
+	// The handles ordered from the most to the least recently used.
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// fileCacheEntry is a single cached file handle or mapped region.
+// Exactly one of file and data is set.
+type fileCacheEntry struct {
+	path string
+	file *os.File
+	data []byte
+}
+
+// newFileCache returns a new file handle cache bounded by maxOpen
+// handles. The bound is raised to 3 if it is lower, since a single
+// disk table search holds the sparse index, the index and the data
+// file open at once.
+func newFileCache(maxOpen int) *fileCache {
+	if maxOpen < 3 {
+		maxOpen = 3
+	}
+
+	return &fileCache{
+		maxOpen: maxOpen,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// open returns a reader over the file positioned at its beginning:
+// a cached or newly opened handle, or a reader over the mapped bytes
+// in the mmap mode. The handle stays owned by the cache and must be
+// returned with release instead of being closed. A nil cache simply
+// opens the file.
+func (c *fileCache) open(path string) (io.ReadSeeker, error) {
+	if c == nil {
+		return os.OpenFile(path, os.O_RDONLY, 0600)
+	}
+
+	if element, exists := c.entries[path]; exists {
+		c.order.MoveToFront(element)
+
+		entry := element.Value.(*fileCacheEntry)
+		if entry.file == nil {
+			return bytes.NewReader(entry.data), nil
+		}
+
+		if _, err := entry.file.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to seek in %s: %w", path, err)
+		}
+
+		return entry.file, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.mmap {
+		// the mapping outlives the descriptor, so the handle is closed
+		// right away; the files that cannot be mapped fall back to the
+		// plain handle below
+		if data, err := mmapFile(file); err == nil {
+			if err := file.Close(); err != nil {
+				return nil, fmt.Errorf("failed to close %s: %w", path, err)
+			}
+
+			c.entries[path] = c.order.PushFront(&fileCacheEntry{path: path, data: data})
+			if err := c.evict(); err != nil {
+				return nil, err
+			}
+
+			return bytes.NewReader(data), nil
+		}
+	}
+
+	c.entries[path] = c.order.PushFront(&fileCacheEntry{path: path, file: file})
+	if err := c.evict(); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// evict closes the least recently used handles over the bound.
+func (c *fileCache) evict() error {
+	for c.order.Len() > c.maxOpen {
+		if err := c.remove(c.order.Back()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// release returns the reader to the cache after use. A nil cache
+// closes the underlying handle.
+func (c *fileCache) release(r io.ReadSeeker) error {
+	if c == nil {
+		if closer, ok := r.(io.Closer); ok {
+			return closer.Close()
+		}
+	}
+
+	return nil
+}
+
+// clear closes all cached handles and unmaps the mapped regions. It
+// must be called when the disk tables change on the disk, since the
+// handles and the mappings open before a merge point to the replaced
+// files.
+func (c *fileCache) clear() error {
+	if c == nil {
+		return nil
+	}
+
+	for c.order.Len() > 0 {
+		if err := c.remove(c.order.Back()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remove removes the element from the cache and closes its handle or
+// unmaps its region.
+func (c *fileCache) remove(element *list.Element) error {
+	entry := element.Value.(*fileCacheEntry)
+
+	c.order.Remove(element)
+	delete(c.entries, entry.path)
+
+	if entry.file == nil {
+		if err := munmapFile(entry.data); err != nil {
+			return fmt.Errorf("failed to unmap %s: %w", entry.path, err)
+		}
+
+		return nil
+	}
+
+	if err := entry.file.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", entry.path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package lsmtree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFileCacheBoundsOpenHandles(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dir, err))
+		}
+	}()
+
+	paths := make([]string, 0)
+	for i := 0; i < 10; i++ {
+		filePath := path.Join(dir, fmt.Sprintf("%d.db", i))
+		if err := ioutil.WriteFile(filePath, []byte(fmt.Sprintf("content-%d", i)), 0600); err != nil {
+			t.Fatalf("failed to write %s: %s", filePath, err)
+		}
+
+		paths = append(paths, filePath)
+	}
+
+	cache := newFileCache(3)
+	for _, filePath := range paths {
+		file, err := cache.open(filePath)
+		if err != nil {
+			t.Fatalf("failed to open %s: %s", filePath, err)
+		}
+		if err := cache.release(file); err != nil {
+			t.Fatalf("failed to release %s: %s", filePath, err)
+		}
+
+		if cache.order.Len() > 3 {
+			t.Fatalf("the cache must hold at most 3 handles, but holds %d", cache.order.Len())
+		}
+	}
+
+	// the reopened handles must read from the beginning of the file
+	for i, filePath := range paths {
+		file, err := cache.open(filePath)
+		if err != nil {
+			t.Fatalf("failed to open %s: %s", filePath, err)
+		}
+
+		content, err := ioutil.ReadAll(file)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", filePath, err)
+		}
+		if string(content) != fmt.Sprintf("content-%d", i) {
+			t.Fatalf("unexpected content of %s: %s", filePath, content)
+		}
+
+		if err := cache.release(file); err != nil {
+			t.Fatalf("failed to release %s: %s", filePath, err)
+		}
+	}
+
+	if err := cache.clear(); err != nil {
+		t.Fatalf("failed to clear the cache: %s", err)
+	}
+	if cache.order.Len() != 0 {
+		t.Fatalf("the cleared cache must hold no handles, but holds %d", cache.order.Len())
+	}
+}
+
+func TestFileCacheMmapReads(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dir, err))
+		}
+	}()
+
+	filePath := path.Join(dir, "0.db")
+	if err := ioutil.WriteFile(filePath, []byte("content-0"), 0600); err != nil {
+		t.Fatalf("failed to write %s: %s", filePath, err)
+	}
+
+	cache := newFileCache(3)
+	cache.mmap = true
+
+	// both the first open that maps the file and the cached reopen must
+	// read the full content from the beginning
+	for i := 0; i < 2; i++ {
+		file, err := cache.open(filePath)
+		if err != nil {
+			t.Fatalf("failed to open %s: %s", filePath, err)
+		}
+
+		content, err := ioutil.ReadAll(file)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", filePath, err)
+		}
+		if string(content) != "content-0" {
+			t.Fatalf("unexpected content of %s: %s", filePath, content)
+		}
+
+		if err := cache.release(file); err != nil {
+			t.Fatalf("failed to release %s: %s", filePath, err)
+		}
+	}
+
+	// the content must survive the deletion of the mapped file, since
+	// the merges delete the disk tables before the cache is cleared
+	if err := os.Remove(filePath); err != nil {
+		t.Fatalf("failed to remove %s: %s", filePath, err)
+	}
+	file, err := cache.open(filePath)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", filePath, err)
+	}
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", filePath, err)
+	}
+	if string(content) != "content-0" {
+		t.Fatalf("unexpected content of %s: %s", filePath, content)
+	}
+	if err := cache.release(file); err != nil {
+		t.Fatalf("failed to release %s: %s", filePath, err)
+	}
+
+	if err := cache.clear(); err != nil {
+		t.Fatalf("failed to clear the cache: %s", err)
+	}
+	if cache.order.Len() != 0 {
+		t.Fatalf("the cleared cache must hold no mappings, but holds %d", cache.order.Len())
+	}
+}
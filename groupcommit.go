@@ -0,0 +1,107 @@
+package lsmtree
+
+import (
+	"os"
+	"sync"
+)
+
+// walCommitter shares one WAL fsync among the writers that commit
+// concurrently: every writer appends its record to the WAL first, and
+// the first writer of a batch syncs the file for everyone enqueued by
+// then. The fsync cost is amortized across the batch, so the
+// concurrent writers are not serialized on their own fsyncs.
+type walCommitter struct {
+	mu sync.Mutex
+
+	// Signalled when the committer goes idle, so the WAL rotation can
+	// wait out the in-flight batches.
+	idle *sync.Cond
+
+	// The writers whose records are not yet covered by an fsync.
+	waiters []chan error
+
+	// Whether a batch is being synced at the moment.
+	syncing bool
+
+	// The number of the performed fsyncs.
+	syncs int
+}
+
+// newWALCommitter returns a new idle committer.
+func newWALCommitter() *walCommitter {
+	c := &walCommitter{}
+	c.idle = sync.NewCond(&c.mu)
+
+	return c
+}
+
+// enqueue registers a writer for the next fsync batch of the WAL file
+// and returns the channel its sync result arrives on. The writers that
+// enqueue while a sync is in flight form the next batch. It must be
+// called while still holding the commit mutex of the tree: a drain
+// then never observes the committer idle while a writer that already
+// appended its record still waits for the sync, so the WAL is never
+// rotated or closed under it.
+func (c *walCommitter) enqueue(wal *os.File) <-chan error {
+	done := make(chan error, 1)
+
+	c.mu.Lock()
+	c.waiters = append(c.waiters, done)
+	if !c.syncing {
+		c.syncing = true
+		go c.run(wal)
+	}
+	c.mu.Unlock()
+
+	return done
+}
+
+// run syncs the WAL file batch by batch until no writers are waiting,
+// releasing the writers of each batch once their records are durable.
+func (c *walCommitter) run(wal *os.File) {
+	for {
+		c.mu.Lock()
+		waiters := c.waiters
+		c.waiters = nil
+		if len(waiters) == 0 {
+			c.syncing = false
+			c.idle.Broadcast()
+			c.mu.Unlock()
+
+			return
+		}
+		c.syncs++
+		c.mu.Unlock()
+
+		err := wal.Sync()
+		for _, done := range waiters {
+			done <- err
+		}
+	}
+}
+
+// drain blocks until the in-flight batches are synced and the
+// committer goes idle. It runs before the WAL file is rotated, so no
+// fsync is issued on a closed file. The writers enqueue under the
+// commit mutex and the rotations run under it too, so a writer is
+// either drained or enqueues against the new WAL file. A nil committer
+// needs no draining.
+func (c *walCommitter) drain() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	for c.syncing {
+		c.idle.Wait()
+	}
+	c.mu.Unlock()
+}
+
+// syncCount returns the number of the performed fsyncs.
+func (c *walCommitter) syncCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.syncs
+}
@@ -0,0 +1,220 @@
+package lsmtree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestGroupCommitBatchesSyncs(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	const writers = 20
+	const writesPerWriter = 10
+	writes := writers * writesPerWriter
+
+	// whether the concurrent writers overlap enough to share an fsync
+	// depends on the scheduling, so the batching is asserted over a few
+	// attempts instead of a single racy run
+	batched := false
+	for attempt := 0; attempt < 5 && !batched; attempt++ {
+		tree, err := Open(dbDir, GroupCommit())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, writers)
+		for writer := 0; writer < writers; writer++ {
+			wg.Add(1)
+			go func(writer int) {
+				defer wg.Done()
+
+				for i := 0; i < writesPerWriter; i++ {
+					key := []byte(fmt.Sprintf("key-%02d-%02d", writer, i))
+					if err := tree.Put(key, []byte("v")); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(writer)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		batched = tree.committer.syncCount() < writes
+
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !batched {
+		t.Fatalf("expected fewer syncs than the %d writes on at least one attempt", writes)
+	}
+
+	// all writes are durable: the reopened tree replays them
+	tree, err := Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for writer := 0; writer < writers; writer++ {
+		for i := 0; i < writesPerWriter; i++ {
+			key := []byte(fmt.Sprintf("key-%02d-%02d", writer, i))
+			value, ok, err := tree.Get(key)
+			if err != nil {
+				t.Fatalf("unexpected error for %s: %s", key, err)
+			}
+			if !ok || !bytes.Equal(value, []byte("v")) {
+				t.Fatalf("the key %s is not durable: %v, %s", key, ok, value)
+			}
+		}
+	}
+}
+
+func TestGroupCommitConcurrentWithFlushes(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	// the tiny threshold makes the concurrent writes trigger frequent
+	// flushes, so the WAL keeps being rotated while other writers sit
+	// between their append and their commit wait
+	tree, err := Open(dbDir, GroupCommit(), MemTableThreshold(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 8
+	const writesPerWriter = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for writer := 0; writer < writers; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+
+			for i := 0; i < writesPerWriter; i++ {
+				key := []byte(fmt.Sprintf("key-%02d-%02d", writer, i))
+				if err := tree.Put(key, []byte("v")); err != nil {
+					errs <- fmt.Errorf("failed to put %s: %w", key, err)
+					return
+				}
+			}
+		}(writer)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// all writes are durable across the flushes and the rotations
+	tree, err = Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for writer := 0; writer < writers; writer++ {
+		for i := 0; i < writesPerWriter; i++ {
+			key := []byte(fmt.Sprintf("key-%02d-%02d", writer, i))
+			value, ok, err := tree.Get(key)
+			if err != nil {
+				t.Fatalf("unexpected error for %s: %s", key, err)
+			}
+			if !ok || !bytes.Equal(value, []byte("v")) {
+				t.Fatalf("the key %s is not durable: %v, %s", key, ok, value)
+			}
+		}
+	}
+}
+
+func TestGroupCommitPutAfterClose(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := Open(dbDir, GroupCommit())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Put([]byte("a"), []byte("va")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the grouped writers check the closed flag under the commit
+	// mutex instead of in Put and Delete
+	if err := tree.Put([]byte("b"), []byte("vb")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed from Put, but got: %v", err)
+	}
+	if err := tree.Delete([]byte("a")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed from Delete, but got: %v", err)
+	}
+}
+
+func TestGroupCommitDelete(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := Open(dbDir, GroupCommit())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if err := tree.Put([]byte("a"), []byte("va")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := tree.Get([]byte("a")); err != nil || ok {
+		t.Fatalf("the deleted key must not be found: %v, %v", ok, err)
+	}
+}
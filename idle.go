@@ -0,0 +1,109 @@
+package lsmtree
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// idleValueMagic prefixes the values stored with a sliding expiration
+// by PutWithIdle. The caller must not store values that start with the
+// magic through Put while the idle entries are in use, since Get would
+// mistake them for the idle records.
+var idleValueMagic = []byte("\x00lsm-idle\x00")
+
+// idleValueOverhead is the number of bytes the idle encoding adds to
+// the user value: the magic, the idle duration and the last-access
+// timestamp.
+var idleValueOverhead = len(idleValueMagic) + 16
+
+// LazyIdleBump makes Get bump the last-access timestamp of the idle
+// entries in the MemTable only, so the reads cost no WAL writes. The
+// bumps that have not been flushed yet are lost on a crash, so the
+// entries may expire earlier than their last read suggests.
+func LazyIdleBump() func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.lazyIdleBump = true
+	}
+}
+
+// PutWithIdle puts the key with a sliding expiration: the entry
+// expires once it has not been read for the idle duration, while every
+// Get of it extends its life by bumping the stored last-access
+// timestamp. The bump is a write through the regular Put path, so the
+// reads of the idle entries carry the write amplification of one Put
+// each; LazyIdleBump trades the durability of the bumps for avoiding
+// it. An expired entry is reported as absent by Get; its record stays
+// on the disk until the key is overwritten or deleted. The range scans
+// yield the live idle entries with their user value, without bumping
+// the timestamp, and skip the expired ones.
+func (t *LSMTree) PutWithIdle(key []byte, value []byte, idle time.Duration) error {
+	if t.closed {
+		return ErrClosed
+	}
+
+	if len(key) == 0 {
+		return ErrKeyRequired
+	} else if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	if len(value) == 0 {
+		return ErrValueRequired
+	}
+	if uint64(len(value)+idleValueOverhead) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+	if idle <= 0 {
+		return fmt.Errorf("idle duration must be positive, but got %s", idle)
+	}
+
+	return t.put(key, encodeIdleValue(value, int(idle), int(time.Now().UnixNano())))
+}
+
+// getIdle handles a stored idle value on Get: an expired entry is
+// reported as absent, a live one has its last-access timestamp bumped
+// and its user value returned.
+func (t *LSMTree) getIdle(key []byte, stored []byte) ([]byte, bool, error) {
+	idle, lastAccess, value := decodeIdleValue(stored)
+	now := int(time.Now().UnixNano())
+	if now-lastAccess > idle {
+		return nil, false, nil
+	}
+
+	bumped := encodeIdleValue(value, idle, now)
+	if t.lazyIdleBump {
+		// the bump skips the WAL, so it is lost on a crash, but the
+		// read stays free of the disk writes
+		t.memTable.put(key, bumped)
+		t.cache.invalidate(key)
+	} else if err := t.put(key, bumped); err != nil {
+		return nil, false, fmt.Errorf("failed to bump the last-access time: %w", err)
+	}
+
+	return value, true, nil
+}
+
+// encodeIdleValue encodes the user value together with the idle
+// duration and the last-access timestamp, both in nanoseconds.
+func encodeIdleValue(value []byte, idle, lastAccess int) []byte {
+	stored := make([]byte, 0, idleValueOverhead+len(value))
+	stored = append(stored, idleValueMagic...)
+	stored = append(stored, encodeIntPair(idle, lastAccess)...)
+	stored = append(stored, value...)
+
+	return stored
+}
+
+// isIdleValue returns true if the stored value carries a sliding
+// expiration.
+func isIdleValue(value []byte) bool {
+	return len(value) >= idleValueOverhead && bytes.HasPrefix(value, idleValueMagic)
+}
+
+// decodeIdleValue decodes the idle duration, the last-access timestamp
+// and the user value from the stored value.
+func decodeIdleValue(stored []byte) (int, int, []byte) {
+	idle, lastAccess := decodeIntPair(stored[len(idleValueMagic):])
+
+	return idle, lastAccess, stored[idleValueOverhead:]
+}
@@ -0,0 +1,676 @@
+package lsmtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// KeyIterator iterates over all keys in the database in sorted order
+// without reading the values. For disk tables it reads the index files,
+// which store only keys and offsets to the values. Since the index does
+// not record whether a key is a tombstone, the iterator reads the record
+// header from the data file for the most recent occurrence of each key:
+// the record is a tombstone if it consists of the key only. Deleted keys
+// are skipped.
+type KeyIterator struct {
+	// Sources are ordered from the most recent to the oldest: first
+	// the MemTable and then the disk tables from the newest to the oldest.
+	sources []keySource
+	next    []byte
+	end     bool
+}
+
+// keySources returns the sources of the database ordered from the most
+// recent to the oldest: first the MemTable and then the disk tables
+// from the newest to the oldest.
+func (t *LSMTree) keySources() ([]keySource, error) {
+	sources := make([]keySource, 0, t.maxDiskTableIndex+2)
+	sources = append(sources, newMemTableKeySource(t.memTable))
+
+	for index := t.maxDiskTableIndex; index >= 0; index-- {
+		source, err := newDiskTableKeySource(t.dbDir, index)
+		if err != nil {
+			// the disk table might have been merged into a newer one
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			closeKeySources(sources)
+			return nil, fmt.Errorf("failed to open disk table %d: %w", index, err)
+		}
+
+		// the reference defers the deletion of the disk table by the
+		// merges until the source is closed
+		source.refs = t.tables
+		t.tables.acquire(index)
+
+		sources = append(sources, source)
+	}
+
+	return sources, nil
+}
+
+// KeyIterator returns an iterator over all keys in the database
+// in sorted order. The iterator must be closed after use.
+func (t *LSMTree) KeyIterator() (*KeyIterator, error) {
+	sources, err := t.keySources()
+	if err != nil {
+		return nil, err
+	}
+
+	it := &KeyIterator{sources: sources}
+	if err := it.advance(); err != nil {
+		it.Close()
+		return nil, err
+	}
+
+	return it, nil
+}
+
+// HasNext returns true if there is a next key.
+func (it *KeyIterator) HasNext() bool {
+	return !it.end
+}
+
+// Next returns the current key and advances the iterator position.
+func (it *KeyIterator) Next() ([]byte, error) {
+	key := it.next
+	if err := it.advance(); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Close closes all the sources of the iterator.
+func (it *KeyIterator) Close() error {
+	return closeKeySources(it.sources)
+}
+
+// advance moves the iterator to the next key that is not deleted.
+func (it *KeyIterator) advance() error {
+	for {
+		var minKey []byte
+		for _, source := range it.sources {
+			if source.hasNext() && (minKey == nil || bytes.Compare(source.key(), minKey) < 0) {
+				minKey = source.key()
+			}
+		}
+
+		if minKey == nil {
+			it.next = nil
+			it.end = true
+			return nil
+		}
+
+		deleted, checked := false, false
+		for _, source := range it.sources {
+			if !source.hasNext() || !bytes.Equal(source.key(), minKey) {
+				continue
+			}
+
+			// the first source that holds the key is the most
+			// recent one and it wins over the older sources
+			if !checked {
+				d, err := source.deleted()
+				if err != nil {
+					return fmt.Errorf("failed to check whether key is deleted: %w", err)
+				}
+
+				deleted, checked = d, true
+			}
+
+			if err := source.advance(); err != nil {
+				return fmt.Errorf("failed to advance key source: %w", err)
+			}
+		}
+
+		if !deleted {
+			it.next = minKey
+			return nil
+		}
+	}
+}
+
+// Entry is a single key-value pair yielded by the public iterators.
+// The value is nil and Tombstone is true for the deleted keys, which
+// are only yielded when the iterator is asked to include them.
+type Entry struct {
+	Key   []byte
+	Value []byte
+	// Tombstone is true if the entry marks the key as deleted.
+	Tombstone bool
+}
+
+// RangeOptions controls whether the range bounds are inclusive.
+// The common convention is start-inclusive and end-exclusive,
+// which is what DefaultRangeOptions holds.
+type RangeOptions struct {
+	// StartInclusive includes the entry with the start key itself.
+	StartInclusive bool
+	// EndInclusive includes the entry with the end key itself.
+	EndInclusive bool
+	// IncludeTombstones makes the iterator yield the deleted keys
+	// stored in the raw tables instead of skipping them.
+	IncludeTombstones bool
+
+	// rawEntries yields the records in their stored representation:
+	// the idle entries keep their encoding and are not filtered when
+	// expired, and the chunked values stay as their marker and chunk
+	// records. It is only set by the internal scans that must see the
+	// physical records.
+	rawEntries bool
+}
+
+// DefaultRangeOptions is the common convention for the range bounds:
+// the start is inclusive and the end is exclusive.
+var DefaultRangeOptions = RangeOptions{StartInclusive: true, EndInclusive: false}
+
+// RangeIterator iterates over the entries with the keys in the given
+// range in sorted order. Deleted keys are skipped.
+type RangeIterator struct {
+	// The tree the iterator reads from, used to decode the stored
+	// representation of the idle entries and the chunked values.
+	tree *LSMTree
+	// Sources are ordered from the most recent to the oldest.
+	sources    []keySource
+	start, end []byte
+	options    RangeOptions
+	next       Entry
+	done       bool
+}
+
+// Range returns an iterator over the entries with the keys between
+// start and end in sorted order. The options control whether the
+// bounds are inclusive. A nil end means there is no upper bound.
+// The entries stored with PutWithIdle are yielded with their user
+// value while they are live and are skipped once expired, without
+// bumping their last-access timestamp. With the chunking enabled the
+// chunked values are reassembled and their internal chunk records are
+// skipped. The iterator must be closed after use.
+func (t *LSMTree) Range(start, end []byte, options RangeOptions) (*RangeIterator, error) {
+	sources, err := t.keySources()
+	if err != nil {
+		return nil, err
+	}
+
+	it := &RangeIterator{tree: t, sources: sources, start: start, end: end, options: options}
+	if err := it.advance(); err != nil {
+		it.Close()
+		return nil, err
+	}
+
+	return it, nil
+}
+
+// ResumeScan returns an iterator over the entries with the keys
+// strictly after afterKey in sorted order, so a batch job can store
+// the last processed key as a checkpoint and continue from it after
+// a restart. A nil afterKey scans from the first key. The iterator
+// must be closed after use.
+func (t *LSMTree) ResumeScan(afterKey []byte) (*RangeIterator, error) {
+	// the exclusive start skips the already processed key itself
+	return t.Range(afterKey, nil, RangeOptions{StartInclusive: false})
+}
+
+// HasNext returns true if there is a next entry.
+func (it *RangeIterator) HasNext() bool {
+	return !it.done
+}
+
+// Next returns the current entry and advances the iterator position.
+func (it *RangeIterator) Next() (Entry, error) {
+	entry := it.next
+	if err := it.advance(); err != nil {
+		return Entry{}, err
+	}
+
+	return entry, nil
+}
+
+// Close closes all the sources of the iterator.
+func (it *RangeIterator) Close() error {
+	return closeKeySources(it.sources)
+}
+
+// advance moves the iterator to the next key within the bounds
+// that is not deleted.
+func (it *RangeIterator) advance() error {
+	for {
+		var minKey []byte
+		for _, source := range it.sources {
+			if source.hasNext() && (minKey == nil || bytes.Compare(source.key(), minKey) < 0) {
+				minKey = source.key()
+			}
+		}
+
+		if minKey == nil || it.afterEnd(minKey) {
+			it.next = Entry{}
+			it.done = true
+			return nil
+		}
+
+		inRange := !it.beforeStart(minKey)
+
+		var value []byte
+		picked := false
+		for _, source := range it.sources {
+			if !source.hasNext() || !bytes.Equal(source.key(), minKey) {
+				continue
+			}
+
+			// the first source that holds the key is the most
+			// recent one and it wins over the older sources
+			if inRange && !picked {
+				v, err := source.value()
+				if err != nil {
+					return fmt.Errorf("failed to read value: %w", err)
+				}
+
+				value, picked = v, true
+			}
+
+			if err := source.advance(); err != nil {
+				return fmt.Errorf("failed to advance key source: %w", err)
+			}
+		}
+
+		if !inRange {
+			continue
+		}
+
+		// the chunk records are internal to the chunked values stored
+		// under the user keys
+		if !it.options.rawEntries && it.tree.chunkLargeValues && bytes.Contains(minKey, chunkKeySuffix) {
+			continue
+		}
+
+		// a nil value marks a tombstone
+		if value == nil && !it.options.IncludeTombstones {
+			continue
+		}
+
+		if value != nil && !it.options.rawEntries {
+			if isIdleValue(value) {
+				idle, lastAccess, userValue := decodeIdleValue(value)
+				// an expired idle entry is dead and is skipped; a live
+				// one yields its user value, without bumping its
+				// last-access timestamp
+				if int(time.Now().UnixNano())-lastAccess > idle {
+					continue
+				}
+				value = userValue
+			}
+
+			if it.tree.chunkLargeValues && isChunkMarker(value) {
+				reassembled, exists, err := it.tree.getChunked(minKey, value)
+				if err != nil {
+					return fmt.Errorf("failed to reassemble the chunked value: %w", err)
+				}
+				if !exists {
+					continue
+				}
+				value = reassembled
+			}
+		}
+
+		it.next = Entry{Key: minKey, Value: value, Tombstone: value == nil}
+
+		return nil
+	}
+}
+
+// seek fast-forwards the iterator to the first entry with the key not
+// below the given key, using the sparse indexes of the disk tables to
+// skip over the entries in between. It never moves backward.
+func (it *RangeIterator) seek(key []byte) error {
+	if it.done {
+		return nil
+	}
+
+	// the buffered entry is the minimum of the source positions, so
+	// once it reaches the key, every source is already past it
+	if bytes.Compare(it.next.Key, key) >= 0 {
+		return nil
+	}
+
+	for _, source := range it.sources {
+		if err := source.seek(key); err != nil {
+			return fmt.Errorf("failed to seek key source: %w", err)
+		}
+	}
+
+	return it.advance()
+}
+
+// beforeStart returns true if the key is below the lower bound.
+func (it *RangeIterator) beforeStart(key []byte) bool {
+	cmp := bytes.Compare(key, it.start)
+
+	return cmp < 0 || (cmp == 0 && !it.options.StartInclusive)
+}
+
+// afterEnd returns true if the key is above the upper bound.
+// A nil upper bound means there is none.
+func (it *RangeIterator) afterEnd(key []byte) bool {
+	if it.end == nil {
+		return false
+	}
+
+	cmp := bytes.Compare(key, it.end)
+
+	return cmp > 0 || (cmp == 0 && !it.options.EndInclusive)
+}
+
+// keySource yields keys in sorted order from one of the places
+// the database stores data in: the MemTable or a disk table.
+type keySource interface {
+	// hasNext returns true if there is a buffered key.
+	hasNext() bool
+	// key returns the buffered key without advancing the source.
+	key() []byte
+	// value returns the value of the buffered key, nil for a tombstone.
+	value() ([]byte, error)
+	// deleted returns true if the buffered key is a tombstone.
+	deleted() (bool, error)
+	// advance moves the source to the next key.
+	advance() error
+	// seek moves the source forward to the first key not below the
+	// given key. It never moves backward.
+	seek(key []byte) error
+	// close closes all allocated resources.
+	close() error
+}
+
+// closeKeySources closes all the given sources and returns the first error.
+func closeKeySources(sources []keySource) error {
+	var firstErr error
+	for _, source := range sources {
+		if err := source.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// memTableKeySource yields keys from the MemTable.
+type memTableKeySource struct {
+	it           *memTableIterator
+	currentKey   []byte
+	currentValue []byte
+	end          bool
+}
+
+// newMemTableKeySource returns a new key source for the given MemTable.
+func newMemTableKeySource(memTable *memTable) *memTableKeySource {
+	source := &memTableKeySource{it: memTable.iterator()}
+	source.advance()
+
+	return source
+}
+
+func (s *memTableKeySource) hasNext() bool {
+	return !s.end
+}
+
+func (s *memTableKeySource) key() []byte {
+	return s.currentKey
+}
+
+func (s *memTableKeySource) value() ([]byte, error) {
+	return s.currentValue, nil
+}
+
+func (s *memTableKeySource) deleted() (bool, error) {
+	return s.currentValue == nil, nil
+}
+
+func (s *memTableKeySource) advance() error {
+	if !s.it.hasNext() {
+		s.currentKey, s.currentValue = nil, nil
+		s.end = true
+		return nil
+	}
+
+	s.currentKey, s.currentValue = s.it.next()
+
+	return nil
+}
+
+// seek advances the source entry by entry, since the MemTable already
+// resides in memory and the skipped entries cost no I/O.
+func (s *memTableKeySource) seek(key []byte) error {
+	for !s.end && bytes.Compare(s.currentKey, key) < 0 {
+		if err := s.advance(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *memTableKeySource) close() error {
+	return nil
+}
+
+// diskTableKeySource yields keys from the index file of a disk table.
+// The data file is only used to check whether a key is a tombstone by
+// reading the record header at the offset stored in the index.
+type diskTableKeySource struct {
+	indexFile *os.File
+	dataFile  *os.File
+	// The sparse index is opened together with the other files, so
+	// the seeks read the restart points of the same table generation
+	// even after a merge replaces the files under their paths.
+	sparseIndexFile *os.File
+	currentKey      []byte
+	currentOffset   int
+	end             bool
+	// The index of the disk table and the reference counter that
+	// defers the deletion of the table while the source is open.
+	index int
+	refs  *tableRefs
+}
+
+// newDiskTableKeySource returns a new key source for the disk table
+// with the given index.
+func newDiskTableKeySource(dbDir string, index int) (*diskTableKeySource, error) {
+	prefix := strconv.Itoa(index) + "-"
+
+	indexPath := diskTableFilePath(dbDir, prefix, diskTableIndexFileName)
+	indexFile, err := os.OpenFile(indexPath, os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index file %s: %w", indexPath, err)
+	}
+
+	dataPath := diskTableFilePath(dbDir, prefix, diskTableDataFileName)
+	dataFile, err := os.OpenFile(dataPath, os.O_RDONLY, 0600)
+	if err != nil {
+		indexFile.Close()
+		return nil, fmt.Errorf("failed to open data file %s: %w", dataPath, err)
+	}
+
+	sparseIndexPath := diskTableFilePath(dbDir, prefix, diskTableSparseIndexFileName)
+	sparseIndexFile, err := os.OpenFile(sparseIndexPath, os.O_RDONLY, 0600)
+	if err != nil {
+		indexFile.Close()
+		dataFile.Close()
+		return nil, fmt.Errorf("failed to open sparse index file %s: %w", sparseIndexPath, err)
+	}
+
+	source := &diskTableKeySource{indexFile: indexFile, dataFile: dataFile, sparseIndexFile: sparseIndexFile, index: index}
+	if err := source.advance(); err != nil {
+		source.close()
+		return nil, err
+	}
+
+	return source, nil
+}
+
+func (s *diskTableKeySource) hasNext() bool {
+	return !s.end
+}
+
+func (s *diskTableKeySource) key() []byte {
+	return s.currentKey
+}
+
+func (s *diskTableKeySource) value() ([]byte, error) {
+	if _, err := s.dataFile.Seek(int64(s.currentOffset), io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek: %w", err)
+	}
+
+	_, value, err := decode(s.dataFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read: %w", err)
+	}
+
+	return value, nil
+}
+
+func (s *diskTableKeySource) deleted() (bool, error) {
+	if _, err := s.dataFile.Seek(int64(s.currentOffset), io.SeekStart); err != nil {
+		return false, fmt.Errorf("failed to seek: %w", err)
+	}
+
+	// the record header: the total length and the key length,
+	// the record is a tombstone if it consists of the key only
+	var encodedEntryLen [8]byte
+	if _, err := io.ReadFull(s.dataFile, encodedEntryLen[:]); err != nil {
+		return false, fmt.Errorf("failed to read record header: %w", err)
+	}
+
+	rawEntryLen := binary.BigEndian.Uint64(encodedEntryLen[:])
+	flagged := rawEntryLen&recordFlagsBit != 0
+	checksummed := rawEntryLen&recordChecksumBit != 0
+	padded := rawEntryLen&recordPaddingBit != 0
+	entryLen := int(rawEntryLen &^ (recordFlagsBit | recordChecksumBit | recordPaddingBit))
+
+	// the pad length byte and the checksum precede the key length
+	// and the flags byte follows it
+	headerLen := 8
+	if padded {
+		headerLen++
+	}
+	if checksummed {
+		headerLen += 4
+	}
+	if flagged {
+		headerLen++
+	}
+
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(s.dataFile, header); err != nil {
+		return false, fmt.Errorf("failed to read record header: %w", err)
+	}
+
+	keyStart, padLen := 0, 0
+	if padded {
+		padLen = int(header[0])
+		keyStart = 1
+	}
+	if checksummed {
+		keyStart += 4
+	}
+	keyLen := decodeInt(header[keyStart : keyStart+8])
+
+	// the trailing padding is not part of the key or the value
+	return entryLen == headerLen+keyLen+padLen, nil
+}
+
+func (s *diskTableKeySource) advance() error {
+	suffix, value, err := decode(s.indexFile)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read: %w", err)
+	}
+	if err == io.EOF {
+		s.currentKey, s.currentOffset = nil, 0
+		s.end = true
+		return nil
+	}
+
+	// the index entries are prefix-compressed against the previous key
+	s.currentKey, s.currentOffset = decodeKeyOffset(s.currentKey, suffix, value)
+
+	return nil
+}
+
+// seek jumps to the restart point of the index file that the sparse
+// index holds for the key and advances from there, so the index
+// entries in between are skipped instead of being read one by one.
+// The iterators are ordered by bytes.Compare, so the seek is too.
+func (s *diskTableKeySource) seek(key []byte) error {
+	if s.end || bytes.Compare(s.currentKey, key) >= 0 {
+		return nil
+	}
+
+	// the search reads the handle opened with the source, never the
+	// path, so the restart points always belong to the same table
+	// generation as the index and the data files
+	if _, err := s.sparseIndexFile.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek: %w", err)
+	}
+
+	from, _, ok, err := searchInSparseIndex(s.sparseIndexFile, key, bytes.Compare)
+	if err != nil {
+		return fmt.Errorf("failed to search in sparse index file %s: %w", s.sparseIndexFile.Name(), err)
+	}
+
+	if ok {
+		current, err := s.indexFile.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return fmt.Errorf("failed to seek: %w", err)
+		}
+
+		// the jump only ever goes forward, the restart points behind
+		// the current position are already consumed
+		if int64(from) > current {
+			if _, err := s.indexFile.Seek(int64(from), io.SeekStart); err != nil {
+				return fmt.Errorf("failed to seek: %w", err)
+			}
+
+			// the restart point resets the prefix compression
+			s.currentKey = nil
+			if err := s.advance(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for !s.end && bytes.Compare(s.currentKey, key) < 0 {
+		if err := s.advance(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *diskTableKeySource) close() error {
+	if err := s.indexFile.Close(); err != nil {
+		return fmt.Errorf("failed to close index file: %w", err)
+	}
+
+	if err := s.dataFile.Close(); err != nil {
+		return fmt.Errorf("failed to close data file: %w", err)
+	}
+
+	if err := s.sparseIndexFile.Close(); err != nil {
+		return fmt.Errorf("failed to close sparse index file: %w", err)
+	}
+
+	if s.refs != nil {
+		if err := s.refs.release(s.index); err != nil {
+			return fmt.Errorf("failed to release disk table %d: %w", s.index, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+package lsmtree
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// KeyRange returns the approximate smallest and largest keys in the
+// database. It combines the MemTable keys with the first and the last
+// entries of each disk table sparse index, so it does not touch the
+// data files. The approximation errs on the narrow side: the largest
+// key of a disk table may fall behind the last sparse entry, and the
+// tombstones stored in the disk tables cannot be skipped without
+// reading the data files. Use KeyRangeExact for the exact answer.
+// ok is false if the database holds no keys.
+func (t *LSMTree) KeyRange() (min, max []byte, ok bool, err error) {
+	for it := t.memTable.iterator(); it.hasNext(); {
+		key, value := it.next()
+		// the MemTable knows its tombstones, skip them
+		if value == nil {
+			continue
+		}
+
+		min, max = narrowKeyRange(min, max, key)
+	}
+
+	indexes, err := listDiskTables(t.dbDir, t.maxDiskTableIndex)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("failed to list disk tables: %w", err)
+	}
+
+	for _, index := range indexes {
+		first, last, err := sparseIndexKeyRange(t.dbDir, index)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if first == nil {
+			continue
+		}
+
+		min, max = narrowKeyRange(min, max, first)
+		min, max = narrowKeyRange(min, max, last)
+	}
+
+	return min, max, min != nil, nil
+}
+
+// KeyRangeExact returns the exact smallest and largest keys in the
+// database, skipping the tombstones. It iterates over all keys, so it
+// is linear in the size of the database. ok is false if the database
+// holds no keys.
+func (t *LSMTree) KeyRangeExact() (min, max []byte, ok bool, err error) {
+	it, err := t.KeyIterator()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	defer it.Close()
+
+	for it.HasNext() {
+		key, err := it.Next()
+		if err != nil {
+			return nil, nil, false, err
+		}
+
+		if min == nil {
+			min = key
+		}
+		max = key
+	}
+
+	return min, max, min != nil, nil
+}
+
+// narrowKeyRange extends the min and max bounds with the key.
+func narrowKeyRange(min, max, key []byte) ([]byte, []byte) {
+	if min == nil || bytes.Compare(key, min) < 0 {
+		min = key
+	}
+	if max == nil || bytes.Compare(key, max) > 0 {
+		max = key
+	}
+
+	return min, max
+}
+
+// diskTableKeyBounds returns the exact smallest and largest keys
+// stored in the disk table with the given index, including the
+// tombstones. The smallest key is the first sparse index entry. The
+// largest key trails the last sparse entry, so only the tail of the
+// index file behind it is scanned, at most sparseKeyDistance entries.
+// Both keys are nil for an empty disk table.
+func diskTableKeyBounds(dbDir string, index int) ([]byte, []byte, error) {
+	prefix := strconv.Itoa(index) + "-"
+
+	sparseIndexPath := diskTableFilePath(dbDir, prefix, diskTableSparseIndexFileName)
+	sparseIndexFile, err := os.OpenFile(sparseIndexPath, os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open sparse index file %s: %w", sparseIndexPath, err)
+	}
+	defer sparseIndexFile.Close()
+
+	var min, prev []byte
+	tailOffset := 0
+	for {
+		suffix, value, err := decode(sparseIndexFile)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read: %w", err)
+		}
+
+		key, offset := decodeKeyOffset(prev, suffix, value)
+		if min == nil {
+			min = key
+		}
+		prev = key
+		tailOffset = offset
+	}
+	if min == nil {
+		return nil, nil, nil
+	}
+
+	indexPath := diskTableFilePath(dbDir, prefix, diskTableIndexFileName)
+	indexFile, err := os.OpenFile(indexPath, os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open index file %s: %w", indexPath, err)
+	}
+	defer indexFile.Close()
+
+	if _, err := indexFile.Seek(int64(tailOffset), io.SeekStart); err != nil {
+		return nil, nil, fmt.Errorf("failed to seek: %w", err)
+	}
+
+	// the tail starts at a restart point, so the prefix-compressed
+	// entries are reconstructed from the preceding keys
+	max := prev
+	var prevTail []byte
+	for {
+		suffix, value, err := decode(indexFile)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read: %w", err)
+		}
+
+		key, _ := decodeKeyOffset(prevTail, suffix, value)
+		prevTail = key
+		max = key
+	}
+
+	return min, max, nil
+}
+
+// sparseIndexKeyRange returns the first and the last keys stored in
+// the sparse index of the disk table with the given index.
+func sparseIndexKeyRange(dbDir string, index int) ([]byte, []byte, error) {
+	sparseIndexPath := diskTableFilePath(dbDir, strconv.Itoa(index)+"-", diskTableSparseIndexFileName)
+	sparseIndexFile, err := os.OpenFile(sparseIndexPath, os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open sparse index file %s: %w", sparseIndexPath, err)
+	}
+	defer sparseIndexFile.Close()
+
+	var first, last []byte
+	for {
+		suffix, value, err := decode(sparseIndexFile)
+		if err == io.EOF {
+			return first, last, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read: %w", err)
+		}
+
+		key, _ := decodeKeyOffset(last, suffix, value)
+		if first == nil {
+			first = key
+		}
+		last = key
+	}
+}
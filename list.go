@@ -0,0 +1,86 @@
+package lsmtree
+
+import (
+	"fmt"
+)
+
+// Append appends the element to the list of values stored under the
+// key. The list is stored as a single length-prefixed value, so the
+// append is a read-modify-write: it is not atomic and concurrent
+// appends to the same key from multiple goroutines can lose elements.
+func (t *LSMTree) Append(key []byte, element []byte) error {
+	value, exists, err := t.Get(key)
+	if err != nil {
+		return fmt.Errorf("failed to get the current list: %w", err)
+	}
+
+	var elements [][]byte
+	if exists {
+		elements, err = decodeList(value)
+		if err != nil {
+			return fmt.Errorf("failed to decode the current list: %w", err)
+		}
+	}
+
+	return t.Put(key, encodeList(append(elements, element)))
+}
+
+// GetList returns the elements of the list stored under the key in the
+// order they were appended. It returns nil if the key does not exist.
+func (t *LSMTree) GetList(key []byte) ([][]byte, error) {
+	value, exists, err := t.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the list: %w", err)
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	elements, err := decodeList(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the list: %w", err)
+	}
+
+	return elements, nil
+}
+
+// encodeList encodes the list elements as a single value.
+// Must be compatible with decodeList.
+func encodeList(elements [][]byte) []byte {
+	// encoding format, repeated for each element:
+	// [encoded element length in bytes][element]
+
+	size := 0
+	for _, element := range elements {
+		size += 8 + len(element)
+	}
+
+	encoded := make([]byte, 0, size)
+	for _, element := range elements {
+		encoded = append(encoded, encodeInt(len(element))...)
+		encoded = append(encoded, element...)
+	}
+
+	return encoded
+}
+
+// decodeList decodes the list elements from the value.
+// Must be compatible with encodeList.
+func decodeList(value []byte) ([][]byte, error) {
+	elements := make([][]byte, 0)
+	for len(value) > 0 {
+		if len(value) < 8 {
+			return nil, fmt.Errorf("the list value is corrupted, failed to read element length")
+		}
+
+		elementLen := decodeInt(value[0:8])
+		if len(value) < 8+elementLen {
+			return nil, fmt.Errorf("the list value is corrupted, failed to read element")
+		}
+
+		elements = append(elements, value[8:8+elementLen])
+		value = value[8+elementLen:]
+	}
+
+	return elements, nil
+}
@@ -0,0 +1,38 @@
+package lsmtree
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncodeListDecodeList(t *testing.T) {
+	cases := [][][]byte{
+		{},
+		{[]byte("a")},
+		{[]byte("a"), []byte("bb"), []byte("ccc")},
+	}
+
+	for _, expected := range cases {
+		actual, err := decodeList(encodeList(expected))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if !reflect.DeepEqual(expected, actual) {
+			t.Fatalf("%s != %s", expected, actual)
+		}
+	}
+}
+
+func TestDecodeListForCorruptedValue(t *testing.T) {
+	corrupted := [][]byte{
+		{0x01},
+		append(encodeInt(10), []byte("short")...),
+	}
+
+	for _, value := range corrupted {
+		if _, err := decodeList(value); err == nil {
+			t.Fatalf("expected an error for the corrupted value %x", value)
+		}
+	}
+}
@@ -1,11 +1,17 @@
 package lsmtree
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
 	"os"
 	"path"
+	"strconv"
+	"sync"
+	"time"
 )
 
 const (
@@ -19,15 +25,71 @@ const (
 	MaxValueSize = math.MaxUint16
 )
 
+// Compaction strategies that can be set with the CompactionStrategy option.
+const (
+	// CompactionMergeOldest merges the two oldest disk tables once the
+	// disk table number passes the threshold.
+	CompactionMergeOldest = 0
+	// CompactionSizeTiered groups disk tables of a similar size and
+	// merges the oldest such group, which suits write-heavy
+	// workloads better.
+	CompactionSizeTiered = 1
+	// CompactionTombstoneDensity scores the disk tables by their
+	// estimated reclaimable bytes and merges the highest-scoring
+	// adjacent pair, so the merges reclaim the most space per I/O.
+	CompactionTombstoneDensity = 2
+)
+
+// Checksum modes that can be set with the ChecksumMode option.
+const (
+	// ChecksumOff disables writing the checksums for the new records.
+	// The records that already carry a checksum are still verified
+	// when they are read.
+	ChecksumOff = 0
+	// ChecksumOnRead writes the checksums for the new disk table
+	// records and verifies each record when it is read. It is
+	// the default.
+	ChecksumOnRead = 1
+	// ChecksumOnOpen is ChecksumOnRead plus a full sweep over all disk
+	// tables at Open, so a corrupted record fails fast instead of when
+	// its key happens to be read.
+	ChecksumOnOpen = 2
+)
+
+// Corrupt table policies that can be set with the OnCorruptTable option.
+const (
+	// CorruptTableFail returns the error of the read that hits the
+	// corrupted disk table. It is the default.
+	CorruptTableFail = 0
+	// CorruptTableSkip treats the corrupted disk table as empty: the
+	// read logs a warning and continues with the older tables.
+	CorruptTableSkip = 1
+	// CorruptTableQuarantine renames the files of the corrupted disk
+	// table aside and continues with the older tables, so the bad
+	// files are kept for inspection without failing the reads.
+	CorruptTableQuarantine = 2
+)
+
 const (
 	// WAL file name.
 	walFileName = "wal.db"
 	// Default MemTable table threshold.
 	defaultMemTableThreshold = 64000 // 64 kB
+	// The minimal accepted MemTable threshold. A smaller threshold
+	// flushes a disk table per a few keys and floods the directory
+	// with tiny tables faster than the merges reclaim them.
+	minMemTableThreshold = 16
 	// Default distance between keys in sparse index.
 	defaultSparseKeyDistance = 128
 	// Default DiskTable number threshold.
 	defaultDiskTableNumThreshold = 10
+	// Default bound on the open file handles when the file cache is
+	// implied by another option rather than set with MaxOpenFiles.
+	defaultMaxOpenFiles = 64
+	// Default estimate of the in-memory overhead per MemTable entry:
+	// the three node pointers and the color of the red-black tree node
+	// plus the key and the value slice headers.
+	defaultMemTableEntryOverhead = 80
 )
 
 var (
@@ -39,8 +101,143 @@ var (
 	ErrKeyTooLarge = errors.New("key too large")
 	// ErrValueTooLarge is returned when putting a value that is larger than MaxValueSize.
 	ErrValueTooLarge = errors.New("value too large")
+	// ErrDiskTableMissing is returned when one of the disk table files does not exist.
+	ErrDiskTableMissing = errors.New("disk table is missing")
+	// ErrWALWrite is returned when writing to the WAL file fails.
+	ErrWALWrite = errors.New("failed to write to the WAL")
+	// ErrFlushFailed is returned when flushing the MemTable onto the disk fails.
+	ErrFlushFailed = errors.New("failed to flush the MemTable")
+	// ErrKeysOutOfOrder is returned when bulk loading keys that are not
+	// in strictly increasing order.
+	ErrKeysOutOfOrder = errors.New("keys are not in strictly increasing order")
+	// ErrIOTimeout is returned when an I/O operation does not finish
+	// within the configured timeout. The operation is not interrupted
+	// and may still complete later.
+	ErrIOTimeout = errors.New("I/O operation timed out")
+	// ErrWriteStall is returned by the writes when the disk table
+	// number passes the write stall threshold. The writes resume once
+	// a compaction brings the number back under the threshold.
+	ErrWriteStall = errors.New("writes are stalled until compaction catches up")
+	// ErrChecksumMismatch is returned when the checksum of a record
+	// does not match its payload, which means the file is corrupted.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrWALNotReplayed is returned by the writes and the flushes on a
+	// database opened with SkipWALReplay: the unreplayed WAL records
+	// would be lost on the next WAL clear.
+	ErrWALNotReplayed = errors.New("the WAL is not replayed, writes are rejected")
+	// ErrDirectoryNotWritable is returned by Open when the database
+	// directory exists, but does not permit writes, so the WAL file
+	// cannot be created in it.
+	ErrDirectoryNotWritable = errors.New("the database directory is not writable")
+	// ErrKeyNotFound is returned by MustDelete when the key to delete
+	// is not present in the database.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrClosed is returned by the reads and the writes after Close,
+	// instead of operating on the closed file handles.
+	ErrClosed = errors.New("the database is closed")
+	// ErrTableAltered is returned by VerifyTable when a file of the
+	// disk table does not match its manifest anymore.
+	ErrTableAltered = errors.New("the disk table does not match its manifest")
 )
 
+// Stats holds the cumulative write counters of the tree. Comparing the
+// bytes written to the disk with the bytes of the user data gives the
+// write amplification of the tree.
+type Stats struct {
+	// BytesWrittenWAL is the total number of bytes appended to the WAL.
+	BytesWrittenWAL int
+	// BytesWrittenFlush is the total number of bytes written to the
+	// disk tables by the MemTable flushes.
+	BytesWrittenFlush int
+	// BytesWrittenMerge is the total number of bytes written to the
+	// disk tables by the merges.
+	BytesWrittenMerge int
+	// UserBytesWritten is the total number of the key and value bytes
+	// passed to Put and Delete.
+	UserBytesWritten int
+	// FlushCount is the number of the MemTable flushes that wrote a
+	// disk table. The flushes of an empty MemTable are not counted.
+	FlushCount int
+	// LastFlushDuration is how long the last counted flush took.
+	LastFlushDuration time.Duration
+	// TotalFlushDuration is the summed duration of all counted flushes.
+	TotalFlushDuration time.Duration
+	// AvgBytesPerFlush is BytesWrittenFlush averaged over FlushCount.
+	AvgBytesPerFlush int
+	// Cache holds the hit and miss counters of the cache layers.
+	Cache CacheStats
+	// CompactionScores holds the estimated reclaimable bytes by the
+	// disk table index, as computed by the last run of the
+	// tombstone-density scorer. It stays empty unless the
+	// CompactionTombstoneDensity strategy is set.
+	CompactionScores map[int]int
+}
+
+// CacheStats holds the cumulative hit and miss counters of the cache
+// layers on the Get path, so the effectiveness of each cache can be
+// measured. The counters stay zero for the caches that are not enabled.
+type CacheStats struct {
+	// ValueHits is the number of the Get calls served from the
+	// value cache.
+	ValueHits int
+	// ValueMisses is the number of the Get calls that missed the
+	// value cache.
+	ValueMisses int
+}
+
+// Logger logs the internal events of the tree, like flushes and merges,
+// for human-readable diagnostics. It is satisfied by log.Logger from
+// the standard library.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// noopLogger discards all log lines. It is the default logger.
+type noopLogger struct{}
+
+func (noopLogger) Printf(format string, args ...interface{}) {}
+
+// Comparator defines the order of the keys. It returns a negative
+// number if a is less than b, zero if they are equal and a positive
+// number if a is greater than b. The default comparator is bytes.Compare.
+type Comparator func(a, b []byte) int
+
+// Iterator yields keys and values. It is implemented by the caller
+// to feed the data into the tree, for example, for the bulk load.
+type Iterator interface {
+	// HasNext returns true if there is a next entry.
+	HasNext() bool
+	// Next returns the current key and value and advances the iterator position.
+	Next() (key []byte, value []byte, err error)
+}
+
+// wrappedError pairs one of the exported sentinel errors with the
+// underlying cause, so callers can check both with errors.Is and errors.As.
+type wrappedError struct {
+	sentinel error
+	err      error
+}
+
+// wrapError attaches the sentinel error to the underlying error.
+func wrapError(sentinel, err error) error {
+	return &wrappedError{sentinel: sentinel, err: err}
+}
+
+// Error returns the string representation of the error.
+func (e *wrappedError) Error() string {
+	return e.sentinel.Error() + ": " + e.err.Error()
+}
+
+// Unwrap returns the underlying cause.
+func (e *wrappedError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether the target is the attached sentinel error.
+func (e *wrappedError) Is(target error) bool {
+	return target == e.sentinel
+}
+
 // LSMTree (https://en.wikipedia.org/wiki/Log-structured_merge-tree)
 // is log-structure merge-tree implementation for storing data in files.
 // The implementation is not goroutine-safe! Make sure that if needed the access
@@ -77,25 +274,260 @@ type LSMTree struct {
 
 	// Distance between keys in sparse index.
 	sparseKeyDistance int
+
+	// If positive, a sparse sample is also emitted once the index file
+	// grows by that many bytes since the last one, whichever of the two
+	// distances is reached first.
+	sparseByteDistance int
+
+	// Current size of the WAL file in bytes.
+	walSize int
+
+	// If the WAL size in bytes passes the MemTable size multiplied
+	// by the threshold, the WAL is rewritten to keep only the latest
+	// record per key. Zero disables the WAL compaction.
+	walCompactionThreshold int
+
+	// How the disk tables to merge are picked once the disk table
+	// number passes the threshold.
+	compactionStrategy int
+
+	// The estimated reclaimable bytes by the disk table index, as
+	// computed by the last run of the tombstone-density scorer.
+	compactionScores map[int]int
+
+	// If set, the WAL writes and the disk table writes are retried
+	// on transient I/O errors. If nil, every operation runs once.
+	retrier *ioRetrier
+
+	// If the WAL grows by the threshold in bytes since the last
+	// MemTable snapshot, the MemTable is serialized to the snapshot
+	// file, so Open replays only the trailing WAL records.
+	// Zero disables the snapshots.
+	memTableSnapshotThreshold int
+
+	// The WAL offset covered by the latest MemTable snapshot.
+	snapshotWALOffset int
+
+	// Logs the internal events of the tree, like flushes and merges.
+	// By default all log lines are discarded.
+	logger Logger
+
+	// Cumulative write counters for the write amplification tracking.
+	stats Stats
+
+	// If set, merges run in the background and at most
+	// maxConcurrentCompactions of them run at once, the rest are queued.
+	// If nil, merges run synchronously in Put.
+	compactions *compactionLimiter
+
+	// If set, merges are scheduled on the pool shared with the other
+	// trees instead of the per-tree limiter.
+	compactionPool *CompactionPool
+
+	// If set, the hook runs before every write and may reject it or
+	// replace the stored value.
+	beforePut func(key, value []byte) ([]byte, error)
+
+	// If set, the hook runs after every flush with the index and the
+	// file paths of the created disk table.
+	afterFlush func(index int, files []string) error
+
+	// If set, the hook restores the missing files of a disk table on
+	// the read path before the search is retried.
+	fetchTable func(dbDir string, index int) error
+
+	// If positive, the disk table records are padded to the multiples
+	// of blockAlign bytes for the aligned reads.
+	blockAlign int
+
+	// If positive, the merges split the output into several tables
+	// partitioned by the key range once it passes the threshold.
+	maxTableBytes int
+
+	// If set, the merge writes are throttled by the limiter, so the
+	// background compaction does not saturate the disk bandwidth.
+	compactionRateLimiter *compactionRateLimiter
+
+	// The application metadata entries stored outside of the LSM
+	// keyspace, loaded from the app meta file at Open.
+	appMeta map[string][]byte
+
+	// If set, the merges consult the resolver for the keys stored in
+	// several disk tables instead of letting the newest value win.
+	conflictResolver ConflictResolver
+
+	// If set, the writers share one WAL fsync per batch instead of
+	// syncing their records one by one, and the writes are serialized
+	// by the mutex, so Put and Delete are safe for concurrent callers.
+	committer *walCommitter
+	commitMu  sync.Mutex
+
+	// The estimated in-memory overhead per MemTable entry and whether
+	// the flush threshold compares against the memory-inclusive figure
+	// instead of the raw key and value bytes.
+	memTableEntryOverhead int
+	memoryAwareFlush      bool
+
+	// The first error of a background compaction, it is returned on Close.
+	compactionErr error
+
+	// If set, Close merges all disk tables into one before closing,
+	// so the database is reopened in the most compact state.
+	compactOnClose bool
+
+	// If set, Put never flushes the MemTable on its own and the
+	// flushes happen only through the explicit Flush calls.
+	manualFlush bool
+
+	// If set, the recently read values are cached and the repeated
+	// reads of hot keys skip the disk search. Nil disables the cache.
+	cache *valueCache
+
+	// If set, the disk table file handles are kept open and reused
+	// across the reads, bounded by the number of open handles. Nil
+	// opens and closes the files on every read.
+	files *fileCache
+
+	// Whether the disk table files are memory-mapped for the reads
+	// instead of being read through the file handles.
+	mmapReads bool
+
+	// The hard cap on the disk table number: once reached, the writes
+	// fail with ErrWriteStall until a compaction catches up.
+	// Zero disables the backpressure.
+	writeStallThreshold int
+
+	// Counts the open iterators per disk table, so the merges defer
+	// the deletion of the tables that are still being read.
+	tables *tableRefs
+
+	// If set, the values larger than MaxValueSize are transparently
+	// split into chunk records and reassembled on Get.
+	chunkLargeValues bool
+
+	// If set, Get bumps the last-access timestamp of the entries
+	// stored with PutWithIdle in the MemTable only, so the bumps cost
+	// no WAL writes, but a crash loses them.
+	lazyIdleBump bool
+
+	// Defines the order of the keys in the disk table searches.
+	// By default bytes.Compare.
+	compare Comparator
+
+	// If set, the MemTable is flushed in the background every interval,
+	// so the WAL does not grow unbounded during the idle-write periods.
+	// Zero disables the timer-driven flushes.
+	flushInterval time.Duration
+
+	// Fires the timer-driven flushes.
+	flushTicker *time.Ticker
+
+	// Signals the background flush goroutine to stop.
+	flushStop chan struct{}
+
+	// Closed when the background flush goroutine exits, so Close can
+	// join an in-flight timer-driven flush before releasing the
+	// resources it uses.
+	flushDone chan struct{}
+
+	// The first error of a background flush, it is returned on Close.
+	flushErr error
+
+	// Whether the disk table records carry checksums and when they
+	// are verified. By default ChecksumOnRead.
+	checksumMode int
+
+	// How the reads treat a corrupted disk table. By default
+	// CorruptTableFail.
+	corruptTablePolicy int
+
+	// The number of range-partitioned disk tables a flush writes
+	// instead of one. Zero or one keeps the single table per flush.
+	flushPartitions int
+
+	// The block size of the MemTable arena allocator in bytes. Zero
+	// stores the inserted slices individually.
+	arenaBlockSize int
+
+	// Whether Close has been called. The reads and the writes of a
+	// closed database return ErrClosed instead of touching the closed
+	// file handles. The flag changes under commitMu, so the concurrent
+	// writers of the group commit observe it reliably.
+	closed bool
+
+	// Whether a new database stores each disk table in its own
+	// subdirectory under dbDir/tables. For an existing database the
+	// layout is detected from the directory instead.
+	subdirLayout bool
+
+	// Whether the WAL records carry per-record checksums.
+	walChecksum bool
+
+	// Whether Open skipped replaying the WAL into the MemTable. The
+	// writes and the flushes are rejected until the database is
+	// reopened without the option.
+	skipWALReplay bool
+
+	// The size in bytes of the read buffer for the data file scans.
+	// Zero disables the buffering.
+	readBufferSize int
 }
 
 // MemTableThreshold sets memTableThreshold for LSMTree.
 // If MemTable size in bytes passes the threshold, it must
-// be flushed to the filesystem.
+// be flushed to the filesystem. Open rejects the thresholds
+// smaller than 16 bytes: they create a disk table per a few
+// keys, which slows the reads down until a compaction runs.
 func MemTableThreshold(memTableThreshold int) func(*LSMTree) {
 	return func(t *LSMTree) {
 		t.memTableThreshold = memTableThreshold
 	}
 }
 
+// MemTableEntryOverhead overrides the estimated in-memory overhead per
+// MemTable entry used by ApproxMemoryBytes and the memory-aware flush.
+func MemTableEntryOverhead(n int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.memTableEntryOverhead = n
+	}
+}
+
+// MemoryAwareFlush makes the flush threshold compare against
+// ApproxMemoryBytes instead of the raw key and value bytes, so the
+// MemTable is flushed before its real memory footprint outgrows the
+// threshold. It helps the memory-constrained deployments where the
+// per-entry overhead of the tree nodes matters.
+func MemoryAwareFlush() func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.memoryAwareFlush = true
+	}
+}
+
 // SparseKeyDistance sets sparseKeyDistance for LSMTree.
 // Distance between keys in sparse index.
+// The sparse index is self-describing per file, so the disk tables
+// written with a different distance keep their original spacing and
+// stay readable; the new flushes and merges use the new distance.
 func SparseKeyDistance(sparseKeyDistance int) func(*LSMTree) {
 	return func(t *LSMTree) {
 		t.sparseKeyDistance = sparseKeyDistance
 	}
 }
 
+// SparseSampling makes the sparse index sample a key when either
+// everyNKeys keys or everyMBytes index bytes have passed since the
+// last sample, whichever comes first. The count keeps the bounded
+// index scan short for the small keys and the byte bound keeps it
+// short for the large ones. With everyMBytes of zero only the count
+// applies, like with SparseKeyDistance.
+func SparseSampling(everyNKeys, everyMBytes int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.sparseKeyDistance = everyNKeys
+		t.sparseByteDistance = everyMBytes
+	}
+}
+
 // DiskTableNumThreshold sets diskTableNumThreshold for LSMTree.
 // If DiskTable number passes the threshold, disk tables must be
 // merged to decrease it.
@@ -105,144 +537,1836 @@ func DiskTableNumThreshold(diskTableNumThreshold int) func(*LSMTree) {
 	}
 }
 
-// Open opens the database. Only one instance of the tree is allowed to
-// read and write to the directory.
-func Open(dbDir string, options ...func(*LSMTree)) (*LSMTree, error) {
-	if _, err := os.Stat(dbDir); os.IsNotExist(err) {
-		return nil, fmt.Errorf("directory %s does not exist", dbDir)
+// WALCompactionThreshold sets walCompactionThreshold for LSMTree.
+// If the WAL size in bytes passes the MemTable size multiplied
+// by the threshold, the WAL is rewritten to keep only the latest
+// record per key. Zero disables the WAL compaction.
+func WALCompactionThreshold(walCompactionThreshold int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.walCompactionThreshold = walCompactionThreshold
 	}
+}
 
-	walPath := path.Join(dbDir, walFileName)
-	wal, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open file %s: %w", walPath, err)
+// WithLogger sets the logger for LSMTree. The tree logs the internal
+// events, like flushes and merges, for human-readable diagnostics.
+// By default all log lines are discarded.
+func WithLogger(logger Logger) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.logger = logger
 	}
+}
 
-	memTable, err := loadMemTable(wal)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load entries from %s: %w", walPath, err)
+// MemTableSnapshotThreshold sets memTableSnapshotThreshold for LSMTree.
+// If the WAL grows by the threshold in bytes since the last MemTable
+// snapshot, the MemTable is serialized to the snapshot file, so Open
+// replays only the trailing WAL records. Zero disables the snapshots.
+func MemTableSnapshotThreshold(memTableSnapshotThreshold int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.memTableSnapshotThreshold = memTableSnapshotThreshold
 	}
+}
 
-	diskTableNum, maxDiskTableIndex, err := readDiskTableMeta(dbDir)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read disk table meta: %w", err)
+// IORetries makes the WAL writes and the disk table writes retry on
+// transient I/O errors, like EAGAIN and EINTR, up to n times with the
+// backoff between the attempts. Permanent errors are never retried.
+func IORetries(n int, backoff time.Duration) func(*LSMTree) {
+	return func(t *LSMTree) {
+		if t.retrier == nil {
+			t.retrier = &ioRetrier{}
+		}
+
+		t.retrier.retries = n
+		t.retrier.backoff = backoff
 	}
+}
 
-	t := &LSMTree{
-		wal:                   wal,
-		memTable:              memTable,
-		dbDir:                 dbDir,
-		maxDiskTableIndex:     maxDiskTableIndex,
-		memTableThreshold:     defaultMemTableThreshold,
-		sparseKeyDistance:     defaultSparseKeyDistance,
-		diskTableNum:          diskTableNum,
-		diskTableNumThreshold: defaultDiskTableNumThreshold,
+// IOTimeout bounds how long a single WAL write or disk table write may
+// take and makes it return ErrIOTimeout when exceeded, so a hanging
+// Sync on flaky storage does not block the whole tree. A timed-out
+// operation is not interrupted and may still complete later, so the
+// timeout error does not guarantee the write is lost.
+func IOTimeout(d time.Duration) func(*LSMTree) {
+	return func(t *LSMTree) {
+		if t.retrier == nil {
+			t.retrier = &ioRetrier{}
+		}
+
+		t.retrier.timeout = d
 	}
-	for _, option := range options {
-		option(t)
+}
+
+// ChecksumMode sets how the per-record checksums of the disk tables
+// are written and verified: ChecksumOff, ChecksumOnRead (the default)
+// or ChecksumOnOpen. The checksums only cover the disk table data
+// files, the WAL and the index files are not checksummed.
+func ChecksumMode(checksumMode int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.checksumMode = checksumMode
 	}
+}
 
-	return t, nil
+// ReadBufferSize makes the data file scans of the reads buffered with
+// a buffer of n bytes, so the bounded scan between the sparse index
+// samples issues fewer syscalls. Zero, the default, reads the records
+// from the OS one by one.
+func ReadBufferSize(n int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.readBufferSize = n
+	}
 }
 
-// Close closes all allocated resources.
-func (t *LSMTree) Close() error {
-	if err := t.wal.Close(); err != nil {
-		return fmt.Errorf("failed to close file %s: %w", t.wal.Name(), err)
+// MaxOpenFiles keeps the disk table file handles open and reused
+// across the reads, bounded by n handles at once. The least recently
+// used handles are closed when the bound is passed and reopened on
+// demand, so many disk tables do not run the process into the
+// "too many open files" errors. The bound is raised to 3 if it is
+// lower, since a single read holds up to three files open.
+func MaxOpenFiles(n int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.files = newFileCache(n)
 	}
+}
 
-	return nil
+// MemTableArena copies the keys and the values inserted into the
+// MemTable into the blocks of an arena allocator with the given block
+// size in bytes, instead of holding each slice as its own allocation.
+// A write-heavy load allocates millions of small slices otherwise, and
+// the arena turns them into a handful of blocks that are dropped
+// wholesale when a flush clears the MemTable. The entries replayed
+// from the WAL on Open stay individually allocated.
+func MemTableArena(blockSize int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.arenaBlockSize = blockSize
+	}
 }
 
-// Put puts the key into the db.
-func (t *LSMTree) Put(key []byte, value []byte) error {
-	if len(key) == 0 {
-		return ErrKeyRequired
-	} else if len(key) > MaxKeySize {
-		return ErrKeyTooLarge
-	} else if len(value) == 0 {
-		return ErrValueRequired
-	} else if uint64(len(value)) > MaxValueSize {
-		return ErrValueTooLarge
+// FlushPartitions makes every flush split the MemTable into n disk
+// tables covering disjoint key ranges instead of writing a single one.
+// The split points follow the key distribution of the MemTable, so each
+// table receives an equal share of the keys. The smaller tables narrow
+// the bounds pruning of the reads and give the merges finer-grained
+// work at the price of more files per flush.
+func FlushPartitions(n int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.flushPartitions = n
 	}
+}
 
-	if err := appendToWAL(t.wal, key, value); err != nil {
-		return fmt.Errorf("failed to append to file %s: %w", t.wal.Name(), err)
+// OnCorruptTable sets how the reads treat a disk table whose files
+// fail to be read or decoded: CorruptTableFail (the default),
+// CorruptTableSkip or CorruptTableQuarantine. The lenient policies
+// trade the strictness for the availability of the rest of the keys,
+// since only the keys of the corrupted table are affected.
+func OnCorruptTable(policy int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.corruptTablePolicy = policy
 	}
+}
 
-	t.memTable.put(key, value)
+// MmapReads memory-maps the disk table files and serves the reads from
+// the mapped bytes instead of the file read syscalls, which speeds up
+// the repeated gets against the same tables. The mappings are dropped
+// when the tables are merged or deleted and on Close. On the platforms
+// without the memory mapping support the reads fall back to the plain
+// file handles. The option implies MaxOpenFiles with the default bound
+// unless one is set explicitly.
+func MmapReads() func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.mmapReads = true
+	}
+}
 
-	if t.memTable.bytes() >= t.memTableThreshold {
-		if err := t.flushMemTable(); err != nil {
-			return fmt.Errorf("failed to flush MemTable: %w", err)
-		}
+// WALChecksum makes every WAL record carry the CRC-32 checksum of its
+// payload and verify it on replay. The replay stops at the first record
+// that is truncated or fails its checksum and cuts the rest of the log
+// off as a lost tail, instead of loading the corrupted records or
+// failing the whole open. The records streamed with PutStream are not
+// checksummed, since their values are not buffered in memory.
+func WALChecksum() func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.walChecksum = true
 	}
+}
 
-	if t.diskTableNum >= t.diskTableNumThreshold {
-		oldest := t.maxDiskTableIndex - t.diskTableNum + 1
-		if err := mergeDiskTables(t.dbDir, oldest, oldest+1, t.sparseKeyDistance); err != nil {
-			return fmt.Errorf("failed to merge disk tables: %w", err)
-		}
+// SkipWALReplay makes Open skip replaying the WAL into the MemTable,
+// so reopening with a large WAL is fast. Only the flushed data is
+// visible: the records that are still in the WAL cannot be read until
+// the database is reopened without the option. The writes and the
+// flushes return ErrWALNotReplayed, since they would clear the WAL
+// and lose its unreplayed records.
+func SkipWALReplay() func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.skipWALReplay = true
+	}
+}
 
-		newDiskTableNum := t.diskTableNum - 1
-		if err := updateDiskTableMeta(t.dbDir, newDiskTableNum, t.maxDiskTableIndex); err != nil {
-			return fmt.Errorf("failed to update disk table meta: %w", err)
-		}
+// SubdirectoryLayout stores the files of each disk table in its own
+// subdirectory, like dbDir/tables/3/data.db, instead of the flat
+// layout that prefixes the file names with the disk table index. The
+// layout is detected from the directory on open, so the option only
+// takes effect on a database without disk tables: a database created
+// with the flat layout keeps it.
+func SubdirectoryLayout() func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.subdirLayout = true
+	}
+}
 
-		t.diskTableNum--
+// CompactionStrategy sets compactionStrategy for LSMTree.
+// How the disk tables to merge are picked once the disk table
+// number passes the threshold.
+func CompactionStrategy(compactionStrategy int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.compactionStrategy = compactionStrategy
 	}
+}
 
-	return nil
+// MaxConcurrentCompactions makes merges run in the background and sets
+// the maximum number of them that run at once. The rest are queued and
+// run in the order they were triggered. Close waits for the in-flight
+// merges and drops the queued ones.
+func MaxConcurrentCompactions(n int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.compactions = newCompactionLimiter(n)
+	}
 }
 
-// Get the value for the key from the db.
-func (t *LSMTree) Get(key []byte) ([]byte, bool, error) {
-	value, exists := t.memTable.get(key)
-	if exists {
-		return value, value != nil, nil
+// AfterFlush sets the hook invoked after every flush with the index of
+// the created disk table and the paths of its data, index and sparse
+// index files. The disk table and the meta file are durable by then,
+// so the hook may upload or archive the files for the tiered storage.
+// An error returned by the hook fails the flush.
+func AfterFlush(hook func(index int, files []string) error) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.afterFlush = hook
 	}
+}
 
-	value, exists, err := searchInDiskTables(t.dbDir, t.maxDiskTableIndex, key)
-	if err != nil {
-		return nil, false, fmt.Errorf("failed to search in DiskTables: %w", err)
+// FetchTable sets the hook invoked with the database directory and the
+// disk table index when the files of the table are missing on the read
+// path. The hook restores the files, for example by downloading them
+// from the object storage an AfterFlush hook uploaded them to, and the
+// search is retried. A hook error means the table is not available and
+// the search skips it like a merged-away table.
+func FetchTable(hook func(dbDir string, index int) error) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.fetchTable = hook
 	}
+}
 
-	return value, exists, nil
+// BlockAlign makes the disk table writer pad every data file record
+// with zero bytes to a multiple of n, so the records start at the
+// n-byte boundaries. It helps the direct I/O and the storage backends
+// that care about the block alignment, at the cost of the padding
+// bytes. The n must not exceed 256. By default the records are not
+// aligned.
+func BlockAlign(n int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.blockAlign = n
+	}
 }
 
-// Delete delete the value by key from the db.
-func (t *LSMTree) Delete(key []byte) error {
-	if err := appendToWAL(t.wal, key, nil); err != nil {
-		return fmt.Errorf("failed to append to file %s: %w", t.wal.Name(), err)
+// ConflictResolver merges the two values stored for the same key when
+// the disk tables are merged. It receives the older value a and the
+// newer value b; a tombstone is passed as a nil value, so the resolver
+// can decide between a delete and a put. Returning nil keeps the key
+// deleted.
+type ConflictResolver func(key, aValue, bValue []byte) []byte
+
+// ConflictResolution sets the resolver consulted by the merges when
+// the same key is stored in several disk tables. By default the newer
+// value wins, which matches the last-write semantics of the tree. A
+// custom resolver suits the CRDT-style values that can be merged
+// instead of overwritten.
+func ConflictResolution(resolver ConflictResolver) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.conflictResolver = resolver
 	}
+}
 
-	t.memTable.delete(key)
+// GroupCommit makes the concurrent writers share one WAL fsync per
+// batch: every writer appends its record to the WAL, and the first
+// writer of a batch syncs the file for everyone enqueued by then. The
+// fsync cost is amortized across the batch, so many goroutines calling
+// Put and Delete at once are not serialized on their own fsyncs. The
+// option also makes Put and Delete safe for the concurrent callers;
+// the reads still require external synchronization.
+func GroupCommit() func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.committer = newWALCommitter()
+	}
+}
 
-	return nil
+// CompactionRateLimit throttles the merge writes to bytesPerSec with
+// a token bucket, so the background compaction leaves the disk
+// bandwidth for the foreground reads and writes. The flushes are not
+// throttled. By default the merges write at full speed.
+func CompactionRateLimit(bytesPerSec int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.compactionRateLimiter = newCompactionRateLimiter(bytesPerSec)
+	}
 }
 
-// flushMemTable flushes current MemTable onto the disk and clears it.
-// The function expects it to run in the synchronized block,
-// and thus it does not use any synchronization mechanisms.
-func (t *LSMTree) flushMemTable() error {
-	newDiskTableNum := t.diskTableNum + 1
-	newDiskTableIndex := t.maxDiskTableIndex + 1
+// MaxTableBytes sets the size threshold above which the merges split
+// the output into several disk tables partitioned by the key range,
+// so a full compaction does not pile everything into one huge table.
+// The partitions cover disjoint key ranges and the searches outside of
+// their bounds skip them cheaply. By default the output of a merge is
+// a single table.
+func MaxTableBytes(n int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.maxTableBytes = n
+	}
+}
 
-	if err := createDiskTable(t.memTable, t.dbDir, newDiskTableIndex, t.sparseKeyDistance); err != nil {
-		return fmt.Errorf("failed to create disk table %d: %w", newDiskTableIndex, err)
+// BeforePut sets the hook invoked with the key and the value before
+// every write. Returning an error aborts the write before it touches
+// the WAL; returning a different value stores it instead of the
+// original one. The hook is an extension point for the schema-like
+// validation and the value transformation.
+func BeforePut(hook func(key, value []byte) ([]byte, error)) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.beforePut = hook
 	}
+}
 
-	if err := updateDiskTableMeta(t.dbDir, newDiskTableNum, newDiskTableIndex); err != nil {
-		return fmt.Errorf("failed to update max disk table index %d: %w", newDiskTableIndex, err)
+// WithCompactionPool makes the merges of the tree run in the
+// background on the given pool, which may be shared by many trees to
+// bound the total compaction concurrency of the process. Close drops
+// the queued merges of the tree and waits for its in-flight ones, the
+// pool keeps serving the other trees.
+func WithCompactionPool(pool *CompactionPool) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.compactionPool = pool
+	}
+}
+
+// WriteStallThreshold sets the hard cap on the disk table number:
+// once reached, Put fails with ErrWriteStall until a compaction brings
+// the number back under the cap. It protects the read latency when
+// the flushes outpace the merges under sustained heavy writes.
+// A sensible cap is about twice the disk table number threshold.
+// Zero disables the backpressure.
+func WriteStallThreshold(n int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.writeStallThreshold = n
 	}
+}
 
-	newWAL, err := clearWAL(t.dbDir, t.wal)
+// ValueCacheBytes makes Get cache the values read from the disk tables
+// in an LRU cache bounded by n bytes, so the repeated reads of hot keys
+// skip the disk search. The cache is invalidated for the affected key
+// on Put and Delete and fully on the flushes and merges, so it never
+// returns a value for a key that was updated or deleted.
+func ValueCacheBytes(n int) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.cache = newValueCache(n)
+	}
+}
+
+// ManualFlush disables the automatic MemTable flushes in Put, so the
+// MemTable threshold is ignored and the flushes happen only through
+// the explicit Flush calls. It is useful for reproducible benchmarks,
+// where the write throughput and the flush cost are measured separately.
+func ManualFlush() func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.manualFlush = true
+	}
+}
+
+// FlushInterval makes the MemTable flush every interval in addition to
+// the size-based flushes, so the WAL does not grow unbounded during
+// the idle-write periods. The flush runs in a background goroutine and
+// the tree is not goroutine-safe, so the callers that keep writing
+// concurrently must synchronize the access on their side. Close stops
+// the timer and returns the first error of the background flushes.
+func FlushInterval(d time.Duration) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.flushInterval = d
+	}
+}
+
+// CompactOnClose makes Close run CompactAll before closing the WAL,
+// so a long-lived process that occasionally restarts leaves the
+// database in the most compact state for the next run.
+func CompactOnClose() func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.compactOnClose = true
+	}
+}
+
+// WithComparator sets the comparator that defines the order of the keys
+// for the disk table searches and the BulkLoad order check. The disk
+// tables must be sorted in the comparator order, so a custom comparator
+// is only useful with BulkLoad: the MemTable flushes always write the
+// tables in the byte order. The same comparator must be used across the
+// runs that share the same directory.
+func WithComparator(compare Comparator) func(*LSMTree) {
+	return func(t *LSMTree) {
+		t.compare = compare
+	}
+}
+
+// Open opens the database. Only one instance of the tree is allowed to
+// read and write to the directory.
+func Open(dbDir string, options ...func(*LSMTree)) (*LSMTree, error) {
+	if _, err := os.Stat(dbDir); os.IsNotExist(err) {
+		return nil, fmt.Errorf("directory %s does not exist", dbDir)
+	}
+
+	walPath := path.Join(dbDir, walFileName)
+	wal, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
-		return fmt.Errorf("failed to clear the WAL file: %w", err)
+		// distinguish the permission error from the other failures, so
+		// a read-only deployment is easy to diagnose
+		if os.IsPermission(err) {
+			return nil, wrapError(ErrDirectoryNotWritable, fmt.Errorf("failed to open file %s: %w", walPath, err))
+		}
+
+		return nil, fmt.Errorf("failed to open file %s: %w", walPath, err)
+	}
+
+	diskTableNum, maxDiskTableIndex, err := readDiskTableMeta(dbDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read disk table meta: %w", err)
+	}
+
+	appMeta, err := readAppMeta(dbDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the application metadata: %w", err)
+	}
+
+	walStat, err := wal.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file %s: %w", walPath, err)
+	}
+
+	t := &LSMTree{
+		wal:                   wal,
+		walSize:               int(walStat.Size()),
+		memTable:              newMemTable(),
+		dbDir:                 dbDir,
+		maxDiskTableIndex:     maxDiskTableIndex,
+		memTableThreshold:     defaultMemTableThreshold,
+		sparseKeyDistance:     defaultSparseKeyDistance,
+		memTableEntryOverhead: defaultMemTableEntryOverhead,
+		appMeta:               appMeta,
+		diskTableNum:          diskTableNum,
+		diskTableNumThreshold: defaultDiskTableNumThreshold,
+		logger:                noopLogger{},
+		tables:                newTableRefs(dbDir),
+		compare:               bytes.Compare,
+		checksumMode:          ChecksumOnRead,
+	}
+	for _, option := range options {
+		option(t)
+	}
+
+	// a non-positive distance would cause a division by zero
+	// on the first flush
+	if t.sparseKeyDistance <= 0 {
+		return nil, fmt.Errorf("sparse key distance must be positive, but got %d", t.sparseKeyDistance)
+	}
+	if t.sparseByteDistance < 0 {
+		return nil, fmt.Errorf("sparse byte distance must not be negative, but got %d", t.sparseByteDistance)
+	}
+	// a smaller threshold would flush a disk table per a few keys
+	// and flood the directory with tiny tables
+	if t.memTableThreshold < minMemTableThreshold {
+		return nil, fmt.Errorf("MemTable threshold must be at least %d, but got %d", minMemTableThreshold, t.memTableThreshold)
+	}
+	if t.blockAlign < 0 || t.blockAlign > maxBlockAlign {
+		return nil, fmt.Errorf("block alignment must be between 0 and %d, but got %d", maxBlockAlign, t.blockAlign)
+	}
+	if t.corruptTablePolicy < CorruptTableFail || t.corruptTablePolicy > CorruptTableQuarantine {
+		return nil, fmt.Errorf("unknown corrupt table policy %d", t.corruptTablePolicy)
+	}
+	if t.flushPartitions < 0 {
+		return nil, fmt.Errorf("flush partitions must not be negative, but got %d", t.flushPartitions)
+	}
+	if t.arenaBlockSize < 0 {
+		return nil, fmt.Errorf("arena block size must not be negative, but got %d", t.arenaBlockSize)
+	}
+
+	// the mappings live in the file cache, so the mapped reads need
+	// one even if MaxOpenFiles is not set
+	if t.mmapReads {
+		if t.files == nil {
+			t.files = newFileCache(defaultMaxOpenFiles)
+		}
+		t.files.mmap = true
+	}
+
+	// the table swap of a merge drops the cached handles of the
+	// replaced files before the readers resume
+	t.tables.files = t.files
+
+	if !t.skipWALReplay {
+		memTable, snapshotWALOffset, err := loadMemTableWithSnapshot(dbDir, wal)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load entries from %s: %w", walPath, err)
+		}
+
+		t.memTable = memTable
+		t.snapshotWALOffset = snapshotWALOffset
+	}
+
+	if t.arenaBlockSize > 0 {
+		t.memTable.arena = newArena(t.arenaBlockSize)
+	}
+
+	// switching the layout of the existing disk tables is not
+	// supported, so the tables directory is only created when
+	// there are none yet
+	if t.subdirLayout && t.diskTableNum == 0 {
+		tablesDir := path.Join(dbDir, diskTableSubdirName)
+		if err := os.MkdirAll(tablesDir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create directory %s: %w", tablesDir, err)
+		}
+	}
+
+	if t.checksumMode == ChecksumOnOpen {
+		if err := verifyDiskTables(dbDir, maxDiskTableIndex); err != nil {
+			return nil, fmt.Errorf("failed to verify disk tables: %w", err)
+		}
+	}
+
+	if t.flushInterval > 0 {
+		t.flushTicker = time.NewTicker(t.flushInterval)
+		t.flushStop = make(chan struct{})
+		t.flushDone = make(chan struct{})
+		go t.flushLoop()
+	}
+
+	t.logger.Printf("opened %s: MemTable bytes=%d, disk tables=%d, snapshot WAL offset=%d", dbDir, t.memTable.bytes(), diskTableNum, t.snapshotWALOffset)
+
+	return t, nil
+}
+
+// flushLoop flushes the MemTable every flush interval until the tree
+// is closed. The ticks with an empty MemTable are skipped. The flushes
+// run under the commit mutex, so they never race with the foreground
+// writes.
+func (t *LSMTree) flushLoop() {
+	defer close(t.flushDone)
+
+	for {
+		select {
+		case <-t.flushStop:
+			return
+		case <-t.flushTicker.C:
+			t.commitMu.Lock()
+			if t.memTable.keys() == 0 {
+				t.commitMu.Unlock()
+				continue
+			}
+
+			if err := t.flushMemTable(); err != nil {
+				if t.flushErr == nil {
+					t.flushErr = wrapError(ErrFlushFailed, err)
+				}
+				t.commitMu.Unlock()
+				continue
+			}
+
+			if t.diskTableNum >= t.diskTableNumThreshold {
+				if err := t.compact(); err != nil && t.flushErr == nil {
+					t.flushErr = err
+				}
+			}
+			t.commitMu.Unlock()
+		}
+	}
+}
+
+// Close closes all allocated resources. It waits for the in-flight
+// background merges and drops the queued ones. Closing an already
+// closed database does nothing, so a deferred Close alongside an
+// explicit one is safe.
+func (t *LSMTree) Close() error {
+	// the closed flag is set under the commit mutex: with the group
+	// commit the concurrent writers check it under the mutex, so they
+	// either complete before the close or observe the flag
+	t.commitMu.Lock()
+	if t.closed {
+		t.commitMu.Unlock()
+		return nil
+	}
+	t.closed = true
+	t.commitMu.Unlock()
+
+	if t.flushTicker != nil {
+		t.flushTicker.Stop()
+		close(t.flushStop)
+		// an in-flight timer-driven flush still uses the WAL and the
+		// MemTable, so the goroutine is joined before the resources
+		// are released
+		<-t.flushDone
+		if t.flushErr != nil {
+			return fmt.Errorf("background flush failed: %w", t.flushErr)
+		}
+	}
+
+	if t.compactions != nil {
+		t.compactions.close()
+		if t.compactionErr != nil {
+			return fmt.Errorf("background compaction failed: %w", t.compactionErr)
+		}
+	}
+
+	if t.compactionPool != nil {
+		t.compactionPool.deregister(t)
+		if t.compactionErr != nil {
+			return fmt.Errorf("background compaction failed: %w", t.compactionErr)
+		}
+	}
+
+	if t.compactOnClose {
+		if err := t.CompactAll(); err != nil {
+			return fmt.Errorf("failed to compact on close: %w", err)
+		}
+	}
+
+	if err := t.files.clear(); err != nil {
+		return fmt.Errorf("failed to close the cached file handles: %w", err)
+	}
+
+	t.committer.drain()
+
+	if err := t.wal.Close(); err != nil {
+		return fmt.Errorf("failed to close file %s: %w", t.wal.Name(), err)
+	}
+
+	return nil
+}
+
+// Refresh re-reads the on-disk state of the database without closing
+// and reopening the directory. It is meant for a reader that follows a
+// writer process over a shared directory: after the writer flushes,
+// Refresh makes the new disk tables and the trailing WAL records
+// visible. The disk table meta and the application metadata are
+// re-read, the MemTable is reloaded from the WAL and the caches are
+// invalidated, since the cached values may be stale.
+func (t *LSMTree) Refresh() error {
+	diskTableNum, maxDiskTableIndex, err := readDiskTableMeta(t.dbDir)
+	if err != nil {
+		return fmt.Errorf("failed to read disk table meta: %w", err)
+	}
+	t.diskTableNum = diskTableNum
+	t.maxDiskTableIndex = maxDiskTableIndex
+
+	appMeta, err := readAppMeta(t.dbDir)
+	if err != nil {
+		return fmt.Errorf("failed to read the application metadata: %w", err)
+	}
+	t.appMeta = appMeta
+
+	// the writer recreates the WAL file on every flush and WAL
+	// compaction, so the old handle may point to a removed file and
+	// the WAL is reopened instead of reread through it
+	walPath := path.Join(t.dbDir, walFileName)
+	wal, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", walPath, err)
+	}
+
+	t.committer.drain()
+	if err := t.wal.Close(); err != nil {
+		return fmt.Errorf("failed to close file %s: %w", t.wal.Name(), err)
+	}
+	t.wal = wal
+
+	walStat, err := wal.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file %s: %w", walPath, err)
+	}
+	t.walSize = int(walStat.Size())
+
+	if !t.skipWALReplay {
+		memTable, snapshotWALOffset, err := loadMemTableWithSnapshot(t.dbDir, wal)
+		if err != nil {
+			return fmt.Errorf("failed to load entries from %s: %w", walPath, err)
+		}
+
+		t.memTable = memTable
+		t.snapshotWALOffset = snapshotWALOffset
+	}
+
+	if t.arenaBlockSize > 0 {
+		t.memTable.arena = newArena(t.arenaBlockSize)
+	}
+
+	t.cache.clear()
+	if err := t.files.clear(); err != nil {
+		return fmt.Errorf("failed to close the cached file handles: %w", err)
+	}
+
+	return nil
+}
+
+// Put puts the key into the db.
+func (t *LSMTree) Put(key []byte, value []byte) error {
+	// with the group commit the concurrent callers are supported and
+	// the closed flag changes under the commit mutex, so putGrouped
+	// checks it there instead
+	if t.committer == nil && t.closed {
+		return ErrClosed
+	}
+
+	if len(key) == 0 {
+		return ErrKeyRequired
+	} else if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+
+	// the hook runs before the WAL append, so the rejected writes
+	// never touch the WAL, and the transformed value is validated
+	// in place of the original one
+	if t.beforePut != nil {
+		transformed, err := t.beforePut(key, value)
+		if err != nil {
+			return fmt.Errorf("the write is rejected by the BeforePut hook: %w", err)
+		}
+		value = transformed
+	}
+
+	if len(value) == 0 {
+		return ErrValueRequired
+	}
+
+	// the values that look like a chunk marker are stored as a single
+	// chunk, so Get never mistakes them for one
+	if t.chunkLargeValues && (uint64(len(value)) > MaxValueSize || isChunkMarker(value)) {
+		return t.putChunked(key, value)
+	}
+
+	if uint64(len(value)) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+
+	return t.put(key, value)
+}
+
+// put writes the key and the value without the chunk routing of Put.
+// The key and the value must already be validated.
+func (t *LSMTree) put(key []byte, value []byte) error {
+	if t.committer != nil {
+		return t.putGrouped(key, value)
+	}
+
+	// the write runs under the commit mutex, so a timer-driven flush
+	// of flushLoop never observes the MemTable and the WAL mid-write
+	t.commitMu.Lock()
+	defer t.commitMu.Unlock()
+
+	if t.skipWALReplay {
+		return ErrWALNotReplayed
+	}
+
+	if t.writeStallThreshold > 0 && t.diskTableNum >= t.writeStallThreshold {
+		return ErrWriteStall
+	}
+
+	if err := t.retrier.do(func() error { return appendToWAL(t.wal, key, value, t.walChecksum) }); err != nil {
+		return wrapError(ErrWALWrite, fmt.Errorf("failed to append to file %s: %w", t.wal.Name(), err))
+	}
+	t.walSize += t.walRecordLen(key, value)
+	t.stats.BytesWrittenWAL += t.walRecordLen(key, value)
+	t.stats.UserBytesWritten += len(key) + len(value)
+
+	t.memTable.put(key, value)
+	t.cache.invalidate(key)
+
+	if err := t.compactWALIfNeeded(); err != nil {
+		return fmt.Errorf("failed to compact the WAL file: %w", err)
+	}
+
+	if err := t.snapshotMemTableIfNeeded(); err != nil {
+		return fmt.Errorf("failed to snapshot the MemTable: %w", err)
+	}
+
+	if !t.manualFlush && t.flushSize() >= t.memTableThreshold {
+		if err := t.flushMemTable(); err != nil {
+			return wrapError(ErrFlushFailed, err)
+		}
+	}
+
+	if t.diskTableNum >= t.diskTableNumThreshold {
+		if err := t.compact(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// putGrouped writes the key and the value under the group commit: the
+// WAL record is appended without an fsync, the in-memory state changes
+// under the mutex, and the fsync is shared with the concurrent writers
+// through the committer. A write that triggers a flush needs no WAL
+// fsync of its own, since the flushed disk table is synced already.
+func (t *LSMTree) putGrouped(key []byte, value []byte) error {
+	t.commitMu.Lock()
+
+	if t.closed {
+		t.commitMu.Unlock()
+		return ErrClosed
+	}
+
+	if t.skipWALReplay {
+		t.commitMu.Unlock()
+		return ErrWALNotReplayed
+	}
+
+	if t.writeStallThreshold > 0 && t.diskTableNum >= t.writeStallThreshold {
+		t.commitMu.Unlock()
+		return ErrWriteStall
+	}
+
+	if err := t.retrier.do(func() error { return writeToWAL(t.wal, key, value, t.walChecksum) }); err != nil {
+		t.commitMu.Unlock()
+		return wrapError(ErrWALWrite, fmt.Errorf("failed to append to file %s: %w", t.wal.Name(), err))
+	}
+	t.walSize += t.walRecordLen(key, value)
+	t.stats.BytesWrittenWAL += t.walRecordLen(key, value)
+	t.stats.UserBytesWritten += len(key) + len(value)
+
+	t.memTable.put(key, value)
+	t.cache.invalidate(key)
+
+	return t.finishGrouped()
+}
+
+// finishGrouped runs the maintenance steps of a grouped write and
+// either commits the record through the committer or completes right
+// away if a flush made it durable. The commit mutex must be held and
+// is released before the blocking commit wait, so the concurrent
+// writers keep filling the batch.
+func (t *LSMTree) finishGrouped() error {
+	if err := t.compactWALIfNeeded(); err != nil {
+		t.commitMu.Unlock()
+		return fmt.Errorf("failed to compact the WAL file: %w", err)
+	}
+
+	if err := t.snapshotMemTableIfNeeded(); err != nil {
+		t.commitMu.Unlock()
+		return fmt.Errorf("failed to snapshot the MemTable: %w", err)
+	}
+
+	if !t.manualFlush && t.flushSize() >= t.memTableThreshold {
+		if err := t.flushMemTable(); err != nil {
+			t.commitMu.Unlock()
+			return wrapError(ErrFlushFailed, err)
+		}
+
+		if t.diskTableNum >= t.diskTableNumThreshold {
+			if err := t.compact(); err != nil {
+				t.commitMu.Unlock()
+				return err
+			}
+		}
+
+		t.commitMu.Unlock()
+		return nil
+	}
+
+	// the waiter is enqueued under the mutex, so a WAL rotation or a
+	// close never misses it, and the blocking wait runs after the
+	// release, so the concurrent writers keep filling the batch
+	done := t.committer.enqueue(t.wal)
+	t.commitMu.Unlock()
+
+	return <-done
+}
+
+// walRecordLen returns the number of bytes a WAL record for the key
+// and the value takes with the current options. The records streamed
+// with PutStream are never checksummed, so they are accounted with
+// timestampedLen directly.
+func (t *LSMTree) walRecordLen(key []byte, value []byte) int {
+	if t.walChecksum {
+		// plus the 4 bytes of the CRC-32 checksum
+		return timestampedLen(key, value) + 4
+	}
+
+	return timestampedLen(key, value)
+}
+
+// PutStream puts the key with the value streamed from the reader into
+// the db. Exactly size bytes are read from the reader. The value is
+// streamed into the WAL without buffering it first, but the MemTable
+// still holds a copy of the value in memory until the next flush.
+// Unlike Put, the write is not retried on transient I/O errors, since
+// a failed attempt has already consumed part of the reader.
+func (t *LSMTree) PutStream(key []byte, value io.Reader, size int) error {
+	if len(key) == 0 {
+		return ErrKeyRequired
+	} else if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	} else if size <= 0 {
+		return ErrValueRequired
+	} else if uint64(size) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+
+	if t.skipWALReplay {
+		return ErrWALNotReplayed
+	}
+
+	// the write runs under the commit mutex, like put, so it never
+	// races with a timer-driven flush of flushLoop
+	t.commitMu.Lock()
+	defer t.commitMu.Unlock()
+
+	if t.writeStallThreshold > 0 && t.diskTableNum >= t.writeStallThreshold {
+		return ErrWriteStall
+	}
+
+	// the MemTable needs its own copy of the value,
+	// so it is captured while the WAL write streams by
+	var buffered bytes.Buffer
+	buffered.Grow(size)
+
+	if err := appendToWALFrom(t.wal, key, io.TeeReader(value, &buffered), size); err != nil {
+		return wrapError(ErrWALWrite, fmt.Errorf("failed to append to file %s: %w", t.wal.Name(), err))
+	}
+	t.walSize += timestampedLen(key, nil) + size
+	t.stats.BytesWrittenWAL += timestampedLen(key, nil) + size
+	t.stats.UserBytesWritten += len(key) + size
+
+	t.memTable.put(key, buffered.Bytes())
+	t.cache.invalidate(key)
+
+	if err := t.compactWALIfNeeded(); err != nil {
+		return fmt.Errorf("failed to compact the WAL file: %w", err)
+	}
+
+	if err := t.snapshotMemTableIfNeeded(); err != nil {
+		return fmt.Errorf("failed to snapshot the MemTable: %w", err)
+	}
+
+	if !t.manualFlush && t.flushSize() >= t.memTableThreshold {
+		if err := t.flushMemTable(); err != nil {
+			return wrapError(ErrFlushFailed, err)
+		}
+	}
+
+	if t.diskTableNum >= t.diskTableNumThreshold {
+		if err := t.compact(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compact picks the disk tables to merge according to the compaction
+// strategy and merges them, either synchronously or in the background
+// if MaxConcurrentCompactions is set.
+func (t *LSMTree) compact() error {
+	// a pending background merge works off the run it picked when it
+	// was scheduled; picking another run from the same disk state
+	// would merge overlapping table ranges, so the next merge waits
+	// for the threshold check of a later flush instead
+	if t.compactions != nil && t.compactions.pending() {
+		return nil
+	}
+	if t.compactionPool != nil && t.compactionPool.busy(t) {
+		return nil
+	}
+
+	var run []int
+	if t.compactionStrategy == CompactionSizeTiered {
+		picked, err := pickSizeTieredRun(t.dbDir, t.maxDiskTableIndex)
+		if err != nil {
+			return fmt.Errorf("failed to pick disk tables to merge: %w", err)
+		}
+
+		run = picked
+	} else if t.compactionStrategy == CompactionTombstoneDensity {
+		picked, scores, err := pickTombstoneRun(t.dbDir, t.maxDiskTableIndex)
+		if err != nil {
+			return fmt.Errorf("failed to pick disk tables to merge: %w", err)
+		}
+
+		run = picked
+		t.compactionScores = scores
+	} else {
+		oldest := t.maxDiskTableIndex - t.diskTableNum + 1
+		run = []int{oldest, oldest + 1}
+	}
+
+	if len(run) < 2 {
+		return nil
+	}
+
+	// the tombstones are dropped only when the merge includes the
+	// oldest disk table, so the deleted keys are never resurrected
+	// by the values still stored in the older tables
+	indexes, err := listDiskTables(t.dbDir, t.maxDiskTableIndex)
+	if err != nil {
+		return fmt.Errorf("failed to list disk tables: %w", err)
+	}
+	dropTombstones := len(indexes) > 0 && run[0] == indexes[0]
+
+	newDiskTableNum := t.diskTableNum - (len(run) - 1)
+
+	merge := func() (int, int, error) {
+		start := time.Now()
+		t.logger.Printf("merge started: disk tables=%v", run)
+
+		n, tables, err := mergeDiskTableRun(t.dbDir, run, t.sparseKeyDistance, t.sparseByteDistance, dropTombstones, t.tables, t.checksumMode != ChecksumOff, t.blockAlign, t.maxTableBytes, t.compactionRateLimiter, t.conflictResolver)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to merge disk tables: %w", err)
+		}
+
+		t.logger.Printf("merge finished: disk tables=%v, duration=%s", run, time.Since(start))
+
+		return n, tables, nil
+	}
+
+	if t.compactionPool != nil || t.compactions != nil {
+		// the worker publishes the results back under the commit
+		// mutex once the merge finishes, the split adjustment of the
+		// disk table number included
+		t.diskTableNum = newDiskTableNum
+		if t.compactionPool != nil {
+			t.compactionPool.schedule(t, func() { t.publishMerge(merge()) })
+		} else {
+			t.compactions.schedule(func() { t.publishMerge(merge()) })
+		}
+
+		return nil
+	}
+
+	n, tables, err := merge()
+	if err != nil {
+		return err
+	}
+	t.stats.BytesWrittenMerge += n
+
+	// a split merge fills more than one index slot of the run
+	t.diskTableNum = newDiskTableNum + tables - 1
+
+	if err := updateDiskTableMeta(t.dbDir, t.diskTableNum, t.maxDiskTableIndex); err != nil {
+		return fmt.Errorf("failed to update disk table meta: %w", err)
+	}
+	t.cache.clear()
+
+	return nil
+}
+
+// publishMerge applies the results of a finished background merge to
+// the tree: the merge statistics, the split adjustment of the disk
+// table number, the meta file and the cleared value cache. It runs on
+// the worker goroutine, so the shared state changes under the commit
+// mutex that guards it on the foreground write path.
+func (t *LSMTree) publishMerge(n int, tables int, err error) {
+	t.commitMu.Lock()
+	defer t.commitMu.Unlock()
+
+	if err == nil {
+		t.stats.BytesWrittenMerge += n
+
+		// a split merge fills more than one index slot of the run
+		t.diskTableNum += tables - 1
+
+		if metaErr := updateDiskTableMeta(t.dbDir, t.diskTableNum, t.maxDiskTableIndex); metaErr != nil {
+			err = fmt.Errorf("failed to update disk table meta: %w", metaErr)
+		}
+		t.cache.clear()
+	}
+
+	if err != nil && t.compactionErr == nil {
+		t.compactionErr = err
+	}
+}
+
+// Flush flushes the MemTable onto the disk and clears it. It does
+// nothing if the MemTable is empty. If the disk table number passes
+// the threshold after the flush, the disk tables are compacted.
+func (t *LSMTree) Flush() error {
+	if t.skipWALReplay {
+		return ErrWALNotReplayed
+	}
+
+	// the flush runs under the commit mutex, so it never races with
+	// a timer-driven flush of flushLoop
+	t.commitMu.Lock()
+	defer t.commitMu.Unlock()
+
+	if err := t.flushMemTable(); err != nil {
+		return wrapError(ErrFlushFailed, err)
+	}
+
+	if t.diskTableNum >= t.diskTableNumThreshold {
+		if err := t.compact(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FlushAndWait flushes the MemTable and waits for the background
+// merges the flush may have scheduled, so on return the disk tables
+// and the meta file fully reflect the flushed records. With the
+// synchronous compaction it is equivalent to Flush.
+func (t *LSMTree) FlushAndWait() error {
+	if err := t.Flush(); err != nil {
+		return err
+	}
+
+	if t.compactions != nil {
+		t.compactions.wait()
+	}
+	if t.compactionPool != nil {
+		t.compactionPool.wait(t)
+	}
+
+	if t.compactionErr != nil {
+		return fmt.Errorf("background compaction failed: %w", t.compactionErr)
+	}
+
+	return nil
+}
+
+// CompactAll merges all disk tables into a single one. It runs
+// synchronously and does nothing if the database holds fewer than
+// two disk tables.
+func (t *LSMTree) CompactAll() error {
+	run, err := listDiskTables(t.dbDir, t.maxDiskTableIndex)
+	if err != nil {
+		return fmt.Errorf("failed to list disk tables: %w", err)
+	}
+	if len(run) < 2 {
+		return nil
+	}
+
+	start := time.Now()
+	t.logger.Printf("full merge started: disk tables=%v", run)
+
+	// the run includes the oldest disk table, so the tombstones
+	// are safe to drop
+	n, tables, err := mergeDiskTableRun(t.dbDir, run, t.sparseKeyDistance, t.sparseByteDistance, true, t.tables, t.checksumMode != ChecksumOff, t.blockAlign, t.maxTableBytes, t.compactionRateLimiter, t.conflictResolver)
+	if err != nil {
+		return fmt.Errorf("failed to merge disk tables: %w", err)
+	}
+	t.stats.BytesWrittenMerge += n
+
+	if err := updateDiskTableMeta(t.dbDir, tables, t.maxDiskTableIndex); err != nil {
+		return fmt.Errorf("failed to update disk table meta: %w", err)
+	}
+	t.diskTableNum = tables
+	t.cache.clear()
+
+	t.logger.Printf("full merge finished: disk tables=%v, duration=%s", run, time.Since(start))
+
+	return nil
+}
+
+// CompactFor merges the disk tables pair by pair, oldest first, until
+// the budget elapses. The merge in progress when the budget runs out
+// is finished cleanly, so no partial tables are left behind, and the
+// remaining tables are left for the next maintenance window. It runs
+// synchronously and does nothing if the database holds fewer than
+// two disk tables.
+func (t *LSMTree) CompactFor(d time.Duration) error {
+	deadline := time.Now().Add(d)
+
+	for {
+		run, err := listDiskTables(t.dbDir, t.maxDiskTableIndex)
+		if err != nil {
+			return fmt.Errorf("failed to list disk tables: %w", err)
+		}
+		if len(run) < 2 || !time.Now().Before(deadline) {
+			return nil
+		}
+
+		start := time.Now()
+		t.logger.Printf("budgeted merge started: disk tables=%v", run[:2])
+
+		// the pair includes the oldest disk table, so the tombstones
+		// are safe to drop
+		n, tables, err := mergeDiskTableRun(t.dbDir, run[:2], t.sparseKeyDistance, t.sparseByteDistance, true, t.tables, t.checksumMode != ChecksumOff, t.blockAlign, t.maxTableBytes, t.compactionRateLimiter, t.conflictResolver)
+		if err != nil {
+			return fmt.Errorf("failed to merge disk tables: %w", err)
+		}
+		t.stats.BytesWrittenMerge += n
+
+		if err := updateDiskTableMeta(t.dbDir, t.diskTableNum-2+tables, t.maxDiskTableIndex); err != nil {
+			return fmt.Errorf("failed to update disk table meta: %w", err)
+		}
+		t.diskTableNum -= 2 - tables
+		t.cache.clear()
+
+		t.logger.Printf("budgeted merge finished: disk tables=%v, duration=%s", run[:2], time.Since(start))
+	}
+}
+
+// Get the value for the key from the db.
+func (t *LSMTree) Get(key []byte) ([]byte, bool, error) {
+	if t.closed {
+		return nil, false, ErrClosed
+	}
+
+	value, exists, err := t.get(key)
+	if err != nil || !exists {
+		return value, exists, err
+	}
+
+	if t.chunkLargeValues && isChunkMarker(value) {
+		return t.getChunked(key, value)
+	}
+
+	if isIdleValue(value) {
+		return t.getIdle(key, value)
+	}
+
+	return value, true, nil
+}
+
+// get returns the value for the key without the chunk reassembly of Get.
+func (t *LSMTree) get(key []byte) ([]byte, bool, error) {
+	if value, exists := t.cache.get(key); exists {
+		return value, true, nil
+	}
+
+	value, exists := t.memTable.get(key)
+	if exists {
+		return value, value != nil, nil
+	}
+
+	// fast path: no disk tables yet, the disk search is
+	// skipped without touching the filesystem
+	if t.maxDiskTableIndex < 0 {
+		return nil, false, nil
+	}
+
+	// the search holds the read side of the swap lock, so a background
+	// merge never swaps the tables out from under it
+	t.tables.lockRead()
+	value, exists, err := searchInDiskTables(t.dbDir, t.maxDiskTableIndex, key, t.compare, t.files, t.readBufferSize, t.fetchTable, t.corruptTablePolicy, t.logger)
+	t.tables.unlockRead()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to search in DiskTables: %w", err)
+	}
+
+	if exists && value != nil {
+		t.cache.put(key, value)
+	}
+
+	// a nil value found in a disk table is a tombstone
+	return value, exists && value != nil, nil
+}
+
+// OpenValue returns a reader over the value stored for the key along
+// with the value length, so a large value is read as a stream instead
+// of being loaded into memory first. A value that still resides in the
+// MemTable is served from the in-memory copy; a value stored in a disk
+// table is streamed straight from the data file through a section
+// reader over its value region, so the record checksum is not
+// verified. The reader must be closed and consumed before the next
+// write, since a flush or a merge may remove the underlying data file.
+// The values stored in chunks by ChunkLargeValues are not reassembled.
+// It pairs with PutStream on the write side.
+func (t *LSMTree) OpenValue(key []byte) (io.ReadCloser, int, bool, error) {
+	if len(key) == 0 {
+		return nil, 0, false, ErrKeyRequired
+	}
+
+	if value, exists := t.memTable.get(key); exists {
+		// a nil value in the MemTable is a tombstone
+		if value == nil {
+			return nil, 0, false, nil
+		}
+
+		return ioutil.NopCloser(bytes.NewReader(value)), len(value), true, nil
+	}
+
+	// fast path: no disk tables yet, the disk search is
+	// skipped without touching the filesystem
+	if t.maxDiskTableIndex < 0 {
+		return nil, 0, false, nil
+	}
+
+	for index := t.maxDiskTableIndex; index >= 0; index-- {
+		reader, size, found, err := openValueInDiskTable(t.dbDir, index, key, t.compare, t.files, t.logger)
+		if errors.Is(err, ErrDiskTableMissing) {
+			// the table was merged away, the record lives
+			// in one of the newer tables
+			continue
+		}
+		if err != nil {
+			return nil, 0, false, fmt.Errorf("failed to search in disk table with index %d: %w", index, err)
+		}
+
+		if found {
+			// a found record without a reader is a tombstone
+			if reader == nil {
+				return nil, 0, false, nil
+			}
+
+			return reader, size, true, nil
+		}
+	}
+
+	return nil, 0, false, nil
+}
+
+// SearchDepth returns how many disk tables Get would consult for the
+// key before finding it, or the number of all disk tables if the key
+// is absent. A key that still resides in the MemTable has the depth
+// zero. It is useful for diagnosing the read amplification per key:
+// the higher the depth, the more tables a read of the key touches.
+func (t *LSMTree) SearchDepth(key []byte) (int, error) {
+	if _, exists := t.memTable.get(key); exists {
+		return 0, nil
+	}
+
+	depth := 0
+	for index := t.maxDiskTableIndex; index >= 0; index-- {
+		found, err := keyInDiskTable(t.dbDir, index, key, t.compare, t.files)
+		if errors.Is(err, ErrDiskTableMissing) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to search in disk table with index %d: %w", index, err)
+		}
+
+		depth++
+		if found {
+			break
+		}
+	}
+
+	return depth, nil
+}
+
+// CompareAndSwap puts the new value for the key only if the current
+// value equals the old one. If old is nil, the key must be absent.
+// Returns true if the swap happened. Since the tree is not
+// goroutine-safe, the swap is only atomic for the serialized
+// single-writer access.
+func (t *LSMTree) CompareAndSwap(key, old, new []byte) (bool, error) {
+	current, ok, err := t.Get(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to get the current value: %w", err)
+	}
+
+	if old == nil {
+		if ok {
+			return false, nil
+		}
+	} else if !ok || !bytes.Equal(current, old) {
+		return false, nil
+	}
+
+	if err := t.Put(key, new); err != nil {
+		return false, fmt.Errorf("failed to put the new value: %w", err)
+	}
+
+	return true, nil
+}
+
+// Swap puts the value for the key and returns the value the key held
+// before the write, along with whether the key existed. A deleted key
+// reads back as absent. Since the tree is not goroutine-safe, the
+// swap is only atomic for the serialized single-writer access.
+func (t *LSMTree) Swap(key []byte, value []byte) ([]byte, bool, error) {
+	old, had, err := t.Get(key)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get the current value: %w", err)
+	}
+
+	if err := t.Put(key, value); err != nil {
+		return nil, false, fmt.Errorf("failed to put the new value: %w", err)
+	}
+
+	return old, had, nil
+}
+
+// PutIfChanged puts the value for the key only if the key does not
+// already hold it, so re-putting an identical value costs a read
+// instead of a WAL record. A deleted or absent key always takes the
+// write. Returns true if the write happened.
+func (t *LSMTree) PutIfChanged(key, value []byte) (bool, error) {
+	current, ok, err := t.Get(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to get the current value: %w", err)
+	}
+
+	if ok && bytes.Equal(current, value) {
+		return false, nil
+	}
+
+	if err := t.Put(key, value); err != nil {
+		return false, fmt.Errorf("failed to put the new value: %w", err)
+	}
+
+	return true, nil
+}
+
+// GetInto returns the value for the key from the db by copying it into
+// dst instead of allocating a fresh slice on every call. The value is
+// appended to dst[:0], so dst is grown only if its capacity is not
+// enough. The returned slice shares the backing array with dst whenever
+// the capacity allows it and never aliases the internal storage of
+// the tree.
+func (t *LSMTree) GetInto(key []byte, dst []byte) ([]byte, bool, error) {
+	value, exists := t.memTable.get(key)
+	if exists {
+		if value == nil {
+			return dst[:0], false, nil
+		}
+
+		return t.appendValue(dst, key, value)
+	}
+
+	// fast path: no disk tables yet, the disk search is
+	// skipped without touching the filesystem
+	if t.maxDiskTableIndex < 0 {
+		return dst[:0], false, nil
+	}
+
+	// the search holds the read side of the swap lock, so a background
+	// merge never swaps the tables out from under it
+	t.tables.lockRead()
+	value, exists, err := searchInDiskTables(t.dbDir, t.maxDiskTableIndex, key, t.compare, t.files, t.readBufferSize, t.fetchTable, t.corruptTablePolicy, t.logger)
+	t.tables.unlockRead()
+	if err != nil {
+		return dst[:0], false, fmt.Errorf("failed to search in DiskTables: %w", err)
+	}
+	// a nil value found in a disk table is a tombstone
+	if !exists || value == nil {
+		return dst[:0], false, nil
+	}
+
+	return t.appendValue(dst, key, value)
+}
+
+// appendValue appends the value for the key to dst[:0], reassembling
+// it from the chunk records if the value is a chunk marker.
+func (t *LSMTree) appendValue(dst []byte, key []byte, value []byte) ([]byte, bool, error) {
+	if t.chunkLargeValues && isChunkMarker(value) {
+		assembled, exists, err := t.getChunked(key, value)
+		if err != nil || !exists {
+			return dst[:0], false, err
+		}
+
+		return append(dst[:0], assembled...), true, nil
+	}
+
+	return append(dst[:0], value...), true, nil
+}
+
+// Delete delete the value by key from the db.
+func (t *LSMTree) Delete(key []byte) error {
+	// with the group commit the concurrent callers are supported and
+	// the closed flag changes under the commit mutex, so deleteGrouped
+	// checks it there instead
+	if t.committer == nil && t.closed {
+		return ErrClosed
+	}
+
+	// deleting a chunked value must not leave its chunk records behind
+	if t.chunkLargeValues {
+		if err := t.deleteChunks(key); err != nil {
+			return err
+		}
+	}
+
+	return t.delete(key)
+}
+
+// delete writes the tombstone for the key without the chunk cleanup
+// of Delete.
+func (t *LSMTree) delete(key []byte) error {
+	if t.committer != nil {
+		return t.deleteGrouped(key)
+	}
+
+	// the delete runs under the commit mutex, like put, so it never
+	// races with a timer-driven flush of flushLoop
+	t.commitMu.Lock()
+	defer t.commitMu.Unlock()
+
+	if t.skipWALReplay {
+		return ErrWALNotReplayed
+	}
+
+	// the MemTable tracks the tombstones of the current generation,
+	// so a repeated delete of the same key is already persisted in
+	// the WAL and re-appending it would only grow the WAL; the flush
+	// clears the MemTable and the next delete persists again
+	if value, exists := t.memTable.get(key); exists && value == nil {
+		return nil
+	}
+
+	if err := t.retrier.do(func() error { return appendToWAL(t.wal, key, nil, t.walChecksum) }); err != nil {
+		return wrapError(ErrWALWrite, fmt.Errorf("failed to append to file %s: %w", t.wal.Name(), err))
+	}
+	t.walSize += t.walRecordLen(key, nil)
+	t.stats.BytesWrittenWAL += t.walRecordLen(key, nil)
+	t.stats.UserBytesWritten += len(key)
+
+	t.memTable.delete(key)
+	t.cache.invalidate(key)
+
+	if err := t.compactWALIfNeeded(); err != nil {
+		return fmt.Errorf("failed to compact the WAL file: %w", err)
+	}
+
+	if err := t.snapshotMemTableIfNeeded(); err != nil {
+		return fmt.Errorf("failed to snapshot the MemTable: %w", err)
+	}
+
+	return nil
+}
+
+// deleteGrouped writes the tombstone for the key under the group
+// commit, like putGrouped does for the values.
+func (t *LSMTree) deleteGrouped(key []byte) error {
+	t.commitMu.Lock()
+
+	if t.closed {
+		t.commitMu.Unlock()
+		return ErrClosed
+	}
+
+	if t.skipWALReplay {
+		t.commitMu.Unlock()
+		return ErrWALNotReplayed
+	}
+
+	// a repeated delete of the same key is already persisted
+	// in the WAL, like in delete
+	if value, exists := t.memTable.get(key); exists && value == nil {
+		t.commitMu.Unlock()
+		return nil
+	}
+
+	if err := t.retrier.do(func() error { return writeToWAL(t.wal, key, nil, t.walChecksum) }); err != nil {
+		t.commitMu.Unlock()
+		return wrapError(ErrWALWrite, fmt.Errorf("failed to append to file %s: %w", t.wal.Name(), err))
+	}
+	t.walSize += t.walRecordLen(key, nil)
+	t.stats.BytesWrittenWAL += t.walRecordLen(key, nil)
+	t.stats.UserBytesWritten += len(key)
+
+	t.memTable.delete(key)
+	t.cache.invalidate(key)
+
+	if err := t.compactWALIfNeeded(); err != nil {
+		t.commitMu.Unlock()
+		return fmt.Errorf("failed to compact the WAL file: %w", err)
+	}
+
+	if err := t.snapshotMemTableIfNeeded(); err != nil {
+		t.commitMu.Unlock()
+		return fmt.Errorf("failed to snapshot the MemTable: %w", err)
+	}
+
+	// the waiter is enqueued under the mutex, so a WAL rotation or a
+	// close never misses it, like in finishGrouped
+	done := t.committer.enqueue(t.wal)
+	t.commitMu.Unlock()
+
+	return <-done
+}
+
+// DeleteIfExists deletes the value by key from the db only if the key
+// is present and returns whether the delete occurred. Unlike Delete, it
+// does not write a tombstone for an absent or an already deleted key,
+// which saves the WAL and disk space on sparse keyspaces.
+func (t *LSMTree) DeleteIfExists(key []byte) (bool, error) {
+	_, ok, err := t.Get(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to get the current value: %w", err)
+	}
+	if !ok {
+		return false, nil
+	}
+
+	if err := t.Delete(key); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// MustDelete deletes the value by key from the db and returns
+// ErrKeyNotFound if the key is not present. Unlike DeleteIfExists, an
+// absent key is an error rather than a reported outcome, so a caller
+// that expects the key to exist does not need its own check.
+func (t *LSMTree) MustDelete(key []byte) error {
+	deleted, err := t.DeleteIfExists(key)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrKeyNotFound
+	}
+
+	return nil
+}
+
+// snapshotMemTableIfNeeded serializes the MemTable to the snapshot file
+// if the WAL has grown by the threshold since the last snapshot.
+// It does nothing if the snapshots are disabled.
+func (t *LSMTree) snapshotMemTableIfNeeded() error {
+	if t.memTableSnapshotThreshold == 0 || t.walSize-t.snapshotWALOffset < t.memTableSnapshotThreshold {
+		return nil
+	}
+
+	if err := writeMemTableSnapshot(t.dbDir, t.memTable, t.walSize); err != nil {
+		return err
+	}
+
+	t.snapshotWALOffset = t.walSize
+
+	return nil
+}
+
+// compactWALIfNeeded rewrites the WAL file to keep only the latest record
+// per key if the WAL size passes the MemTable size multiplied by the
+// compaction threshold. It does nothing if the compaction is disabled.
+func (t *LSMTree) compactWALIfNeeded() error {
+	if t.walCompactionThreshold == 0 || t.walSize <= t.walCompactionThreshold*t.memTable.bytes() {
+		return nil
+	}
+
+	// the compaction rotates the WAL file, so the in-flight group
+	// commits are waited out first
+	t.committer.drain()
+
+	newWAL, walSize, err := compactWAL(t.dbDir, t.wal, t.memTable)
+	if err != nil {
+		return err
+	}
+
+	// the snapshot offset points into the old WAL and is stale now
+	if err := removeMemTableSnapshot(t.dbDir); err != nil {
+		return err
+	}
+
+	t.wal = newWAL
+	t.walSize = walSize
+	t.snapshotWALOffset = 0
+
+	return nil
+}
+
+// ApproxMemoryBytes estimates the real memory footprint of the
+// MemTable: the raw key and value bytes plus the estimated per-entry
+// overhead of the tree nodes. The raw bytes alone understate the
+// footprint considerably for the small keys and values.
+func (t *LSMTree) ApproxMemoryBytes() int {
+	return t.memTable.bytes() + t.memTable.keys()*t.memTableEntryOverhead
+}
+
+// flushSize returns the figure the flush threshold compares against:
+// the raw MemTable bytes, or the memory-inclusive estimate when the
+// memory-aware flush is enabled.
+func (t *LSMTree) flushSize() int {
+	if t.memoryAwareFlush {
+		return t.ApproxMemoryBytes()
+	}
+
+	return t.memTable.bytes()
+}
+
+// Stats returns the cumulative write and cache counters of the tree.
+func (t *LSMTree) Stats() Stats {
+	// the counters change under the commit mutex, by the foreground
+	// writes and by the background merges publishing their results
+	t.commitMu.Lock()
+	stats := t.stats
+
+	if t.compactionScores != nil {
+		scores := make(map[int]int, len(t.compactionScores))
+		for index, score := range t.compactionScores {
+			scores[index] = score
+		}
+
+		stats.CompactionScores = scores
+	}
+	t.commitMu.Unlock()
+
+	hits, misses := t.cache.stats()
+	stats.Cache = CacheStats{ValueHits: int(hits), ValueMisses: int(misses)}
+
+	return stats
+}
+
+// BulkLoad writes the entries yielded by the iterator directly into a new
+// disk table, bypassing the WAL and the MemTable. The iterator must yield
+// keys in strictly increasing order, otherwise ErrKeysOutOfOrder is returned.
+// It is useful for the initial load of presorted data, since it avoids
+// the write amplification of repeated flushes and merges.
+func (t *LSMTree) BulkLoad(it Iterator) error {
+	newDiskTableNum := t.diskTableNum + 1
+	newDiskTableIndex := t.maxDiskTableIndex + 1
+
+	prefix := strconv.Itoa(newDiskTableIndex) + "-"
+	w, err := newDiskTableWriter(t.dbDir, prefix, t.sparseKeyDistance, t.sparseByteDistance, t.checksumMode != ChecksumOff)
+	if err != nil {
+		return fmt.Errorf("failed to create disk table writer: %w", err)
+	}
+	w.blockAlign = t.blockAlign
+
+	var prevKey []byte
+	for it.HasNext() {
+		key, value, err := it.Next()
+		if err != nil {
+			return fmt.Errorf("failed to get next entry: %w", err)
+		}
+
+		if len(key) == 0 {
+			return ErrKeyRequired
+		} else if len(key) > MaxKeySize {
+			return ErrKeyTooLarge
+		}
+
+		if t.beforePut != nil {
+			transformed, err := t.beforePut(key, value)
+			if err != nil {
+				return fmt.Errorf("the write is rejected by the BeforePut hook: %w", err)
+			}
+			value = transformed
+		}
+
+		if len(value) == 0 {
+			return ErrValueRequired
+		} else if uint64(len(value)) > MaxValueSize {
+			return ErrValueTooLarge
+		}
+
+		if prevKey != nil && t.compare(prevKey, key) >= 0 {
+			return ErrKeysOutOfOrder
+		}
+
+		if err := w.write(key, value); err != nil {
+			return fmt.Errorf("failed to write to disk table %d: %w", newDiskTableIndex, err)
+		}
+
+		prevKey = key
+	}
+
+	if err := w.sync(); err != nil {
+		return fmt.Errorf("failed to sync disk table: %w", err)
+	}
+
+	if err := w.close(); err != nil {
+		return fmt.Errorf("failed to close disk table: %w", err)
+	}
+
+	if err := updateDiskTableMeta(t.dbDir, newDiskTableNum, newDiskTableIndex); err != nil {
+		return fmt.Errorf("failed to update disk table meta: %w", err)
+	}
+
+	t.diskTableNum = newDiskTableNum
+	t.maxDiskTableIndex = newDiskTableIndex
+	t.cache.clear()
+
+	return nil
+}
+
+// flushMemTable flushes current MemTable onto the disk and clears it.
+// The function expects it to run in the synchronized block,
+// and thus it does not use any synchronization mechanisms.
+func (t *LSMTree) flushMemTable() error {
+	// the flush rotates the WAL file, so the in-flight group commits
+	// are waited out first
+	t.committer.drain()
+
+	newDiskTableNum := t.diskTableNum
+	newDiskTableIndex := t.maxDiskTableIndex
+
+	// an empty MemTable produces an empty disk table that wastes
+	// files and an index slot, so only the WAL is cleared for it
+	if t.memTable.keys() > 0 {
+		firstIndex := newDiskTableIndex + 1
+		partitions := t.flushPartitions
+		if partitions < 1 {
+			partitions = 1
+		}
+
+		start := time.Now()
+		t.logger.Printf("flush started: MemTable bytes=%d, disk table=%d", t.memTable.bytes(), firstIndex)
+
+		tables := 0
+		err := t.retrier.do(func() error {
+			n, written, err := createPartitionedDiskTables(t.memTable, t.dbDir, firstIndex, partitions, t.sparseKeyDistance, t.sparseByteDistance, t.checksumMode != ChecksumOff, t.blockAlign)
+			if err != nil {
+				return err
+			}
+
+			t.stats.BytesWrittenFlush += n
+			tables = written
+
+			return nil
+		})
+		if err != nil {
+			// a failed flush, such as running out of the disk space
+			// midway, leaves partial table files behind that a later
+			// open would read as live tables; the MemTable and the WAL
+			// are left intact, so no data is lost
+			if removeErr := removePartialDiskTables(t.dbDir, firstIndex, firstIndex+partitions-1); removeErr != nil {
+				t.logger.Printf("failed to remove the partial disk tables: %s", removeErr)
+			}
+
+			return fmt.Errorf("failed to create disk table %d: %w", firstIndex, err)
+		}
+
+		newDiskTableNum += tables
+		newDiskTableIndex = firstIndex + tables - 1
+
+		if err := updateDiskTableMeta(t.dbDir, newDiskTableNum, newDiskTableIndex); err != nil {
+			return fmt.Errorf("failed to update max disk table index %d: %w", newDiskTableIndex, err)
+		}
+
+		// the disk tables and the meta are durable at this point
+		if t.afterFlush != nil {
+			for index := firstIndex; index <= newDiskTableIndex; index++ {
+				prefix := strconv.Itoa(index) + "-"
+				files := []string{
+					diskTableFilePath(t.dbDir, prefix, diskTableDataFileName),
+					diskTableFilePath(t.dbDir, prefix, diskTableIndexFileName),
+					diskTableFilePath(t.dbDir, prefix, diskTableSparseIndexFileName),
+				}
+
+				if err := t.afterFlush(index, files); err != nil {
+					return fmt.Errorf("the after flush hook failed for disk table %d: %w", index, err)
+				}
+			}
+		}
+
+		duration := time.Since(start)
+		t.stats.FlushCount++
+		t.stats.LastFlushDuration = duration
+		t.stats.TotalFlushDuration += duration
+		t.stats.AvgBytesPerFlush = t.stats.BytesWrittenFlush / t.stats.FlushCount
+
+		t.logger.Printf("flush finished: disk table=%d, duration=%s", newDiskTableIndex, duration)
+	}
+
+	newWAL, err := clearWAL(t.dbDir, t.wal)
+	if err != nil {
+		return fmt.Errorf("failed to clear the WAL file: %w", err)
+	}
+	t.logger.Printf("WAL cleared")
+
+	// the snapshot covers the cleared WAL and is of no use anymore
+	if err := removeMemTableSnapshot(t.dbDir); err != nil {
+		return err
 	}
 
 	t.wal = newWAL
+	t.walSize = 0
+	t.snapshotWALOffset = 0
 	t.memTable.clear()
+	t.cache.clear()
 	t.diskTableNum = newDiskTableNum
 	t.maxDiskTableIndex = newDiskTableIndex
 
@@ -1,12 +1,20 @@
 package lsmtree_test
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/krasun/lsmtree"
 )
@@ -128,6 +136,3018 @@ func TestPutForErrors(t *testing.T) {
 	}
 }
 
+// sliceIterator iterates over the given entries, every entry
+// is a key followed by a value.
+type sliceIterator struct {
+	entries  [][]byte
+	position int
+}
+
+func (it *sliceIterator) HasNext() bool {
+	return it.position < len(it.entries)
+}
+
+func (it *sliceIterator) Next() ([]byte, []byte, error) {
+	key, value := it.entries[it.position], it.entries[it.position+1]
+	it.position += 2
+
+	return key, value, nil
+}
+
+func TestBulkLoad(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	entries := make([][]byte, 0, 200000)
+	for i := 0; i < 100000; i++ {
+		key := fmt.Sprintf("key-%06d", i)
+		value := fmt.Sprintf("value-%06d", i)
+		entries = append(entries, []byte(key), []byte(value))
+	}
+
+	if err := tree.BulkLoad(&sliceIterator{entries: entries}); err != nil {
+		t.Fatalf("failed to bulk load: %s", err)
+	}
+
+	for i := 0; i < 100000; i += 1000 {
+		key := fmt.Sprintf("key-%06d", i)
+		value, ok, err := tree.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !ok {
+			t.Fatalf("key must be present %s, but it is not", key)
+		}
+
+		expectedValue := fmt.Sprintf("value-%06d", i)
+		if expectedValue != string(value) {
+			t.Fatalf("value is wrong for key %s: %s != %s", key, expectedValue, value)
+		}
+	}
+
+	unsorted := [][]byte{
+		[]byte("b"), []byte("vb"),
+		[]byte("a"), []byte("va"),
+	}
+	if err := tree.BulkLoad(&sliceIterator{entries: unsorted}); !errors.Is(err, lsmtree.ErrKeysOutOfOrder) {
+		t.Fatalf("expected %v, but got %v", lsmtree.ErrKeysOutOfOrder, err)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestDump(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.SparseKeyDistance(64),
+		lsmtree.MemTableThreshold(100),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for i := 1; i <= 50; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		if err := tree.Put([]byte(key), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := tree.Delete([]byte("key-001")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var dump bytes.Buffer
+	if err := tree.Dump(&dump); err != nil {
+		t.Fatalf("failed to dump: %s", err)
+	}
+	output := dump.String()
+
+	if !strings.Contains(output, "tombstone key=6b65792d303031") {
+		t.Fatalf("dump must contain a tombstone marker for the deleted key:\n%s", output)
+	}
+
+	newest := strings.Index(output, "disktable 1\n")
+	oldest := strings.Index(output, "disktable 0\n")
+	if newest == -1 || oldest == -1 {
+		t.Fatalf("dump must list both disk tables:\n%s", output)
+	}
+	if newest > oldest {
+		t.Fatalf("disk tables must be listed newest-first:\n%s", output)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+// capturingLogger records all log lines for assertions.
+type capturingLogger struct {
+	lines []string
+}
+
+func (l *capturingLogger) Printf(format string, args ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestWithLogger(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	logger := &capturingLogger{}
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.MemTableThreshold(100),
+		lsmtree.WithLogger(logger),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for i := 1; i <= 20; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		if err := tree.Put([]byte(key), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	flushLogged := false
+	for _, line := range logger.lines {
+		if strings.Contains(line, "flush started") {
+			flushLogged = true
+		}
+	}
+	if !flushLogged {
+		t.Fatalf("flush must be logged when the threshold is crossed, logged lines: %v", logger.lines)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestGetWithoutDiskTables(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil && !os.IsNotExist(err) {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	if err := tree.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the database has no disk tables, so Get must not touch
+	// the filesystem at all, even after the directory is gone
+	if err := os.RemoveAll(dbDir); err != nil {
+		t.Fatalf("failed to remove %s: %s", dbDir, err)
+	}
+
+	value, ok, err := tree.Get([]byte("key"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok || string(value) != "value" {
+		t.Fatalf("value is wrong: %s", value)
+	}
+
+	_, ok, err = tree.Get([]byte("missing"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ok {
+		t.Fatalf("key must be absent, but it is not")
+	}
+}
+
+func TestSizeTieredCompaction(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.SparseKeyDistance(64),
+		lsmtree.MemTableThreshold(100),
+		lsmtree.DiskTableNumThreshold(3),
+		lsmtree.CompactionStrategy(lsmtree.CompactionSizeTiered),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for i := 1; i <= 500; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		value := fmt.Sprintf("value-%04d", i)
+		if err := tree.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	dataFiles, err := filepath.Glob(filepath.Join(dbDir, "*-data.db"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(dataFiles) > 3 {
+		t.Fatalf("disk table number is not bounded: %d > 3", len(dataFiles))
+	}
+
+	for i := 1; i <= 500; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		value, ok, err := tree.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !ok {
+			t.Fatalf("key must be present %s, but it is not", key)
+		}
+
+		expectedValue := fmt.Sprintf("value-%04d", i)
+		if expectedValue != string(value) {
+			t.Fatalf("value is wrong for key %s: %s != %s", key, expectedValue, value)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	// the key is absent, old value must be nil for the swap to happen
+	swapped, err := tree.CompareAndSwap([]byte("key"), []byte("other"), []byte("value"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if swapped {
+		t.Fatalf("swap must not happen for the absent key")
+	}
+
+	swapped, err = tree.CompareAndSwap([]byte("key"), nil, []byte("value"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !swapped {
+		t.Fatalf("swap must happen for the absent key and nil old value")
+	}
+
+	// the key is present, the old value must match
+	swapped, err = tree.CompareAndSwap([]byte("key"), []byte("other"), []byte("new value"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if swapped {
+		t.Fatalf("swap must not happen for the mismatched old value")
+	}
+
+	swapped, err = tree.CompareAndSwap([]byte("key"), []byte("value"), []byte("new value"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !swapped {
+		t.Fatalf("swap must happen for the matched old value")
+	}
+
+	value, ok, err := tree.Get([]byte("key"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok || string(value) != "new value" {
+		t.Fatalf("value is wrong after the swap: %s", value)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestSwap(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	// the first write, there is no previous value
+	old, had, err := tree.Swap([]byte("key"), []byte("value"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if had || old != nil {
+		t.Fatalf("the first write must return no previous value, got %s", old)
+	}
+
+	// the overwrite must return the prior value
+	old, had, err = tree.Swap([]byte("key"), []byte("new value"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !had || string(old) != "value" {
+		t.Fatalf("the overwrite must return the prior value, got %s", old)
+	}
+
+	// a deleted key reads back as absent
+	if err := tree.Delete([]byte("key")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	old, had, err = tree.Swap([]byte("key"), []byte("resurrected"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if had || old != nil {
+		t.Fatalf("the deleted key must return no previous value, got %s", old)
+	}
+
+	value, ok, err := tree.Get([]byte("key"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok || string(value) != "resurrected" {
+		t.Fatalf("value is wrong after the swap: %s", value)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestPutIfChanged(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	// the first write always happens
+	changed, err := tree.PutIfChanged([]byte("key"), []byte("value"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !changed {
+		t.Fatal("the first write must happen")
+	}
+
+	// re-putting the same value is a no-op, the WAL does not grow
+	walBefore := tree.Stats().BytesWrittenWAL
+	changed, err = tree.PutIfChanged([]byte("key"), []byte("value"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if changed {
+		t.Fatal("re-putting the same value must be a no-op")
+	}
+	if walAfter := tree.Stats().BytesWrittenWAL; walAfter != walBefore {
+		t.Fatalf("the no-op write must not grow the WAL: %d != %d", walAfter, walBefore)
+	}
+
+	// a different value takes the write
+	changed, err = tree.PutIfChanged([]byte("key"), []byte("new value"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !changed {
+		t.Fatal("a different value must take the write")
+	}
+
+	// a tombstone counts as changed even for the same value
+	if err := tree.Delete([]byte("key")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	changed, err = tree.PutIfChanged([]byte("key"), []byte("new value"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !changed {
+		t.Fatal("the write after the delete must happen")
+	}
+
+	value, ok, err := tree.Get([]byte("key"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok || string(value) != "new value" {
+		t.Fatalf("value is wrong after the writes: %s", value)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestBeforePutHook(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	rejected := errors.New("keys with the forbidden prefix are rejected")
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.BeforePut(func(key, value []byte) ([]byte, error) {
+			if bytes.HasPrefix(key, []byte("forbidden")) {
+				return nil, rejected
+			}
+
+			// the stored values are transformed to upper case
+			return bytes.ToUpper(value), nil
+		}),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	// the rejected write must abort before touching the WAL
+	if err := tree.Put([]byte("forbidden-key"), []byte("value")); !errors.Is(err, rejected) {
+		t.Fatalf("the put must be rejected by the hook, got: %s", err)
+	}
+	if wal := tree.Stats().BytesWrittenWAL; wal != 0 {
+		t.Fatalf("the rejected write must not touch the WAL, but it wrote %d bytes", wal)
+	}
+
+	if _, ok, err := tree.Get([]byte("forbidden-key")); err != nil || ok {
+		t.Fatalf("the rejected key must be absent: %v, %s", ok, err)
+	}
+
+	// the transforming hook stores the transformed value
+	if err := tree.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	value, ok, err := tree.Get([]byte("key"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok || string(value) != "VALUE" {
+		t.Fatalf("the transformed value must be stored, got %s", value)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestGetInto(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for i := 1; i <= 100; i++ {
+		key := strconv.Itoa(i)
+		value := strconv.Itoa(i * 2)
+		if err := tree.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	buffer := make([]byte, 0, 64)
+	for i := 1; i <= 100; i++ {
+		key := strconv.Itoa(i)
+		value, ok, err := tree.GetInto([]byte(key), buffer)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !ok {
+			t.Fatalf("key must be present %s, but it is not", key)
+		}
+
+		expectedValue := strconv.Itoa(i * 2)
+		if expectedValue != string(value) {
+			t.Fatalf("value is wrong for key %s: %s != %s", key, expectedValue, value)
+		}
+
+		buffer = value
+	}
+
+	_, ok, err := tree.GetInto([]byte("missing"), buffer)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ok {
+		t.Fatalf("key must be absent, but it is not")
+	}
+
+	key := []byte("42")
+	allocs := testing.AllocsPerRun(100, func() {
+		value, _, err := tree.GetInto(key, buffer)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		buffer = value
+	})
+	if allocs > 0 {
+		t.Fatalf("expected no allocations per get, but got %v", allocs)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestKeyIterator(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.SparseKeyDistance(64),
+		lsmtree.MemTableThreshold(100),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	expected := make([]string, 0)
+	for i := 1; i <= 100; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		err := tree.Put([]byte(key), []byte(strconv.Itoa(i*2)))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if i%2 != 0 {
+			expected = append(expected, key)
+		}
+	}
+
+	for i := 1; i <= 100; i++ {
+		if i%2 == 0 {
+			key := fmt.Sprintf("key-%03d", i)
+			if err := tree.Delete([]byte(key)); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+	}
+
+	it, err := tree.KeyIterator()
+	if err != nil {
+		t.Fatalf("failed to instantiate key iterator: %s", err)
+	}
+
+	actual := make([]string, 0)
+	for it.HasNext() {
+		key, err := it.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		actual = append(actual, string(key))
+	}
+
+	if err := it.Close(); err != nil {
+		t.Fatalf("failed to close key iterator: %s", err)
+	}
+
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("%v != %v", expected, actual)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestRange(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.SparseKeyDistance(64),
+		// flush after every other key to spread the keys
+		// over the MemTable and the disk tables
+		lsmtree.MemTableThreshold(32),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if err := tree.Put([]byte(key), []byte("v"+key)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	cases := []struct {
+		options  lsmtree.RangeOptions
+		expected []string
+	}{
+		{lsmtree.RangeOptions{StartInclusive: true, EndInclusive: false}, []string{"b", "c"}},
+		{lsmtree.RangeOptions{StartInclusive: true, EndInclusive: true}, []string{"b", "c", "d"}},
+		{lsmtree.RangeOptions{StartInclusive: false, EndInclusive: false}, []string{"c"}},
+		{lsmtree.RangeOptions{StartInclusive: false, EndInclusive: true}, []string{"c", "d"}},
+	}
+
+	for _, c := range cases {
+		it, err := tree.Range([]byte("b"), []byte("d"), c.options)
+		if err != nil {
+			t.Fatalf("failed to instantiate range iterator: %s", err)
+		}
+
+		actual := make([]string, 0)
+		for it.HasNext() {
+			entry, err := it.Next()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if expected := "v" + string(entry.Key); expected != string(entry.Value) {
+				t.Fatalf("%s != %s", expected, entry.Value)
+			}
+
+			actual = append(actual, string(entry.Key))
+		}
+
+		if err := it.Close(); err != nil {
+			t.Fatalf("failed to close range iterator: %s", err)
+		}
+
+		if !reflect.DeepEqual(c.expected, actual) {
+			t.Fatalf("options %+v: %v != %v", c.options, c.expected, actual)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestResumeScan(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.SparseKeyDistance(64),
+		// flush after every other key to spread the keys
+		// over the MemTable and the disk tables
+		lsmtree.MemTableThreshold(32),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if err := tree.Put([]byte(key), []byte("v"+key)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	cases := []struct {
+		afterKey []byte
+		expected []string
+	}{
+		// the checkpointed key itself is skipped
+		{[]byte("c"), []string{"d", "e"}},
+		// a checkpoint between the stored keys resumes at the next one
+		{[]byte("bb"), []string{"c", "d", "e"}},
+		// the last key leaves nothing to resume
+		{[]byte("e"), []string{}},
+		// a nil checkpoint scans from the first key
+		{nil, []string{"a", "b", "c", "d", "e"}},
+	}
+
+	for _, c := range cases {
+		it, err := tree.ResumeScan(c.afterKey)
+		if err != nil {
+			t.Fatalf("failed to instantiate iterator: %s", err)
+		}
+
+		actual := make([]string, 0)
+		for it.HasNext() {
+			entry, err := it.Next()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			actual = append(actual, string(entry.Key))
+		}
+
+		if err := it.Close(); err != nil {
+			t.Fatalf("failed to close iterator: %s", err)
+		}
+
+		if !reflect.DeepEqual(c.expected, actual) {
+			t.Fatalf("after %s: %v != %v", c.afterKey, c.expected, actual)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestCompactOnClose(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.SparseKeyDistance(64),
+		lsmtree.MemTableThreshold(100),
+		// keep the threshold high, so only Close compacts
+		lsmtree.DiskTableNumThreshold(64),
+		lsmtree.CompactOnClose(),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for i := 1; i <= 100; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		if err := tree.Put(key, []byte(strconv.Itoa(i*2))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+
+	dataFiles, err := filepath.Glob(filepath.Join(dbDir, "*-data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dataFiles) != 1 {
+		t.Fatalf("expected a single disk table after close, got %v", dataFiles)
+	}
+
+	tree, err = lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for i := 1; i <= 100; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		value, exists, err := tree.Get(key)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !exists {
+			t.Fatalf("key %s must exist after reopening", key)
+		}
+		if expected := strconv.Itoa(i * 2); expected != string(value) {
+			t.Fatalf("%s != %s", expected, value)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestPutStream(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	// the largest value the tree currently accepts, bump to 10 MB
+	// once values above MaxValueSize are supported
+	expected := make([]byte, lsmtree.MaxValueSize)
+	for i := range expected {
+		expected[i] = byte(i)
+	}
+
+	key := []byte("blob")
+	if err := tree.PutStream(key, bytes.NewReader(expected), len(expected)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	value, exists, err := tree.Get(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !exists {
+		t.Fatalf("key %s must exist", key)
+	}
+	if !bytes.Equal(expected, value) {
+		t.Fatalf("the read value differs from the streamed one")
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+
+	// the streamed value must be readable from the WAL after reopening
+	tree, err = lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	value, exists, err = tree.Get(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !exists {
+		t.Fatalf("key %s must exist after reopening", key)
+	}
+	if !bytes.Equal(expected, value) {
+		t.Fatalf("the read value differs from the streamed one after reopening")
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	users := tree.Namespace([]byte("users:"))
+	orders := tree.Namespace([]byte("orders:"))
+
+	for _, key := range []string{"alice", "bob"} {
+		if err := users.Put([]byte(key), []byte("u-"+key)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	for _, key := range []string{"bob", "carol"} {
+		if err := orders.Put([]byte(key), []byte("o-"+key)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// the namespaces must not see each other's keys
+	if _, exists, err := users.Get([]byte("carol")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if exists {
+		t.Fatalf("the key carol must not be visible in the users namespace")
+	}
+
+	value, exists, err := users.Get([]byte("bob"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !exists || string(value) != "u-bob" {
+		t.Fatalf("expected u-bob in the users namespace, got %s", value)
+	}
+
+	it, err := users.Scan()
+	if err != nil {
+		t.Fatalf("failed to instantiate namespace iterator: %s", err)
+	}
+
+	actual := make([]string, 0)
+	for it.HasNext() {
+		entry, err := it.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if expected := "u-" + string(entry.Key); expected != string(entry.Value) {
+			t.Fatalf("%s != %s", expected, entry.Value)
+		}
+
+		actual = append(actual, string(entry.Key))
+	}
+
+	if err := it.Close(); err != nil {
+		t.Fatalf("failed to close namespace iterator: %s", err)
+	}
+
+	if expected := []string{"alice", "bob"}; !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("%v != %v", expected, actual)
+	}
+
+	if err := users.Delete([]byte("bob")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the delete must not leak into the other namespace
+	if _, exists, err := orders.Get([]byte("bob")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if !exists {
+		t.Fatalf("the key bob must still exist in the orders namespace")
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestTypedUint64Keys(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.MemTableThreshold(128))
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	typed := tree.Typed(lsmtree.Uint64KeyCodec{})
+
+	// the naive decimal encoding would order 100 before 2 and 30,
+	// the big-endian codec must keep the numeric order
+	keys := []uint64{2, 100, 7, 30, 1000, 5}
+	for _, key := range keys {
+		if err := typed.Put(key, []byte(strconv.FormatUint(key, 10))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	value, exists, err := typed.Get(uint64(100))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !exists || string(value) != "100" {
+		t.Fatalf("expected 100, got %s", value)
+	}
+
+	if err := typed.Delete(uint64(7)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	it, err := typed.Range(uint64(2), uint64(1000), lsmtree.RangeOptions{StartInclusive: true, EndInclusive: true})
+	if err != nil {
+		t.Fatalf("failed to instantiate typed iterator: %s", err)
+	}
+
+	actual := make([]uint64, 0)
+	for it.HasNext() {
+		entry, err := it.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		actual = append(actual, entry.Key.(uint64))
+	}
+
+	if err := it.Close(); err != nil {
+		t.Fatalf("failed to close typed iterator: %s", err)
+	}
+
+	if expected := []uint64{2, 5, 30, 100, 1000}; !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("%v != %v", expected, actual)
+	}
+
+	// the codec must reject keys of the wrong type
+	if err := typed.Put("not a number", []byte("value")); err == nil {
+		t.Fatalf("expected an error for the key of the wrong type")
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestAppMeta(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	if err := tree.PutMeta("schema-version", []byte("2")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := tree.Put([]byte("user-key"), []byte("user-value")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+
+	// the metadata must survive the reopen
+	tree, err = lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	value, exists := tree.GetMeta("schema-version")
+	if !exists || string(value) != "2" {
+		t.Fatalf("expected the schema version 2, got %s, exists = %v", value, exists)
+	}
+	if _, exists := tree.GetMeta("unknown"); exists {
+		t.Fatalf("the unknown metadata entry must not exist")
+	}
+
+	// the metadata must not leak into the LSM keyspace
+	it, err := tree.Range(nil, nil, lsmtree.DefaultRangeOptions)
+	if err != nil {
+		t.Fatalf("failed to instantiate iterator: %s", err)
+	}
+	for it.HasNext() {
+		entry, err := it.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if string(entry.Key) != "user-key" {
+			t.Fatalf("unexpected key in the scan: %s", entry.Key)
+		}
+	}
+	if err := it.Close(); err != nil {
+		t.Fatalf("failed to close iterator: %s", err)
+	}
+
+	if err := tree.DeleteMeta("schema-version"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, exists := tree.GetMeta("schema-version"); exists {
+		t.Fatalf("the deleted metadata entry must not exist")
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	// spread the keys and a tombstone across several disk tables
+	for i := 0; i < 20; i++ {
+		key := strconv.Itoa(i)
+		if err := tree.Put([]byte(key), []byte("v"+key)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if i%5 == 4 {
+			if err := tree.Flush(); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+	}
+	if err := tree.Delete([]byte("7")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	before, err := tree.Fingerprint()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the compaction rewrites the layout and drops the tombstone, but
+	// the live contents and the fingerprint stay the same
+	if err := tree.CompactAll(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	after, err := tree.Fingerprint()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if before != after {
+		t.Fatalf("the fingerprint must not depend on the layout: %d != %d", before, after)
+	}
+
+	if err := tree.Put([]byte("3"), []byte("changed")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	changed, err := tree.Fingerprint()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if changed == before {
+		t.Fatalf("the fingerprint must change with the contents")
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestChangesSince(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+	defer tree.Close()
+
+	if err := tree.Put([]byte("a"), []byte("va")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := tree.Put([]byte("b"), []byte("vb")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the checkpoint is the largest sequence seen so far
+	var checkpoint uint64
+	count := 0
+	err = tree.ChangesSince(0, func(key, value []byte, deleted bool, seq uint64) error {
+		if seq <= checkpoint {
+			return fmt.Errorf("the sequences must ascend, but got %d after %d", seq, checkpoint)
+		}
+		checkpoint = seq
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 changes, but got %d", count)
+	}
+
+	if err := tree.Put([]byte("c"), []byte("vc")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := tree.Delete([]byte("a")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	type change struct {
+		key     string
+		value   string
+		deleted bool
+	}
+	changes := make([]change, 0)
+	last := checkpoint
+	err = tree.ChangesSince(checkpoint, func(key, value []byte, deleted bool, seq uint64) error {
+		if seq <= last {
+			return fmt.Errorf("the sequences must ascend, but got %d after %d", seq, last)
+		}
+		last = seq
+		changes = append(changes, change{string(key), string(value), deleted})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []change{{"c", "vc", false}, {"a", "", true}}
+	if !reflect.DeepEqual(expected, changes) {
+		t.Fatalf("%v != %v", expected, changes)
+	}
+}
+
+func TestOpenValue(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+	defer tree.Close()
+
+	large := make([]byte, 50000)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+
+	if err := tree.PutStream([]byte("large"), bytes.NewReader(large), len(large)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	if err := tree.Put([]byte("small"), []byte("in-memory")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the large value is streamed from the data file in chunks
+	reader, size, exists, err := tree.OpenValue([]byte("large"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !exists {
+		t.Fatalf("the large value must exist")
+	}
+	if size != len(large) {
+		t.Fatalf("expected size %d, but got %d", len(large), size)
+	}
+
+	streamed := make([]byte, 0, size)
+	chunk := make([]byte, 1024)
+	for {
+		n, err := reader.Read(chunk)
+		streamed = append(streamed, chunk[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read the value: %s", err)
+		}
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatalf("failed to close the reader: %s", err)
+	}
+
+	if !bytes.Equal(large, streamed) {
+		t.Fatalf("the streamed value does not match the written bytes")
+	}
+
+	// the small value is served from the MemTable
+	reader, size, exists, err = tree.OpenValue([]byte("small"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !exists || size != len("in-memory") {
+		t.Fatalf("expected the in-memory value of size %d, got %v, %d", len("in-memory"), exists, size)
+	}
+	streamed, err = ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read the value: %s", err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatalf("failed to close the reader: %s", err)
+	}
+	if string(streamed) != "in-memory" {
+		t.Fatalf("expected in-memory, but got %s", streamed)
+	}
+
+	// a missing key reports no value
+	if _, _, exists, err := tree.OpenValue([]byte("missing")); err != nil || exists {
+		t.Fatalf("the missing key must not exist, got %v, %v", exists, err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	writer, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+	defer writer.Close()
+
+	if err := writer.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	reader, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+	defer reader.Close()
+
+	if value, exists, err := reader.Get([]byte("a")); err != nil || !exists || string(value) != "1" {
+		t.Fatalf("expected a=1, got %s, %v, %v", value, exists, err)
+	}
+
+	// the writer flushes a new disk table and leaves a record
+	// in the WAL
+	if err := writer.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	if err := writer.Put([]byte("c"), []byte("3")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the stale reader does not see the new disk table yet
+	if _, exists, err := reader.Get([]byte("b")); err != nil || exists {
+		t.Fatalf("b must not be visible before Refresh, got %v, %v", exists, err)
+	}
+
+	if err := reader.Refresh(); err != nil {
+		t.Fatalf("failed to refresh: %s", err)
+	}
+
+	if value, exists, err := reader.Get([]byte("b")); err != nil || !exists || string(value) != "2" {
+		t.Fatalf("expected b=2 after Refresh, got %s, %v, %v", value, exists, err)
+	}
+	if value, exists, err := reader.Get([]byte("c")); err != nil || !exists || string(value) != "3" {
+		t.Fatalf("expected c=3 after Refresh, got %s, %v, %v", value, exists, err)
+	}
+}
+
+func TestManualFlush(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.MemTableThreshold(100),
+		lsmtree.ManualFlush(),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	// writes far beyond the MemTable threshold
+	for i := 1; i <= 100; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		if err := tree.Put(key, []byte(strconv.Itoa(i*2))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	dataFiles, err := filepath.Glob(filepath.Join(dbDir, "*-data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dataFiles) != 0 {
+		t.Fatalf("no disk tables must be created before Flush, but got %v", dataFiles)
+	}
+
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	dataFiles, err = filepath.Glob(filepath.Join(dbDir, "*-data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dataFiles) != 1 {
+		t.Fatalf("expected a single disk table after Flush, got %v", dataFiles)
+	}
+
+	for i := 1; i <= 100; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		value, exists, err := tree.Get(key)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !exists {
+			t.Fatalf("key %s must exist after the flush", key)
+		}
+		if expected := strconv.Itoa(i * 2); expected != string(value) {
+			t.Fatalf("%s != %s", expected, value)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestAppendAndGetList(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	// the low threshold forces flushes between the appends,
+	// so the list crosses the flush boundary
+	tree, err := lsmtree.Open(dbDir, lsmtree.MemTableThreshold(64))
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	key := []byte("list")
+	expected := make([][]byte, 0)
+	for i := 1; i <= 20; i++ {
+		element := []byte(fmt.Sprintf("element-%02d", i))
+		if err := tree.Append(key, element); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		expected = append(expected, element)
+	}
+
+	actual, err := tree.GetList(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("%s != %s", expected, actual)
+	}
+
+	if elements, err := tree.GetList([]byte("absent")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if elements != nil {
+		t.Fatalf("expected nil for an absent key, got %s", elements)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestRangeWithTombstones(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.ManualFlush())
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := tree.Put([]byte(key), []byte("v"+key)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := tree.Delete([]byte("b")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the flush stores the tombstone in a raw disk table
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	it, err := tree.Range(nil, nil, lsmtree.RangeOptions{
+		StartInclusive:    true,
+		IncludeTombstones: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to instantiate range iterator: %s", err)
+	}
+
+	entries := make([]lsmtree.Entry, 0)
+	for it.HasNext() {
+		entry, err := it.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if err := it.Close(); err != nil {
+		t.Fatalf("failed to close range iterator: %s", err)
+	}
+
+	expected := []lsmtree.Entry{
+		{Key: []byte("a"), Value: []byte("va")},
+		{Key: []byte("b"), Tombstone: true},
+		{Key: []byte("c"), Value: []byte("vc")},
+	}
+	if !reflect.DeepEqual(expected, entries) {
+		t.Fatalf("%v != %v", expected, entries)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestValueCacheInvalidation(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.ManualFlush(),
+		lsmtree.ValueCacheBytes(1024),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	if err := tree.Put([]byte("a"), []byte("va1")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// move the value to a disk table, so Get populates the cache
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	if value, _, err := tree.Get([]byte("a")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(value) != "va1" {
+		t.Fatalf("expected va1, got %s", value)
+	}
+
+	// the overwrite must invalidate the cached value
+	if err := tree.Put([]byte("a"), []byte("va2")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if value, _, err := tree.Get([]byte("a")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(value) != "va2" {
+		t.Fatalf("expected va2 after the overwrite, got %s", value)
+	}
+
+	// cache the disk value again and delete the key
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	if _, _, err := tree.Get([]byte("a")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := tree.Delete([]byte("a")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, exists, err := tree.Get([]byte("a")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if exists {
+		t.Fatalf("the deleted key a must not be served from the cache")
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestWriteStall(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.MemTableThreshold(20),
+		// keep the merge threshold high, so the disk tables
+		// pile up until the hard cap is reached
+		lsmtree.DiskTableNumThreshold(64),
+		lsmtree.WriteStallThreshold(3),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	stalled := false
+	for i := 1; i <= 100; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		err := tree.Put(key, []byte(strconv.Itoa(i*2)))
+		if errors.Is(err, lsmtree.ErrWriteStall) {
+			stalled = true
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if !stalled {
+		t.Fatalf("the writes must stall once the disk table cap is reached")
+	}
+
+	// a manual compaction brings the table number back under
+	// the cap and the writes resume
+	if err := tree.CompactAll(); err != nil {
+		t.Fatalf("failed to compact: %s", err)
+	}
+
+	if err := tree.Put([]byte("resumed"), []byte("v")); err != nil {
+		t.Fatalf("the writes must resume after the compaction, got: %s", err)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestKeyRange(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.ManualFlush())
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	if _, _, ok, err := tree.KeyRange(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if ok {
+		t.Fatalf("an empty database must report no key range")
+	}
+
+	for _, key := range []string{"b", "c", "d", "e", "f"} {
+		if err := tree.Put([]byte(key), []byte("v"+key)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	min, max, ok, err := tree.KeyRange()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok || string(min) != "b" || string(max) != "f" {
+		t.Fatalf("expected the range [b, f], got [%s, %s]", min, max)
+	}
+
+	// spread the keys over a disk table and the MemTable and
+	// delete the largest key: the exact range must shrink to e
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	if err := tree.Put([]byte("a"), []byte("va")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := tree.Delete([]byte("f")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	min, max, ok, err = tree.KeyRangeExact()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok || string(min) != "a" || string(max) != "e" {
+		t.Fatalf("expected the exact range [a, e], got [%s, %s]", min, max)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestRepeatedDeleteWritesOneWALRecord(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.ManualFlush())
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	// the first delete persists the tombstone
+	if err := tree.Delete([]byte("key")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	walAfterFirst := tree.Stats().BytesWrittenWAL
+	if walAfterFirst == 0 {
+		t.Fatal("the first delete must write a WAL record")
+	}
+
+	// the repeated deletes within the same generation do not grow the WAL
+	for i := 0; i < 10; i++ {
+		if err := tree.Delete([]byte("key")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if wal := tree.Stats().BytesWrittenWAL; wal != walAfterFirst {
+		t.Fatalf("the repeated deletes must not grow the WAL: %d != %d", wal, walAfterFirst)
+	}
+
+	// a put replaces the tombstone, so the next delete persists again
+	if err := tree.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	walBefore := tree.Stats().BytesWrittenWAL
+	if err := tree.Delete([]byte("key")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if wal := tree.Stats().BytesWrittenWAL; wal <= walBefore {
+		t.Fatal("the delete after the put must write a WAL record")
+	}
+
+	// the flush clears the generation and the next delete persists
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	walBefore = tree.Stats().BytesWrittenWAL
+	if err := tree.Delete([]byte("key")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if wal := tree.Stats().BytesWrittenWAL; wal <= walBefore {
+		t.Fatal("the delete after the flush must write a WAL record")
+	}
+
+	if _, ok, err := tree.Get([]byte("key")); err != nil || ok {
+		t.Fatalf("the key must be deleted: %v, %s", ok, err)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestDeleteIfExists(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	if err := tree.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the key is present, the delete must occur
+	deleted, err := tree.DeleteIfExists([]byte("key"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !deleted {
+		t.Fatalf("delete must occur for the present key")
+	}
+
+	// the key is already deleted, no new tombstone must be written
+	walBytes := tree.Stats().BytesWrittenWAL
+	deleted, err = tree.DeleteIfExists([]byte("key"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if deleted {
+		t.Fatalf("delete must not occur for the already deleted key")
+	}
+	if tree.Stats().BytesWrittenWAL != walBytes {
+		t.Fatalf("no tombstone must be written for the already deleted key")
+	}
+
+	// the key is absent, no tombstone must be written
+	deleted, err = tree.DeleteIfExists([]byte("absent"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if deleted {
+		t.Fatalf("delete must not occur for the absent key")
+	}
+	if tree.Stats().BytesWrittenWAL != walBytes {
+		t.Fatalf("no tombstone must be written for the absent key")
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestMustDelete(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	if err := tree.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the key is present, the delete must succeed
+	if err := tree.MustDelete([]byte("key")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok, err := tree.Get([]byte("key")); err != nil || ok {
+		t.Fatalf("the deleted key must not be found: %v, %v", ok, err)
+	}
+
+	// the key is already deleted, so it is absent
+	if err := tree.MustDelete([]byte("key")); !errors.Is(err, lsmtree.ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound for the deleted key, but got: %v", err)
+	}
+
+	// the key was never put
+	if err := tree.MustDelete([]byte("absent")); !errors.Is(err, lsmtree.ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound for the absent key, but got: %v", err)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestAdversarialByteKeys(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	// the keys are arbitrary bytes: embedded and leading null bytes,
+	// all-0xFF keys and the keys around them must survive every layer
+	keys := [][]byte{
+		{0x00},
+		{0x00, 0x00},
+		{0x00, 0xFF},
+		{'a', 0x00, 'b'},
+		{0xFE, 0xFF, 0xFF},
+		{0xFF},
+		{0xFF, 0x00},
+		{0xFF, 0xFF},
+		{0xFF, 0xFF, 0xFF},
+	}
+
+	for i, key := range keys {
+		if err := tree.Put(key, []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatalf("unexpected error for %x: %s", key, err)
+		}
+	}
+
+	assert := func() {
+		for i, key := range keys {
+			value, ok, err := tree.Get(key)
+			if err != nil {
+				t.Fatalf("unexpected error for %x: %s", key, err)
+			}
+			if !ok || !bytes.Equal(value, []byte(fmt.Sprintf("value-%d", i))) {
+				t.Fatalf("values do not match for %x: %s", key, value)
+			}
+		}
+	}
+
+	// the keys must read back from the MemTable and, after the flush,
+	// from the disk tables with their bounds and sparse index pruning
+	assert()
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	assert()
+
+	// the full scan must return the keys in the bytes.Compare order
+	expected := make([][]byte, len(keys))
+	copy(expected, keys)
+	sort.Slice(expected, func(i, j int) bool { return bytes.Compare(expected[i], expected[j]) < 0 })
+
+	it, err := tree.Range(nil, nil, lsmtree.DefaultRangeOptions)
+	if err != nil {
+		t.Fatalf("failed to instantiate iterator: %s", err)
+	}
+	scanned := make([][]byte, 0, len(keys))
+	for it.HasNext() {
+		entry, err := it.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		scanned = append(scanned, entry.Key)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatalf("failed to close iterator: %s", err)
+	}
+	if !reflect.DeepEqual(expected, scanned) {
+		t.Fatalf("the scan order does not match bytes.Compare: %x != %x", expected, scanned)
+	}
+
+	// an all-0xFF prefix has no incrementable successor, so its scan
+	// runs unbounded and must still stop at its own keys
+	it, err = tree.Range([]byte{0xFF, 0xFF}, nil, lsmtree.DefaultRangeOptions)
+	if err != nil {
+		t.Fatalf("failed to instantiate iterator: %s", err)
+	}
+	scanned = scanned[:0]
+	for it.HasNext() {
+		entry, err := it.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		scanned = append(scanned, entry.Key)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatalf("failed to close iterator: %s", err)
+	}
+	if !reflect.DeepEqual([][]byte{{0xFF, 0xFF}, {0xFF, 0xFF, 0xFF}}, scanned) {
+		t.Fatalf("unexpected keys in the all-0xFF scan: %x", scanned)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestVerifyTable(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+	defer tree.Close()
+
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		if err := tree.Put(key, []byte(fmt.Sprintf("value-%02d", i))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	// the untouched table matches its manifest
+	if err := tree.VerifyTable(0); err != nil {
+		t.Fatalf("the untouched table must verify, but got: %s", err)
+	}
+
+	// flipping a single byte keeps the size and must still be detected
+	dataPath := filepath.Join(dbDir, "0-data.db")
+	data, err := ioutil.ReadFile(dataPath)
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", dataPath, err)
+	}
+	data[len(data)/2] ^= 0xFF
+	if err := ioutil.WriteFile(dataPath, data, 0600); err != nil {
+		t.Fatalf("failed to write %s: %s", dataPath, err)
+	}
+	if err := tree.VerifyTable(0); !errors.Is(err, lsmtree.ErrTableAltered) {
+		t.Fatalf("expected ErrTableAltered for the flipped byte, but got: %v", err)
+	}
+
+	// appending bytes changes the size and must be detected as well
+	data[len(data)/2] ^= 0xFF
+	if err := ioutil.WriteFile(dataPath, append(data, 0x00), 0600); err != nil {
+		t.Fatalf("failed to write %s: %s", dataPath, err)
+	}
+	if err := tree.VerifyTable(0); !errors.Is(err, lsmtree.ErrTableAltered) {
+		t.Fatalf("expected ErrTableAltered for the appended byte, but got: %v", err)
+	}
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	if err := tree.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	// the repeated close must not double-close the WAL handle
+	if err := tree.Close(); err != nil {
+		t.Fatalf("the repeated close must return nil, but got: %s", err)
+	}
+
+	// the operations on the closed database must be rejected instead
+	// of touching the closed file handles
+	if _, _, err := tree.Get([]byte("key")); !errors.Is(err, lsmtree.ErrClosed) {
+		t.Fatalf("expected ErrClosed from Get, but got: %v", err)
+	}
+	if err := tree.Put([]byte("key"), []byte("value")); !errors.Is(err, lsmtree.ErrClosed) {
+		t.Fatalf("expected ErrClosed from Put, but got: %v", err)
+	}
+	if err := tree.Delete([]byte("key")); !errors.Is(err, lsmtree.ErrClosed) {
+		t.Fatalf("expected ErrClosed from Delete, but got: %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.SparseKeyDistance(64),
+		lsmtree.MemTableThreshold(100),
+		lsmtree.DiskTableNumThreshold(3),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	expectedWAL, expectedUser := 0, 0
+	for i := 1; i <= 100; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		value := fmt.Sprintf("value-%03d", i)
+		if err := tree.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		// every WAL record is the key and the value with the 16 bytes
+		// of the length prefixes and the 8 bytes of the timestamp
+		expectedWAL += 24 + len(key) + len(value)
+		expectedUser += len(key) + len(value)
+	}
+
+	stats := tree.Stats()
+	if stats.BytesWrittenWAL != expectedWAL {
+		t.Fatalf("WAL bytes do not match: %d != %d", stats.BytesWrittenWAL, expectedWAL)
+	}
+	if stats.UserBytesWritten != expectedUser {
+		t.Fatalf("user bytes do not match: %d != %d", stats.UserBytesWritten, expectedUser)
+	}
+	if stats.BytesWrittenFlush <= 0 {
+		t.Fatalf("flush bytes must be positive, but got %d", stats.BytesWrittenFlush)
+	}
+	if stats.BytesWrittenMerge <= 0 {
+		t.Fatalf("merge bytes must be positive, but got %d", stats.BytesWrittenMerge)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestSharedCompactionPool(t *testing.T) {
+	pool := lsmtree.NewCompactionPool(1)
+
+	dbDirs := make([]string, 2)
+	trees := make([]*lsmtree.LSMTree, 2)
+	for i := range trees {
+		dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+		if err != nil {
+			panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+		}
+		defer func() {
+			if err := os.RemoveAll(dbDir); err != nil {
+				panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+			}
+		}()
+		dbDirs[i] = dbDir
+
+		tree, err := lsmtree.Open(
+			dbDir,
+			lsmtree.SparseKeyDistance(64),
+			lsmtree.MemTableThreshold(100),
+			lsmtree.DiskTableNumThreshold(3),
+			lsmtree.WithCompactionPool(pool),
+		)
+		if err != nil {
+			panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+		}
+		trees[i] = tree
+	}
+
+	// both trees flush and compact many times, all the merges are
+	// scheduled on the single shared worker
+	for i := 1; i <= 100; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		value := []byte(fmt.Sprintf("value-%03d", i))
+		for _, tree := range trees {
+			if err := tree.Put(key, value); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+	}
+
+	// closing the first tree deregisters it from the pool, the merges
+	// of the second tree keep running
+	for _, tree := range trees {
+		if err := tree.Close(); err != nil {
+			panic(fmt.Errorf("failed to close: %w", err))
+		}
+	}
+
+	for _, dbDir := range dbDirs {
+		tree, err := lsmtree.Open(dbDir)
+		if err != nil {
+			panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+		}
+
+		for i := 1; i <= 100; i++ {
+			key := []byte(fmt.Sprintf("key-%03d", i))
+			value, ok, err := tree.Get(key)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !ok || !bytes.Equal(value, []byte(fmt.Sprintf("value-%03d", i))) {
+				t.Fatalf("the key %s is lost after the compactions", key)
+			}
+		}
+
+		if err := tree.Close(); err != nil {
+			panic(fmt.Errorf("failed to close: %w", err))
+		}
+	}
+}
+
+func TestFlushAndWait(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.SparseKeyDistance(64),
+		lsmtree.DiskTableNumThreshold(3),
+		lsmtree.MaxConcurrentCompactions(1),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	if err := tree.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	depth, err := tree.SearchDepth([]byte("key"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if depth != 0 {
+		t.Fatalf("the key must still reside in the MemTable, got depth %d", depth)
+	}
+
+	// after the barrier the key must be fully on disk, even when the
+	// merges run in the background
+	if err := tree.FlushAndWait(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	depth, err = tree.SearchDepth([]byte("key"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if depth < 1 {
+		t.Fatalf("the key must reside in a disk table, got depth %d", depth)
+	}
+
+	value, ok, err := tree.Get([]byte("key"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok || string(value) != "value" {
+		t.Fatalf("value is wrong after the flush: %s", value)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestConcurrentGetDuringMerge(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	// the rate limit slows the background merge down, so the readers
+	// below overlap with it and with the final table swap
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.DiskTableNumThreshold(3),
+		lsmtree.MaxConcurrentCompactions(1),
+		lsmtree.CompactionRateLimit(4096),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	expected := func(i int) []byte {
+		if i < 50 {
+			return []byte(fmt.Sprintf("new-%03d", i))
+		}
+
+		return []byte(fmt.Sprintf("value-%03d", i))
+	}
+
+	// the first table holds the old values of the keys 0..49, the
+	// second overwrites them, so a half-swapped read during the merge
+	// of the two would resurrect the old values
+	for i := 0; i < 50; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("old-%03d", i))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key-%03d", i)), expected(i)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	for i := 100; i < 150; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key-%03d", i)), expected(i)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	// the third flush passes the threshold and schedules the
+	// background merge of the two oldest tables
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	const readers = 4
+	deadline := time.Now().Add(2 * time.Second)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, readers)
+	for reader := 0; reader < readers; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for time.Now().Before(deadline) {
+				for i := 0; i < 150; i++ {
+					key := []byte(fmt.Sprintf("key-%03d", i))
+					value, ok, err := tree.Get(key)
+					if err != nil {
+						errs <- fmt.Errorf("unexpected error for %s: %w", key, err)
+						return
+					}
+					if !ok || !bytes.Equal(value, expected(i)) {
+						errs <- fmt.Errorf("wrong value for %s during the merge: %v, %s", key, ok, value)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// Close waits for the background merge and surfaces its error
+	if err := tree.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	tree, err = lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+	defer tree.Close()
+
+	for i := 0; i < 150; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		value, ok, err := tree.Get(key)
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %s", key, err)
+		}
+		if !ok || !bytes.Equal(value, expected(i)) {
+			t.Fatalf("wrong value for %s after the merge: %v, %s", key, ok, value)
+		}
+	}
+}
+
+func TestCompactFor(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.SparseKeyDistance(64),
+		lsmtree.MemTableThreshold(100),
+		lsmtree.DiskTableNumThreshold(100),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for i := 1; i <= 100; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		value := fmt.Sprintf("value-%03d", i)
+		if err := tree.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// the depth of an absent key counts all disk tables
+	depthBefore, err := tree.SearchDepth([]byte("zzz-absent"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if depthBefore < 2 {
+		t.Fatalf("the writes must produce at least two disk tables, got %d", depthBefore)
+	}
+
+	budget := 50 * time.Millisecond
+	start := time.Now()
+	if err := tree.CompactFor(budget); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the budget is soft: only the merge in progress is finished,
+	// so the overrun stays within a single pair merge
+	if elapsed := time.Since(start); elapsed > budget+5*time.Second {
+		t.Fatalf("the compaction overran the budget by too much: %s", elapsed)
+	}
+
+	depthAfter, err := tree.SearchDepth([]byte("zzz-absent"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if depthAfter >= depthBefore {
+		t.Fatalf("the compaction must reduce the table number: %d >= %d", depthAfter, depthBefore)
+	}
+
+	// no orphaned merge files may be left behind
+	files, err := ioutil.ReadDir(dbDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "merge") {
+			t.Fatalf("an orphaned merge file is left behind: %s", f.Name())
+		}
+	}
+
+	for i := 1; i <= 100; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		value, ok, err := tree.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !ok || string(value) != fmt.Sprintf("value-%03d", i) {
+			t.Fatalf("the key %s is lost after the compaction", key)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestAfterFlushHook(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	type flush struct {
+		index int
+		files []string
+	}
+	flushes := make([]flush, 0)
+
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.SparseKeyDistance(64),
+		lsmtree.MemTableThreshold(100),
+		lsmtree.DiskTableNumThreshold(100),
+		lsmtree.AfterFlush(func(index int, files []string) error {
+			// the files must be fully written when the hook fires
+			for _, file := range files {
+				if _, err := os.Stat(file); err != nil {
+					return fmt.Errorf("the flushed file is missing: %w", err)
+				}
+			}
+
+			flushes = append(flushes, flush{index: index, files: files})
+
+			return nil
+		}),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for i := 1; i <= 100; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		value := fmt.Sprintf("value-%03d", i)
+		if err := tree.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if len(flushes) == 0 {
+		t.Fatal("the hook must fire on the threshold-triggered flushes")
+	}
+
+	for i, f := range flushes {
+		if f.index != i {
+			t.Fatalf("the disk table indexes must be sequential: %d != %d", f.index, i)
+		}
+
+		expected := []string{
+			filepath.Join(dbDir, fmt.Sprintf("%d-data.db", f.index)),
+			filepath.Join(dbDir, fmt.Sprintf("%d-index.db", f.index)),
+			filepath.Join(dbDir, fmt.Sprintf("%d-sparse.db", f.index)),
+		}
+		if !reflect.DeepEqual(expected, f.files) {
+			t.Fatalf("file paths do not match: %v != %v", expected, f.files)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestFetchTableHook(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.ManualFlush())
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+	if err := tree.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+
+	// the disk table files are evicted to a "remote" directory
+	remoteDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", remoteDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(remoteDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", remoteDir, err))
+		}
+	}()
+
+	names := []string{"0-data.db", "0-index.db", "0-sparse.db"}
+	for _, name := range names {
+		if err := os.Rename(filepath.Join(dbDir, name), filepath.Join(remoteDir, name)); err != nil {
+			t.Fatalf("failed to evict %s: %s", name, err)
+		}
+	}
+
+	fetched := 0
+	tree, err = lsmtree.Open(dbDir, lsmtree.FetchTable(func(dir string, index int) error {
+		if dir != dbDir {
+			return fmt.Errorf("unexpected directory: %s", dir)
+		}
+
+		fetched++
+		for _, name := range names {
+			local := filepath.Join(dir, fmt.Sprintf("%d-%s", index, strings.TrimPrefix(name, "0-")))
+			if err := os.Rename(filepath.Join(remoteDir, name), local); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", name, err)
+			}
+		}
+
+		return nil
+	}))
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	value, ok, err := tree.Get([]byte("key"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok || string(value) != "value" {
+		t.Fatalf("the key must be readable after the fetch, got %s", value)
+	}
+	if fetched != 1 {
+		t.Fatalf("the hook must fire once for the missing table, but fired %d times", fetched)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestApproxMemoryBytes(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.ManualFlush())
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	if m := tree.ApproxMemoryBytes(); m != 0 {
+		t.Fatalf("an empty MemTable must estimate zero bytes, got %d", m)
+	}
+
+	put := func(from, to int) int {
+		raw := 0
+		for i := from; i <= to; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			value := fmt.Sprintf("value-%03d", i)
+			if err := tree.Put([]byte(key), []byte(value)); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			raw += len(key) + len(value)
+		}
+
+		return raw
+	}
+
+	raw := put(1, 100)
+	m100 := tree.ApproxMemoryBytes()
+	if m100 <= raw {
+		t.Fatalf("the estimate must include the per-entry overhead: %d <= %d", m100, raw)
+	}
+
+	// the entries are of equal size, so the estimate must scale
+	// linearly with the key count
+	put(101, 200)
+	m200 := tree.ApproxMemoryBytes()
+	if m200-m100 != m100 {
+		t.Fatalf("the estimate must scale with the key count: %d != %d", m200-m100, m100)
+	}
+
+	// the flush clears the MemTable and the estimate drops to zero
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if m := tree.ApproxMemoryBytes(); m != 0 {
+		t.Fatalf("the estimate must drop to zero after the flush, got %d", m)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestFlushStats(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.SparseKeyDistance(64),
+		lsmtree.MemTableThreshold(100),
+		lsmtree.DiskTableNumThreshold(100),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for i := 1; i <= 100; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		value := fmt.Sprintf("value-%03d", i)
+		if err := tree.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	stats := tree.Stats()
+	if stats.FlushCount <= 1 {
+		t.Fatalf("repeatedly crossing the threshold must flush more than once, but flushed %d times", stats.FlushCount)
+	}
+	if stats.LastFlushDuration <= 0 {
+		t.Fatalf("the last flush duration must be positive, but got %s", stats.LastFlushDuration)
+	}
+	if stats.TotalFlushDuration < stats.LastFlushDuration {
+		t.Fatalf("the total flush duration %s must not be below the last one %s", stats.TotalFlushDuration, stats.LastFlushDuration)
+	}
+	if stats.AvgBytesPerFlush != stats.BytesWrittenFlush/stats.FlushCount {
+		t.Fatalf("average bytes per flush do not match: %d != %d", stats.AvgBytesPerFlush, stats.BytesWrittenFlush/stats.FlushCount)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestSkipWALReplay(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	if err := tree.Put([]byte("flushed"), []byte("value")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the key stays in the WAL only, it must not be visible
+	// when the replay is skipped
+	if err := tree.Put([]byte("unflushed"), []byte("value")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+
+	tree, err = lsmtree.Open(dbDir, lsmtree.SkipWALReplay())
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	if _, ok, err := tree.Get([]byte("flushed")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if !ok {
+		t.Fatalf("the flushed key must be visible")
+	}
+
+	if _, ok, err := tree.Get([]byte("unflushed")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if ok {
+		t.Fatalf("the key held only by the WAL must not be visible")
+	}
+
+	// the writes would clear the WAL and lose its unreplayed
+	// records, so they must be rejected
+	if err := tree.Put([]byte("key"), []byte("value")); !errors.Is(err, lsmtree.ErrWALNotReplayed) {
+		t.Fatalf("expected ErrWALNotReplayed, but got %v", err)
+	}
+	if err := tree.Delete([]byte("key")); !errors.Is(err, lsmtree.ErrWALNotReplayed) {
+		t.Fatalf("expected ErrWALNotReplayed, but got %v", err)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+
+	// a normal reopen replays the WAL and surfaces the key again
+	tree, err = lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	if _, ok, err := tree.Get([]byte("unflushed")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if !ok {
+		t.Fatalf("the WAL key must be visible after the normal reopen")
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestOpenForInvalidSparseKeyDistance(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	if _, err := lsmtree.Open(dbDir, lsmtree.SparseKeyDistance(0)); err == nil {
+		t.Fatalf("expected an error for zero sparse key distance, but got nil")
+	}
+
+	if _, err := lsmtree.Open(dbDir, lsmtree.SparseKeyDistance(-1)); err == nil {
+		t.Fatalf("expected an error for negative sparse key distance, but got nil")
+	}
+}
+
+func TestOpenForTinyMemTableThreshold(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	// such a threshold would create a disk table per key
+	if _, err := lsmtree.Open(dbDir, lsmtree.MemTableThreshold(1)); err == nil {
+		t.Fatalf("expected an error for the tiny MemTable threshold, but got nil")
+	}
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.MemTableThreshold(16))
+	if err != nil {
+		t.Fatalf("unexpected error for the minimal MemTable threshold: %s", err)
+	}
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestOpenForReadOnlyDirectory(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("the root user is not restricted by the directory permissions")
+	}
+
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		// restore the permissions, so the directory can be removed
+		if err := os.Chmod(dbDir, 0700); err != nil {
+			panic(fmt.Errorf("failed to chmod %s: %w", dbDir, err))
+		}
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	if err := os.Chmod(dbDir, 0500); err != nil {
+		t.Fatalf("failed to chmod %s: %s", dbDir, err)
+	}
+
+	_, err = lsmtree.Open(dbDir)
+	if !errors.Is(err, lsmtree.ErrDirectoryNotWritable) {
+		t.Fatalf("expected %v, but got %v", lsmtree.ErrDirectoryNotWritable, err)
+	}
+}
+
 func TestPut100(t *testing.T) {
 	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
 	if err != nil {
@@ -141,7 +3161,985 @@ func TestPut100(t *testing.T) {
 
 	tree, err := lsmtree.Open(
 		dbDir,
-		lsmtree.SparseKeyDistance(64),
+		lsmtree.SparseKeyDistance(64),
+		lsmtree.MemTableThreshold(100),
+		lsmtree.DiskTableNumThreshold(3),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	fmt.Println(tree)
+
+	// key = "1", value = "2"
+	// key = "2", value = "4"
+	// ...
+	for i := 1; i <= 100; i++ {
+		key := strconv.Itoa(i)
+		value := strconv.Itoa(i * 2)
+		err := tree.Put([]byte(key), []byte(value))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// key = "1", value = "2"
+	// key = "2", value deleted
+	// key = "3", value = "6"
+	// key = "4", value deleted
+	// ...
+	for i := 1; i <= 100; i++ {
+		if i%2 == 0 {
+			key := strconv.Itoa(i)
+			err := tree.Delete([]byte(key))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+	}
+
+	tree, err = lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for i := 1; i <= 100; i++ {
+		key := strconv.Itoa(i)
+		value, ok, err := tree.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if i%2 == 0 && ok {
+			t.Fatalf("key must be deleted %s, but it is not", key)
+		}
+
+		if i%2 != 0 {
+			if !ok {
+				t.Fatalf("key must be present %s, but it is not", key)
+			} else {
+				expectedValue := strconv.Itoa(i * 2)
+				if expectedValue != string(value) {
+					t.Fatalf("value is wrong for key %s: %s != %s", key, expectedValue, value)
+				}
+			}
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestChunkedLargeValues(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.ChunkLargeValues())
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	large := make([]byte, 3*lsmtree.MaxValueSize+1234)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+
+	if err := tree.Put([]byte("large"), large); err != nil {
+		t.Fatalf("failed to put the large value: %s", err)
+	}
+	if err := tree.Put([]byte("small"), []byte("value")); err != nil {
+		t.Fatalf("failed to put the small value: %s", err)
+	}
+
+	value, ok, err := tree.Get([]byte("large"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok || !bytes.Equal(value, large) {
+		t.Fatalf("the large value must be read back intact")
+	}
+
+	// the chunks and the marker must survive the flush
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	value, ok, err = tree.Get([]byte("large"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok || !bytes.Equal(value, large) {
+		t.Fatalf("the large value must be read back intact after the flush")
+	}
+
+	if value, ok, err := tree.Get([]byte("small")); err != nil || !ok || !bytes.Equal(value, []byte("value")) {
+		t.Fatalf("the small value must not be affected by the chunking")
+	}
+
+	if err := tree.Delete([]byte("large")); err != nil {
+		t.Fatalf("failed to delete the large value: %s", err)
+	}
+	if _, ok, err := tree.Get([]byte("large")); err != nil || ok {
+		t.Fatalf("the large value must be deleted")
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+
+	// without the option the oversized values are still rejected
+	tree, err = lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+	if err := tree.Put([]byte("large"), large); err != lsmtree.ErrValueTooLarge {
+		t.Fatalf("expected ErrValueTooLarge, got %v", err)
+	}
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestPutWithIdle(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+	defer tree.Close()
+
+	idle := 400 * time.Millisecond
+	if err := tree.PutWithIdle([]byte("accessed"), []byte("value"), idle); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := tree.PutWithIdle([]byte("forgotten"), []byte("value"), idle); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// each read bumps the last-access timestamp, so the entry outlives
+	// its idle duration as long as it keeps being read
+	for i := 0; i < 4; i++ {
+		time.Sleep(200 * time.Millisecond)
+
+		value, ok, err := tree.Get([]byte("accessed"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !ok || !bytes.Equal(value, []byte("value")) {
+			t.Fatalf("the accessed entry must not expire, got: %v, %s", ok, value)
+		}
+	}
+
+	// the unaccessed entry sat idle for the whole loop above
+	if _, ok, err := tree.Get([]byte("forgotten")); err != nil || ok {
+		t.Fatalf("the unaccessed entry must expire: %v, %v", ok, err)
+	}
+
+	// once the reads stop, the accessed entry expires as well
+	time.Sleep(idle + 100*time.Millisecond)
+	if _, ok, err := tree.Get([]byte("accessed")); err != nil || ok {
+		t.Fatalf("the entry must expire once the reads stop: %v, %v", ok, err)
+	}
+}
+
+func TestPutWithIdleLazy(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.LazyIdleBump())
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+	defer tree.Close()
+
+	idle := 400 * time.Millisecond
+	if err := tree.PutWithIdle([]byte("key"), []byte("value"), idle); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the idle entries survive a flush: the bumps keep working against
+	// the value read back from the disk table
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	stats := tree.Stats()
+	for i := 0; i < 4; i++ {
+		time.Sleep(200 * time.Millisecond)
+
+		value, ok, err := tree.Get([]byte("key"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !ok || !bytes.Equal(value, []byte("value")) {
+			t.Fatalf("the accessed entry must not expire, got: %v, %s", ok, value)
+		}
+	}
+
+	// the lazy bumps never touch the WAL
+	if written := tree.Stats().BytesWrittenWAL - stats.BytesWrittenWAL; written != 0 {
+		t.Fatalf("the lazy bumps must not write to the WAL, but wrote %d bytes", written)
+	}
+
+	time.Sleep(idle + 100*time.Millisecond)
+	if _, ok, err := tree.Get([]byte("key")); err != nil || ok {
+		t.Fatalf("the entry must expire once the reads stop: %v, %v", ok, err)
+	}
+}
+
+func TestRangeDecodesIdleAndChunkedValues(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.ChunkLargeValues())
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+	defer tree.Close()
+
+	large := make([]byte, 2*lsmtree.MaxValueSize+99)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+
+	if err := tree.Put([]byte("large"), large); err != nil {
+		t.Fatalf("failed to put the large value: %s", err)
+	}
+	if err := tree.Put([]byte("plain"), []byte("value")); err != nil {
+		t.Fatalf("failed to put the plain value: %s", err)
+	}
+	if err := tree.PutWithIdle([]byte("session"), []byte("value"), 10*time.Second); err != nil {
+		t.Fatalf("failed to put the idle entry: %s", err)
+	}
+	if err := tree.PutWithIdle([]byte("stale"), []byte("value"), 50*time.Millisecond); err != nil {
+		t.Fatalf("failed to put the idle entry: %s", err)
+	}
+
+	// the disk tables must be decoded like the MemTable
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	it, err := tree.Range(nil, nil, lsmtree.DefaultRangeOptions)
+	if err != nil {
+		t.Fatalf("failed to instantiate iterator: %s", err)
+	}
+	defer it.Close()
+
+	entries := make(map[string][]byte)
+	for it.HasNext() {
+		entry, err := it.Next()
+		if err != nil {
+			t.Fatalf("failed to get next entry: %s", err)
+		}
+
+		entries[string(entry.Key)] = entry.Value
+	}
+
+	// the expired idle entry is skipped and the chunk records stay
+	// internal, so exactly the three live user keys remain
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, but got %d: %v", len(entries), entries)
+	}
+	if !bytes.Equal(entries["large"], large) {
+		t.Fatalf("the chunked value must be reassembled by the scan")
+	}
+	if !bytes.Equal(entries["plain"], []byte("value")) {
+		t.Fatalf("the plain value must be read back intact")
+	}
+	if !bytes.Equal(entries["session"], []byte("value")) {
+		t.Fatalf("the live idle entry must yield its user value")
+	}
+
+	// DropPrefix still sees the physical records: the marker and the
+	// chunk records of the large value are all tombstoned
+	if count, err := tree.CountPrefix([]byte("large")); err != nil || count != 4 {
+		t.Fatalf("expected the marker and 3 chunk records, but got %d, %v", count, err)
+	}
+	if err := tree.DropPrefix([]byte("large")); err != nil {
+		t.Fatalf("failed to drop the prefix: %s", err)
+	}
+	if count, err := tree.CountPrefix([]byte("large")); err != nil || count != 0 {
+		t.Fatalf("expected no records after the drop, but got %d, %v", count, err)
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.FlushInterval(50*time.Millisecond))
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	// far below the MemTable threshold, so only the timer can flush it
+	if err := tree.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	flushed := false
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); {
+		dataFiles, err := filepath.Glob(filepath.Join(dbDir, "*-data.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dataFiles) > 0 {
+			flushed = true
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !flushed {
+		t.Fatalf("the pending data must be flushed after the interval")
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestChecksumModes(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if err := tree.Put([]byte(key), []byte("value-"+key)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+
+	// corrupt the value of the last record in the data file
+	dataFiles, err := filepath.Glob(filepath.Join(dbDir, "*-data.db"))
+	if err != nil || len(dataFiles) != 1 {
+		t.Fatalf("expected a single data file, got %v (%v)", dataFiles, err)
+	}
+	data, err := ioutil.ReadFile(dataFiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xFF
+	if err := ioutil.WriteFile(dataFiles[0], data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// with ChecksumOnRead the corruption surfaces only when
+	// the corrupted key is read
+	tree, err = lsmtree.Open(dbDir)
+	if err != nil {
+		t.Fatalf("ChecksumOnRead must not fail at open: %s", err)
+	}
+	if value, ok, err := tree.Get([]byte("a")); err != nil || !ok || !bytes.Equal(value, []byte("value-a")) {
+		t.Fatalf("the intact key must be readable, got %s, %v, %v", value, ok, err)
+	}
+	if _, _, err := tree.Get([]byte("e")); !errors.Is(err, lsmtree.ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch for the corrupted key, got %v", err)
+	}
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+
+	// with ChecksumOnOpen the corruption fails fast at open
+	if _, err := lsmtree.Open(dbDir, lsmtree.ChecksumMode(lsmtree.ChecksumOnOpen)); !errors.Is(err, lsmtree.ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch at open, got %v", err)
+	}
+}
+
+func TestCountPrefix(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.ManualFlush())
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	// half of the prefixed keys go to a disk table, the other half
+	// stays in the MemTable, and some keys sit outside the prefix
+	for i := 1; i <= 10; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("user:%02d", i)), []byte("v")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := tree.Put([]byte("other"), []byte("v")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for i := 11; i <= 15; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("user:%02d", i)), []byte("v")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// the deletes span both sides of the flush boundary
+	if err := tree.Delete([]byte("user:03")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := tree.Delete([]byte("user:12")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	count, err := tree.CountPrefix([]byte("user:"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if count != 13 {
+		t.Fatalf("expected 13 keys under the prefix, got %d", count)
+	}
+
+	if _, err := tree.CountPrefix(nil); !errors.Is(err, lsmtree.ErrKeyRequired) {
+		t.Fatalf("an empty prefix must be rejected, got: %s", err)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestDropPrefix(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.MemTableThreshold(100))
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	// the keys are spread over the disk tables and the MemTable
+	for i := 0; i < 10; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("tenant-a/key-%d", i)), []byte("va")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := tree.Put([]byte(fmt.Sprintf("tenant-b/key-%d", i)), []byte("vb")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if err := tree.DropPrefix([]byte("tenant-a/")); err != nil {
+		t.Fatalf("failed to drop the prefix: %s", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, ok, err := tree.Get([]byte(fmt.Sprintf("tenant-a/key-%d", i))); err != nil || ok {
+			t.Fatalf("the dropped key tenant-a/key-%d must not be found", i)
+		}
+		if value, ok, err := tree.Get([]byte(fmt.Sprintf("tenant-b/key-%d", i))); err != nil || !ok || !bytes.Equal(value, []byte("vb")) {
+			t.Fatalf("the key tenant-b/key-%d must not be affected", i)
+		}
+	}
+
+	// the drop must survive a flush and a reopen
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+
+	tree, err = lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok, err := tree.Get([]byte(fmt.Sprintf("tenant-a/key-%d", i))); err != nil || ok {
+			t.Fatalf("the dropped key tenant-a/key-%d must not reappear after the reopen", i)
+		}
+		if _, ok, err := tree.Get([]byte(fmt.Sprintf("tenant-b/key-%d", i))); err != nil || !ok {
+			t.Fatalf("the key tenant-b/key-%d must survive the reopen", i)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestListChildren(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.MemTableThreshold(512))
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+	defer tree.Close()
+
+	// a directory with many leaves, so the scan has something to seek
+	// over; the small MemTable threshold spreads the keys over several
+	// disk tables and the MemTable
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("fs/home/alice/file-%03d.txt", i))
+		if err := tree.Put(key, []byte("v")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	for _, key := range []string{
+		"fs/etc/hosts",
+		"fs/home/bob/notes.txt",
+		"fs/home/readme",
+		"fs/var/log/syslog",
+		"other/file",
+	} {
+		if err := tree.Put([]byte(key), []byte("v")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	children, err := tree.ListChildren([]byte("fs/home/"), '/')
+	if err != nil {
+		t.Fatalf("failed to list the children: %s", err)
+	}
+	expected := [][]byte{[]byte("alice/"), []byte("bob/"), []byte("readme")}
+	if !reflect.DeepEqual(children, expected) {
+		t.Fatalf("expected the children %q, but got %q", expected, children)
+	}
+
+	children, err = tree.ListChildren([]byte("fs/"), '/')
+	if err != nil {
+		t.Fatalf("failed to list the children: %s", err)
+	}
+	expected = [][]byte{[]byte("etc/"), []byte("home/"), []byte("var/")}
+	if !reflect.DeepEqual(children, expected) {
+		t.Fatalf("expected the children %q, but got %q", expected, children)
+	}
+
+	// a directory of a deleted key disappears from the listing
+	if err := tree.Delete([]byte("fs/etc/hosts")); err != nil {
+		t.Fatalf("failed to delete: %s", err)
+	}
+	children, err = tree.ListChildren([]byte("fs/"), '/')
+	if err != nil {
+		t.Fatalf("failed to list the children: %s", err)
+	}
+	expected = [][]byte{[]byte("home/"), []byte("var/")}
+	if !reflect.DeepEqual(children, expected) {
+		t.Fatalf("expected the children %q, but got %q", expected, children)
+	}
+
+	children, err = tree.ListChildren([]byte("fs/none/"), '/')
+	if err != nil {
+		t.Fatalf("failed to list the children: %s", err)
+	}
+	if len(children) != 0 {
+		t.Fatalf("expected no children, but got %q", children)
+	}
+
+	if _, err := tree.ListChildren(nil, '/'); !errors.Is(err, lsmtree.ErrKeyRequired) {
+		t.Fatalf("expected ErrKeyRequired, but got %v", err)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.ValueCacheBytes(1024))
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	if err := tree.Put([]byte("a"), []byte("va")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := tree.Put([]byte("b"), []byte("vb")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	// the first read of each key misses and fills the cache,
+	// the repeated reads hit
+	for _, key := range []string{"a", "a", "b", "b", "b"} {
+		if _, ok, err := tree.Get([]byte(key)); err != nil || !ok {
+			t.Fatalf("the key %s must be found", key)
+		}
+	}
+
+	stats := tree.Stats()
+	if stats.Cache.ValueHits != 3 {
+		t.Fatalf("expected 3 value cache hits, got %d", stats.Cache.ValueHits)
+	}
+	if stats.Cache.ValueMisses != 2 {
+		t.Fatalf("expected 2 value cache misses, got %d", stats.Cache.ValueMisses)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+
+	// without the cache the counters stay zero
+	tree, err = lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+	if _, _, err := tree.Get([]byte("a")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if stats := tree.Stats(); stats.Cache.ValueHits != 0 || stats.Cache.ValueMisses != 0 {
+		t.Fatalf("the counters must stay zero without the cache, got %+v", stats.Cache)
+	}
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestSearchDepth(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	// the old key ends up in the oldest disk table, the mid key in
+	// the newer one and the new key stays in the MemTable
+	if err := tree.Put([]byte("old"), []byte("vo")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	if err := tree.Put([]byte("mid"), []byte("vm")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	if err := tree.Put([]byte("new"), []byte("vn")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, c := range []struct {
+		key   string
+		depth int
+	}{
+		{"new", 0},
+		{"mid", 1},
+		{"old", 2},
+		{"absent", 2},
+	} {
+		depth, err := tree.SearchDepth([]byte(c.key))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if depth != c.depth {
+			t.Fatalf("expected depth %d for key %s, got %d", c.depth, c.key, depth)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestSubdirectoryLayout(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.SubdirectoryLayout(), lsmtree.MemTableThreshold(100))
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	// the low MemTable threshold spreads the keys over several disk tables
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		if err := tree.Put(key, []byte(fmt.Sprintf("value-%03d", i))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dbDir, "tables", "0", "data.db")); err != nil {
+		t.Fatalf("the disk table files must be stored in the subdirectory: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dbDir, "0-data.db")); !os.IsNotExist(err) {
+		t.Fatalf("the flat layout files must not be created")
+	}
+
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		value, ok, err := tree.Get(key)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !ok || !bytes.Equal(value, []byte(fmt.Sprintf("value-%03d", i))) {
+			t.Fatalf("the key %s must be readable in the subdirectory layout", key)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+
+	// the layout is detected from the directory, the option
+	// is not required on the reopen
+	tree, err = lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		value, ok, err := tree.Get(key)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !ok || !bytes.Equal(value, []byte(fmt.Sprintf("value-%03d", i))) {
+			t.Fatalf("the key %s must survive the reopen", key)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestRecoverUntil(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("before")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	// the bad bulk operation to undo
+	for i := 0; i < 10; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("after")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := tree.Put([]byte(fmt.Sprintf("bad-%d", i)), []byte("after")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+
+	if err := lsmtree.RecoverUntil(dbDir, cutoff); err != nil {
+		t.Fatalf("failed to recover: %s", err)
+	}
+
+	tree, err = lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for i := 0; i < 10; i++ {
+		value, ok, err := tree.Get([]byte(fmt.Sprintf("key-%d", i)))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !ok || !bytes.Equal(value, []byte("before")) {
+			t.Fatalf("the key key-%d must hold the value written before the cutoff", i)
+		}
+
+		if _, ok, err := tree.Get([]byte(fmt.Sprintf("bad-%d", i))); err != nil || ok {
+			t.Fatalf("the key bad-%d written after the cutoff must be discarded", i)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	// the low MemTable threshold and the high merge threshold spread
+	// the keys over more disk tables than the handle bound allows open
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.MaxOpenFiles(4),
+		lsmtree.MemTableThreshold(100),
+		lsmtree.DiskTableNumThreshold(100),
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		if err := tree.Put(key, []byte(fmt.Sprintf("value-%03d", i))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	// repeated reads across all the tables must stay correct while the
+	// cache keeps closing and reopening the least recently used handles
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 50; i++ {
+			key := []byte(fmt.Sprintf("key-%03d", i))
+			value, ok, err := tree.Get(key)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !ok || !bytes.Equal(value, []byte(fmt.Sprintf("value-%03d", i))) {
+				t.Fatalf("the key %s must be readable with the bounded handle cache", key)
+			}
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestMmapReads(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	// the low thresholds spread the keys over many disk tables and
+	// trigger the merges, so the mappings are dropped and recreated
+	// while the tables are replaced under the reads
+	tree, err := lsmtree.Open(
+		dbDir,
+		lsmtree.MmapReads(),
 		lsmtree.MemTableThreshold(100),
 		lsmtree.DiskTableNumThreshold(3),
 	)
@@ -149,61 +4147,298 @@ func TestPut100(t *testing.T) {
 		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
 	}
 
-	fmt.Println(tree)
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		if err := tree.Put(key, []byte(fmt.Sprintf("value-%03d", i))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
 
-	// key = "1", value = "2"
-	// key = "2", value = "4"
-	// ...
-	for i := 1; i <= 100; i++ {
-		key := strconv.Itoa(i)
-		value := strconv.Itoa(i * 2)
-		err := tree.Put([]byte(key), []byte(value))
-		if err != nil {
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	// repeated reads must stay correct while served from the mapped
+	// bytes, including the reads after the merges replaced the tables
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 50; i++ {
+			key := []byte(fmt.Sprintf("key-%03d", i))
+			value, ok, err := tree.Get(key)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !ok || !bytes.Equal(value, []byte(fmt.Sprintf("value-%03d", i))) {
+				t.Fatalf("the key %s must be readable with the mapped reads", key)
+			}
+		}
+	}
+
+	if err := tree.Delete([]byte("key-000")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok, err := tree.Get([]byte("key-000")); err != nil || ok {
+		t.Fatalf("the deleted key must not be found: %v, %v", ok, err)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestFlushPartitions(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.FlushPartitions(3))
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for i := 0; i < 30; i++ {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		if err := tree.Put(key, []byte(fmt.Sprintf("value-%02d", i))); err != nil {
 			t.Fatalf("unexpected error: %s", err)
 		}
 	}
 
-	// key = "1", value = "2"
-	// key = "2", value deleted
-	// key = "3", value = "6"
-	// key = "4", value deleted
-	// ...
-	for i := 1; i <= 100; i++ {
-		if i%2 == 0 {
-			key := strconv.Itoa(i)
-			err := tree.Delete([]byte(key))
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	// the flush must split the MemTable into three disk tables
+	for index := 0; index < 3; index++ {
+		if _, err := os.Stat(filepath.Join(dbDir, fmt.Sprintf("%d-data.db", index))); err != nil {
+			t.Fatalf("the partitioned disk table %d must exist: %s", index, err)
+		}
+	}
+
+	// every key must read back across the partitions, including after
+	// the reopen that reloads the disk table meta
+	assert := func() {
+		for i := 0; i < 30; i++ {
+			key := []byte(fmt.Sprintf("key-%02d", i))
+			value, ok, err := tree.Get(key)
 			if err != nil {
 				t.Fatalf("unexpected error: %s", err)
 			}
+			if !ok || !bytes.Equal(value, []byte(fmt.Sprintf("value-%02d", i))) {
+				t.Fatalf("values do not match for %s: %s", key, value)
+			}
 		}
 	}
+	assert()
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
 
 	tree, err = lsmtree.Open(dbDir)
 	if err != nil {
 		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
 	}
+	assert()
 
-	for i := 1; i <= 100; i++ {
-		key := strconv.Itoa(i)
-		value, ok, err := tree.Get([]byte(key))
-		if err != nil {
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+// prepareCorruptDiskTable creates a database with a single flushed disk
+// table and corrupts the stored value of the key-19 record, so a Get of
+// that key fails its checksum. Returns the database directory.
+func prepareCorruptDiskTable(t *testing.T) string {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		if err := tree.Put(key, []byte(fmt.Sprintf("value-%02d", i))); err != nil {
 			t.Fatalf("unexpected error: %s", err)
 		}
+	}
 
-		if i%2 == 0 && ok {
-			t.Fatalf("key must be deleted %s, but it is not", key)
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+
+	// the records are written in the key order, so the last byte of the
+	// data file belongs to the value of key-19
+	dataPath := filepath.Join(dbDir, "0-data.db")
+	data, err := ioutil.ReadFile(dataPath)
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", dataPath, err)
+	}
+	data[len(data)-1] ^= 0xFF
+	if err := ioutil.WriteFile(dataPath, data, 0600); err != nil {
+		t.Fatalf("failed to write %s: %s", dataPath, err)
+	}
+
+	return dbDir
+}
+
+func TestFlushCleansPartialTables(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		panic(fmt.Errorf("failed to create %s: %w", dbDir, err))
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
 		}
+	}()
 
-		if i%2 != 0 {
-			if !ok {
-				t.Fatalf("key must be present %s, but it is not", key)
-			} else {
-				expectedValue := strconv.Itoa(i * 2)
-				if expectedValue != string(value) {
-					t.Fatalf("value is wrong for key %s: %s != %s", key, expectedValue, value)
-				}
-			}
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+	defer tree.Close()
+
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		if err := tree.Put(key, []byte(fmt.Sprintf("value-%02d", i))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// a directory in place of the sparse index file fails the flush
+	// after the data and the index files were already created, which
+	// mimics running out of the disk space midway
+	if err := os.Mkdir(filepath.Join(dbDir, "0-sparse.db"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Flush(); !errors.Is(err, lsmtree.ErrFlushFailed) {
+		t.Fatalf("expected ErrFlushFailed, but got %v", err)
+	}
+
+	// the partial table files must not be left behind
+	leftovers, err := filepath.Glob(filepath.Join(dbDir, "0-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leftovers) != 0 {
+		t.Fatalf("expected no partial table files, but got %v", leftovers)
+	}
+
+	// the data survives the failed flush in the MemTable
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		value, ok, err := tree.Get(key)
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %s", key, err)
+		}
+		if !ok || !bytes.Equal(value, []byte(fmt.Sprintf("value-%02d", i))) {
+			t.Fatalf("the key %s is lost after the failed flush: %v, %s", key, ok, value)
+		}
+	}
+
+	// with the obstacle gone the next flush succeeds
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		if _, ok, err := tree.Get(key); err != nil || !ok {
+			t.Fatalf("the key %s is lost after the flush: %v, %v", key, ok, err)
+		}
+	}
+}
+
+func TestOnCorruptTableFail(t *testing.T) {
+	dbDir := prepareCorruptDiskTable(t)
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir)
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	// the default policy surfaces the corruption to the reader
+	if _, _, err := tree.Get([]byte("key-19")); !errors.Is(err, lsmtree.ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, but got: %v", err)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestOnCorruptTableSkip(t *testing.T) {
+	dbDir := prepareCorruptDiskTable(t)
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.OnCorruptTable(lsmtree.CorruptTableSkip))
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	// the corrupted table is treated as empty instead of failing
+	if _, ok, err := tree.Get([]byte("key-19")); err != nil || ok {
+		t.Fatalf("the key of the skipped table must not be found: %v, %v", ok, err)
+	}
+
+	// the table files stay in place for the next read to retry
+	if _, err := os.Stat(filepath.Join(dbDir, "0-data.db")); err != nil {
+		t.Fatalf("the skipped table files must stay in place: %s", err)
+	}
+
+	if err := tree.Close(); err != nil {
+		panic(fmt.Errorf("failed to close: %w", err))
+	}
+}
+
+func TestOnCorruptTableQuarantine(t *testing.T) {
+	dbDir := prepareCorruptDiskTable(t)
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
 		}
+	}()
+
+	tree, err := lsmtree.Open(dbDir, lsmtree.OnCorruptTable(lsmtree.CorruptTableQuarantine))
+	if err != nil {
+		panic(fmt.Errorf("failed to open LSM tree %s: %w", dbDir, err))
+	}
+
+	if _, ok, err := tree.Get([]byte("key-19")); err != nil || ok {
+		t.Fatalf("the key of the quarantined table must not be found: %v, %v", ok, err)
+	}
+
+	// the bad files are renamed aside, so the next read skips the table
+	// as a missing one instead of hitting the corruption again
+	if _, err := os.Stat(filepath.Join(dbDir, "0-data.db")); !os.IsNotExist(err) {
+		t.Fatalf("the quarantined data file must be renamed aside: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dbDir, "0-data.db.corrupt")); err != nil {
+		t.Fatalf("the quarantined data file must be kept for inspection: %s", err)
+	}
+	if _, ok, err := tree.Get([]byte("key-19")); err != nil || ok {
+		t.Fatalf("the quarantined table must be skipped on the next read: %v, %v", ok, err)
 	}
 
 	if err := tree.Close(); err != nil {
@@ -0,0 +1,111 @@
+package lsmtree
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+)
+
+// writeDiskTableManifest writes the manifest of the disk table with the
+// given prefix: the size and the CRC-32 checksum of the data, the index
+// and the sparse index files. The manifest pins the bytes of the whole
+// table at the flush time, so VerifyTable detects the files altered out
+// of band, which the per-record checksums cannot, since a record can be
+// rewritten with a matching checksum.
+func writeDiskTableManifest(dbDir, prefix string) error {
+	var manifest bytes.Buffer
+	for _, fileName := range []string{diskTableDataFileName, diskTableIndexFileName, diskTableSparseIndexFileName} {
+		size, checksum, err := checksumFile(diskTableFilePath(dbDir, prefix, fileName))
+		if err != nil {
+			return err
+		}
+
+		if _, err := encode([]byte(fileName), encodeIntPair(size, int(checksum)), &manifest); err != nil {
+			return fmt.Errorf("failed to encode the manifest entry for %s: %w", fileName, err)
+		}
+	}
+
+	manifestPath := diskTableFilePath(dbDir, prefix, diskTableManifestFileName)
+	file, err := os.OpenFile(manifestPath, newDiskTableFlag, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open manifest file %s: %w", manifestPath, err)
+	}
+
+	if _, err := file.Write(manifest.Bytes()); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write manifest file %s: %w", manifestPath, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync manifest file %s: %w", manifestPath, err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close manifest file %s: %w", manifestPath, err)
+	}
+
+	return nil
+}
+
+// VerifyTable recomputes the sizes and the checksums of the files of
+// the disk table with the given index and compares them against its
+// manifest. It returns ErrTableAltered if any file does not match, so
+// the out-of-band tampering and the silent corruption are detected even
+// when every record still carries a valid checksum. The tables written
+// without a manifest, such as the merged ones, cannot be verified.
+func (t *LSMTree) VerifyTable(index int) error {
+	prefix := strconv.Itoa(index) + "-"
+
+	manifestPath := diskTableFilePath(t.dbDir, prefix, diskTableManifestFileName)
+	manifest, err := os.Open(manifestPath)
+	if err != nil {
+		return fmt.Errorf("failed to open manifest file %s: %w", manifestPath, err)
+	}
+	defer manifest.Close()
+
+	for {
+		name, value, err := decode(manifest)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read manifest file %s: %w", manifestPath, err)
+		}
+
+		expectedSize, expectedChecksum := decodeIntPair(value)
+
+		filePath := diskTableFilePath(t.dbDir, prefix, string(name))
+		size, checksum, err := checksumFile(filePath)
+		if err != nil {
+			return err
+		}
+
+		if size != expectedSize {
+			return wrapError(ErrTableAltered, fmt.Errorf("the size of %s changed from %d to %d", filePath, expectedSize, size))
+		}
+		if checksum != uint32(expectedChecksum) {
+			return wrapError(ErrTableAltered, fmt.Errorf("the checksum of %s does not match the manifest", filePath))
+		}
+	}
+}
+
+// checksumFile returns the size of the file in bytes and the CRC-32
+// checksum of its content.
+func checksumFile(filePath string) (int, uint32, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open file %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	hash := crc32.NewIEEE()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read file %s: %w", filePath, err)
+	}
+
+	return int(size), hash.Sum32(), nil
+}
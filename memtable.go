@@ -12,6 +12,11 @@ type memTable struct {
 	data *rbytree.Tree
 	// The size of all keys and values inserted into the MemTable in b.
 	b int
+	// If set, the inserted keys and values are copied into the arena
+	// blocks instead of being held as the individual slices, which
+	// eases the GC pressure of a write-heavy load. Nil stores the
+	// slices as they are passed.
+	arena *arena
 }
 
 // newMemTable returns a new instance of the MemTable.
@@ -21,6 +26,11 @@ func newMemTable() *memTable {
 
 // put puts the key and the value into the table.
 func (mt *memTable) put(key, value []byte) error {
+	if mt.arena != nil {
+		key = mt.arena.copy(key)
+		value = mt.arena.copy(value)
+	}
+
 	prev, exists := mt.data.Put(key, value)
 	if exists {
 		mt.b += -len(prev) + len(value)
@@ -39,6 +49,10 @@ func (mt *memTable) get(key []byte) ([]byte, bool) {
 
 // delete marks the key as deleted in the table, but does not remove it.
 func (mt *memTable) delete(key []byte) error {
+	if mt.arena != nil {
+		key = mt.arena.copy(key)
+	}
+
 	value, exists := mt.data.Put(key, nil)
 	if !exists {
 		mt.b += len(key)
@@ -54,10 +68,20 @@ func (mt *memTable) bytes() int {
 	return mt.b
 }
 
-// clear clears all the data and resets the size.
+// keys returns the number of keys in the MemTable, including the deleted ones.
+func (mt *memTable) keys() int {
+	return mt.data.Size()
+}
+
+// clear clears all the data and resets the size. The arena blocks are
+// dropped wholesale: the flushed entries referencing them go away with
+// the old tree, so the blocks are collected in one piece.
 func (mt *memTable) clear() {
 	mt.data = rbytree.New()
 	mt.b = 0
+	if mt.arena != nil {
+		mt.arena.reset()
+	}
 }
 
 // iterator returns iterator for the MemTable. It also iterates over
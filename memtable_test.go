@@ -1,7 +1,11 @@
 package lsmtree
 
 import (
+	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -74,6 +78,39 @@ func TestMemTable_delete(t *testing.T) {
 	}
 }
 
+func TestFlushEmptyMemTable(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := Open(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open LSM tree %s: %s", dbDir, err)
+	}
+
+	if err := tree.flushMemTable(); err != nil {
+		t.Fatalf("failed to flush the MemTable: %s", err)
+	}
+
+	dataFiles, err := filepath.Glob(filepath.Join(dbDir, "*-"+diskTableDataFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dataFiles) != 0 {
+		t.Fatalf("flushing an empty MemTable must not create disk tables, but created %v", dataFiles)
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+}
+
 func TestMemTable_clear(t *testing.T) {
 	const length = 100
 	mt := newMemTable()
@@ -92,6 +129,86 @@ func TestMemTable_clear(t *testing.T) {
 	}
 }
 
+func TestMemTableArena(t *testing.T) {
+	const length = 100
+	mt := newMemTable()
+	mt.arena = newArena(4096)
+
+	// the inserted slices are copied into the arena, so mutating the
+	// original buffers afterwards must not corrupt the stored entries
+	key := make([]byte, 8)
+	value := make([]byte, 8)
+	for i := 0; i < length; i++ {
+		copy(key, fmt.Sprintf("key-%04d", i))
+		copy(value, fmt.Sprintf("val-%04d", i))
+		if err := mt.put(key, value); err != nil {
+			t.Error(err)
+		}
+	}
+	if mt.data.Size() != length {
+		t.Errorf("length of underlying tree is not as expected, expected: %d, actual: %d", length, mt.data.Size())
+	}
+	for i := 0; i < length; i++ {
+		value, ok := mt.get([]byte(fmt.Sprintf("key-%04d", i)))
+		if !ok || string(value) != fmt.Sprintf("val-%04d", i) {
+			t.Errorf("value does not match for key-%04d: %s", i, value)
+		}
+	}
+
+	// the tombstone values must stay nil through the arena
+	copy(key, fmt.Sprintf("key-%04d", 0))
+	if err := mt.delete(key); err != nil {
+		t.Error(err)
+	}
+	if value, ok := mt.get([]byte(fmt.Sprintf("key-%04d", 0))); !ok || value != nil {
+		t.Errorf("the deleted key must store a nil value, got %v, %v", value, ok)
+	}
+
+	mt.clear()
+	if mt.data.Size() != 0 || mt.bytes() != 0 {
+		t.Errorf("the cleared MemTable must be empty, size: %d, bytes: %d", mt.data.Size(), mt.bytes())
+	}
+	if mt.arena.block != nil || mt.arena.used != 0 {
+		t.Errorf("the cleared MemTable must drop the arena blocks")
+	}
+}
+
+// BenchmarkMemTablePut measures a large in-memory load where every
+// entry is its own allocation, like the plain MemTable retains them.
+// Compare allocs/op with BenchmarkArenaMemTablePut.
+func BenchmarkMemTablePut(b *testing.B) {
+	mt := newMemTable()
+	key := make([]byte, 16)
+	value := make([]byte, 64)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(key, fmt.Sprintf("key-%012d", i))
+		if err := mt.put(append([]byte(nil), key...), append([]byte(nil), value...)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkArenaMemTablePut is the same load with the entries copied
+// into the arena blocks, so the per-entry allocations disappear.
+func BenchmarkArenaMemTablePut(b *testing.B) {
+	mt := newMemTable()
+	mt.arena = newArena(1 << 20)
+	key := make([]byte, 16)
+	value := make([]byte, 64)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(key, fmt.Sprintf("key-%012d", i))
+		if err := mt.put(key, value); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 var r = rand.New(rand.NewSource(time.Now().Unix()))
 
 func randBytes(size int) []byte {
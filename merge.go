@@ -5,119 +5,745 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path"
 	"strconv"
+	"sync"
+	"time"
 )
 
+// compactionLimiter runs compactions in the background and allows at most
+// maxConcurrent of them to run at once. The rest are queued and run in
+// the order they were scheduled.
+type compactionLimiter struct {
+	mu            sync.Mutex
+	cond          *sync.Cond
+	queue         []func()
+	running       int
+	maxConcurrent int
+	closed        bool
+}
+
+// newCompactionLimiter returns a new compaction limiter that allows
+// at most maxConcurrent compactions to run at once.
+func newCompactionLimiter(maxConcurrent int) *compactionLimiter {
+	l := &compactionLimiter{maxConcurrent: maxConcurrent}
+	l.cond = sync.NewCond(&l.mu)
+
+	return l
+}
+
+// schedule queues the compaction and runs it as soon as a slot is free.
+// It does nothing if the limiter is already closed.
+func (l *compactionLimiter) schedule(compact func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return
+	}
+
+	l.queue = append(l.queue, compact)
+	if l.running < l.maxConcurrent {
+		l.running++
+		go l.work()
+	}
+}
+
+// work runs queued compactions until the queue is empty.
+func (l *compactionLimiter) work() {
+	l.mu.Lock()
+	for len(l.queue) > 0 {
+		compact := l.queue[0]
+		l.queue = l.queue[1:]
+
+		l.mu.Unlock()
+		compact()
+		l.mu.Lock()
+	}
+
+	l.running--
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+// pending reports whether the limiter has queued or in-flight
+// compactions.
+func (l *compactionLimiter) pending() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.queue) > 0 || l.running > 0
+}
+
+// wait blocks until the queued and the in-flight compactions finish.
+func (l *compactionLimiter) wait() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for len(l.queue) > 0 || l.running > 0 {
+		l.cond.Wait()
+	}
+}
+
+// close drops the queued compactions and waits for the in-flight
+// ones to finish.
+func (l *compactionLimiter) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closed = true
+	l.queue = nil
+	for l.running > 0 {
+		l.cond.Wait()
+	}
+}
+
+// CompactionPool schedules the background merges of multiple trees on
+// a single bounded worker pool, so the total compaction concurrency of
+// the process stays bounded no matter how many trees are open. The
+// queued merges run in the order they were scheduled across all trees,
+// so a busy tree cannot starve the others indefinitely.
+type CompactionPool struct {
+	mu            sync.Mutex
+	cond          *sync.Cond
+	queue         []compactionTask
+	workers       int
+	running       map[*LSMTree]int
+	maxConcurrent int
+}
+
+// compactionTask pairs a queued merge with the tree that scheduled it,
+// so the merges of a closed tree can be dropped from the queue.
+type compactionTask struct {
+	owner   *LSMTree
+	compact func()
+}
+
+// NewCompactionPool returns a new compaction pool that allows at most
+// maxConcurrent merges to run at once across all trees sharing it.
+func NewCompactionPool(maxConcurrent int) *CompactionPool {
+	p := &CompactionPool{maxConcurrent: maxConcurrent, running: make(map[*LSMTree]int)}
+	p.cond = sync.NewCond(&p.mu)
+
+	return p
+}
+
+// schedule queues the merge of the tree and runs it as soon as a
+// worker is free.
+func (p *CompactionPool) schedule(owner *LSMTree, compact func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.queue = append(p.queue, compactionTask{owner: owner, compact: compact})
+	if p.workers < p.maxConcurrent {
+		p.workers++
+		go p.work()
+	}
+}
+
+// work runs the queued merges until the queue is empty.
+func (p *CompactionPool) work() {
+	p.mu.Lock()
+	for len(p.queue) > 0 {
+		task := p.queue[0]
+		p.queue = p.queue[1:]
+		p.running[task.owner]++
+
+		p.mu.Unlock()
+		task.compact()
+		p.mu.Lock()
+
+		p.running[task.owner]--
+		p.cond.Broadcast()
+	}
+
+	p.workers--
+	p.mu.Unlock()
+}
+
+// wait blocks until the queued and the in-flight merges of the tree
+// finish. The merges of the other trees are not waited for.
+func (p *CompactionPool) wait(owner *LSMTree) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.pending(owner) {
+		p.cond.Wait()
+	}
+}
+
+// busy reports whether the tree has queued or in-flight merges.
+func (p *CompactionPool) busy(owner *LSMTree) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.pending(owner)
+}
+
+// pending reports whether the tree has queued or in-flight merges.
+// The mutex of the pool must be held.
+func (p *CompactionPool) pending(owner *LSMTree) bool {
+	if p.running[owner] > 0 {
+		return true
+	}
+	for _, task := range p.queue {
+		if task.owner == owner {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deregister drops the queued merges of the tree and waits for its
+// in-flight ones to finish, so Close does not leave the merges of a
+// closed tree behind. The pool keeps serving the other trees.
+func (p *CompactionPool) deregister(owner *LSMTree) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	queue := p.queue[:0]
+	for _, task := range p.queue {
+		if task.owner != owner {
+			queue = append(queue, task)
+		}
+	}
+	p.queue = queue
+
+	for p.running[owner] > 0 {
+		p.cond.Wait()
+	}
+	delete(p.running, owner)
+}
+
+// compactionRateLimiter throttles the merge writes with a token
+// bucket: every written byte consumes a token and the tokens refill at
+// bytesPerSec, with the burst capped at one second of tokens. The
+// bucket starts empty and a writer that overdraws it sleeps the debt
+// off. The sleeps are always finite, so a throttled merge cannot
+// deadlock Close, which waits for the in-flight compactions.
+type compactionRateLimiter struct {
+	mu          sync.Mutex
+	bytesPerSec int
+	tokens      float64
+	lastRefill  time.Time
+}
+
+// newCompactionRateLimiter returns a new rate limiter that allows at
+// most bytesPerSec bytes of merge writes per second.
+func newCompactionRateLimiter(bytesPerSec int) *compactionRateLimiter {
+	return &compactionRateLimiter{bytesPerSec: bytesPerSec, lastRefill: time.Now()}
+}
+
+// wait consumes n tokens and sleeps until the bucket refills the
+// overdraft.
+func (l *compactionRateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.lastRefill).Seconds() * float64(l.bytesPerSec)
+	if l.tokens > float64(l.bytesPerSec) {
+		l.tokens = float64(l.bytesPerSec)
+	}
+	l.lastRefill = now
+	l.tokens -= float64(n)
+
+	var sleep time.Duration
+	if l.tokens < 0 {
+		sleep = time.Duration(-l.tokens / float64(l.bytesPerSec) * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if sleep > 0 {
+		time.Sleep(sleep)
+	}
+}
+
 // mergeDiskTables merges disk table with index a and b and
 // creates new merge table with index b.
 // The index a must be less than be and to be older.
-func mergeDiskTables(dbDir string, a, b int, sparseKeyDistance int) error {
-	mergePrefix := "merge"
-	aPrefix := strconv.Itoa(a) + "-"
-	bPrefix := strconv.Itoa(b) + "-"
+// Returns the total number of bytes written.
+func mergeDiskTables(dbDir string, a, b int, sparseKeyDistance int) (int, error) {
+	n, _, err := mergeDiskTableRun(dbDir, []int{a, b}, sparseKeyDistance, 0, false, nil, false, 0, 0, nil, nil)
+
+	return n, err
+}
+
+// mergeDiskTableRun merges the run of disk tables into the newest one
+// in a single pass. The run must be ordered from the oldest to the newest.
+// The merge streams one record at a time per disk table, so memory usage
+// stays proportional to the number of tables regardless of their size.
+// The tombstones may only be dropped when the run includes the oldest
+// disk table: dropping them earlier would resurrect the deleted keys
+// still stored in the older tables.
+// If refs is not nil, the deletion of the disk tables that the open
+// iterators still reference is deferred until they are released, and
+// the final swap of the run for the merged result runs with the
+// readers blocked out, so a concurrent search stays consistent.
+// If checksummed is set, the merged data file records carry the
+// checksums of their payload. If blockAlign is set, they are padded
+// to the block boundaries.
+// If maxTableBytes is positive, the output is split into several
+// tables partitioned by the key range once it passes the threshold.
+// The partitions take over the newest index slots of the run, so their
+// number never exceeds the length of the run.
+// If limiter is not nil, the merge writes are throttled by it.
+// If resolver is not nil, it merges the values stored for the same key
+// in several tables; otherwise the newest value wins.
+// Returns the total number of bytes written and the number of the
+// produced disk tables.
+func mergeDiskTableRun(dbDir string, run []int, sparseKeyDistance, sparseByteDistance int, dropTombstones bool, refs *tableRefs, checksummed bool, blockAlign, maxTableBytes int, limiter *compactionRateLimiter, resolver ConflictResolver) (int, int, error) {
+	iterators := make([]*dataFileIterator, 0, len(run))
+	prefixes := make([]string, 0, len(run))
+	defer func() {
+		for _, it := range iterators {
+			it.close()
+		}
+	}()
+
+	for _, index := range run {
+		prefix := strconv.Itoa(index) + "-"
+		prefixes = append(prefixes, prefix)
+
+		dataPath := diskTableFilePath(dbDir, prefix, diskTableDataFileName)
+		it, err := newDataFileIterator(dataPath)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to instantiate iterator for %s: %w", dataPath, err)
+		}
 
-	aPath := path.Join(dbDir, aPrefix+diskTableDataFileName)
-	aIt, err := newDataFileIterator(aPath)
+		iterators = append(iterators, it)
+	}
+
+	w, err := newSplitDiskTableWriter(dbDir, sparseKeyDistance, sparseByteDistance, checksummed, blockAlign, maxTableBytes, len(run), limiter)
 	if err != nil {
-		return fmt.Errorf("failed to instantiate iterator for %s: %w", aPath, err)
+		return 0, 0, fmt.Errorf("failed to instantiate disk table writer: %w", err)
 	}
-	defer aIt.close()
 
-	bPath := path.Join(dbDir, bPrefix+diskTableDataFileName)
-	bIt, err := newDataFileIterator(bPath)
+	disjoint, err := disjointAscendingRun(dbDir, run)
 	if err != nil {
-		return fmt.Errorf("failed to iterator for %s: %w", bPath, err)
+		return 0, 0, fmt.Errorf("failed to read the key bounds of the run: %w", err)
+	}
+
+	if disjoint {
+		// the key ranges do not overlap, so the per-record key
+		// comparisons of merge are pure overhead and are skipped
+		if err := concat(iterators, w, dropTombstones); err != nil {
+			return 0, 0, fmt.Errorf("failed to concatenate disk tables: %w", err)
+		}
+	} else if err := merge(iterators, w, dropTombstones, resolver); err != nil {
+		return 0, 0, fmt.Errorf("failed to merge disk tables: %w", err)
+	}
+
+	for i, it := range iterators {
+		if err := it.close(); err != nil {
+			return 0, 0, fmt.Errorf("failed to close iterator for disk table %d: %w", run[i], err)
+		}
+	}
+
+	if err := w.sync(); err != nil {
+		return 0, 0, fmt.Errorf("failed to sync merged disk table: %w", err)
+	}
+
+	if err := w.close(); err != nil {
+		return 0, 0, fmt.Errorf("failed to close merged disk table: %w", err)
+	}
+
+	// the partitions take over the newest slots of the run; those
+	// tables are replaced by the renames below, which keeps the
+	// descriptors already open on them valid; the older tables are
+	// deleted, or deferred while the iterators reference them
+	parts := w.tables()
+	reused := prefixes[len(prefixes)-parts:]
+	swap := func() error {
+		if refs != nil {
+			if err := refs.deleteOrDefer(run[:len(run)-parts]); err != nil {
+				return fmt.Errorf("failed to delete disk tables: %w", err)
+			}
+
+			if err := deleteDiskTables(dbDir, reused...); err != nil {
+				return fmt.Errorf("failed to delete disk tables: %w", err)
+			}
+		} else if err := deleteDiskTables(dbDir, prefixes...); err != nil {
+			return fmt.Errorf("failed to delete disk tables: %w", err)
+		}
+
+		for part := 0; part < parts; part++ {
+			if err := renameDiskTable(dbDir, mergePartPrefix(part), reused[part]); err != nil {
+				return fmt.Errorf("failed to rename merged disk table: %w", err)
+			}
+		}
+
+		return nil
+	}
+
+	// the swap runs with the readers blocked out, so a concurrent
+	// search never observes the half-deleted state between the deletes
+	// and the renames
+	if refs != nil {
+		refs.lockSwap()
+		err := swap()
+		if unlockErr := refs.unlockSwap(); err == nil {
+			err = unlockErr
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	} else if err := swap(); err != nil {
+		return 0, 0, err
+	}
+
+	return w.bytes(), parts, nil
+}
+
+// diskTableSink consumes the records produced by merge and concat. It
+// is implemented by the disk table writer and by the splitting writer
+// that partitions the output by the key range.
+type diskTableSink interface {
+	write(key, value []byte) error
+}
+
+// splitDiskTableWriter writes the merged records into one or more disk
+// tables partitioned by the key range: once the current table passes
+// maxTableBytes, the following keys go to a new one. The number of
+// partitions is capped by maxTables, since every partition takes over
+// the index slot of one of the merged tables. With maxTableBytes of
+// zero the output is a single table.
+type splitDiskTableWriter struct {
+	dbDir              string
+	sparseKeyDistance  int
+	sparseByteDistance int
+	checksummed        bool
+	blockAlign         int
+	maxTableBytes      int
+	maxTables          int
+	limiter            *compactionRateLimiter
+
+	writers []*diskTableWriter
+}
+
+// newSplitDiskTableWriter returns new instance of splitDiskTableWriter
+// with the first partition already open.
+func newSplitDiskTableWriter(dbDir string, sparseKeyDistance, sparseByteDistance int, checksummed bool, blockAlign, maxTableBytes, maxTables int, limiter *compactionRateLimiter) (*splitDiskTableWriter, error) {
+	w := &splitDiskTableWriter{
+		dbDir:              dbDir,
+		sparseKeyDistance:  sparseKeyDistance,
+		sparseByteDistance: sparseByteDistance,
+		checksummed:        checksummed,
+		blockAlign:         blockAlign,
+		maxTableBytes:      maxTableBytes,
+		maxTables:          maxTables,
+		limiter:            limiter,
+	}
+
+	if err := w.rotate(); err != nil {
+		return nil, err
 	}
-	defer bIt.close()
 
-	w, err := newDiskTableWriter(dbDir, mergePrefix, sparseKeyDistance)
+	return w, nil
+}
+
+// rotate opens the writer of the next partition.
+func (w *splitDiskTableWriter) rotate() error {
+	next, err := newDiskTableWriter(w.dbDir, mergePartPrefix(len(w.writers)), w.sparseKeyDistance, w.sparseByteDistance, w.checksummed)
 	if err != nil {
 		return fmt.Errorf("failed to instantiate disk table writer: %w", err)
 	}
+	next.blockAlign = w.blockAlign
+	next.limiter = w.limiter
+
+	w.writers = append(w.writers, next)
+
+	return nil
+}
+
+// write writes the key and the value into the current partition,
+// opening the next one once the current passes the size threshold.
+func (w *splitDiskTableWriter) write(key, value []byte) error {
+	current := w.writers[len(w.writers)-1]
+	if w.maxTableBytes > 0 && current.bytes() >= w.maxTableBytes && len(w.writers) < w.maxTables {
+		if err := w.rotate(); err != nil {
+			return err
+		}
 
-	if err := merge(aIt, bIt, w); err != nil {
-		return fmt.Errorf("failed to merge disk tables: %w", err)
+		current = w.writers[len(w.writers)-1]
 	}
 
-	if err := aIt.close(); err != nil {
-		return fmt.Errorf("failed to close iterator for %s: %w", aPath, err)
+	return current.write(key, value)
+}
+
+// sync commits the written contents of every partition to the stable
+// storage.
+func (w *splitDiskTableWriter) sync() error {
+	for _, writer := range w.writers {
+		if err := writer.sync(); err != nil {
+			return err
+		}
 	}
 
-	if err := bIt.close(); err != nil {
-		return fmt.Errorf("failed to close iterator for %s: %w", bPath, err)
+	return nil
+}
+
+// close closes the files of every partition.
+func (w *splitDiskTableWriter) close() error {
+	for _, writer := range w.writers {
+		if err := writer.close(); err != nil {
+			return err
+		}
 	}
 
-	if err := deleteDiskTables(dbDir, aPrefix, bPrefix); err != nil {
-		return fmt.Errorf("failed to delete disk tables: %w", err)
+	return nil
+}
+
+// bytes returns the total number of bytes written to all partitions.
+func (w *splitDiskTableWriter) bytes() int {
+	total := 0
+	for _, writer := range w.writers {
+		total += writer.bytes()
 	}
 
-	if err := renameDiskTable(dbDir, mergePrefix, bPrefix); err != nil {
-		return fmt.Errorf("failed to rename merged disk table: %w", err)
+	return total
+}
+
+// tables returns the number of the produced partitions.
+func (w *splitDiskTableWriter) tables() int {
+	return len(w.writers)
+}
+
+// mergePartPrefix returns the temporary prefix of the merge output
+// partition. The first partition keeps the historical "merge" prefix,
+// so the leftovers of the single-table merges stay recognizable.
+func mergePartPrefix(part int) string {
+	if part == 0 {
+		return "merge"
 	}
 
-	return nil
+	return "merge" + strconv.Itoa(part)
 }
 
-// merge merges keys and values from a and b iterators and writes them
-// into the disk stable using disk table writer.
-func merge(aIt, bIt *dataFileIterator, w *diskTableWriter) error {
-	var aKey, aValue, bKey, bValue []byte
-	for {
-		if aKey == nil && aIt.hasNext() {
-			if k, v, err := aIt.next(); err != nil {
-				return fmt.Errorf("failed to get next for a: %w", err)
-			} else {
-				aKey, aValue = k, v
+// pickSizeTieredRun picks the disk tables to merge for the size-tiered
+// compaction. It returns the oldest run of at least two adjacent disk
+// tables of a similar size, or the two oldest disk tables if there is
+// no such run. The run is ordered from the oldest to the newest.
+func pickSizeTieredRun(dbDir string, maxIndex int) ([]int, error) {
+	indexes, err := listDiskTables(dbDir, maxIndex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list disk tables: %w", err)
+	}
+	if len(indexes) < 2 {
+		return nil, nil
+	}
+
+	tiers := make([]int, len(indexes))
+	for i, index := range indexes {
+		dataPath := diskTableFilePath(dbDir, strconv.Itoa(index)+"-", diskTableDataFileName)
+		stat, err := os.Stat(dataPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat data file %s: %w", dataPath, err)
+		}
+
+		tiers[i] = sizeTier(stat.Size())
+	}
+
+	start := 0
+	for i := 1; i <= len(indexes); i++ {
+		if i < len(indexes) && tiers[i] == tiers[start] {
+			continue
+		}
+
+		if i-start >= 2 {
+			return indexes[start:i], nil
+		}
+
+		start = i
+	}
+
+	// there are no disk tables of a similar size,
+	// merge the two oldest ones
+	return indexes[0:2], nil
+}
+
+// scoreDiskTable estimates the reclaimable bytes of the disk table by
+// scanning its data file: the tombstone records reclaim their own
+// bytes once the deleted keys are merged away. The shadowed values in
+// the older tables are not counted, so the estimate is a lower bound.
+func scoreDiskTable(dbDir string, index int) (int, error) {
+	dataPath := diskTableFilePath(dbDir, strconv.Itoa(index)+"-", diskTableDataFileName)
+	it, err := newDataFileIterator(dataPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to instantiate iterator for %s: %w", dataPath, err)
+	}
+	defer it.close()
+
+	score := 0
+	for it.hasNext() {
+		key, value, err := it.next()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read from the data file: %w", err)
+		}
+
+		if value == nil {
+			score += encodedLen(key, nil)
+		}
+	}
+
+	return score, nil
+}
+
+// pickTombstoneRun picks the disk tables to merge for the
+// tombstone-density compaction. Every disk table is scored by its
+// estimated reclaimable bytes and the adjacent pair with the highest
+// combined score is merged, so the merges reclaim the most space per
+// I/O. With no tombstones anywhere the two oldest disk tables are
+// picked. The run is ordered from the oldest to the newest.
+// Returns the run and the computed scores by the disk table index.
+func pickTombstoneRun(dbDir string, maxIndex int) ([]int, map[int]int, error) {
+	indexes, err := listDiskTables(dbDir, maxIndex)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list disk tables: %w", err)
+	}
+	if len(indexes) < 2 {
+		return nil, nil, nil
+	}
+
+	scores := make(map[int]int, len(indexes))
+	for _, index := range indexes {
+		score, err := scoreDiskTable(dbDir, index)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to score disk table %d: %w", index, err)
+		}
+
+		scores[index] = score
+	}
+
+	// only the adjacent disk tables are merged, since merging around
+	// a skipped table would let its keys be shadowed by older values
+	best := 0
+	for i := 1; i+1 < len(indexes); i++ {
+		if scores[indexes[i]]+scores[indexes[i+1]] > scores[indexes[best]]+scores[indexes[best+1]] {
+			best = i
+		}
+	}
+
+	return indexes[best : best+2], scores, nil
+}
+
+// sizeTier returns the size tier of the disk table: the sizes within
+// the same power of two fall into the same tier.
+func sizeTier(size int64) int {
+	tier := 0
+	for size > 1 {
+		size >>= 1
+		tier++
+	}
+
+	return tier
+}
+
+// disjointAscendingRun reports whether the key ranges of the disk
+// tables in the run are disjoint and ascending, so the run can be
+// concatenated instead of merged. Only the sparse indexes and the
+// index file tails are read to decide. An empty disk table in the
+// run disables the fast path.
+func disjointAscendingRun(dbDir string, run []int) (bool, error) {
+	var prevMax []byte
+	for _, index := range run {
+		min, max, err := diskTableKeyBounds(dbDir, index)
+		if err != nil {
+			return false, fmt.Errorf("failed to read the key bounds of disk table %d: %w", index, err)
+		}
+		if min == nil {
+			return false, nil
+		}
+
+		if prevMax != nil && bytes.Compare(prevMax, min) >= 0 {
+			return false, nil
+		}
+		prevMax = max
+	}
+
+	return true, nil
+}
+
+// concat streams the iterators one after another into the disk table
+// writer without comparing the keys. It is only correct when the key
+// ranges of the iterators are disjoint and ascending, so every key
+// occurs once and the concatenation is already sorted.
+// If dropTombstones is set, the deleted keys are not written to the
+// output, under the same safety condition as in merge.
+func concat(iterators []*dataFileIterator, w diskTableSink, dropTombstones bool) error {
+	for _, it := range iterators {
+		for it.hasNext() {
+			key, value, err := it.next()
+			if err != nil {
+				return fmt.Errorf("failed to get next: %w", err)
+			}
+
+			if value == nil && dropTombstones {
+				continue
+			}
+
+			if err := w.write(key, value); err != nil {
+				return fmt.Errorf("failed to write: %w", err)
 			}
 		}
+	}
 
-		if bKey == nil && bIt.hasNext() {
-			if k, v, err := bIt.next(); err != nil {
-				return fmt.Errorf("failed to get next for b: %w", err)
-			} else {
-				bKey, bValue = k, v
+	return nil
+}
+
+// merge merges keys and values from the iterators, ordered from the
+// oldest to the newest, and writes them into the disk table using the
+// disk table writer. For the same key the record from the newest
+// iterator wins. Each iterator buffers a single record, so the merge
+// never holds more than one record per disk table in memory.
+// If dropTombstones is set, the deleted keys are not written to the
+// output at all, which is only safe when no older disk table can
+// still hold a value for them.
+// If resolver is not nil, it folds the values stored for the same key
+// from the oldest to the newest pair by pair; the tombstones are
+// passed to it as nil values.
+func merge(iterators []*dataFileIterator, w diskTableSink, dropTombstones bool, resolver ConflictResolver) error {
+	for {
+		// iterators buffer the current record in it.key and it.value,
+		// so the minimum can be found without consuming the records
+		var minKey []byte
+		for _, it := range iterators {
+			if it.hasNext() && (minKey == nil || bytes.Compare(it.key, minKey) < 0) {
+				minKey = it.key
 			}
 		}
 
-		if aKey == nil && bKey == nil && !aIt.hasNext() && !bIt.hasNext() {
+		if minKey == nil {
 			return nil
 		}
 
-		if aKey != nil && bKey != nil {
-			cmp := bytes.Compare(aKey, bKey)
-
-			if cmp == 0 {
-				// a key == b key, can discard a, since
-				// the b is newer
-				if err := w.write(bKey, bValue); err != nil {
-					return fmt.Errorf("failed to write: %w", err)
-				}
-				aKey, aValue, bKey, bValue = nil, nil, nil, nil
-			} else if cmp > 0 {
-				// a key > b key
-				// write b key and read the next b key
-				if err := w.write(bKey, bValue); err != nil {
-					return fmt.Errorf("failed to write: %w", err)
-				}
-				bKey, bValue = nil, nil
-			} else if cmp < 0 {
-				// a key < b key
-				if err := w.write(aKey, aValue); err != nil {
-					return fmt.Errorf("failed to write: %w", err)
-				}
-				aKey, aValue = nil, nil
+		// consume the minimum key from every iterator that holds it,
+		// the iterators are ordered from the oldest to the newest,
+		// so without a resolver the last consumed value wins
+		var value []byte
+		first := true
+		for _, it := range iterators {
+			if !it.hasNext() || !bytes.Equal(it.key, minKey) {
+				continue
 			}
-		} else if aKey != nil {
-			if err := w.write(aKey, aValue); err != nil {
-				return fmt.Errorf("failed to write: %w", err)
+
+			_, v, err := it.next()
+			if err != nil {
+				return fmt.Errorf("failed to get next: %w", err)
 			}
-			aKey, aValue = nil, nil
-		} else {
-			if err := w.write(bKey, bValue); err != nil {
-				return fmt.Errorf("failed to write: %w", err)
+
+			if first || resolver == nil {
+				value = v
+				first = false
+			} else {
+				value = resolver(minKey, value, v)
 			}
-			bKey, bValue = nil, nil
+		}
+
+		if value == nil && dropTombstones {
+			continue
+		}
+
+		if err := w.write(minKey, value); err != nil {
+			return fmt.Errorf("failed to write: %w", err)
 		}
 	}
 }
@@ -129,6 +755,10 @@ type dataFileIterator struct {
 	value    []byte
 	end      bool
 	closed   bool
+	// The offset of the record that is returned by the next call to next.
+	nextOffset int
+	// The offset of the record that was most recently returned by next.
+	currentOffset int
 }
 
 // newDataFileIterator instantiates new data file iterator.
@@ -145,11 +775,13 @@ func newDataFileIterator(path string) (*dataFileIterator, error) {
 	end := err == io.EOF
 
 	return &dataFileIterator{
-		dataFile,
-		key,
-		value,
-		end,
-		false,
+		dataFile:      dataFile,
+		key:           key,
+		value:         value,
+		end:           end,
+		closed:        false,
+		nextOffset:    0,
+		currentOffset: 0,
 	}, nil
 }
 
@@ -162,6 +794,13 @@ func (it *dataFileIterator) hasNext() bool {
 func (it *dataFileIterator) next() ([]byte, []byte, error) {
 	key, value := it.key, it.value
 
+	// the checksummed records are longer than encodedLen, so the offset
+	// of the following record is taken from the file position instead
+	start, err := it.dataFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to seek: %w", err)
+	}
+
 	nextKey, nextValue, err := decode(it.dataFile)
 	if err != nil && err != io.EOF {
 		return nil, nil, fmt.Errorf("failed to read: %w", err)
@@ -172,10 +811,30 @@ func (it *dataFileIterator) next() ([]byte, []byte, error) {
 
 	it.key = nextKey
 	it.value = nextValue
+	it.currentOffset = it.nextOffset
+	it.nextOffset = int(start)
 
 	return key, value, nil
 }
 
+// nextWithOffset returns the current key and value together with the
+// offset of the record in the data file and advances the iterator position.
+// The offset points to the beginning of the returned record.
+func (it *dataFileIterator) nextWithOffset() ([]byte, []byte, int, error) {
+	key, value, err := it.next()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return key, value, it.currentOffset, nil
+}
+
+// offset returns the offset in the data file of the record that was
+// most recently returned by next.
+func (it *dataFileIterator) offset() int {
+	return it.currentOffset
+}
+
 // close closes associated file.
 func (it *dataFileIterator) close() error {
 	if it.closed {
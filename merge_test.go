@@ -1,12 +1,17 @@
 package lsmtree
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestMergeDiskTables(t *testing.T) {
@@ -19,14 +24,14 @@ func TestMergeDiskTables(t *testing.T) {
 			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
 		}
 	}()
-	if err := createDiskTable(prepareMemTable1(), dbDir, 0, 3); err != nil {
+	if _, err := createDiskTable(prepareMemTable1(), dbDir, 0, 3, 0, false, 0); err != nil {
 		t.Fatal(err)
 	}
-	if err := createDiskTable(prepareMemTable2(), dbDir, 1, 3); err != nil {
+	if _, err := createDiskTable(prepareMemTable2(), dbDir, 1, 3, 0, false, 0); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := mergeDiskTables(dbDir, 0, 1, 3); err != nil {
+	if _, err := mergeDiskTables(dbDir, 0, 1, 3); err != nil {
 		t.Fatal(err)
 	}
 
@@ -60,6 +65,723 @@ func TestMergeDiskTables(t *testing.T) {
 	}
 }
 
+func TestMergeWithConflictResolver(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	older := newMemTable()
+	older.put([]byte("a"), []byte("va"))
+	older.put([]byte("d"), []byte("vd"))
+	older.put([]byte("k"), []byte("zzz"))
+	if _, err := createDiskTable(older, dbDir, 0, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	newer := newMemTable()
+	newer.delete([]byte("d"))
+	newer.put([]byte("k"), []byte("aaa"))
+	newer.put([]byte("z"), []byte("vz"))
+	if _, err := createDiskTable(newer, dbDir, 1, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// the resolver keeps the lexicographically larger value; the
+	// tombstone for d comes in as a nil value and loses to vd
+	resolver := func(key, aValue, bValue []byte) []byte {
+		if bytes.Compare(aValue, bValue) > 0 {
+			return aValue
+		}
+
+		return bValue
+	}
+
+	if _, _, err := mergeDiskTableRun(dbDir, []int{0, 1}, 3, 0, false, nil, false, 0, 0, nil, resolver); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := newDataFileIterator(path.Join(dbDir, "1-data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.close()
+
+	actual := make([][]byte, 0)
+	for it.hasNext() {
+		key, value, err := it.next()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		actual = append(actual, key, value)
+	}
+
+	expected := [][]byte{
+		[]byte("a"), []byte("va"),
+		[]byte("d"), []byte("vd"),
+		[]byte("k"), []byte("zzz"),
+		[]byte("z"), []byte("vz"),
+	}
+
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("%s != %s", expected, actual)
+	}
+}
+
+func TestMergeLargeDiskTablesStreams(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	const keys = 200000
+	value := func(marker byte) []byte {
+		return bytes.Repeat([]byte{marker}, 64)
+	}
+
+	memTable1 := newMemTable()
+	for i := 0; i < keys; i++ {
+		memTable1.put([]byte(fmt.Sprintf("key-%09d", i)), value('a'))
+	}
+	if _, err := createDiskTable(memTable1, dbDir, 0, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	memTable1 = nil
+
+	memTable2 := newMemTable()
+	for i := keys / 2; i < keys/2+keys; i++ {
+		memTable2.put([]byte(fmt.Sprintf("key-%09d", i)), value('b'))
+	}
+	if _, err := createDiskTable(memTable2, dbDir, 1, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	memTable2 = nil
+
+	runtime.GC()
+	var baseline runtime.MemStats
+	runtime.ReadMemStats(&baseline)
+
+	stop := make(chan struct{})
+	peak := make(chan uint64)
+	go func() {
+		var maxHeap uint64
+		var m runtime.MemStats
+		for {
+			select {
+			case <-stop:
+				peak <- maxHeap
+				return
+			default:
+				runtime.ReadMemStats(&m)
+				if m.HeapAlloc > maxHeap {
+					maxHeap = m.HeapAlloc
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	if _, err := mergeDiskTables(dbDir, 0, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	close(stop)
+	maxHeap := <-peak
+
+	// each data file is about 17 MB, buffering even one of them
+	// would blow past the bound
+	const bound = 8 << 20
+	if maxHeap > baseline.HeapAlloc+bound {
+		t.Fatalf("merge must stream, but the heap grew from %d to %d bytes", baseline.HeapAlloc, maxHeap)
+	}
+
+	it, err := newDataFileIterator(path.Join(dbDir, "1-data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.close()
+
+	count := 0
+	for it.hasNext() {
+		key, value, err := it.next()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		i := count
+		expectedKey := fmt.Sprintf("key-%09d", i)
+		if string(key) != expectedKey {
+			t.Fatalf("%s != %s", expectedKey, key)
+		}
+
+		// the overlapping half must hold the newer values
+		expectedMarker := byte('a')
+		if i >= keys/2 {
+			expectedMarker = 'b'
+		}
+		if value[0] != expectedMarker {
+			t.Fatalf("key %s: %c != %c", key, expectedMarker, value[0])
+		}
+
+		count++
+	}
+
+	if expected := keys/2 + keys; count != expected {
+		t.Fatalf("expected %d keys after the merge, got %d", expected, count)
+	}
+}
+
+func TestMergeRetainsTombstonesAboveOldestTable(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	// the oldest table holds the value, the newer one its tombstone
+	oldest := newMemTable()
+	oldest.put([]byte("x"), []byte("vx"))
+	if _, err := createDiskTable(oldest, dbDir, 0, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted := newMemTable()
+	deleted.delete([]byte("x"))
+	deleted.put([]byte("y"), []byte("vy"))
+	if _, err := createDiskTable(deleted, dbDir, 1, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	newest := newMemTable()
+	newest.put([]byte("z"), []byte("vz"))
+	if _, err := createDiskTable(newest, dbDir, 2, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// the run does not include the oldest table, so dropping the
+	// tombstone here would resurrect the key from table 0
+	if _, _, err := mergeDiskTableRun(dbDir, []int{1, 2}, 3, 0, false, nil, false, 0, 0, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the search must surface the tombstone (a nil value),
+	// not the value from the oldest table
+	if value, _, err := searchInDiskTables(dbDir, 2, []byte("x"), bytes.Compare, nil, 0, nil, CorruptTableFail, noopLogger{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if value != nil {
+		t.Fatalf("the deleted key x must not be resurrected, got %s", value)
+	}
+
+	// once the run includes the oldest table, the tombstone is
+	// physically dropped from the merged output
+	if _, _, err := mergeDiskTableRun(dbDir, []int{0, 2}, 3, 0, true, nil, false, 0, 0, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := newDataFileIterator(path.Join(dbDir, "2-data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.close()
+
+	for it.hasNext() {
+		key, _, err := it.next()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if bytes.Equal(key, []byte("x")) {
+			t.Fatalf("the tombstone for x must be dropped in the full merge")
+		}
+	}
+}
+
+func TestMergeRunSplitByKeyRange(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	if _, err := createDiskTable(prepareMemTable1(), dbDir, 0, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createDiskTable(prepareMemTable2(), dbDir, 1, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// the threshold of one byte forces a split after the first record,
+	// capped by the two index slots of the run
+	_, tables, err := mergeDiskTableRun(dbDir, []int{0, 1}, 3, 0, true, nil, false, 0, 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tables != 2 {
+		t.Fatalf("expected 2 range-partitioned tables, got %d", tables)
+	}
+
+	indexes, err := listDiskTables(dbDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]int{0, 1}, indexes) {
+		t.Fatalf("expected the partitions in the slots [0 1], got %v", indexes)
+	}
+
+	// the partitions must cover disjoint ascending key ranges
+	_, max0, ok0, err := readDiskTableBounds(dbDir, "0-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	min1, _, ok1, err := readDiskTableBounds(dbDir, "1-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok0 || !ok1 || bytes.Compare(max0, min1) >= 0 {
+		t.Fatalf("the partitions must not overlap: max0 = %s, min1 = %s", max0, min1)
+	}
+
+	// every key of the merged view stays retrievable across the partitions
+	cases := map[string]string{
+		"b": "vb2",
+		"c": "vc",
+		"e": "ve",
+		"f": "vf2",
+		"g": "vg",
+		"h": "vh",
+	}
+	for key, expected := range cases {
+		value, ok, err := searchInDiskTables(dbDir, 1, []byte(key), bytes.Compare, nil, 0, nil, CorruptTableFail, noopLogger{})
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %s", key, err)
+		}
+		if !ok || string(value) != expected {
+			t.Fatalf("value does not match for %s: %s != %s", key, expected, value)
+		}
+	}
+
+	// the tombstone for d is dropped by the full merge
+	if _, ok, err := searchInDiskTables(dbDir, 1, []byte("d"), bytes.Compare, nil, 0, nil, CorruptTableFail, noopLogger{}); err != nil || ok {
+		t.Fatalf("the deleted key d must not be found, ok = %v, err = %v", ok, err)
+	}
+}
+
+func TestCompactionRateLimitedMerge(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	value := bytes.Repeat([]byte{'v'}, 100)
+
+	older := newMemTable()
+	for i := 0; i < 20; i++ {
+		older.put([]byte(fmt.Sprintf("a-%03d", i)), value)
+	}
+	if _, err := createDiskTable(older, dbDir, 0, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	newer := newMemTable()
+	for i := 0; i < 20; i++ {
+		newer.put([]byte(fmt.Sprintf("b-%03d", i)), value)
+	}
+	if _, err := createDiskTable(newer, dbDir, 1, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := newCompactionRateLimiter(16000)
+
+	start := time.Now()
+	if _, _, err := mergeDiskTableRun(dbDir, []int{0, 1}, 3, 0, true, nil, false, 0, 0, limiter, nil); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	// 40 records of more than 110 data bytes each must take at least
+	// 4400/16000 of a second through the empty token bucket
+	if elapsed < 200*time.Millisecond {
+		t.Fatalf("the merge must be throttled, took only %s", elapsed)
+	}
+
+	// the merged output is intact
+	for _, key := range []string{"a-000", "a-019", "b-000", "b-019"} {
+		if _, ok, err := searchInDiskTables(dbDir, 1, []byte(key), bytes.Compare, nil, 0, nil, CorruptTableFail, noopLogger{}); err != nil || !ok {
+			t.Fatalf("the key %s must be found, ok = %v, err = %v", key, ok, err)
+		}
+	}
+}
+
+func TestMergeDisjointDiskTables(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	// the key ranges are disjoint and ascending,
+	// so the merge takes the concatenation fast path
+	older := newMemTable()
+	older.put([]byte("a"), []byte("va"))
+	older.put([]byte("b"), []byte("vb"))
+	older.delete([]byte("c"))
+	if _, err := createDiskTable(older, dbDir, 0, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	newer := newMemTable()
+	newer.put([]byte("d"), []byte("vd"))
+	newer.put([]byte("e"), []byte("ve"))
+	if _, err := createDiskTable(newer, dbDir, 1, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if disjoint, err := disjointAscendingRun(dbDir, []int{0, 1}); err != nil {
+		t.Fatal(err)
+	} else if !disjoint {
+		t.Fatalf("the run must be detected as disjoint")
+	}
+
+	if _, err := mergeDiskTables(dbDir, 0, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := newDataFileIterator(path.Join(dbDir, "1-data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.close()
+
+	actual := make([][]byte, 0)
+	for it.hasNext() {
+		key, value, err := it.next()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		actual = append(actual, key, value)
+	}
+
+	expected := [][]byte{
+		[]byte("a"), []byte("va"),
+		[]byte("b"), []byte("vb"),
+		[]byte("c"), nil,
+		[]byte("d"), []byte("vd"),
+		[]byte("e"), []byte("ve"),
+	}
+
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("%s != %s", expected, actual)
+	}
+}
+
+func TestMergeIdenticalRangeDiskTables(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	// both disk tables hold exactly the same keys, the fast path
+	// must not apply and the newer values must win
+	older := newMemTable()
+	older.put([]byte("a"), []byte("va1"))
+	older.put([]byte("b"), []byte("vb1"))
+	if _, err := createDiskTable(older, dbDir, 0, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	newer := newMemTable()
+	newer.put([]byte("a"), []byte("va2"))
+	newer.put([]byte("b"), []byte("vb2"))
+	if _, err := createDiskTable(newer, dbDir, 1, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if disjoint, err := disjointAscendingRun(dbDir, []int{0, 1}); err != nil {
+		t.Fatal(err)
+	} else if disjoint {
+		t.Fatalf("the identical ranges must not be detected as disjoint")
+	}
+
+	if _, err := mergeDiskTables(dbDir, 0, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := newDataFileIterator(path.Join(dbDir, "1-data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.close()
+
+	actual := make([][]byte, 0)
+	for it.hasNext() {
+		key, value, err := it.next()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		actual = append(actual, key, value)
+	}
+
+	expected := [][]byte{
+		[]byte("a"), []byte("va2"),
+		[]byte("b"), []byte("vb2"),
+	}
+
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("%s != %s", expected, actual)
+	}
+}
+
+func prepareDisjointDiskTables(b *testing.B, dbDir string, overlap bool) {
+	const keys = 100000
+
+	memTable1 := newMemTable()
+	for i := 0; i < keys; i++ {
+		memTable1.put([]byte(fmt.Sprintf("key-%09d", i)), []byte("va"))
+	}
+	if _, err := createDiskTable(memTable1, dbDir, 0, defaultSparseKeyDistance, 0, false, 0); err != nil {
+		b.Fatal(err)
+	}
+
+	start := keys
+	if overlap {
+		// a single shared key disables the fast path
+		start = keys - 1
+	}
+
+	memTable2 := newMemTable()
+	for i := start; i < start+keys; i++ {
+		memTable2.put([]byte(fmt.Sprintf("key-%09d", i)), []byte("vb"))
+	}
+	if _, err := createDiskTable(memTable2, dbDir, 1, defaultSparseKeyDistance, 0, false, 0); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkMergeDisjointDiskTables(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+		if err != nil {
+			b.Fatal(err)
+		}
+		prepareDisjointDiskTables(b, dbDir, false)
+		b.StartTimer()
+
+		if _, err := mergeDiskTables(dbDir, 0, 1, defaultSparseKeyDistance); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		if err := os.RemoveAll(dbDir); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+}
+
+func BenchmarkMergeOverlappingDiskTables(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+		if err != nil {
+			b.Fatal(err)
+		}
+		prepareDisjointDiskTables(b, dbDir, true)
+		b.StartTimer()
+
+		if _, err := mergeDiskTables(dbDir, 0, 1, defaultSparseKeyDistance); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		if err := os.RemoveAll(dbDir); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+}
+
+func TestCompactionLimiterRunsSerially(t *testing.T) {
+	limiter := newCompactionLimiter(1)
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for i := 0; i < 2; i++ {
+		limiter.schedule(func() {
+			defer wg.Done()
+
+			n := atomic.AddInt32(&running, 1)
+			if n > atomic.LoadInt32(&maxRunning) {
+				atomic.StoreInt32(&maxRunning, n)
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	wg.Wait()
+	limiter.close()
+
+	if maxRunning != 1 {
+		t.Fatalf("compactions must run serially, but %d ran at once", maxRunning)
+	}
+}
+
+func TestCompactionLimiterCloseDropsQueued(t *testing.T) {
+	limiter := newCompactionLimiter(1)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	limiter.schedule(func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	var queuedRan int32
+	limiter.schedule(func() {
+		atomic.AddInt32(&queuedRan, 1)
+	})
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+
+	// must not deadlock: waits for the in-flight compaction
+	// and drops the queued one
+	limiter.close()
+
+	if atomic.LoadInt32(&queuedRan) != 0 {
+		t.Fatalf("queued compaction must be dropped on close, but it ran")
+	}
+}
+
+func TestCompactionPoolFairAcrossTrees(t *testing.T) {
+	pool := NewCompactionPool(1)
+	a, b := &LSMTree{}, &LSMTree{}
+
+	// the merges of the tree a are queued first, yet the merge of the
+	// tree b must not wait for all of them: the queue is first in,
+	// first out across the trees
+	order := make([]*LSMTree, 0)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	wg.Add(1)
+	pool.schedule(a, func() {
+		defer wg.Done()
+		close(started)
+		<-release
+	})
+	<-started
+
+	for i := 0; i < 3; i++ {
+		wg.Add(2)
+		for _, tree := range []*LSMTree{a, b} {
+			tree := tree
+			pool.schedule(tree, func() {
+				defer wg.Done()
+
+				mu.Lock()
+				order = append(order, tree)
+				mu.Unlock()
+			})
+		}
+	}
+
+	close(release)
+	wg.Wait()
+
+	for i := 0; i < len(order); i += 2 {
+		if order[i] != a || order[i+1] != b {
+			t.Fatalf("the merges must interleave across the trees, but ran %d-th out of order", i)
+		}
+	}
+}
+
+func TestCompactionPoolDeregisterKeepsOtherTrees(t *testing.T) {
+	pool := NewCompactionPool(1)
+	a, b := &LSMTree{}, &LSMTree{}
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	pool.schedule(a, func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	var aRan, bRan int32
+	pool.schedule(a, func() {
+		atomic.AddInt32(&aRan, 1)
+	})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	pool.schedule(b, func() {
+		defer wg.Done()
+		atomic.AddInt32(&bRan, 1)
+	})
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+
+	// must not deadlock: waits for the in-flight merge of the tree
+	// and drops its queued one, the merge of the other tree survives
+	pool.deregister(a)
+	wg.Wait()
+
+	if atomic.LoadInt32(&aRan) != 0 {
+		t.Fatalf("the queued merge of the deregistered tree must be dropped, but it ran")
+	}
+	if atomic.LoadInt32(&bRan) != 1 {
+		t.Fatalf("the merge of the other tree must survive the deregistration")
+	}
+}
+
 func prepareMemTable1() *memTable {
 	memTable := newMemTable()
 
@@ -83,3 +805,54 @@ func prepareMemTable2() *memTable {
 
 	return memTable
 }
+
+func TestPickTombstoneRun(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	// the two oldest disk tables hold only live values
+	clean1 := newMemTable()
+	clean1.put([]byte("a"), []byte("va"))
+	clean1.put([]byte("b"), []byte("vb"))
+	if _, err := createDiskTable(clean1, dbDir, 0, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	clean2 := newMemTable()
+	clean2.put([]byte("c"), []byte("vc"))
+	clean2.put([]byte("d"), []byte("vd"))
+	if _, err := createDiskTable(clean2, dbDir, 1, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// the newest disk table is full of tombstones
+	deleted := newMemTable()
+	deleted.delete([]byte("a"))
+	deleted.delete([]byte("b"))
+	deleted.delete([]byte("c"))
+	if _, err := createDiskTable(deleted, dbDir, 2, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	run, scores, err := pickTombstoneRun(dbDir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(run, []int{1, 2}) {
+		t.Fatalf("the pair with the tombstone-full disk table must be picked, but got %v", run)
+	}
+	if scores[0] != 0 || scores[1] != 0 {
+		t.Fatalf("the clean disk tables must score zero, but got %v", scores)
+	}
+	if scores[2] <= 0 {
+		t.Fatalf("the tombstone-full disk table must score positive, but got %v", scores)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package lsmtree
+
+import (
+	"errors"
+	"os"
+)
+
+// errMmapUnsupported makes the file cache fall back to the plain file
+// reads on the platforms without the memory mapping support.
+var errMmapUnsupported = errors.New("memory mapping is not supported on this platform")
+
+// mmapFile reports that the platform does not support the memory
+// mapping, so the reads are served through the plain file handles.
+func mmapFile(file *os.File) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+// munmapFile does nothing, since no file is ever mapped.
+func munmapFile(data []byte) error {
+	return nil
+}
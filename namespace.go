@@ -0,0 +1,283 @@
+package lsmtree
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Namespaced is a thin wrapper over the tree that transparently
+// prepends the namespace prefix to the keys on writes and strips it
+// on reads, so multiple logical datasets can share one tree without
+// seeing each other's keys.
+type Namespaced struct {
+	t      *LSMTree
+	prefix []byte
+}
+
+// Namespace returns a wrapper over the tree that keeps all keys under
+// the given prefix. Wrappers with different prefixes are isolated from
+// each other as long as no prefix is itself a prefix of another one.
+func (t *LSMTree) Namespace(prefix []byte) *Namespaced {
+	return &Namespaced{t: t, prefix: prefix}
+}
+
+// Put puts the key into the namespace.
+func (n *Namespaced) Put(key []byte, value []byte) error {
+	return n.t.Put(n.prefixed(key), value)
+}
+
+// Get the value for the key from the namespace.
+func (n *Namespaced) Get(key []byte) ([]byte, bool, error) {
+	return n.t.Get(n.prefixed(key))
+}
+
+// Delete delete the value by key from the namespace.
+func (n *Namespaced) Delete(key []byte) error {
+	return n.t.Delete(n.prefixed(key))
+}
+
+// Scan returns an iterator over all entries in the namespace in sorted
+// order. The returned keys have the namespace prefix stripped.
+// The iterator must be closed after use.
+func (n *Namespaced) Scan() (*NamespacedIterator, error) {
+	it, err := n.t.Range(n.prefix, prefixEnd(n.prefix), DefaultRangeOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NamespacedIterator{it: it, prefixLen: len(n.prefix)}, nil
+}
+
+// NamespacedIterator iterates over the entries of a single namespace
+// in sorted order and strips the namespace prefix from the keys.
+type NamespacedIterator struct {
+	it        *RangeIterator
+	prefixLen int
+}
+
+// HasNext returns true if there is a next entry.
+func (it *NamespacedIterator) HasNext() bool {
+	return it.it.HasNext()
+}
+
+// Next returns the current entry with the namespace prefix stripped
+// from the key and advances the iterator position.
+func (it *NamespacedIterator) Next() (Entry, error) {
+	entry, err := it.it.Next()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	entry.Key = entry.Key[it.prefixLen:]
+
+	return entry, nil
+}
+
+// Close closes the iterator.
+func (it *NamespacedIterator) Close() error {
+	return it.it.Close()
+}
+
+// prefixed returns the key with the namespace prefix prepended.
+func (n *Namespaced) prefixed(key []byte) []byte {
+	prefixed := make([]byte, 0, len(n.prefix)+len(key))
+	prefixed = append(prefixed, n.prefix...)
+	prefixed = append(prefixed, key...)
+
+	return prefixed
+}
+
+// DropPrefix removes every key that starts with the given prefix.
+// The matching keys are collected with a range scan over
+// [prefix, prefixEnd) and their tombstones go to the WAL in a single
+// batched write, which is much cheaper than deleting them one by one.
+// It is useful for the multi-tenant cleanup, for example, together
+// with Namespace.
+func (t *LSMTree) DropPrefix(prefix []byte) error {
+	if len(prefix) == 0 {
+		return ErrKeyRequired
+	}
+
+	// with the group commit the concurrent callers are supported and
+	// the closed flag changes under the commit mutex, so the write
+	// phase rechecks it there
+	if t.committer == nil && t.closed {
+		return ErrClosed
+	}
+
+	if t.skipWALReplay {
+		return ErrWALNotReplayed
+	}
+
+	// the scan sees the physical records, so the chunk records and
+	// the expired idle entries under the prefix are tombstoned too
+	it, err := t.Range(prefix, prefixEnd(prefix), RangeOptions{StartInclusive: true, rawEntries: true})
+	if err != nil {
+		return fmt.Errorf("failed to scan the prefix: %w", err)
+	}
+
+	keys := make([][]byte, 0)
+	for it.HasNext() {
+		entry, err := it.Next()
+		if err != nil {
+			it.Close()
+			return fmt.Errorf("failed to scan the prefix: %w", err)
+		}
+
+		keys = append(keys, entry.Key)
+	}
+	if err := it.Close(); err != nil {
+		return fmt.Errorf("failed to close the prefix scan: %w", err)
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// the batched tombstones append to the WAL and change the
+	// in-memory state under the commit mutex, like put, so the write
+	// never interleaves with the grouped writers or a timer-driven
+	// flush of flushLoop
+	t.commitMu.Lock()
+	defer t.commitMu.Unlock()
+
+	if t.closed {
+		return ErrClosed
+	}
+
+	var written int
+	err = t.retrier.do(func() error {
+		n, err := appendTombstonesToWAL(t.wal, keys, t.walChecksum)
+		written = n
+
+		return err
+	})
+	if err != nil {
+		return wrapError(ErrWALWrite, fmt.Errorf("failed to append to file %s: %w", t.wal.Name(), err))
+	}
+	t.walSize += written
+	t.stats.BytesWrittenWAL += written
+
+	for _, key := range keys {
+		t.stats.UserBytesWritten += len(key)
+		t.memTable.delete(key)
+		t.cache.invalidate(key)
+	}
+
+	if err := t.compactWALIfNeeded(); err != nil {
+		return fmt.Errorf("failed to compact the WAL file: %w", err)
+	}
+
+	if err := t.snapshotMemTableIfNeeded(); err != nil {
+		return fmt.Errorf("failed to snapshot the MemTable: %w", err)
+	}
+
+	return nil
+}
+
+// CountPrefix returns how many live keys start with the given prefix.
+// It walks the keys-only path of KeyIterator, which reads the index
+// files and only the record headers of the data files, so the values
+// are never read. The tombstoned keys are not counted.
+func (t *LSMTree) CountPrefix(prefix []byte) (int, error) {
+	if len(prefix) == 0 {
+		return 0, ErrKeyRequired
+	}
+
+	it, err := t.KeyIterator()
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan the prefix: %w", err)
+	}
+	defer it.Close()
+
+	end := prefixEnd(prefix)
+
+	count := 0
+	for it.HasNext() {
+		key, err := it.Next()
+		if err != nil {
+			return 0, fmt.Errorf("failed to scan the prefix: %w", err)
+		}
+
+		if bytes.Compare(key, prefix) < 0 {
+			continue
+		}
+		// a nil end means every key above the prefix matches it
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			break
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+// ListChildren returns the distinct immediate children of the prefix
+// for the keys structured as paths with the separator byte. For every
+// key that starts with the prefix, the segment up to and including the
+// next separator is a child; a key without a separator after the
+// prefix is a leaf and its whole remainder is returned. Instead of
+// enumerating every key of a child, the scan seeks straight to the
+// next child prefix over the sparse indexes, so listing the top of a
+// large hierarchy does not read all its leaves. The children are
+// returned in ascending order.
+func (t *LSMTree) ListChildren(prefix []byte, sep byte) ([][]byte, error) {
+	if len(prefix) == 0 {
+		return nil, ErrKeyRequired
+	}
+
+	it, err := t.Range(prefix, prefixEnd(prefix), DefaultRangeOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan the prefix: %w", err)
+	}
+	defer it.Close()
+
+	children := make([][]byte, 0)
+	for it.HasNext() {
+		entry, err := it.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the prefix: %w", err)
+		}
+
+		rest := entry.Key[len(prefix):]
+		i := bytes.IndexByte(rest, sep)
+		if i < 0 {
+			// a leaf directly under the prefix
+			children = append(children, append([]byte(nil), rest...))
+			continue
+		}
+
+		children = append(children, append([]byte(nil), rest[:i+1]...))
+
+		// the remaining keys of the child are skipped wholesale
+		next := prefixEnd(entry.Key[:len(prefix)+i+1])
+		if next == nil {
+			break
+		}
+		if err := it.seek(next); err != nil {
+			return nil, fmt.Errorf("failed to seek to the next child: %w", err)
+		}
+	}
+
+	return children, nil
+}
+
+// prefixEnd returns the smallest key that is greater than every key
+// with the given prefix, so it serves as the exclusive upper bound for
+// the namespace scans. The trailing 0xFF bytes cannot be incremented
+// and are dropped; if the whole prefix consists of 0xFF bytes, there
+// is no upper bound and nil is returned.
+func prefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xFF {
+			end := make([]byte, i+1)
+			copy(end, prefix)
+			end[i]++
+
+			return end
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package lsmtree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrefixEnd(t *testing.T) {
+	cases := []struct {
+		prefix   []byte
+		expected []byte
+	}{
+		{[]byte("a:"), []byte("a;")},
+		{[]byte{0x01, 0xFF}, []byte{0x02}},
+		{[]byte{0xFF, 0xFF}, nil},
+		{[]byte{0xFF}, nil},
+		{[]byte{0xFF, 0x00}, []byte{0xFF, 0x01}},
+		{[]byte{0x00}, []byte{0x01}},
+		{[]byte{'a', 0x00}, []byte{'a', 0x01}},
+		{[]byte{0x00, 0xFF, 0xFF}, []byte{0x01}},
+	}
+
+	for _, c := range cases {
+		if actual := prefixEnd(c.prefix); !bytes.Equal(c.expected, actual) {
+			t.Fatalf("prefix %x: %x != %x", c.prefix, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package lsmtree
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// TableOverlap reports how many keys two adjacent disk tables share.
+// The shared keys of the older table are shadowed by the newer one, so
+// a high count means the reads of those keys descend through dead
+// records and a merge of the pair would reclaim them.
+type TableOverlap struct {
+	// The indexes of the adjacent disk tables, A is the older one.
+	A, B int
+
+	// The number of keys stored in both tables.
+	SharedKeys int
+}
+
+// Overlaps reports, for every pair of adjacent disk tables, how many
+// keys appear in both. The counts are computed by a merge-style scan
+// of the index files, so the data files and the values are not read.
+// It is useful for diagnosing the read cost: the heavily overlapping
+// pairs are the best candidates for a compaction.
+func (t *LSMTree) Overlaps() ([]TableOverlap, error) {
+	indexes, err := listDiskTables(t.dbDir, t.maxDiskTableIndex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list disk tables: %w", err)
+	}
+
+	overlaps := make([]TableOverlap, 0)
+	for i := 0; i+1 < len(indexes); i++ {
+		shared, err := countSharedKeys(t.dbDir, indexes[i], indexes[i+1], t.compare)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count the shared keys of disk tables %d and %d: %w", indexes[i], indexes[i+1], err)
+		}
+
+		overlaps = append(overlaps, TableOverlap{A: indexes[i], B: indexes[i+1], SharedKeys: shared})
+	}
+
+	return overlaps, nil
+}
+
+// countSharedKeys counts the keys stored in both disk tables by
+// advancing two iterators over their index files in the comparator
+// order, like a merge does.
+func countSharedKeys(dbDir string, a, b int, compare Comparator) (int, error) {
+	aKeys, err := newIndexKeyIterator(dbDir, a)
+	if err != nil {
+		return 0, err
+	}
+	defer aKeys.close()
+
+	bKeys, err := newIndexKeyIterator(dbDir, b)
+	if err != nil {
+		return 0, err
+	}
+	defer bKeys.close()
+
+	aKey, aOk, err := aKeys.next()
+	if err != nil {
+		return 0, err
+	}
+	bKey, bOk, err := bKeys.next()
+	if err != nil {
+		return 0, err
+	}
+
+	shared := 0
+	for aOk && bOk {
+		cmp := compare(aKey, bKey)
+		if cmp == 0 {
+			shared++
+		}
+
+		if cmp <= 0 {
+			aKey, aOk, err = aKeys.next()
+			if err != nil {
+				return 0, err
+			}
+		}
+		if cmp >= 0 {
+			bKey, bOk, err = bKeys.next()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return shared, nil
+}
+
+// indexKeyIterator iterates over the keys stored in the index file of
+// a disk table, reconstructing the prefix-compressed entries from the
+// preceding ones.
+type indexKeyIterator struct {
+	file    *os.File
+	prevKey []byte
+}
+
+// newIndexKeyIterator opens the index file of the disk table with the
+// given index.
+func newIndexKeyIterator(dbDir string, index int) (*indexKeyIterator, error) {
+	indexPath := diskTableFilePath(dbDir, strconv.Itoa(index)+"-", diskTableIndexFileName)
+	file, err := os.Open(indexPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index file %s: %w", indexPath, err)
+	}
+
+	return &indexKeyIterator{file: file}, nil
+}
+
+// next returns the next key of the index file and whether there is one.
+func (it *indexKeyIterator) next() ([]byte, bool, error) {
+	suffix, value, err := decode(it.file)
+	if err == io.EOF {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read: %w", err)
+	}
+
+	key, _ := decodeKeyOffset(it.prevKey, suffix, value)
+	it.prevKey = key
+
+	return key, true, nil
+}
+
+// close closes the underlying index file.
+func (it *indexKeyIterator) close() error {
+	return it.file.Close()
+}
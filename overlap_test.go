@@ -0,0 +1,91 @@
+package lsmtree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestOverlaps(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := Open(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	// no disk tables yet, so there are no pairs to report
+	overlaps, err := tree.Overlaps()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(overlaps) != 0 {
+		t.Fatalf("expected no overlaps, but got %v", overlaps)
+	}
+
+	for _, key := range []string{"b", "c", "d", "e", "f", "g", "h"} {
+		if err := tree.Put([]byte(key), []byte("v"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second table shares b and f, and the tombstone for d also
+	// shadows the record of the first table
+	if err := tree.Put([]byte("b"), []byte("vb2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Delete([]byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("f"), []byte("vf2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	overlaps, err = tree.Overlaps()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(overlaps) != 1 {
+		t.Fatalf("expected a single pair, but got %v", overlaps)
+	}
+	if overlaps[0].A != 0 || overlaps[0].B != 1 || overlaps[0].SharedKeys != 3 {
+		t.Fatalf("expected 3 shared keys between the tables 0 and 1, but got %+v", overlaps[0])
+	}
+
+	// a disjoint third table shares nothing with the second one
+	for _, key := range []string{"x", "y", "z"} {
+		if err := tree.Put([]byte(key), []byte("v"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	overlaps, err = tree.Overlaps()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(overlaps) != 2 {
+		t.Fatalf("expected two pairs, but got %v", overlaps)
+	}
+	if overlaps[1].A != 1 || overlaps[1].B != 2 || overlaps[1].SharedKeys != 0 {
+		t.Fatalf("expected no shared keys between the tables 1 and 2, but got %+v", overlaps[1])
+	}
+}
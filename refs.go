@@ -0,0 +1,115 @@
+package lsmtree
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// tableRefs counts how many open iterators reference each disk table
+// and defers the deletion of the referenced tables until the last
+// iterator closes, so a merge never removes the files a long-running
+// scan still needs.
+type tableRefs struct {
+	mu    sync.Mutex
+	dbDir string
+	// The number of open iterators per disk table index.
+	counts map[int]int
+	// The disk tables whose deletion was deferred by a merge.
+	deferred map[int]bool
+
+	// swap coordinates the table swap of a merge with the readers:
+	// the searches hold the read side, so a search sees either every
+	// original table of the run or the merged result, never the gap
+	// between the deletes and the renames.
+	swap sync.RWMutex
+	// The file cache of the tree, its handles are dropped under the
+	// swap lock, so the readers never read the replaced files through
+	// the cached handles. It may be nil.
+	files *fileCache
+}
+
+// newTableRefs returns a new reference counter for the disk tables
+// in the directory.
+func newTableRefs(dbDir string) *tableRefs {
+	return &tableRefs{
+		dbDir:    dbDir,
+		counts:   make(map[int]int),
+		deferred: make(map[int]bool),
+	}
+}
+
+// acquire increments the reference count of the disk table.
+func (r *tableRefs) acquire(index int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.counts[index]++
+}
+
+// release decrements the reference count of the disk table and deletes
+// its files if the deletion was deferred and no references remain.
+func (r *tableRefs) release(index int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.counts[index]--
+	if r.counts[index] > 0 {
+		return nil
+	}
+
+	delete(r.counts, index)
+	if !r.deferred[index] {
+		return nil
+	}
+
+	delete(r.deferred, index)
+
+	return deleteDiskTables(r.dbDir, strconv.Itoa(index)+"-")
+}
+
+// lockRead blocks a reader for the duration of a disk table search, so
+// a merge cannot swap the tables out from under it. Any number of
+// readers may hold the lock at once.
+func (r *tableRefs) lockRead() {
+	r.swap.RLock()
+}
+
+// unlockRead releases the read side of the swap lock.
+func (r *tableRefs) unlockRead() {
+	r.swap.RUnlock()
+}
+
+// lockSwap blocks the readers out for the table swap of a merge.
+func (r *tableRefs) lockSwap() {
+	r.swap.Lock()
+}
+
+// unlockSwap drops the cached file handles, which point to the replaced
+// files, and lets the readers resume.
+func (r *tableRefs) unlockSwap() error {
+	err := r.files.clear()
+	r.swap.Unlock()
+
+	return err
+}
+
+// deleteOrDefer deletes the files of the unreferenced disk tables and
+// defers the deletion of the referenced ones until they are released.
+func (r *tableRefs) deleteOrDefer(indexes []int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, index := range indexes {
+		if r.counts[index] > 0 {
+			r.deferred[index] = true
+			continue
+		}
+
+		if err := deleteDiskTables(r.dbDir, strconv.Itoa(index)+"-"); err != nil {
+			return fmt.Errorf("failed to delete disk table %d: %w", index, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package lsmtree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMergeDefersDeletionOfReferencedTables(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	if _, err := createDiskTable(prepareMemTable1(), dbDir, 0, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createDiskTable(prepareMemTable2(), dbDir, 1, 3, 0, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	refs := newTableRefs(dbDir)
+
+	// an open iterator on the oldest table
+	it, err := newDataFileIterator(path.Join(dbDir, "0-"+diskTableDataFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs.acquire(0)
+
+	if _, _, err := mergeDiskTableRun(dbDir, []int{0, 1}, 3, 0, false, refs, false, 0, 0, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the merge must not remove the files the iterator still needs
+	dataPath := path.Join(dbDir, "0-"+diskTableDataFileName)
+	if _, err := os.Stat(dataPath); err != nil {
+		t.Fatalf("the referenced disk table must survive the merge: %s", err)
+	}
+
+	for it.hasNext() {
+		if _, _, err := it.next(); err != nil {
+			t.Fatalf("failed to read the referenced disk table: %s", err)
+		}
+	}
+	if err := it.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// once released, the deferred table is cleaned up
+	if err := refs.release(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dataPath); !os.IsNotExist(err) {
+		t.Fatalf("the released disk table must be deleted, got: %v", err)
+	}
+}
@@ -0,0 +1,406 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RepairReport describes what OpenWithRepair fixed in the directory.
+type RepairReport struct {
+	// RemovedMergeFiles are the leftover files of an interrupted merge.
+	RemovedMergeFiles []string
+	// TruncatedWALBytes is the number of bytes cut off the torn WAL tail.
+	TruncatedWALBytes int
+	// MetaFileRebuilt is true if the meta file was of the wrong length
+	// and was rebuilt from the disk tables found in the directory.
+	MetaFileRebuilt bool
+	// RebuiltIndexes are the disk tables whose missing index files
+	// were rebuilt from the data files.
+	RebuiltIndexes []int
+}
+
+// OpenWithRepair checks the database directory for the leftovers of a
+// bad crash, fixes what it finds and then opens the database. It cleans
+// the files of an interrupted merge, rebuilds the meta file if it is
+// corrupted, rebuilds the missing disk table indexes from the data
+// files and truncates the torn WAL tail. The returned report describes
+// what was fixed. The indexes are rebuilt with the default sparse key
+// distance, since the options are applied only when the tree is opened.
+func OpenWithRepair(dbDir string, options ...func(*LSMTree)) (*LSMTree, *RepairReport, error) {
+	report := &RepairReport{}
+
+	removed, err := removeMergeLeftovers(dbDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to remove merge leftovers: %w", err)
+	}
+	report.RemovedMergeFiles = removed
+
+	rebuilt, err := repairDiskTableMeta(dbDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to repair disk table meta: %w", err)
+	}
+	report.MetaFileRebuilt = rebuilt
+
+	indexes, err := rebuildMissingIndexes(dbDir, defaultSparseKeyDistance)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to rebuild missing indexes: %w", err)
+	}
+	report.RebuiltIndexes = indexes
+
+	truncated, err := truncateTornWAL(dbDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to truncate the WAL file: %w", err)
+	}
+	report.TruncatedWALBytes = truncated
+
+	t, err := Open(dbDir, options...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return t, report, nil
+}
+
+// removeMergeLeftovers removes the files of an interrupted merge and
+// returns their names. The merge writes into the files with the "merge"
+// prefix and renames them only once the merge fully succeeds, so the
+// leftovers are safe to delete.
+func removeMergeLeftovers(dbDir string) ([]string, error) {
+	removed := make([]string, 0)
+	// an interrupted split merge leaves the numbered partitions behind
+	// as well, the sweep stops at the first partition with no files
+	for part := 0; ; part++ {
+		prefix := mergePartPrefix(part)
+
+		found := false
+		for _, name := range []string{
+			diskTableDataFileName,
+			diskTableIndexFileName,
+			diskTableSparseIndexFileName,
+			diskTableBoundsFileName,
+		} {
+			filePath := diskTableFilePath(dbDir, prefix, name)
+			if err := os.Remove(filePath); err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+
+				return removed, fmt.Errorf("failed to remove %s: %w", filePath, err)
+			}
+
+			found = true
+			removed = append(removed, strings.TrimPrefix(filePath, dbDir+"/"))
+		}
+
+		if usesSubdirLayout(dbDir) {
+			dirPath := diskTableDirPath(dbDir, prefix)
+			if err := os.Remove(dirPath); err != nil && !os.IsNotExist(err) {
+				return removed, fmt.Errorf("failed to remove %s: %w", dirPath, err)
+			}
+		}
+
+		if !found {
+			break
+		}
+	}
+
+	return removed, nil
+}
+
+// repairDiskTableMeta rebuilds the meta file from the disk tables found
+// in the directory if the file is of the wrong length. Returns true if
+// the meta file was rebuilt.
+func repairDiskTableMeta(dbDir string) (bool, error) {
+	filePath := path.Join(dbDir, diskTableNumFileName)
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read file %s: %w", filePath, err)
+	}
+
+	if len(data) == 16 {
+		return false, nil
+	}
+
+	if err := RepairMeta(dbDir); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RepairMeta rewrites the meta file from the disk tables found in the
+// directory: the data files are scanned and their numeric prefixes
+// give the count and the max index. It recovers a database whose meta
+// file is lost or corrupted while the disk tables are intact. The
+// database must not be open while the meta is repaired.
+func RepairMeta(dbDir string) error {
+	indexes, err := scanDiskTables(dbDir)
+	if err != nil {
+		return fmt.Errorf("failed to scan disk tables: %w", err)
+	}
+
+	maxIndex := -1
+	if len(indexes) > 0 {
+		maxIndex = indexes[len(indexes)-1]
+	}
+
+	if err := updateDiskTableMeta(dbDir, len(indexes), maxIndex); err != nil {
+		return fmt.Errorf("failed to update disk table meta: %w", err)
+	}
+
+	return nil
+}
+
+// rebuildMissingIndexes rebuilds the index and sparse index files from
+// the data files for the disk tables that miss them. Returns the
+// indexes of the rebuilt disk tables.
+func rebuildMissingIndexes(dbDir string, sparseKeyDistance int) ([]int, error) {
+	indexes, err := scanDiskTables(dbDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan disk tables: %w", err)
+	}
+
+	rebuilt := make([]int, 0)
+	for _, index := range indexes {
+		prefix := strconv.Itoa(index) + "-"
+
+		missing := false
+		for _, name := range []string{diskTableIndexFileName, diskTableSparseIndexFileName} {
+			if _, err := os.Stat(diskTableFilePath(dbDir, prefix, name)); os.IsNotExist(err) {
+				missing = true
+			} else if err != nil {
+				return rebuilt, fmt.Errorf("failed to stat %s: %w", prefix+name, err)
+			}
+		}
+
+		if !missing {
+			continue
+		}
+
+		if err := RebuildIndex(dbDir, index, sparseKeyDistance); err != nil {
+			return rebuilt, fmt.Errorf("failed to rebuild index for disk table %d: %w", index, err)
+		}
+
+		rebuilt = append(rebuilt, index)
+	}
+
+	return rebuilt, nil
+}
+
+// truncateTornWAL cuts off the tail of the WAL file left by a write
+// that was interrupted midway, so the replay does not fail on the
+// torn record. Returns the number of bytes cut off.
+func truncateTornWAL(dbDir string) (int, error) {
+	walPath := path.Join(dbDir, walFileName)
+	wal, err := os.OpenFile(walPath, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open the file %s: %w", walPath, err)
+	}
+	defer wal.Close()
+
+	stat, err := wal.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat the file %s: %w", walPath, err)
+	}
+	size := stat.Size()
+
+	// walk the records without decoding them: a record is torn if its
+	// length prefix is incomplete or it claims more bytes than the file holds
+	valid := int64(0)
+	for valid < size {
+		var header [8]byte
+		if _, err := io.ReadFull(wal, header[:]); err != nil {
+			break
+		}
+
+		entryLen := int64(binary.BigEndian.Uint64(header[:]) &^ (recordFlagsBit | recordChecksumBit | recordTimestampBit))
+		if valid+8+entryLen > size {
+			break
+		}
+
+		if _, err := wal.Seek(entryLen, io.SeekCurrent); err != nil {
+			return 0, fmt.Errorf("failed to seek: %w", err)
+		}
+
+		valid += 8 + entryLen
+	}
+
+	truncated := int(size - valid)
+	if truncated == 0 {
+		return 0, nil
+	}
+
+	if err := wal.Truncate(valid); err != nil {
+		return 0, fmt.Errorf("failed to truncate the file %s: %w", walPath, err)
+	}
+
+	if err := wal.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync the file %s: %w", walPath, err)
+	}
+
+	return truncated, nil
+}
+
+// RecoverUntil cuts the WAL so that only the entries recorded at or
+// before the given time are replayed on the next open. It is useful
+// for undoing a bad bulk operation: the later entries are discarded.
+// Only the entries still held by the WAL are affected, the entries
+// already flushed to the disk tables stay as they are. The entries
+// written by the older versions carry no timestamp and are kept.
+// The database must not be open while it is recovered.
+func RecoverUntil(dbDir string, until time.Time) error {
+	walPath := path.Join(dbDir, walFileName)
+	wal, err := os.OpenFile(walPath, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open the file %s: %w", walPath, err)
+	}
+	defer wal.Close()
+
+	stat, err := wal.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat the file %s: %w", walPath, err)
+	}
+	size := stat.Size()
+
+	// walk the records and stop at the first one recorded after the
+	// cutoff: the WAL is append-only, so all later records follow it
+	valid := int64(0)
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(wal, header[:]); err != nil {
+			break
+		}
+
+		rawEntryLen := binary.BigEndian.Uint64(header[:])
+		entryLen := int64(rawEntryLen &^ (recordFlagsBit | recordChecksumBit | recordTimestampBit))
+		if valid+8+entryLen > size {
+			break
+		}
+
+		skip := entryLen
+		if rawEntryLen&recordChecksumBit != 0 {
+			// the checksum precedes the timestamp
+			if _, err := wal.Seek(4, io.SeekCurrent); err != nil {
+				return fmt.Errorf("failed to seek: %w", err)
+			}
+
+			skip -= 4
+		}
+		if rawEntryLen&recordTimestampBit != 0 {
+			var encodedNanos [8]byte
+			if _, err := io.ReadFull(wal, encodedNanos[:]); err != nil {
+				break
+			}
+
+			if int64(binary.BigEndian.Uint64(encodedNanos[:])) > until.UnixNano() {
+				break
+			}
+
+			skip -= 8
+		}
+
+		if _, err := wal.Seek(skip, io.SeekCurrent); err != nil {
+			return fmt.Errorf("failed to seek: %w", err)
+		}
+
+		valid += 8 + entryLen
+	}
+
+	if err := wal.Truncate(valid); err != nil {
+		return fmt.Errorf("failed to truncate the file %s: %w", walPath, err)
+	}
+
+	if err := wal.Sync(); err != nil {
+		return fmt.Errorf("failed to sync the file %s: %w", walPath, err)
+	}
+
+	// the MemTable snapshot may cover the discarded entries, so it is
+	// removed and the next open replays the WAL from the start
+	if err := removeMemTableSnapshot(dbDir); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// scanDiskTables returns the indexes of the disk tables found in the
+// directory in ascending order. Unlike listDiskTables, it does not need
+// the max index from the meta file, so it works even if the meta file
+// is corrupted.
+func scanDiskTables(dbDir string) ([]int, error) {
+	if usesSubdirLayout(dbDir) {
+		return scanDiskTableSubdirs(dbDir)
+	}
+
+	files, err := ioutil.ReadDir(dbDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", dbDir, err)
+	}
+
+	indexes := make([]int, 0)
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, "-"+diskTableDataFileName) {
+			continue
+		}
+
+		index, err := strconv.Atoi(strings.TrimSuffix(name, "-"+diskTableDataFileName))
+		if err != nil {
+			continue
+		}
+
+		indexes = append(indexes, index)
+	}
+
+	// the directory listing is ordered by the file name,
+	// not by the numeric index
+	sort.Ints(indexes)
+
+	return indexes, nil
+}
+
+// scanDiskTableSubdirs returns the indexes of the disk tables found in
+// the subdirectory layout, where the disk table index is the name of
+// the directory that holds the data file.
+func scanDiskTableSubdirs(dbDir string) ([]int, error) {
+	tablesDir := path.Join(dbDir, diskTableSubdirName)
+	files, err := ioutil.ReadDir(tablesDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", tablesDir, err)
+	}
+
+	indexes := make([]int, 0)
+	for _, file := range files {
+		index, err := strconv.Atoi(file.Name())
+		if err != nil {
+			continue
+		}
+
+		if _, err := os.Stat(path.Join(tablesDir, file.Name(), diskTableDataFileName)); err != nil {
+			continue
+		}
+
+		indexes = append(indexes, index)
+	}
+
+	sort.Ints(indexes)
+
+	return indexes, nil
+}
@@ -0,0 +1,168 @@
+package lsmtree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestOpenWithRepair(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := Open(dbDir, MemTableThreshold(100))
+	if err != nil {
+		t.Fatalf("failed to open LSM tree %s: %s", dbDir, err)
+	}
+
+	for i := 1; i <= 50; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		if err := tree.Put(key, []byte(strconv.Itoa(i*2))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	// simulate a bad crash: a leftover of an interrupted merge,
+	// a corrupted meta file, lost index files and a torn WAL tail
+	mergeLeftover := path.Join(dbDir, "merge"+diskTableDataFileName)
+	if err := ioutil.WriteFile(mergeLeftover, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	metaPath := path.Join(dbDir, diskTableNumFileName)
+	if err := ioutil.WriteFile(metaPath, []byte("torn"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(path.Join(dbDir, "0-"+diskTableIndexFileName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(dbDir, "0-"+diskTableSparseIndexFileName)); err != nil {
+		t.Fatal(err)
+	}
+
+	walPath := path.Join(dbDir, walFileName)
+	wal, err := os.OpenFile(walPath, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a record header that claims more bytes than the file holds
+	tornRecord := append(encodeInt(100), []byte("torn")...)
+	if _, err := wal.Write(tornRecord); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, report, err := OpenWithRepair(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open LSM tree with repair: %s", err)
+	}
+
+	if len(report.RemovedMergeFiles) != 1 || report.RemovedMergeFiles[0] != "merge"+diskTableDataFileName {
+		t.Fatalf("unexpected removed merge files: %v", report.RemovedMergeFiles)
+	}
+	if !report.MetaFileRebuilt {
+		t.Fatalf("the meta file must be rebuilt")
+	}
+	if len(report.RebuiltIndexes) != 1 || report.RebuiltIndexes[0] != 0 {
+		t.Fatalf("unexpected rebuilt indexes: %v", report.RebuiltIndexes)
+	}
+	if report.TruncatedWALBytes != len(tornRecord) {
+		t.Fatalf("expected %d truncated WAL bytes, got %d", len(tornRecord), report.TruncatedWALBytes)
+	}
+
+	for i := 1; i <= 50; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		value, exists, err := tree.Get(key)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !exists {
+			t.Fatalf("key %s must exist after the repair", key)
+		}
+		if expected := strconv.Itoa(i * 2); expected != string(value) {
+			t.Fatalf("%s != %s", expected, value)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+}
+
+func TestRepairMeta(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	tree, err := Open(dbDir, MemTableThreshold(100), DiskTableNumThreshold(100))
+	if err != nil {
+		t.Fatalf("failed to open LSM tree %s: %s", dbDir, err)
+	}
+
+	for i := 1; i <= 50; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		if err := tree.Put(key, []byte(strconv.Itoa(i*2))); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	// the lost meta file hides the disk tables from Open
+	metaPath := path.Join(dbDir, diskTableNumFileName)
+	if err := os.Remove(metaPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RepairMeta(dbDir); err != nil {
+		t.Fatalf("failed to repair the meta file: %s", err)
+	}
+
+	tree, err = Open(dbDir, MemTableThreshold(100), DiskTableNumThreshold(100))
+	if err != nil {
+		t.Fatalf("failed to open LSM tree %s: %s", dbDir, err)
+	}
+
+	for i := 1; i <= 50; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		value, exists, err := tree.Get(key)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !exists {
+			t.Fatalf("key %s must exist after the repair", key)
+		}
+		if expected := strconv.Itoa(i * 2); expected != string(value) {
+			t.Fatalf("%s != %s", expected, value)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+}
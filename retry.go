@@ -0,0 +1,84 @@
+package lsmtree
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// transientErrors are the I/O errors that are worth retrying, since
+// they tend to resolve on their own on networked and overlay
+// filesystems. Permanent errors, like ENOSPC, are never retried.
+var transientErrors = []error{syscall.EAGAIN, syscall.EINTR}
+
+// ioRetrier retries I/O operations that fail with a transient error
+// and optionally bounds how long a single attempt may take.
+type ioRetrier struct {
+	// The number of retries after the first failed attempt.
+	retries int
+	// The time to wait between the attempts.
+	backoff time.Duration
+	// The time a single attempt may take, zero means no limit.
+	timeout time.Duration
+}
+
+// do runs the operation and retries it up to retries times with the
+// backoff between the attempts while the error is transient.
+// A nil retrier runs the operation once.
+func (r *ioRetrier) do(op func() error) error {
+	if r == nil {
+		return op()
+	}
+
+	var err error
+	for attempt := 0; attempt <= r.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(r.backoff)
+		}
+
+		err = r.run(op)
+		if err == nil {
+			return nil
+		}
+
+		if !isTransient(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// run executes a single attempt of the operation, enforcing the timeout
+// if it is set. A timed-out operation is not interrupted: its goroutine
+// keeps running and the operation may still complete later, so the
+// returned ErrIOTimeout does not mean the write is lost.
+func (r *ioRetrier) run(op func() error) error {
+	if r.timeout == 0 {
+		return op()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- op()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(r.timeout):
+		return ErrIOTimeout
+	}
+}
+
+// isTransient returns true if the error is one of the known
+// transient I/O errors.
+func isTransient(err error) bool {
+	for _, transient := range transientErrors {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,117 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIORetrierRetriesTransientErrors(t *testing.T) {
+	retrier := &ioRetrier{retries: 2, backoff: time.Millisecond}
+
+	attempts := 0
+	err := retrier.do(func() error {
+		attempts++
+		if attempts == 1 {
+			return fmt.Errorf("failed to write: %w", syscall.EAGAIN)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, but got %d", attempts)
+	}
+}
+
+func TestIORetrierGivesUpOnPermanentErrors(t *testing.T) {
+	retrier := &ioRetrier{retries: 2, backoff: time.Millisecond}
+
+	attempts := 0
+	err := retrier.do(func() error {
+		attempts++
+		return fmt.Errorf("failed to write: %w", syscall.ENOSPC)
+	})
+
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected %v, but got %v", syscall.ENOSPC, err)
+	}
+	if attempts != 1 {
+		t.Fatalf("permanent error must not be retried, but got %d attempts", attempts)
+	}
+}
+
+func TestIORetrierExhaustsRetries(t *testing.T) {
+	retrier := &ioRetrier{retries: 2, backoff: time.Millisecond}
+
+	attempts := 0
+	err := retrier.do(func() error {
+		attempts++
+		return fmt.Errorf("failed to write: %w", syscall.EINTR)
+	})
+
+	if !errors.Is(err, syscall.EINTR) {
+		t.Fatalf("expected %v, but got %v", syscall.EINTR, err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, but got %d", attempts)
+	}
+}
+
+func TestNilIORetrierRunsOnce(t *testing.T) {
+	var retrier *ioRetrier
+
+	attempts := 0
+	err := retrier.do(func() error {
+		attempts++
+		return fmt.Errorf("failed to write: %w", syscall.EAGAIN)
+	})
+
+	if !errors.Is(err, syscall.EAGAIN) {
+		t.Fatalf("expected %v, but got %v", syscall.EAGAIN, err)
+	}
+	if attempts != 1 {
+		t.Fatalf("expected 1 attempt, but got %d", attempts)
+	}
+}
+
+func TestIORetrierTimesOutSlowOperations(t *testing.T) {
+	retrier := &ioRetrier{retries: 2, backoff: time.Millisecond, timeout: 10 * time.Millisecond}
+
+	// a slow operation simulates a Sync hanging on flaky storage; the
+	// timed-out operation keeps running after do returns, so the
+	// attempts are counted atomically
+	var attempts int32
+	err := retrier.do(func() error {
+		atomic.AddInt32(&attempts, 1)
+		time.Sleep(100 * time.Millisecond)
+
+		return nil
+	})
+
+	if !errors.Is(err, ErrIOTimeout) {
+		t.Fatalf("expected %v, but got %v", ErrIOTimeout, err)
+	}
+	// the timeout is not a transient error and must not be retried
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Fatalf("expected 1 attempt, but got %d", n)
+	}
+}
+
+func TestIORetrierAllowsFastOperations(t *testing.T) {
+	retrier := &ioRetrier{timeout: 100 * time.Millisecond}
+
+	err := retrier.do(func() error {
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
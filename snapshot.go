@@ -0,0 +1,136 @@
+package lsmtree
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// MemTable snapshot file name. The snapshot stores the sorted contents
+// of the MemTable together with the WAL offset it covers, so Open can
+// load it and replay only the trailing WAL records.
+const memTableSnapshotFileName = "memtable.snapshot"
+
+// writeMemTableSnapshot serializes the sorted contents of the MemTable
+// together with the WAL offset it covers. The snapshot is written to a
+// temporary file first and only then atomically renamed, so a crash in
+// the middle never leaves a corrupted snapshot behind.
+func writeMemTableSnapshot(dbDir string, memTable *memTable, walOffset int) error {
+	snapshotPath := path.Join(dbDir, memTableSnapshotFileName)
+	tmpPath := snapshotPath + ".tmp"
+
+	tmpFile, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open the file %s: %w", tmpPath, err)
+	}
+
+	if _, err := tmpFile.Write(encodeInt(walOffset)); err != nil {
+		return fmt.Errorf("failed to write to the file %s: %w", tmpPath, err)
+	}
+
+	for it := memTable.iterator(); it.hasNext(); {
+		key, value := it.next()
+		if _, err := encode(key, value, tmpFile); err != nil {
+			return fmt.Errorf("failed to encode and write to the file %s: %w", tmpPath, err)
+		}
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync the file %s: %w", tmpPath, err)
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close the file %s: %w", tmpPath, err)
+	}
+
+	if err := os.Rename(tmpPath, snapshotPath); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tmpPath, snapshotPath, err)
+	}
+
+	return nil
+}
+
+// readMemTableSnapshot loads the MemTable from the snapshot file and
+// returns the WAL offset the snapshot covers. If there is no snapshot,
+// a nil MemTable is returned.
+func readMemTableSnapshot(dbDir string) (*memTable, int, error) {
+	snapshotPath := path.Join(dbDir, memTableSnapshotFileName)
+	snapshotFile, err := os.OpenFile(snapshotPath, os.O_RDONLY, 0600)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+
+		return nil, 0, fmt.Errorf("failed to open the file %s: %w", snapshotPath, err)
+	}
+	defer snapshotFile.Close()
+
+	var encodedWALOffset [8]byte
+	if _, err := io.ReadFull(snapshotFile, encodedWALOffset[:]); err != nil {
+		return nil, 0, fmt.Errorf("failed to read the WAL offset from %s: %w", snapshotPath, err)
+	}
+	walOffset := decodeInt(encodedWALOffset[:])
+
+	memTable := newMemTable()
+	for {
+		key, value, err := decode(snapshotFile)
+		if err != nil && err != io.EOF {
+			return nil, 0, fmt.Errorf("failed to read: %w", err)
+		}
+		if err == io.EOF {
+			return memTable, walOffset, nil
+		}
+
+		if value != nil {
+			memTable.put(key, value)
+		} else {
+			memTable.delete(key)
+		}
+	}
+}
+
+// removeMemTableSnapshot deletes the snapshot file if it exists.
+func removeMemTableSnapshot(dbDir string) error {
+	snapshotPath := path.Join(dbDir, memTableSnapshotFileName)
+	if err := os.Remove(snapshotPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove the file %s: %w", snapshotPath, err)
+	}
+
+	return nil
+}
+
+// loadMemTableWithSnapshot loads the MemTable from the snapshot file if
+// it exists and replays only the WAL records after the offset the
+// snapshot covers. Without a snapshot, or if the snapshot covers more
+// than the WAL holds, the whole WAL is replayed. Returns the MemTable
+// and the WAL offset of the used snapshot.
+func loadMemTableWithSnapshot(dbDir string, wal *os.File) (*memTable, int, error) {
+	memTable, walOffset, err := readMemTableSnapshot(dbDir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read the MemTable snapshot: %w", err)
+	}
+
+	if memTable != nil {
+		walStat, err := wal.Stat()
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to stat the WAL file: %w", err)
+		}
+
+		// the snapshot is stale if it covers more than the WAL holds
+		if int64(walOffset) <= walStat.Size() {
+			if err := replayWAL(wal, memTable, walOffset); err != nil {
+				return nil, 0, err
+			}
+
+			return memTable, walOffset, nil
+		}
+	}
+
+	memTable, err = loadMemTable(wal)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return memTable, 0, nil
+}
@@ -0,0 +1,98 @@
+package lsmtree
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestMemTableSnapshot(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	walPath := path.Join(dbDir, walFileName)
+	wal, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("failed to open file %s: %s", walPath, err)
+	}
+	defer wal.Close()
+
+	for i := 1; i <= 10; i++ {
+		key := []byte(strconv.Itoa(i))
+		value := []byte(strconv.Itoa(i * 2))
+		if err := appendToWAL(wal, key, value, false); err != nil {
+			t.Fatalf("failed to append to the WAL file: %s", err)
+		}
+	}
+
+	memTable, err := loadMemTable(wal)
+	if err != nil {
+		t.Fatalf("failed to load the MemTable: %s", err)
+	}
+
+	walOffset, err := wal.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatalf("failed to seek: %s", err)
+	}
+
+	if err := writeMemTableSnapshot(dbDir, memTable, int(walOffset)); err != nil {
+		t.Fatalf("failed to write the MemTable snapshot: %s", err)
+	}
+
+	// a few trailing records after the snapshot: an update,
+	// a new key and a delete
+	if err := appendToWAL(wal, []byte("1"), []byte("updated"), false); err != nil {
+		t.Fatalf("failed to append to the WAL file: %s", err)
+	}
+	if err := appendToWAL(wal, []byte("11"), []byte("22"), false); err != nil {
+		t.Fatalf("failed to append to the WAL file: %s", err)
+	}
+	if err := appendToWAL(wal, []byte("2"), nil, false); err != nil {
+		t.Fatalf("failed to append to the WAL file: %s", err)
+	}
+
+	loaded, snapshotWALOffset, err := loadMemTableWithSnapshot(dbDir, wal)
+	if err != nil {
+		t.Fatalf("failed to load the MemTable with the snapshot: %s", err)
+	}
+	if snapshotWALOffset != int(walOffset) {
+		t.Fatalf("snapshot WAL offset does not match: %d != %d", snapshotWALOffset, walOffset)
+	}
+
+	expected, err := loadMemTable(wal)
+	if err != nil {
+		t.Fatalf("failed to load the MemTable: %s", err)
+	}
+
+	expectedIt, loadedIt := expected.iterator(), loaded.iterator()
+	for expectedIt.hasNext() {
+		if !loadedIt.hasNext() {
+			t.Fatalf("the loaded MemTable has fewer entries than expected")
+		}
+
+		expectedKey, expectedValue := expectedIt.next()
+		key, value := loadedIt.next()
+
+		if !bytes.Equal(expectedKey, key) {
+			t.Fatalf("keys do not match: %s != %s", string(expectedKey), string(key))
+		}
+		if !bytes.Equal(expectedValue, value) {
+			t.Fatalf("values do not match for %s: %s != %s", string(key), string(expectedValue), string(value))
+		}
+	}
+	if loadedIt.hasNext() {
+		t.Fatalf("the loaded MemTable has more entries than expected")
+	}
+}
@@ -0,0 +1,182 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// KeyCodec converts the typed keys to their byte representation and
+// back, so users with int or string keys do not have to hand-encode
+// them. The encoding must preserve the order of the type: if a < b,
+// then EncodeKey(a) must be lexicographically smaller than
+// EncodeKey(b), otherwise the range scans return the keys out of the
+// type order.
+type KeyCodec interface {
+	// EncodeKey returns the byte representation of the key.
+	EncodeKey(key interface{}) ([]byte, error)
+	// DecodeKey restores the key from its byte representation.
+	DecodeKey(encoded []byte) (interface{}, error)
+}
+
+// Uint64KeyCodec encodes uint64 keys as eight big-endian bytes, which
+// preserves the numeric order.
+type Uint64KeyCodec struct{}
+
+// EncodeKey returns the byte representation of the key.
+func (Uint64KeyCodec) EncodeKey(key interface{}) ([]byte, error) {
+	k, ok := key.(uint64)
+	if !ok {
+		return nil, fmt.Errorf("expected the uint64 key, but got %T", key)
+	}
+
+	encoded := make([]byte, 8)
+	binary.BigEndian.PutUint64(encoded, k)
+
+	return encoded, nil
+}
+
+// DecodeKey restores the key from its byte representation.
+func (Uint64KeyCodec) DecodeKey(encoded []byte) (interface{}, error) {
+	if len(encoded) != 8 {
+		return nil, fmt.Errorf("expected 8 bytes for the uint64 key, but got %d", len(encoded))
+	}
+
+	return binary.BigEndian.Uint64(encoded), nil
+}
+
+// StringKeyCodec encodes string keys as their raw bytes, which already
+// sort lexicographically.
+type StringKeyCodec struct{}
+
+// EncodeKey returns the byte representation of the key.
+func (StringKeyCodec) EncodeKey(key interface{}) ([]byte, error) {
+	k, ok := key.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected the string key, but got %T", key)
+	}
+
+	return []byte(k), nil
+}
+
+// DecodeKey restores the key from its byte representation.
+func (StringKeyCodec) DecodeKey(encoded []byte) (interface{}, error) {
+	return string(encoded), nil
+}
+
+// TypedTree is a thin wrapper over the tree that encodes the typed
+// keys with the codec on writes and decodes them on reads.
+type TypedTree struct {
+	t     *LSMTree
+	codec KeyCodec
+}
+
+// Typed returns a wrapper over the tree that converts the typed keys
+// with the given codec.
+func (t *LSMTree) Typed(codec KeyCodec) *TypedTree {
+	return &TypedTree{t: t, codec: codec}
+}
+
+// Put puts the typed key into the tree.
+func (t *TypedTree) Put(key interface{}, value []byte) error {
+	encoded, err := t.codec.EncodeKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode the key: %w", err)
+	}
+
+	return t.t.Put(encoded, value)
+}
+
+// Get the value for the typed key from the tree.
+func (t *TypedTree) Get(key interface{}) ([]byte, bool, error) {
+	encoded, err := t.codec.EncodeKey(key)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode the key: %w", err)
+	}
+
+	return t.t.Get(encoded)
+}
+
+// Delete delete the value by the typed key from the tree.
+func (t *TypedTree) Delete(key interface{}) error {
+	encoded, err := t.codec.EncodeKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode the key: %w", err)
+	}
+
+	return t.t.Delete(encoded)
+}
+
+// Range returns an iterator over the entries with the keys between
+// start and end. A nil bound leaves the corresponding side of the
+// range open, as in the byte-oriented Range. Because the codec
+// preserves the order of the type, the entries come back in the type
+// order. The iterator must be closed after use.
+func (t *TypedTree) Range(start, end interface{}, options RangeOptions) (*TypedIterator, error) {
+	var encodedStart, encodedEnd []byte
+	var err error
+
+	if start != nil {
+		encodedStart, err = t.codec.EncodeKey(start)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode the start key: %w", err)
+		}
+	}
+	if end != nil {
+		encodedEnd, err = t.codec.EncodeKey(end)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode the end key: %w", err)
+		}
+	}
+
+	it, err := t.t.Range(encodedStart, encodedEnd, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TypedIterator{it: it, codec: t.codec}, nil
+}
+
+// Scan returns an iterator over all entries in the tree in the order
+// of the key type. The iterator must be closed after use.
+func (t *TypedTree) Scan() (*TypedIterator, error) {
+	return t.Range(nil, nil, DefaultRangeOptions)
+}
+
+// TypedEntry is a single entry with the decoded key.
+type TypedEntry struct {
+	Key   interface{}
+	Value []byte
+}
+
+// TypedIterator iterates over the entries in sorted order and decodes
+// the keys with the codec.
+type TypedIterator struct {
+	it    *RangeIterator
+	codec KeyCodec
+}
+
+// HasNext returns true if there is a next entry.
+func (it *TypedIterator) HasNext() bool {
+	return it.it.HasNext()
+}
+
+// Next returns the current entry with the decoded key and advances
+// the iterator position.
+func (it *TypedIterator) Next() (TypedEntry, error) {
+	entry, err := it.it.Next()
+	if err != nil {
+		return TypedEntry{}, err
+	}
+
+	key, err := it.codec.DecodeKey(entry.Key)
+	if err != nil {
+		return TypedEntry{}, fmt.Errorf("failed to decode the key: %w", err)
+	}
+
+	return TypedEntry{Key: key, Value: entry.Value}, nil
+}
+
+// Close closes the iterator.
+func (it *TypedIterator) Close() error {
+	return it.it.Close()
+}
@@ -1,10 +1,13 @@
 package lsmtree
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"time"
 )
 
 // clearWAL closes the current file and open the new file in the truncate mode.
@@ -23,14 +26,101 @@ func clearWAL(dbDir string, wal *os.File) (*os.File, error) {
 	return wal, nil
 }
 
-// appendToWAL appends entry to the WAL file.
-func appendToWAL(wal *os.File, key []byte, value []byte) error {
+// compactWAL rewrites the WAL file so that it contains only the latest
+// record for each key, which is exactly the current state of the MemTable.
+// The new file is fully written and synced first and only then atomically
+// replaces the old one, so the log survives a crash at any point.
+// Returns the new WAL file and its size in bytes.
+func compactWAL(dbDir string, wal *os.File, memTable *memTable) (*os.File, int, error) {
+	walPath := path.Join(dbDir, walFileName)
+	compactPath := walPath + ".compact"
+
+	compactFile, err := os.OpenFile(compactPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open the file %s: %w", compactPath, err)
+	}
+
+	size := 0
+	for it := memTable.iterator(); it.hasNext(); {
+		key, value := it.next()
+		n, err := encode(key, value, compactFile)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to encode and write to the file %s: %w", compactPath, err)
+		}
+		size += n
+	}
+
+	if err := compactFile.Sync(); err != nil {
+		return nil, 0, fmt.Errorf("failed to sync the file %s: %w", compactPath, err)
+	}
+
+	if err := compactFile.Close(); err != nil {
+		return nil, 0, fmt.Errorf("failed to close the file %s: %w", compactPath, err)
+	}
+
+	if err := wal.Close(); err != nil {
+		return nil, 0, fmt.Errorf("failed to close the WAL file %s: %w", walPath, err)
+	}
+
+	if err := os.Rename(compactPath, walPath); err != nil {
+		return nil, 0, fmt.Errorf("failed to rename %s to %s: %w", compactPath, walPath, err)
+	}
+
+	newWAL, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open the file %s: %w", walPath, err)
+	}
+
+	return newWAL, size, nil
+}
+
+// appendToWAL appends entry to the WAL file. The entry records the
+// timestamp of the write, so the WAL can later be cut at a point in
+// time with RecoverUntil. If checksummed is set, the entry carries
+// the CRC-32 checksum of its payload.
+func appendToWAL(wal *os.File, key []byte, value []byte, checksummed bool) error {
+	if err := writeToWAL(wal, key, value, checksummed); err != nil {
+		return err
+	}
+
+	if err := wal.Sync(); err != nil {
+		return fmt.Errorf("failed to sync the file: %w", err)
+	}
+
+	return nil
+}
+
+// writeToWAL appends entry to the WAL file without syncing it. The
+// group commit writes the records through it and shares the sync with
+// the concurrent writers.
+func writeToWAL(wal *os.File, key []byte, value []byte, checksummed bool) error {
+	// for safety, since the file is open in read-write mode
+	if _, err := wal.Seek(0, io.SeekEnd); err != nil {
+		return fmt.Errorf("failed to seek to the end: %w", err)
+	}
+
+	var err error
+	if checksummed {
+		_, err = encodeChecksummedTimestamped(key, value, time.Now().UnixNano(), wal)
+	} else {
+		_, err = encodeTimestamped(key, value, time.Now().UnixNano(), wal)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode and write to the file: %w", err)
+	}
+
+	return nil
+}
+
+// appendToWALFrom appends an entry with the value streamed from the
+// reader to the WAL file. Exactly size bytes are read from the reader.
+func appendToWALFrom(wal *os.File, key []byte, value io.Reader, size int) error {
 	// for safety, since the file is open in read-write mode
 	if _, err := wal.Seek(0, io.SeekEnd); err != nil {
 		return fmt.Errorf("failed to seek to the end: %w", err)
 	}
 
-	if _, err := encode(key, value, wal); err != nil {
+	if _, err := encodeTimestampedFrom(key, time.Now().UnixNano(), value, size, wal); err != nil {
 		return fmt.Errorf("failed to encode and write to the file: %w", err)
 	}
 
@@ -41,21 +131,87 @@ func appendToWAL(wal *os.File, key []byte, value []byte) error {
 	return nil
 }
 
-// loadMemTable loads MemTable from the WAL file.
-func loadMemTable(wal *os.File) (*memTable, error) {
+// appendTombstonesToWAL appends the tombstones for all given keys to
+// the WAL file in a single batched write and sync, which is much
+// cheaper than appending them one by one. If checksummed is set, the
+// tombstones carry the CRC-32 checksums of their payload.
+// Returns the number of bytes written.
+func appendTombstonesToWAL(wal *os.File, keys [][]byte, checksummed bool) (int, error) {
 	// for safety, since the file is open in read-write mode
-	if _, err := wal.Seek(0, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("failed to seek to the beginning: %w", err)
+	if _, err := wal.Seek(0, io.SeekEnd); err != nil {
+		return 0, fmt.Errorf("failed to seek to the end: %w", err)
+	}
+
+	nanos := time.Now().UnixNano()
+
+	var batch bytes.Buffer
+	for _, key := range keys {
+		var err error
+		if checksummed {
+			_, err = encodeChecksummedTimestamped(key, nil, nanos, &batch)
+		} else {
+			_, err = encodeTimestamped(key, nil, nanos, &batch)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode: %w", err)
+		}
+	}
+
+	n, err := wal.Write(batch.Bytes())
+	if err != nil {
+		return n, fmt.Errorf("failed to write to the file: %w", err)
 	}
 
+	if err := wal.Sync(); err != nil {
+		return n, fmt.Errorf("failed to sync the file: %w", err)
+	}
+
+	return n, nil
+}
+
+// loadMemTable loads MemTable from the WAL file.
+func loadMemTable(wal *os.File) (*memTable, error) {
 	memTable := newMemTable()
+	if err := replayWAL(wal, memTable, 0); err != nil {
+		return nil, err
+	}
+
+	return memTable, nil
+}
+
+// replayWAL applies the WAL records starting at the given offset
+// to the MemTable. A record that is truncated or fails its checksum
+// ends the replay: it and everything after it are treated as a lost
+// tail and cut off, so a torn or bit-flipped write does not fail the
+// whole open and the later appends stay readable.
+func replayWAL(wal *os.File, memTable *memTable, offset int) error {
+	if _, err := wal.Seek(int64(offset), io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek to the offset %d: %w", offset, err)
+	}
+
 	for {
+		start, err := wal.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return fmt.Errorf("failed to seek: %w", err)
+		}
+
 		key, value, err := decode(wal)
+		if errors.Is(err, errTruncatedRecord) || errors.Is(err, ErrChecksumMismatch) {
+			if err := wal.Truncate(start); err != nil {
+				return fmt.Errorf("failed to truncate the WAL file: %w", err)
+			}
+
+			if err := wal.Sync(); err != nil {
+				return fmt.Errorf("failed to sync the WAL file: %w", err)
+			}
+
+			return nil
+		}
 		if err != nil && err != io.EOF {
-			return nil, fmt.Errorf("failed to read: %w", err)
+			return fmt.Errorf("failed to read: %w", err)
 		}
 		if err == io.EOF {
-			return memTable, nil
+			return nil
 		}
 
 		if value != nil {
@@ -0,0 +1,270 @@
+package lsmtree
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// TestWALReadableByDataFilePath proves that the WAL and the disk tables
+// share a single encoding: the file written by the WAL write path is
+// read back record by record through the data file read path.
+func TestWALReadableByDataFilePath(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	walPath := path.Join(dbDir, walFileName)
+	wal, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("failed to open file %s: %s", walPath, err)
+	}
+
+	expected := [][]byte{
+		[]byte("a"), []byte("va"),
+		[]byte("b"), nil, // a tombstone
+		[]byte("c"), []byte("vc"),
+	}
+
+	for i := 0; i < len(expected); i += 2 {
+		if err := appendToWAL(wal, expected[i], expected[i+1], false); err != nil {
+			t.Fatalf("failed to append to the WAL file: %s", err)
+		}
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("failed to close the WAL file: %s", err)
+	}
+
+	it, err := newDataFileIterator(walPath)
+	if err != nil {
+		t.Fatalf("failed to instantiate iterator for %s: %s", walPath, err)
+	}
+	defer it.close()
+
+	actual := make([][]byte, 0)
+	for it.hasNext() {
+		key, value, err := it.next()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		actual = append(actual, key, value)
+	}
+
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("%s != %s", expected, actual)
+	}
+}
+
+func TestCompactWAL(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	walPath := path.Join(dbDir, walFileName)
+	wal, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("failed to open file %s: %s", walPath, err)
+	}
+
+	// the key "a" is overwritten many times, only the latest
+	// record must survive the compaction
+	for i := 0; i < 100; i++ {
+		if err := appendToWAL(wal, []byte("a"), []byte(strconv.Itoa(i)), false); err != nil {
+			t.Fatalf("failed to append to the WAL file: %s", err)
+		}
+	}
+	if err := appendToWAL(wal, []byte("b"), []byte("vb"), false); err != nil {
+		t.Fatalf("failed to append to the WAL file: %s", err)
+	}
+
+	memTable, err := loadMemTable(wal)
+	if err != nil {
+		t.Fatalf("failed to load the MemTable: %s", err)
+	}
+
+	statBefore, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatalf("failed to stat the WAL file: %s", err)
+	}
+
+	newWAL, size, err := compactWAL(dbDir, wal, memTable)
+	if err != nil {
+		t.Fatalf("failed to compact the WAL file: %s", err)
+	}
+	defer newWAL.Close()
+
+	statAfter, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatalf("failed to stat the WAL file: %s", err)
+	}
+
+	if statAfter.Size() >= statBefore.Size() {
+		t.Fatalf("the WAL file did not shrink: %d >= %d", statAfter.Size(), statBefore.Size())
+	}
+	if int64(size) != statAfter.Size() {
+		t.Fatalf("returned size does not match the file size: %d != %d", size, statAfter.Size())
+	}
+
+	replayed, err := loadMemTable(newWAL)
+	if err != nil {
+		t.Fatalf("failed to load the MemTable: %s", err)
+	}
+
+	cases := []struct {
+		key   []byte
+		value []byte
+	}{
+		{[]byte("a"), []byte("99")},
+		{[]byte("b"), []byte("vb")},
+	}
+
+	for _, c := range cases {
+		value, ok := replayed.get(c.key)
+		if !ok {
+			t.Fatalf("key %s is not found after the compaction", string(c.key))
+		}
+		if !bytes.Equal(c.value, value) {
+			t.Fatalf("values do not match for %s: %s != %s", string(c.key), string(c.value), string(value))
+		}
+	}
+}
+
+// TestReplayWALOrder proves that the replay applies the records in the
+// order they were written: a delete between two puts must not shadow
+// the later put, and a trailing delete must leave a tombstone.
+func TestReplayWALOrder(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	walPath := path.Join(dbDir, walFileName)
+	wal, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("failed to open file %s: %s", walPath, err)
+	}
+	defer wal.Close()
+
+	// put, delete, put again: the last put must win
+	records := []struct {
+		key   []byte
+		value []byte
+	}{
+		{[]byte("a"), []byte("v1")},
+		{[]byte("a"), nil},
+		{[]byte("a"), []byte("v2")},
+		// put twice, then delete: the tombstone must win
+		{[]byte("b"), []byte("v1")},
+		{[]byte("b"), []byte("v2")},
+		{[]byte("b"), nil},
+	}
+	for _, r := range records {
+		if err := appendToWAL(wal, r.key, r.value, false); err != nil {
+			t.Fatalf("failed to append to the WAL file: %s", err)
+		}
+	}
+
+	memTable, err := loadMemTable(wal)
+	if err != nil {
+		t.Fatalf("failed to load the MemTable: %s", err)
+	}
+
+	if value, ok := memTable.get([]byte("a")); !ok || !bytes.Equal(value, []byte("v2")) {
+		t.Fatalf("the put after the delete must win, got %s", value)
+	}
+	if value, ok := memTable.get([]byte("b")); !ok || value != nil {
+		t.Fatalf("the trailing delete must leave a tombstone, got %s", value)
+	}
+}
+
+func TestReplayWALStopsAtCorruptedRecord(t *testing.T) {
+	dbDir, err := ioutil.TempDir(os.TempDir(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dbDir); err != nil {
+			panic(fmt.Errorf("failed to remove %s: %w", dbDir, err))
+		}
+	}()
+
+	walPath := path.Join(dbDir, walFileName)
+	wal, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("failed to open file %s: %s", walPath, err)
+	}
+	defer wal.Close()
+
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	offsets := make([]int64, 0)
+	for _, key := range keys {
+		offset, err := wal.Seek(0, io.SeekEnd)
+		if err != nil {
+			t.Fatalf("failed to seek: %s", err)
+		}
+		offsets = append(offsets, offset)
+
+		if err := appendToWAL(wal, key, []byte("v"), true); err != nil {
+			t.Fatalf("failed to append to the WAL file: %s", err)
+		}
+	}
+
+	// flip a byte in the value of the middle record, right at the end
+	size, err := wal.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatalf("failed to seek: %s", err)
+	}
+	recordLen := (size - offsets[0]) / int64(len(keys))
+	if _, err := wal.WriteAt([]byte{0xff}, offsets[1]+recordLen-1); err != nil {
+		t.Fatalf("failed to corrupt the WAL file: %s", err)
+	}
+
+	memTable, err := loadMemTable(wal)
+	if err != nil {
+		t.Fatalf("failed to load the MemTable: %s", err)
+	}
+
+	// the records before the corrupted one must be recovered
+	if _, ok := memTable.get([]byte("a")); !ok {
+		t.Fatal("the key before the corrupted record is lost")
+	}
+	// the corrupted record and everything after it are a lost tail
+	if _, ok := memTable.get([]byte("b")); ok {
+		t.Fatal("the corrupted record must not be replayed")
+	}
+	if _, ok := memTable.get([]byte("c")); ok {
+		t.Fatal("the record after the corrupted one must not be replayed")
+	}
+
+	stat, err := wal.Stat()
+	if err != nil {
+		t.Fatalf("failed to stat the WAL file: %s", err)
+	}
+	if stat.Size() != offsets[1] {
+		t.Fatalf("the WAL file must be cut at the corrupted record: %d != %d", stat.Size(), offsets[1])
+	}
+}